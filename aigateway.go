@@ -0,0 +1,799 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AI_CONFIG_FILE     = "ai.json"        // Provider profiles, next to config.json
+	AI_REQUEST_TIMEOUT = 5 * time.Minute  // Non-streaming completions; local models on a CPU are slow
+	AI_MAX_REQUEST     = 64 << 20         // Images travel as data: URIs
+	AI_MAX_LINE        = 16 << 20         // Longest SSE line accepted from a provider
+	AI_DEFAULT_AUTH    = "Authorization"  // Sent as "Bearer <key>"
+	AI_ERROR_GATEWAY   = "gateway_error"  // The gateway itself failed
+	AI_ERROR_UPSTREAM  = "upstream_error" // The provider answered with an error
+)
+
+// AiProviderConfig is a stored provider profile. The key is kept encrypted
+// with protectSecret and never leaves the server.
+type AiProviderConfig struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	BaseURL    string `json:"baseUrl"` // API root (.../v1) or the full chat completions URL
+	Model      string `json:"model"`
+	AuthHeader string `json:"authHeader,omitempty"` // Header carrying the key, default Authorization: Bearer
+	Secret     string `json:"secret,omitempty"`     // Encrypted API key, base64
+	KeyHint    string `json:"keyHint,omitempty"`    // Last characters of the key, for display
+}
+
+type aiConfig struct {
+	Active    string             `json:"active"`
+	Providers []AiProviderConfig `json:"providers"`
+}
+
+// AiProviderInfo is a profile as the page sees it, without the key.
+type AiProviderInfo struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	BaseURL    string `json:"baseUrl"`
+	Model      string `json:"model"`
+	AuthHeader string `json:"authHeader,omitempty"`
+	HasKey     bool   `json:"hasKey"`
+	KeyHint    string `json:"keyHint,omitempty"`
+	Active     bool   `json:"active"`
+}
+
+type AiProviderRequest struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	BaseURL    string  `json:"baseUrl"`
+	Model      string  `json:"model"`
+	AuthHeader string  `json:"authHeader"`
+	APIKey     *string `json:"apiKey"` // nil keeps the stored key, "" removes it
+	Active     bool    `json:"active"`
+}
+
+// Providers offered before the user has configured anything. Their ids
+// match the provider names used by the AI settings dialog.
+var aiProviderPresets = []AiProviderConfig{
+	{ID: "zhipu", Name: "Zhipu GLM", BaseURL: "https://open.bigmodel.cn/api/paas/v4", Model: "glm-4.6v-flash"},
+	{ID: "openai", Name: "OpenAI", BaseURL: "https://api.openai.com/v1", Model: "gpt-4o-mini"},
+	{ID: "ollama", Name: "Ollama", BaseURL: "http://localhost:11434/v1", Model: "llava"},
+	{ID: "lmstudio", Name: "LM Studio", BaseURL: "http://localhost:1234/v1"},
+}
+
+var (
+	aiConfigMu   sync.Mutex
+	aiProviderID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	aiHTTPClient = &http.Client{} // Deadlines come from the request context
+)
+
+// handleAI serves the /api/ai/* gateway:
+//
+//	GET  /api/ai/providers            profiles without keys
+//	POST /api/ai/providers            create or update a profile
+//	POST /api/ai/providers/delete     remove a profile {"id": ...}
+//	GET  /api/ai/models?provider=     the provider's model list
+//	POST /api/ai/chat/completions     OpenAI chat completions, "provider" picks the profile
+//	POST /api/ai/ocr/pdf              transcribe a PDF page by page, see handlePdfOCR
+func handleAI(w http.ResponseWriter, r *http.Request) {
+	if !sameOriginRequest(r) {
+		writeAiError(w, http.StatusForbidden, AI_ERROR_GATEWAY, "cross-origin requests are not allowed")
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/ai/providers" && r.Method == "GET":
+		handleAiProviders(w, r)
+	case r.URL.Path == "/api/ai/providers" && r.Method == "POST":
+		handleAiProviderSave(w, r)
+	case r.URL.Path == "/api/ai/providers/delete" && r.Method == "POST":
+		handleAiProviderDelete(w, r)
+	case r.URL.Path == "/api/ai/models" && r.Method == "GET":
+		handleAiModels(w, r)
+	case r.URL.Path == "/api/ai/chat/completions" && r.Method == "POST":
+		handleAiChat(w, r)
+	case r.URL.Path == "/api/ai/ocr/pdf" && r.Method == "POST":
+		handlePdfOCR(w, r)
+	default:
+		writeAiError(w, http.StatusNotFound, AI_ERROR_GATEWAY, "unknown AI endpoint")
+	}
+}
+
+// sameOriginRequest refuses requests made by other web pages. The server
+// answers every origin with CORS headers, but only the editor itself may
+// spend the stored keys or change the settings. The Host header has to name
+// the server itself: a page whose domain was rebound to 127.0.0.1 is
+// same-origin with itself, but sends its own name.
+func sameOriginRequest(r *http.Request) bool {
+	if !localServerHost(r.Host) {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // Not a browser, or a same-origin GET
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// localServerHost reports whether host is an address the editor is
+// reached at.
+func localServerHost(host string) bool {
+	port := strconv.Itoa(APP_PORT)
+	return strings.EqualFold(host, "127.0.0.1:"+port) || strings.EqualFold(host, "localhost:"+port)
+}
+
+// --- Profiles ---
+
+func aiConfigPath() (string, error) {
+	dir, err := appConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, AI_CONFIG_FILE), nil
+}
+
+// loadAiConfig reads ai.json; a missing file is an empty config. Callers
+// hold aiConfigMu.
+func loadAiConfig() (aiConfig, error) {
+	var cfg aiConfig
+	path, err := aiConfigPath()
+	if err != nil {
+		return cfg, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, json.Unmarshal(data, &cfg)
+}
+
+func saveAiConfig(cfg aiConfig) error {
+	path, err := aiConfigPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// providers lists the stored profiles followed by the presets not yet
+// configured.
+func (cfg *aiConfig) providers() []AiProviderConfig {
+	list := append([]AiProviderConfig{}, cfg.Providers...)
+	for _, preset := range aiProviderPresets {
+		if cfg.find(preset.ID) < 0 {
+			list = append(list, preset)
+		}
+	}
+	return list
+}
+
+func (cfg *aiConfig) find(id string) int {
+	for i, p := range cfg.Providers {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookup returns the profile for id, the active one for "".
+func (cfg *aiConfig) lookup(id string) (AiProviderConfig, bool) {
+	if id == "" {
+		id = cfg.Active
+	}
+	for _, p := range cfg.providers() {
+		if p.ID == id || id == "" {
+			return p, true
+		}
+	}
+	return AiProviderConfig{}, false
+}
+
+func handleAiProviders(w http.ResponseWriter, r *http.Request) {
+	aiConfigMu.Lock()
+	cfg, err := loadAiConfig()
+	aiConfigMu.Unlock()
+	if err != nil {
+		writeAiError(w, http.StatusInternalServerError, AI_ERROR_GATEWAY, "Failed to read AI settings: "+err.Error())
+		return
+	}
+
+	active, _ := cfg.lookup("")
+	infos := []AiProviderInfo{}
+	for _, p := range cfg.providers() {
+		infos = append(infos, AiProviderInfo{
+			ID:         p.ID,
+			Name:       p.Name,
+			BaseURL:    p.BaseURL,
+			Model:      p.Model,
+			AuthHeader: p.AuthHeader,
+			HasKey:     p.Secret != "",
+			KeyHint:    p.KeyHint,
+			Active:     p.ID == active.ID,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+func handleAiProviderSave(w http.ResponseWriter, r *http.Request) {
+	var req AiProviderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "Invalid request body")
+		return
+	}
+	if !aiProviderID.MatchString(req.ID) {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "Invalid provider id")
+		return
+	}
+	if u, err := url.Parse(req.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "Base URL must be an http(s) URL")
+		return
+	}
+
+	aiConfigMu.Lock()
+	defer aiConfigMu.Unlock()
+	cfg, err := loadAiConfig()
+	if err != nil {
+		writeAiError(w, http.StatusInternalServerError, AI_ERROR_GATEWAY, "Failed to read AI settings: "+err.Error())
+		return
+	}
+
+	p, _ := cfg.lookup(req.ID)
+	if p.ID != req.ID {
+		p = AiProviderConfig{ID: req.ID}
+	}
+	if p.Secret != "" && req.APIKey == nil && strings.TrimSpace(req.BaseURL) != p.BaseURL {
+		// The stored key belongs to the old server; it must be entered
+		// again for the new one rather than follow the URL anywhere.
+		p.Secret, p.KeyHint = "", ""
+	}
+	p.Name, p.BaseURL, p.Model, p.AuthHeader = req.Name, strings.TrimSpace(req.BaseURL), req.Model, req.AuthHeader
+	if p.Name == "" {
+		p.Name = p.ID
+	}
+	if req.APIKey != nil {
+		key := strings.TrimSpace(*req.APIKey)
+		p.Secret, p.KeyHint = "", ""
+		if key != "" {
+			sealed, err := protectSecret([]byte(key))
+			if err != nil {
+				writeAiError(w, http.StatusInternalServerError, AI_ERROR_GATEWAY, "Failed to encrypt API key: "+err.Error())
+				return
+			}
+			p.Secret = base64.StdEncoding.EncodeToString(sealed)
+			if len(key) > 8 {
+				p.KeyHint = "…" + key[len(key)-4:]
+			}
+		}
+	}
+
+	if i := cfg.find(p.ID); i >= 0 {
+		cfg.Providers[i] = p
+	} else {
+		cfg.Providers = append(cfg.Providers, p)
+	}
+	if req.Active || cfg.Active == "" {
+		cfg.Active = p.ID
+	}
+	if err := saveAiConfig(cfg); err != nil {
+		writeAiError(w, http.StatusInternalServerError, AI_ERROR_GATEWAY, "Failed to save AI settings: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleAiProviderDelete(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "Invalid request body")
+		return
+	}
+
+	aiConfigMu.Lock()
+	defer aiConfigMu.Unlock()
+	cfg, err := loadAiConfig()
+	if err != nil {
+		writeAiError(w, http.StatusInternalServerError, AI_ERROR_GATEWAY, "Failed to read AI settings: "+err.Error())
+		return
+	}
+	if i := cfg.find(req.ID); i >= 0 {
+		cfg.Providers = append(cfg.Providers[:i], cfg.Providers[i+1:]...)
+	}
+	if cfg.Active == req.ID {
+		cfg.Active = ""
+	}
+	if err := saveAiConfig(cfg); err != nil {
+		writeAiError(w, http.StatusInternalServerError, AI_ERROR_GATEWAY, "Failed to save AI settings: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// resolveAiProvider loads a profile together with its decrypted key.
+func resolveAiProvider(id string) (AiProviderConfig, string, error) {
+	aiConfigMu.Lock()
+	cfg, err := loadAiConfig()
+	aiConfigMu.Unlock()
+	if err != nil {
+		return AiProviderConfig{}, "", fmt.Errorf("failed to read AI settings: %w", err)
+	}
+	p, ok := cfg.lookup(id)
+	if !ok {
+		return p, "", fmt.Errorf("unknown AI provider %q", id)
+	}
+	if p.Secret == "" {
+		return p, "", nil // Local servers usually need no key
+	}
+	sealed, err := base64.StdEncoding.DecodeString(p.Secret)
+	if err != nil {
+		return p, "", fmt.Errorf("stored API key of %q is damaged", p.ID)
+	}
+	key, err := unprotectSecret(sealed)
+	if err != nil {
+		return p, "", fmt.Errorf("stored API key of %q cannot be decrypted, enter it again: %w", p.ID, err)
+	}
+	return p, string(key), nil
+}
+
+// endpoint resolves an API path against the base URL, which may already be
+// the full chat completions URL as the settings dialog stores it.
+func (p AiProviderConfig) endpoint(name string) string {
+	base := strings.TrimRight(p.BaseURL, "/")
+	base = strings.TrimSuffix(base, "/chat/completions")
+	return base + "/" + name
+}
+
+func (p AiProviderConfig) authorize(req *http.Request, key string) {
+	if key == "" {
+		return
+	}
+	if p.AuthHeader == "" || strings.EqualFold(p.AuthHeader, AI_DEFAULT_AUTH) {
+		req.Header.Set(AI_DEFAULT_AUTH, "Bearer "+key)
+		return
+	}
+	req.Header.Set(p.AuthHeader, key) // Azure style "api-key" headers
+}
+
+// --- Proxy ---
+
+func handleAiModels(w http.ResponseWriter, r *http.Request) {
+	p, key, err := resolveAiProvider(r.URL.Query().Get("provider"))
+	if err != nil {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	upstream, err := http.NewRequestWithContext(ctx, "GET", p.endpoint("models"), nil)
+	if err != nil {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, err.Error())
+		return
+	}
+	p.authorize(upstream, key)
+
+	resp, err := aiHTTPClient.Do(upstream)
+	if err != nil {
+		writeAiError(w, http.StatusBadGateway, AI_ERROR_GATEWAY, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, AI_MAX_LINE))
+	if resp.StatusCode != http.StatusOK {
+		writeAiError(w, resp.StatusCode, AI_ERROR_UPSTREAM, upstreamErrorMessage(body))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// handleAiChat forwards an OpenAI chat completions request to a provider
+// and answers in the OpenAI format whatever the provider's dialect. With
+// "stream": true the answer is relayed as server-sent events.
+func handleAiChat(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, AI_MAX_REQUEST+1))
+	if err != nil || len(body) > AI_MAX_REQUEST {
+		writeAiError(w, http.StatusRequestEntityTooLarge, AI_ERROR_GATEWAY, "Request too large")
+		return
+	}
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "Invalid request body")
+		return
+	}
+
+	var providerID, model string
+	var stream bool
+	json.Unmarshal(req["provider"], &providerID)
+	json.Unmarshal(req["model"], &model)
+	json.Unmarshal(req["stream"], &stream)
+	delete(req, "provider")
+
+	p, key, err := resolveAiProvider(providerID)
+	if err != nil {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, err.Error())
+		return
+	}
+	if model == "" {
+		model = p.Model
+	}
+	if model == "" {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "No model configured for "+p.Name)
+		return
+	}
+	req["model"], _ = json.Marshal(model)
+	payload, _ := json.Marshal(req)
+
+	ctx := r.Context() // Cancelled when the page goes away
+	if !stream {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, AI_REQUEST_TIMEOUT)
+		defer cancel()
+	}
+	upstream, err := http.NewRequestWithContext(ctx, "POST", p.endpoint("chat/completions"), bytes.NewReader(payload))
+	if err != nil {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, err.Error())
+		return
+	}
+	upstream.Header.Set("Content-Type", "application/json")
+	if stream {
+		upstream.Header.Set("Accept", "text/event-stream")
+	}
+	p.authorize(upstream, key)
+
+	resp, err := aiHTTPClient.Do(upstream)
+	if err != nil {
+		log.Printf("[AI] %s request failed: %v", p.ID, err)
+		writeAiError(w, http.StatusBadGateway, AI_ERROR_GATEWAY, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		log.Printf("[AI] %s answered %s", p.ID, resp.Status)
+		writeAiError(w, resp.StatusCode, AI_ERROR_UPSTREAM, upstreamErrorMessage(errBody))
+		return
+	}
+
+	if stream {
+		relayAiStream(w, resp, model)
+		return
+	}
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, AI_MAX_REQUEST))
+	if err != nil {
+		writeAiError(w, http.StatusBadGateway, AI_ERROR_GATEWAY, err.Error())
+		return
+	}
+	var up aiUpstreamResponse
+	if err := json.Unmarshal(respBody, &up); err != nil {
+		writeAiError(w, http.StatusBadGateway, AI_ERROR_GATEWAY, "Unreadable provider response: "+err.Error())
+		return
+	}
+	if len(up.Error) > 0 && string(up.Error) != "null" {
+		writeAiError(w, http.StatusBadGateway, AI_ERROR_UPSTREAM, upstreamErrorMessage(respBody))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(up.normalize(model, false))
+}
+
+// relayAiStream re-emits the provider's SSE chunks in the OpenAI chunk
+// format. Providers that ignore "stream" get their answer sent as a single
+// chunk, so the page only has to handle one shape.
+func relayAiStream(w http.ResponseWriter, resp *http.Response, model string) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	send := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	sendError := func(message string) {
+		send(map[string]AiError{"error": {Message: message, Type: AI_ERROR_UPSTREAM}})
+	}
+
+	if !strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		var up aiUpstreamResponse
+		if err := json.NewDecoder(resp.Body).Decode(&up); err != nil {
+			sendError("Unreadable provider response: " + err.Error())
+			return
+		}
+		send(up.normalize(model, true))
+	} else {
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64<<10), AI_MAX_LINE)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue // Comments, event: and id: fields
+			}
+			data = strings.TrimSpace(data)
+			if data == "[DONE]" {
+				break
+			}
+			var up aiUpstreamResponse
+			if json.Unmarshal([]byte(data), &up) != nil {
+				continue
+			}
+			if len(up.Error) > 0 && string(up.Error) != "null" {
+				sendError(upstreamErrorMessage([]byte(data)))
+				return
+			}
+			send(up.normalize(model, true))
+		}
+		if err := scanner.Err(); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				sendError(err.Error())
+			}
+			return
+		}
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// aiUpstreamError is a provider's error answer to aiComplete.
+type aiUpstreamError struct {
+	Status     int
+	Message    string
+	RetryAfter time.Duration // From a Retry-After header, 0 if none
+}
+
+func (e *aiUpstreamError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.Status)
+}
+
+// aiComplete runs a non-streaming chat completion for features on the
+// server side and returns the text of the first choice.
+func aiComplete(ctx context.Context, p AiProviderConfig, key string, req map[string]interface{}) (string, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	upstream, err := http.NewRequestWithContext(ctx, "POST", p.endpoint("chat/completions"), bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	upstream.Header.Set("Content-Type", "application/json")
+	p.authorize(upstream, key)
+
+	resp, err := aiHTTPClient.Do(upstream)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, AI_MAX_REQUEST))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &aiUpstreamError{Status: resp.StatusCode, Message: upstreamErrorMessage(body)}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return "", e
+	}
+
+	var up aiUpstreamResponse
+	if err := json.Unmarshal(body, &up); err != nil {
+		return "", fmt.Errorf("unreadable provider response: %w", err)
+	}
+	if len(up.Error) > 0 && string(up.Error) != "null" {
+		return "", &aiUpstreamError{Status: http.StatusBadGateway, Message: upstreamErrorMessage(body)}
+	}
+	out := up.normalize(p.Model, false)
+	if len(out.Choices) == 0 {
+		return "", nil
+	}
+	return out.Choices[0].Message.Content, nil
+}
+
+// --- OpenAI format ---
+
+type AiChatMessage struct {
+	Role             string `json:"role,omitempty"`
+	Content          string `json:"content"`
+	ReasoningContent string `json:"reasoning_content,omitempty"` // GLM and DeepSeek thinking output
+}
+
+type AiChatChoice struct {
+	Index        int            `json:"index"`
+	Message      *AiChatMessage `json:"message,omitempty"`
+	Delta        *AiChatMessage `json:"delta,omitempty"`
+	FinishReason *string        `json:"finish_reason"`
+}
+
+type AiChatResponse struct {
+	ID      string          `json:"id"`
+	Object  string          `json:"object"`
+	Created int64           `json:"created"`
+	Model   string          `json:"model"`
+	Choices []AiChatChoice  `json:"choices"`
+	Usage   json.RawMessage `json:"usage,omitempty"`
+}
+
+type AiError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    int    `json:"code,omitempty"` // Provider's HTTP status
+}
+
+// aiUpstreamResponse accepts the variations providers make on the OpenAI
+// response: content as a string or a list of parts, reasoning fields,
+// missing ids and roles.
+type aiUpstreamResponse struct {
+	ID      string `json:"id"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index        int              `json:"index"`
+		Message      *aiUpstreamDelta `json:"message"`
+		Delta        *aiUpstreamDelta `json:"delta"`
+		Text         *string          `json:"text"` // Legacy completions
+		FinishReason *string          `json:"finish_reason"`
+	} `json:"choices"`
+	Usage json.RawMessage `json:"usage"`
+	Error json.RawMessage `json:"error"`
+}
+
+type aiUpstreamDelta struct {
+	Role             string          `json:"role"`
+	Content          json.RawMessage `json:"content"`
+	ReasoningContent string          `json:"reasoning_content"`
+	Reasoning        string          `json:"reasoning"` // Ollama and OpenRouter
+}
+
+func (up *aiUpstreamResponse) normalize(model string, chunk bool) AiChatResponse {
+	out := AiChatResponse{
+		ID:      up.ID,
+		Object:  "chat.completion",
+		Created: up.Created,
+		Model:   up.Model,
+		Choices: []AiChatChoice{},
+	}
+	if chunk {
+		out.Object = "chat.completion.chunk"
+	}
+	if out.ID == "" {
+		out.ID = "chatcmpl-" + generateID()
+	}
+	if out.Created == 0 {
+		out.Created = time.Now().Unix()
+	}
+	if out.Model == "" {
+		out.Model = model
+	}
+	if len(up.Usage) > 0 && string(up.Usage) != "null" {
+		out.Usage = up.Usage
+	}
+
+	for _, c := range up.Choices {
+		src := c.Message
+		if src == nil {
+			src = c.Delta
+		}
+		msg := &AiChatMessage{}
+		if src != nil {
+			msg.Role = src.Role
+			msg.Content = aiContentText(src.Content)
+			msg.ReasoningContent = src.ReasoningContent
+			if msg.ReasoningContent == "" {
+				msg.ReasoningContent = src.Reasoning
+			}
+		} else if c.Text != nil {
+			msg.Content = *c.Text
+		}
+		choice := AiChatChoice{Index: c.Index, FinishReason: c.FinishReason}
+		if chunk {
+			choice.Delta = msg
+		} else {
+			if msg.Role == "" {
+				msg.Role = "assistant"
+			}
+			choice.Message = msg
+		}
+		out.Choices = append(out.Choices, choice)
+	}
+	return out
+}
+
+// aiContentText flattens message content given as a list of parts.
+func aiContentText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(raw, &parts) != nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, part := range parts {
+		if part.Type == "" || part.Type == "text" || part.Type == "output_text" {
+			sb.WriteString(part.Text)
+		}
+	}
+	return sb.String()
+}
+
+// upstreamErrorMessage digs the message out of a provider's error body,
+// which comes as {"error":{"message"}}, {"error":"..."} or {"message"}.
+func upstreamErrorMessage(body []byte) string {
+	var e struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+		Msg     string          `json:"msg"`
+	}
+	if json.Unmarshal(body, &e) == nil {
+		var nested struct {
+			Message string `json:"message"`
+		}
+		var plain string
+		switch {
+		case json.Unmarshal(e.Error, &nested) == nil && nested.Message != "":
+			return nested.Message
+		case json.Unmarshal(e.Error, &plain) == nil && plain != "":
+			return plain
+		case e.Message != "":
+			return e.Message
+		case e.Msg != "":
+			return e.Msg
+		}
+	}
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 500 {
+		msg = msg[:500] + "…"
+	}
+	return msg
+}
+
+// writeAiError answers in the OpenAI error format.
+func writeAiError(w http.ResponseWriter, status int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	e := AiError{Message: message, Type: errType}
+	if errType == AI_ERROR_UPSTREAM {
+		e.Code = status
+	}
+	json.NewEncoder(w).Encode(map[string]AiError{"error": e})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testAiKey = "sk-test-0123456789"
+
+// newTestAiGateway stores a profile "fake" pointing at a fake
+// OpenAI-compatible server and returns the gateway in front of it. The
+// configuration goes to a temporary folder.
+func newTestAiGateway(t *testing.T, upstream http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("APPDATA", dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+
+	fake := httptest.NewServer(upstream)
+	t.Cleanup(fake.Close)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Host = "127.0.0.1:" + strconv.Itoa(APP_PORT)
+		handleAI(w, r)
+	}))
+	t.Cleanup(gateway.Close)
+
+	key := testAiKey
+	saveTestAiProvider(t, gateway, AiProviderRequest{ID: "fake", BaseURL: fake.URL + "/v1", Model: "fake-model", APIKey: &key, Active: true})
+	return gateway
+}
+
+func saveTestAiProvider(t *testing.T, gateway *httptest.Server, req AiProviderRequest) {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	resp, err := http.Post(gateway.URL+"/api/ai/providers", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("saving provider: %s", resp.Status)
+	}
+}
+
+// checkTestAiRequest fails the upstream request unless it carries the key
+// and the configured model.
+func checkTestAiRequest(t *testing.T, r *http.Request) {
+	if r.URL.Path != "/v1/chat/completions" {
+		t.Errorf("upstream path = %s", r.URL.Path)
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer "+testAiKey {
+		t.Errorf("upstream Authorization = %q", got)
+	}
+	var req struct {
+		Model    string `json:"model"`
+		Provider string `json:"provider"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Model != "fake-model" || req.Provider != "" {
+		t.Errorf("upstream got model %q, provider %q", req.Model, req.Provider)
+	}
+}
+
+func postTestAiChat(t *testing.T, gateway *httptest.Server, stream bool) *http.Response {
+	t.Helper()
+	body := fmt.Sprintf(`{"provider":"fake","stream":%v,"messages":[{"role":"user","content":"Hi"}]}`, stream)
+	resp, err := http.Post(gateway.URL+"/api/ai/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAiChatCompletion(t *testing.T) {
+	gateway := newTestAiGateway(t, func(w http.ResponseWriter, r *http.Request) {
+		checkTestAiRequest(t, r)
+		w.Header().Set("Content-Type", "application/json")
+		// Content as a list of parts and a reasoning field, as some providers send it
+		io.WriteString(w, `{"choices":[{"index":0,"message":{"content":[{"type":"text","text":"Hello "},{"type":"text","text":"there"}],"reasoning":"thinking"},"finish_reason":"stop"}],"usage":{"total_tokens":3}}`)
+	})
+
+	resp := postTestAiChat(t, gateway, false)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s", resp.Status)
+	}
+	var out AiChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Object != "chat.completion" || out.Model != "fake-model" || !strings.HasPrefix(out.ID, "chatcmpl-") {
+		t.Errorf("envelope = %+v", out)
+	}
+	if len(out.Choices) != 1 || out.Choices[0].Message == nil {
+		t.Fatalf("choices = %+v", out.Choices)
+	}
+	msg := out.Choices[0].Message
+	if msg.Role != "assistant" || msg.Content != "Hello there" || msg.ReasoningContent != "thinking" {
+		t.Errorf("message = %+v", msg)
+	}
+	if string(out.Usage) != `{"total_tokens":3}` {
+		t.Errorf("usage = %s", out.Usage)
+	}
+}
+
+func TestAiChatStream(t *testing.T) {
+	gateway := newTestAiGateway(t, func(w http.ResponseWriter, r *http.Request) {
+		checkTestAiRequest(t, r)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, ": keep-alive\n\n")
+		io.WriteString(w, `data: {"id":"c1","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`+"\n\n")
+		io.WriteString(w, "event: message\n")
+		io.WriteString(w, `data: {"id":"c1","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`+"\n\n")
+		io.WriteString(w, "data: [DONE]\n\n")
+	})
+
+	resp := postTestAiChat(t, gateway, true)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var content strings.Builder
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		events = append(events, data)
+		if data == "[DONE]" {
+			continue
+		}
+		var chunk AiChatResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("chunk %q: %v", data, err)
+		}
+		if chunk.Object != "chat.completion.chunk" || chunk.ID != "c1" || len(chunk.Choices) != 1 || chunk.Choices[0].Delta == nil {
+			t.Fatalf("chunk = %s", data)
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	if content.String() != "Hello" {
+		t.Errorf("relayed content = %q", content.String())
+	}
+	if len(events) != 3 || events[2] != "[DONE]" {
+		t.Errorf("events = %q", events)
+	}
+}
+
+func TestAiChatUpstreamError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"OpenAI shape", http.StatusTooManyRequests, `{"error":{"message":"Rate limit reached","type":"requests"}}`, "Rate limit reached"},
+		{"plain error string", http.StatusUnauthorized, `{"error":"invalid key"}`, "invalid key"},
+		{"message field", http.StatusBadRequest, `{"code":1214,"msg":"bad model"}`, "bad model"},
+		{"not JSON", http.StatusInternalServerError, "upstream exploded", "upstream exploded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := newTestAiGateway(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			resp := postTestAiChat(t, gateway, false)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			var out map[string]AiError
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+			want := AiError{Message: tt.want, Type: AI_ERROR_UPSTREAM, Code: tt.status}
+			if out["error"] != want {
+				t.Errorf("error = %+v, want %+v", out["error"], want)
+			}
+		})
+	}
+}
+
+func TestAiProviderKeyStaysWithBaseURL(t *testing.T) {
+	var auth []string
+	gateway := newTestAiGateway(t, func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[]}`)
+	})
+	aiConfigMu.Lock()
+	cfg, _ := loadAiConfig()
+	aiConfigMu.Unlock()
+	p, _ := cfg.lookup("fake")
+
+	// Same URL without a key keeps it
+	saveTestAiProvider(t, gateway, AiProviderRequest{ID: "fake", BaseURL: p.BaseURL, Model: "fake-model"})
+	postTestAiChat(t, gateway, false)
+	// Another server without a key drops it; the same server is used so
+	// the request can be observed.
+	saveTestAiProvider(t, gateway, AiProviderRequest{ID: "fake", BaseURL: p.BaseURL + "/", Model: "fake-model"})
+	postTestAiChat(t, gateway, false)
+
+	if len(auth) != 2 || auth[0] != "Bearer "+testAiKey || auth[1] != "" {
+		t.Errorf("Authorization sent = %q", auth)
+	}
+}
+
+func TestSameOriginRequest(t *testing.T) {
+	local := "127.0.0.1:" + strconv.Itoa(APP_PORT)
+	tests := []struct {
+		host, origin string
+		want         bool
+	}{
+		{local, "", true},
+		{local, "http://" + local, true},
+		{"localhost:" + strconv.Itoa(APP_PORT), "http://localhost:" + strconv.Itoa(APP_PORT), true},
+		{local, "http://evil.example", false},
+		{"evil.example:" + strconv.Itoa(APP_PORT), "http://evil.example:" + strconv.Itoa(APP_PORT), false}, // DNS rebinding
+		{"evil.example:" + strconv.Itoa(APP_PORT), "", false},
+		{"127.0.0.1:1", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/ai/providers", nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := sameOriginRequest(r); got != tt.want {
+			t.Errorf("Host %s, Origin %q: got %v, want %v", tt.host, tt.origin, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// dataImageRe finds data: image URIs in plain text such as Markdown.
+var dataImageRe = regexp.MustCompile(`data:image/[\w.+-]+(?:;[\w-]+=[^;,\s]*)*(?:;base64)?,[A-Za-z0-9+/=%._~!$&*-]+`)
+
+// hashedAssetRe matches file names written by the extractor, so orphan
+// removal never touches files the user put there.
+var hashedAssetRe = regexp.MustCompile(`^[0-9a-f]{16}\.[a-z0-9]+$`)
+
+// Extensions for the image types browsers put into data: URIs.
+var imageExtensions = map[string]string{
+	"image/png":     ".png",
+	"image/jpeg":    ".jpg",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/svg+xml": ".svg",
+	"image/bmp":     ".bmp",
+	"image/avif":    ".avif",
+	"image/x-icon":  ".ico",
+}
+
+// decodeDataURI returns the media type and payload of a data: URI.
+func decodeDataURI(uri string) (string, []byte, error) {
+	if !strings.HasPrefix(uri, "data:") {
+		return "", nil, fmt.Errorf("not a data URI")
+	}
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return "", nil, fmt.Errorf("malformed data URI")
+	}
+	meta, payload := uri[5:comma], uri[comma+1:]
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(meta, ";")[0]))
+
+	if strings.HasSuffix(meta, ";base64") {
+		// Line breaks and padding vary between producers
+		payload = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+				return -1
+			}
+			return r
+		}, payload)
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "="))
+		}
+		return mediaType, data, err
+	}
+	unescaped, err := url.PathUnescape(payload)
+	return mediaType, []byte(unescaped), err
+}
+
+// assetExtractor writes data: images of a document into its asset folder,
+// one file per distinct content, and hands back the relative reference.
+type assetExtractor struct {
+	assetDir string // bundle or _assets folder
+	docDir   string // directory of the saved document
+	written  map[string]string
+	count    int
+	err      error
+
+	images *ImageOptions // Optimize before writing, when set
+	report ImageReport
+}
+
+func newAssetExtractor(assetDir, docPath string) *assetExtractor {
+	return &assetExtractor{
+		assetDir: assetDir,
+		docDir:   filepath.Dir(docPath),
+		written:  make(map[string]string),
+	}
+}
+
+func (e *assetExtractor) extract(ref string) (string, bool) {
+	if e.err != nil || !strings.HasPrefix(strings.ToLower(ref), "data:image/") {
+		return "", false
+	}
+	mediaType, data, err := decodeDataURI(ref)
+	if err != nil || len(data) == 0 {
+		return "", false
+	}
+	if e.images != nil {
+		out, outType := optimizeImage(data, *e.images)
+		if outType != "" {
+			e.report.add(len(data), len(out))
+			data, mediaType = out, outType
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:8])
+	name, ok := e.written[hash]
+	if !ok {
+		ext := imageExtensions[mediaType]
+		if ext == "" {
+			if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+				ext = exts[0]
+			} else {
+				ext = ".bin"
+			}
+		}
+		name = hash + ext
+		path := filepath.Join(e.assetDir, name)
+		// Content-addressed: an existing file with this name is the same image
+		if _, err := os.Stat(path); err != nil {
+			if err := os.MkdirAll(e.assetDir, 0755); err != nil {
+				e.err = err
+				return "", false
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				e.err = err
+				return "", false
+			}
+		}
+		e.written[hash] = name
+	}
+	e.count++
+
+	rel, err := filepath.Rel(e.docDir, filepath.Join(e.assetDir, name))
+	if err != nil {
+		return "", false
+	}
+	return (&url.URL{Path: filepath.ToSlash(rel)}).String(), true
+}
+
+// extractDataURIs moves every data: image of an HTML document into assetDir
+// and rewrites the references relative to docPath. images, if not nil,
+// optimizes each image first and collects the savings in report.
+func extractDataURIs(htmlContent, docPath, assetDir string, images *ImageOptions, report *ImageReport) (string, error) {
+	e := newAssetExtractor(assetDir, docPath)
+	e.images = images
+	defer func() { mergeImageReport(report, &e.report) }()
+	a := &assetRewriter{
+		baseDir: filepath.Dir(docPath),
+		mapRef:  e.extract,
+	}
+	out := a.rewriteHTML(htmlContent)
+	if e.err != nil {
+		return htmlContent, e.err
+	}
+	if e.count > 0 {
+		log.Printf("[Assets] Extracted %d inline images (%d files) to %s", e.count, len(e.written), assetDir)
+	}
+	return out, nil
+}
+
+// extractDataURIsInText does the same for Markdown source.
+func extractDataURIsInText(text, docPath, assetDir string, images *ImageOptions, report *ImageReport) (string, error) {
+	e := newAssetExtractor(assetDir, docPath)
+	e.images = images
+	defer func() { mergeImageReport(report, &e.report) }()
+	out := dataImageRe.ReplaceAllStringFunc(text, func(ref string) string {
+		if newRef, ok := e.extract(ref); ok {
+			return newRef
+		}
+		return ref
+	})
+	if e.err != nil {
+		return text, e.err
+	}
+	return out, nil
+}
+
+// hasDataImages reports whether content embeds any data: image.
+func hasDataImages(content string) bool {
+	return strings.Contains(strings.ToLower(content), "data:image/")
+}
+
+// removeOrphanedHashedAssets deletes extractor-written files in assetDir
+// that the saved content no longer mentions.
+func removeOrphanedHashedAssets(assetDir, content string) {
+	entries, err := os.ReadDir(assetDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !hashedAssetRe.MatchString(name) || strings.Contains(content, name) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(assetDir, name)); err == nil {
+			log.Printf("[Assets] Removed orphaned %s", name)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// Modes of the asset garbage collector
+	ASSET_GC_REPORT = "report" // Only list unreferenced files
+	ASSET_GC_TRASH  = "trash"  // Move them into ASSET_TRASH_DIR inside the asset folder
+	ASSET_GC_DELETE = "delete" // Remove them
+
+	ASSET_TRASH_DIR = ".trash"
+)
+
+// editorAssetRe matches the names the editor gives new images on save
+// (image_1.png, ...).
+var editorAssetRe = regexp.MustCompile(`^image_[0-9]+\.[a-z0-9]+$`)
+
+type AssetGCReport struct {
+	Document   string   `json:"document"`
+	AssetDir   string   `json:"assetDir"`
+	Mode       string   `json:"mode"`
+	Referenced int      `json:"referenced"`
+	Orphans    []string `json:"orphans"`   // Relative to AssetDir
+	Processed  []string `json:"processed"` // Orphans moved or deleted
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// documentAssetDir returns the folder holding a document's assets: the
+// Name_assets sidecar for Markdown, the Name bundle folder for HTML. ok is
+// false when the document has no dedicated folder.
+func documentAssetDir(docPath string) (string, bool) {
+	dir := filepath.Dir(docPath)
+	name := filepath.Base(docPath)
+	nameNoExt := strings.TrimSuffix(name, filepath.Ext(name))
+
+	var assetDir string
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".md", ".markdown":
+		assetDir = filepath.Join(dir, nameNoExt+"_assets")
+	case ".html", ".htm":
+		if !strings.EqualFold(filepath.Base(dir), nameNoExt) {
+			return "", false
+		}
+		assetDir = dir
+	default:
+		return "", false
+	}
+	if info, err := os.Stat(assetDir); err != nil || !info.IsDir() {
+		return "", false
+	}
+	return assetDir, true
+}
+
+// collectDocumentRefs returns the lock keys of every local file a document
+// refers to, following linked stylesheets and their url()/@import.
+func collectDocumentRefs(docPath string) (map[string]bool, error) {
+	content, err := os.ReadFile(docPath)
+	if err != nil {
+		return nil, err
+	}
+	content, _ = decodeTextDocument(content, docPath)
+	htmlContent := string(content)
+	switch strings.ToLower(filepath.Ext(docPath)) {
+	case ".md", ".markdown":
+		if htmlContent, err = markdownToHTML(content); err != nil {
+			return nil, err
+		}
+	}
+
+	refs := make(map[string]bool)
+	var stylesheets []string
+	record := func(path string) (string, bool) {
+		key := getLockKey(path)
+		if !refs[key] {
+			refs[key] = true
+			if strings.EqualFold(filepath.Ext(path), ".css") {
+				stylesheets = append(stylesheets, path)
+			}
+		}
+		return "", false
+	}
+
+	a := &assetRewriter{
+		baseDir:     filepath.Dir(docPath),
+		rewrite:     record,
+		followLinks: true,
+	}
+	a.rewriteHTML(htmlContent)
+
+	for len(stylesheets) > 0 {
+		css := stylesheets[0]
+		stylesheets = stylesheets[1:]
+		if data, err := os.ReadFile(css); err == nil {
+			a.rewriteCSS(string(data), filepath.Dir(css))
+		}
+	}
+	return refs, nil
+}
+
+// collectAssetGarbage finds files in the document's asset folder that it no
+// longer refers to and handles them according to mode. Documents, folders
+// and dot files are never touched.
+func collectAssetGarbage(docPath, mode string) (*AssetGCReport, error) {
+	switch mode {
+	case ASSET_GC_REPORT, ASSET_GC_TRASH, ASSET_GC_DELETE:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+
+	assetDir, ok := documentAssetDir(docPath)
+	if !ok {
+		return nil, fmt.Errorf("%s has no asset folder", filepath.Base(docPath))
+	}
+	refs, err := collectDocumentRefs(docPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AssetGCReport{
+		Document:   docPath,
+		AssetDir:   assetDir,
+		Mode:       mode,
+		Referenced: len(refs),
+		Orphans:    []string{},
+		Processed:  []string{},
+	}
+
+	// Only files directly in the folder are candidates; subfolders and dot
+	// entries (.git, .trash) are left alone. A bundle folder may hold
+	// anything else the user keeps next to the document, so there only
+	// names the editor itself writes are considered.
+	ext := strings.ToLower(filepath.Ext(docPath))
+	bundle := ext == ".html" || ext == ".htm"
+	entries, err := os.ReadDir(assetDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".html", ".htm", ".md", ".markdown":
+			continue
+		}
+		if bundle && !editorAssetRe.MatchString(name) && !hashedAssetRe.MatchString(name) {
+			continue
+		}
+		if refs[getLockKey(filepath.Join(assetDir, name))] {
+			continue
+		}
+		report.Orphans = append(report.Orphans, name)
+	}
+
+	for _, rel := range report.Orphans {
+		path := filepath.Join(assetDir, filepath.FromSlash(rel))
+		var err error
+		switch mode {
+		case ASSET_GC_REPORT:
+			continue
+		case ASSET_GC_TRASH:
+			err = moveToAssetTrash(assetDir, rel)
+		case ASSET_GC_DELETE:
+			err = os.Remove(path)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", rel, err))
+			continue
+		}
+		report.Processed = append(report.Processed, rel)
+	}
+
+	if len(report.Orphans) > 0 {
+		log.Printf("[Assets] %s: %d orphaned files in %s (%s, %d processed)", filepath.Base(docPath), len(report.Orphans), assetDir, mode, len(report.Processed))
+	}
+	return report, nil
+}
+
+// moveToAssetTrash moves assetDir/rel to assetDir/.trash/rel, keeping an
+// earlier trashed copy by suffixing the new one with a timestamp.
+func moveToAssetTrash(assetDir, rel string) error {
+	src := filepath.Join(assetDir, filepath.FromSlash(rel))
+	dst := filepath.Join(assetDir, ASSET_TRASH_DIR, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		ext := filepath.Ext(dst)
+		dst = fmt.Sprintf("%s.%s%s", strings.TrimSuffix(dst, ext), time.Now().Format("20060102-150405"), ext)
+	}
+	return os.Rename(src, dst)
+}
+
+// handleAssetGC runs the collector for any document on demand:
+// /api/assets/gc?path=...&mode=report|trash|delete. Modes that change files
+// require POST.
+func handleAssetGC(w http.ResponseWriter, r *http.Request) {
+	docPath := r.URL.Query().Get("path")
+	if docPath == "" {
+		http.Error(w, "Empty file path", http.StatusBadRequest)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = ASSET_GC_REPORT
+	}
+	if mode != ASSET_GC_REPORT && r.Method != http.MethodPost {
+		http.Error(w, "Use POST to change files", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := collectAssetGarbage(docPath, mode)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Asset scan failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
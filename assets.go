@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// cssURLRe matches url(...) with double, single or no quotes.
+var cssURLRe = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)`)
+
+// cssImportRe matches @import "x.css" / @import 'x.css' (the url() form is
+// covered by cssURLRe).
+var cssImportRe = regexp.MustCompile(`@import\s+(?:"([^"]*)"|'([^']*)')`)
+
+// Attributes holding a single resource URL, per element.
+var resourceAttrs = map[atom.Atom][]string{
+	atom.Img:    {"src"},
+	atom.Source: {"src"},
+	atom.Video:  {"src", "poster"},
+	atom.Audio:  {"src"},
+	atom.Track:  {"src"},
+	atom.Embed:  {"src"},
+	atom.Object: {"data"},
+	atom.Input:  {"src"}, // <input type="image">
+	atom.Script: {"src"},
+}
+
+// assetRewriter walks an HTML document with the x/net/html tokenizer and
+// replaces every reference to a local file: src/srcset/poster/data
+// attributes, SVG hrefs, CSS url() in style attributes and <style> blocks,
+// and <link rel="stylesheet"> (inlined as <style> when inlineStylesheets is
+// set). Markup it does not touch is copied through byte for byte.
+type assetRewriter struct {
+	baseDir string
+	// mapRef, if set, sees every reference first (including remote and
+	// /api/asset URLs); false passes it on to rewrite.
+	mapRef func(ref string) (string, bool)
+	// rewrite maps an absolute local path to the reference written in its
+	// place; false keeps the original reference.
+	rewrite           func(path string) (string, bool)
+	inlineStylesheets bool
+	// followLinks also passes href of <a>, <area> and <link> through
+	// rewriteRef (used when scanning for every file a document refers to).
+	followLinks bool
+}
+
+// inlineLocalAssets embeds all local resources of an HTML file as data URIs
+// so the document survives being served from another origin.
+// Images go through the optimization pipeline when it is enabled globally.
+func inlineLocalAssets(htmlContent string, htmlFilePath string) string {
+	rewrite := fileDataURI
+	opts := globalImageOptions()
+	var report ImageReport
+	if opts.Enabled {
+		rewrite = func(path string) (string, bool) {
+			uri, ok := fileDataURI(path)
+			if ok && strings.HasPrefix(uri, "data:image/") {
+				uri = optimizeDataURI(uri, opts, &report)
+			}
+			return uri, ok
+		}
+	}
+
+	a := &assetRewriter{
+		baseDir:           filepath.Dir(htmlFilePath),
+		rewrite:           rewrite,
+		inlineStylesheets: true,
+	}
+	out := a.rewriteHTML(htmlContent)
+	imageReportLog(filepath.Base(htmlFilePath), &report)
+	return out
+}
+
+// fileDataURI reads path into a data: URI.
+func fileDataURI(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("data:%s;base64,%s", detectMimeType(path, data), base64.StdEncoding.EncodeToString(data)), true
+}
+
+// detectMimeType prefers the extension (content sniffing cannot tell SVG or
+// CSS apart from plain text) and falls back to sniffing.
+func detectMimeType(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".svg":
+		return "image/svg+xml"
+	case ".css":
+		return "text/css"
+	case ".webp":
+		return "image/webp"
+	}
+	if t := mime.TypeByExtension(filepath.Ext(path)); t != "" {
+		return t
+	}
+	return http.DetectContentType(data)
+}
+
+// localAssetPath resolves ref against baseDir. ok is false for remote,
+// inline and fragment references.
+func localAssetPath(ref, baseDir string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "//") {
+		return "", false
+	}
+
+	if u, err := url.Parse(ref); err == nil && len(u.Scheme) > 1 {
+		// Drive letters ("C:") parse as one-letter schemes
+		if u.Scheme != "file" {
+			return "", false
+		}
+		p := u.Path
+		if len(p) > 2 && p[0] == '/' && p[2] == ':' {
+			p = p[1:] // file:///C:/x -> C:/x
+		}
+		return filepath.FromSlash(p), true
+	}
+
+	cleanPath := ref
+	if idx := strings.IndexAny(cleanPath, "?#"); idx != -1 {
+		cleanPath = cleanPath[:idx]
+	}
+	if unescaped, err := url.PathUnescape(cleanPath); err == nil {
+		cleanPath = unescaped
+	}
+	cleanPath = filepath.FromSlash(cleanPath)
+	if filepath.IsAbs(cleanPath) {
+		return cleanPath, true
+	}
+	return filepath.Join(baseDir, cleanPath), true
+}
+
+func (a *assetRewriter) rewriteRef(ref, baseDir string) (string, bool) {
+	if a.mapRef != nil {
+		if newRef, ok := a.mapRef(strings.TrimSpace(ref)); ok {
+			return newRef, true
+		}
+	}
+	if a.rewrite == nil {
+		return "", false
+	}
+	path, ok := localAssetPath(ref, baseDir)
+	if !ok {
+		return "", false
+	}
+	return a.rewrite(path)
+}
+
+// rewriteSrcset rewrites each candidate URL of a srcset, keeping the
+// descriptors. URLs are split on whitespace as in the HTML spec, so data:
+// URIs with commas survive.
+func (a *assetRewriter) rewriteSrcset(v, baseDir string) (string, bool) {
+	var out []string
+	changed := false
+	for i := 0; i < len(v); {
+		for i < len(v) && (v[i] == ',' || isHTMLSpace(v[i])) {
+			i++
+		}
+		if i >= len(v) {
+			break
+		}
+		start := i
+		for i < len(v) && !isHTMLSpace(v[i]) {
+			i++
+		}
+		ref := v[start:i]
+		descriptor := ""
+		if strings.HasSuffix(ref, ",") {
+			ref = strings.TrimRight(ref, ",")
+		} else {
+			dStart := i
+			for i < len(v) && v[i] != ',' {
+				i++
+			}
+			descriptor = strings.TrimSpace(v[dStart:i])
+		}
+
+		if newRef, ok := a.rewriteRef(ref, baseDir); ok {
+			ref = newRef
+			changed = true
+		}
+		if descriptor != "" {
+			ref += " " + descriptor
+		}
+		out = append(out, ref)
+	}
+	return strings.Join(out, ", "), changed
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// rewriteCSS rewrites url() and @import references in a stylesheet whose
+// relative URLs resolve against baseDir.
+func (a *assetRewriter) rewriteCSS(css, baseDir string) (string, bool) {
+	changed := false
+	css = cssURLRe.ReplaceAllStringFunc(css, func(m string) string {
+		sub := cssURLRe.FindStringSubmatch(m)
+		ref := sub[1] + sub[2] + sub[3]
+		if newRef, ok := a.rewriteRef(ref, baseDir); ok {
+			changed = true
+			return cssURL(newRef)
+		}
+		return m
+	})
+	css = cssImportRe.ReplaceAllStringFunc(css, func(m string) string {
+		sub := cssImportRe.FindStringSubmatch(m)
+		if newRef, ok := a.rewriteRef(sub[1]+sub[2], baseDir); ok {
+			changed = true
+			return "@import " + cssURL(newRef)
+		}
+		return m
+	})
+	return css, changed
+}
+
+// cssURL quotes ref only when needed, so rewritten style attributes do not
+// fill up with escaped quotes.
+func cssURL(ref string) string {
+	if strings.ContainsAny(ref, "\"'() \t\n") {
+		return `url("` + strings.ReplaceAll(ref, `"`, `%22`) + `")`
+	}
+	return "url(" + ref + ")"
+}
+
+// inlineStylesheet loads a linked local stylesheet, resolving its own url()
+// references against the stylesheet's directory.
+func (a *assetRewriter) inlineStylesheet(href string) (string, bool) {
+	path, ok := localAssetPath(href, a.baseDir)
+	if !ok {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	css, _ := a.rewriteCSS(string(data), filepath.Dir(path))
+	// Keep the text from closing the element early
+	css = strings.ReplaceAll(css, "</style", `<\/style`)
+	return "<style>\n" + css + "\n</style>", true
+}
+
+// rewriteTag updates resource attributes of a start tag in place.
+func (a *assetRewriter) rewriteTag(tok *html.Token) bool {
+	changed := false
+	for i := range tok.Attr {
+		attr := &tok.Attr[i]
+		key := strings.ToLower(attr.Key)
+
+		switch {
+		case key == "style":
+			if css, ok := a.rewriteCSS(attr.Val, a.baseDir); ok {
+				attr.Val, changed = css, true
+			}
+		case key == "srcset" && (tok.DataAtom == atom.Img || tok.DataAtom == atom.Source):
+			if v, ok := a.rewriteSrcset(attr.Val, a.baseDir); ok {
+				attr.Val, changed = v, true
+			}
+		case (key == "href" || key == "xlink:href") && tok.DataAtom == atom.Image: // SVG <image>
+			if v, ok := a.rewriteRef(attr.Val, a.baseDir); ok {
+				attr.Val, changed = v, true
+			}
+		case key == "href" && a.followLinks && (tok.DataAtom == atom.A || tok.DataAtom == atom.Area || tok.DataAtom == atom.Link):
+			if v, ok := a.rewriteRef(attr.Val, a.baseDir); ok {
+				attr.Val, changed = v, true
+			}
+		default:
+			for _, name := range resourceAttrs[tok.DataAtom] {
+				if key != name {
+					continue
+				}
+				if v, ok := a.rewriteRef(attr.Val, a.baseDir); ok {
+					attr.Val, changed = v, true
+				}
+			}
+		}
+	}
+	return changed
+}
+
+func tokenAttr(tok *html.Token, key string) string {
+	for _, a := range tok.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// isStylesheetLink reports <link rel="stylesheet"> (rel is a token list).
+func isStylesheetLink(tok *html.Token) bool {
+	if tok.DataAtom != atom.Link {
+		return false
+	}
+	for _, rel := range strings.Fields(strings.ToLower(tokenAttr(tok, "rel"))) {
+		if rel == "stylesheet" {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *assetRewriter) rewriteHTML(src string) (result string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[Recovery] Panic while rewriting local assets: %v", r)
+			result = src
+		}
+	}()
+
+	z := html.NewTokenizer(strings.NewReader(src))
+	var sb strings.Builder
+	sb.Grow(len(src))
+	inStyle := false
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return src
+			}
+			return sb.String()
+		}
+		raw := string(z.Raw())
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+
+			if a.inlineStylesheets && isStylesheetLink(&tok) {
+				if style, ok := a.inlineStylesheet(tokenAttr(&tok, "href")); ok {
+					sb.WriteString(style)
+					continue
+				}
+			}
+
+			if a.rewriteTag(&tok) {
+				sb.WriteString(tok.String())
+			} else {
+				sb.WriteString(raw)
+			}
+			if tok.DataAtom == atom.Style && tt == html.StartTagToken {
+				inStyle = true
+			}
+
+		case html.EndTagToken:
+			tok := z.Token()
+			if tok.DataAtom == atom.Style {
+				inStyle = false
+			}
+			sb.WriteString(raw)
+
+		case html.TextToken:
+			if inStyle {
+				css, _ := a.rewriteCSS(raw, a.baseDir)
+				sb.WriteString(css)
+			} else {
+				sb.WriteString(raw)
+			}
+
+		default:
+			sb.WriteString(raw)
+		}
+	}
+}
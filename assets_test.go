@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAssetRewriter(t *testing.T) {
+	base := t.TempDir()
+	os.MkdirAll(filepath.Join(base, "css"), 0755)
+	os.WriteFile(filepath.Join(base, "css", "site.css"), []byte(`body { background: url("../img/bg.png") }`), 0644)
+	// Local files become asset:<path relative to the document>
+	rewrite := func(path string) (string, bool) {
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return "", false
+		}
+		return "asset:" + filepath.ToSlash(rel), true
+	}
+
+	tests := []struct {
+		name   string
+		in     string
+		want   string
+		inline bool // inlineStylesheets
+		follow bool // followLinks
+	}{
+		{
+			name: "img src",
+			in:   `<p><img src="img/a.png" alt="A"></p>`,
+			want: `<p><img src="asset:img/a.png" alt="A"></p>`,
+		},
+		{
+			name: "remote and data URLs stay",
+			in:   `<img src="https://example.com/a.png"><img src="data:image/png;base64,AAAA">`,
+			want: `<img src="https://example.com/a.png"><img src="data:image/png;base64,AAAA">`,
+		},
+		{
+			name: "srcset keeps descriptors",
+			in:   `<img srcset="a.png 1x, img/b@2x.png 2x,https://cdn/c.png 3x">`,
+			want: `<img srcset="asset:a.png 1x, asset:img/b@2x.png 2x, https://cdn/c.png 3x">`,
+		},
+		{
+			name: "srcset with a data URI",
+			in:   `<img srcset="data:image/png;base64,AA,BB 1x, b.png 2x">`,
+			want: `<img srcset="data:image/png;base64,AA,BB 1x, asset:b.png 2x">`,
+		},
+		{
+			name: "picture source",
+			in:   `<picture><source srcset="wide.webp" media="(min-width: 800px)"><source src="v.webm"><img src="narrow.jpg"></picture>`,
+			want: `<picture><source srcset="asset:wide.webp" media="(min-width: 800px)"><source src="asset:v.webm"><img src="asset:narrow.jpg"></picture>`,
+		},
+		{
+			name: "unquoted attribute",
+			in:   `<img src=img/a.png width=10>`,
+			want: `<img src="asset:img/a.png" width="10">`,
+		},
+		{
+			name: "percent-escaped and query",
+			in:   `<img src="my%20pic.png?v=2#x">`,
+			want: `<img src="asset:my pic.png">`,
+		},
+		{
+			name: "style attribute url()",
+			in:   `<div style="background: url('bg one.png'); border-image: url(b.png) 30"></div>`,
+			want: `<div style="background: url(&#34;asset:bg one.png&#34;); border-image: url(asset:b.png) 30"></div>`,
+		},
+		{
+			name: "style block",
+			in:   "<style>@import 'base.css';\n.a { background: url(\"img/a.png\") } .b { background: url(https://x/y.png) }</style><p>url(not-css.png)</p>",
+			want: "<style>@import url(asset:base.css);\n.a { background: url(asset:img/a.png) } .b { background: url(https://x/y.png) }</style><p>url(not-css.png)</p>",
+		},
+		{
+			name: "stylesheet link kept",
+			in:   `<link rel="stylesheet" href="css/site.css">`,
+			want: `<link rel="stylesheet" href="css/site.css">`,
+		},
+		{
+			name:   "stylesheet link followed",
+			in:     `<link rel="stylesheet" href="css/site.css"><a href="other.html">x</a><a href="#top">y</a>`,
+			want:   `<link rel="stylesheet" href="asset:css/site.css"><a href="asset:other.html">x</a><a href="#top">y</a>`,
+			follow: true,
+		},
+		{
+			name:   "stylesheet link inlined",
+			in:     `<link rel="preload stylesheet" href="css/site.css"><link rel="icon" href="i.png">`,
+			want:   "<style>\nbody { background: url(asset:img/bg.png) }\n</style><link rel=\"icon\" href=\"i.png\">",
+			inline: true,
+		},
+		{
+			name: "video poster and object data",
+			in:   `<video src="v.mp4" poster="poster.jpg" controls><track src="subs.vtt"></video><object data="doc.pdf" type="application/pdf"></object>`,
+			want: `<video src="asset:v.mp4" poster="asset:poster.jpg" controls=""><track src="asset:subs.vtt"></video><object data="asset:doc.pdf" type="application/pdf"></object>`,
+		},
+		{
+			name: "svg image href",
+			in:   `<svg><image href="i.svg"/><image xlink:href="j.svg"/></svg>`,
+			want: `<svg><image href="asset:i.svg"/><image xlink:href="asset:j.svg"/></svg>`,
+		},
+		{
+			name: "> inside an attribute value",
+			in:   `<p title="a > b"><img alt="x > y" src="a.png"></p>`,
+			want: `<p title="a > b"><img alt="x &gt; y" src="asset:a.png"></p>`,
+		},
+		{
+			name: "untouched markup is copied byte for byte",
+			in:   "<!DOCTYPE html>\n<P Class=x>Text &amp; <b>bold</b><!-- <img src=c.png> --></P>",
+			want: "<!DOCTYPE html>\n<P Class=x>Text &amp; <b>bold</b><!-- <img src=c.png> --></P>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &assetRewriter{baseDir: base, rewrite: rewrite, inlineStylesheets: tt.inline, followLinks: tt.follow}
+			if got := a.rewriteHTML(tt.in); got != tt.want {
+				t.Errorf("rewriteHTML(%s)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalAssetPath(t *testing.T) {
+	base := filepath.FromSlash("/docs/a")
+	tests := []struct {
+		ref  string
+		want string
+		ok   bool
+	}{
+		{"img/x.png", "/docs/a/img/x.png", true},
+		{"../b/y.png", "/docs/b/y.png", true},
+		{"x%20y.png?v=1", "/docs/a/x y.png", true},
+		{"file:///tmp/z.png", "/tmp/z.png", true},
+		{"https://example.com/x.png", "", false},
+		{"//cdn.example.com/x.png", "", false},
+		{"data:image/png;base64,AA", "", false},
+		{"#frag", "", false},
+		{"  ", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := localAssetPath(tt.ref, base)
+		if ok != tt.ok || (ok && got != filepath.FromSlash(tt.want)) {
+			t.Errorf("localAssetPath(%q) = %q, %v; want %q, %v", tt.ref, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	ASSET_URL_PATH = "/api/asset"
+
+	// Values of the ?assets= parameter on /api/open-file
+	ASSET_MODE_INLINE = ""     // Embed local resources as data URIs (default)
+	ASSET_MODE_LAZY   = "lazy" // Reference them through /api/asset
+)
+
+// assetURLRe finds /api/asset URLs in plain text such as Markdown.
+var assetURLRe = regexp.MustCompile(`(?:https?://(?:127\.0\.0\.1|localhost)(?::\d+)?)?/api/asset\?[^\s()"'<>]+`)
+
+// Documents opened with lazy assets. An id only grants access to files
+// below the directory of the document it was issued for.
+var (
+	docDirs     = make(map[string]string) // doc id -> document directory
+	docIDByPath = make(map[string]string) // lock key -> doc id
+	docDirsMu   sync.RWMutex
+)
+
+// registerDocument returns the asset id for the document at path, reusing
+// the id when the same file is opened again.
+func registerDocument(path string) string {
+	key := getLockKey(path)
+	docDirsMu.Lock()
+	defer docDirsMu.Unlock()
+	if id, ok := docIDByPath[key]; ok {
+		return id
+	}
+	id := generateID()
+	docIDByPath[key] = id
+	docDirs[id] = filepath.Dir(filepath.Clean(path))
+	return id
+}
+
+// resolveLocalAssets prepares the local resources of an HTML document for
+// the editor according to the requested asset mode.
+func resolveLocalAssets(htmlContent, htmlFilePath, mode string) string {
+	if mode == ASSET_MODE_LAZY {
+		return lazyLocalAssets(htmlContent, htmlFilePath)
+	}
+	return inlineLocalAssets(htmlContent, htmlFilePath)
+}
+
+// lazyLocalAssets points local resources at /api/asset so the browser
+// fetches them on demand. Files outside the document directory cannot be
+// served and are inlined instead; stylesheets are still inlined (their
+// url() references go through /api/asset as well).
+func lazyLocalAssets(htmlContent, htmlFilePath string) string {
+	docID := registerDocument(htmlFilePath)
+	docDir := filepath.Dir(filepath.Clean(htmlFilePath))
+
+	a := &assetRewriter{
+		baseDir: filepath.Dir(htmlFilePath),
+		rewrite: func(path string) (string, bool) {
+			info, err := os.Stat(path)
+			if err != nil || info.IsDir() {
+				return "", false
+			}
+			rel, ok := relativeAssetPath(docDir, path)
+			if !ok {
+				return fileDataURI(path)
+			}
+			return fmt.Sprintf("%s?doc=%s&path=%s", ASSET_URL_PATH, docID, url.QueryEscape(rel)), true
+		},
+		inlineStylesheets: true,
+	}
+	return a.rewriteHTML(htmlContent)
+}
+
+// relativeAssetPath returns path relative to dir in slash form, or false
+// when it lies outside dir.
+func relativeAssetPath(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// resolveAssetPath maps a doc id and relative path back to a file, refusing
+// anything that escapes the document directory (including via symlinks).
+func resolveAssetPath(docID, relPath string) (string, bool) {
+	docDirsMu.RLock()
+	dir, ok := docDirs[docID]
+	docDirsMu.RUnlock()
+	if !ok || relPath == "" {
+		return "", false
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(relPath))
+	if _, ok := relativeAssetPath(dir, path); !ok {
+		return "", false
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", false
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", false
+	}
+	if _, ok := relativeAssetPath(realDir, realPath); !ok {
+		return "", false
+	}
+	return path, true
+}
+
+// assetURLFile resolves an /api/asset URL (root-relative or pointing at the
+// local server) to the file it serves.
+func assetURLFile(ref string) (string, bool) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Path != ASSET_URL_PATH {
+		return "", false
+	}
+	if u.Host != "" {
+		host := u.Hostname()
+		if host != "127.0.0.1" && host != "localhost" {
+			return "", false
+		}
+	}
+	q := u.Query()
+	return resolveAssetPath(q.Get("doc"), q.Get("path"))
+}
+
+// resolveAssetURLs replaces /api/asset references before a document is
+// written to targetPath: as data URIs when inline is set, otherwise as
+// paths relative to the saved file.
+func resolveAssetURLs(htmlContent, targetPath string, inline bool) string {
+	targetDir := filepath.Dir(targetPath)
+	a := &assetRewriter{
+		baseDir: targetDir,
+		mapRef: func(ref string) (string, bool) {
+			return savedAssetRef(ref, targetDir, inline)
+		},
+	}
+	return a.rewriteHTML(htmlContent)
+}
+
+// resolveAssetURLsInText does the same for Markdown source.
+func resolveAssetURLsInText(text, targetPath string, inline bool) string {
+	targetDir := filepath.Dir(targetPath)
+	return assetURLRe.ReplaceAllStringFunc(text, func(ref string) string {
+		if newRef, ok := savedAssetRef(ref, targetDir, inline); ok {
+			return newRef
+		}
+		return ref
+	})
+}
+
+func savedAssetRef(ref, targetDir string, inline bool) (string, bool) {
+	path, ok := assetURLFile(ref)
+	if !ok {
+		return "", false
+	}
+	if !inline {
+		// Rel fails across volumes; inlining keeps the image then
+		if rel, err := filepath.Rel(targetDir, path); err == nil {
+			return (&url.URL{Path: filepath.ToSlash(rel)}).String(), true
+		}
+	}
+	return fileDataURI(path)
+}
+
+// handleAsset streams a resource of a lazily opened document. Range and
+// conditional requests are handled by http.ServeContent; the ETag lets the
+// browser revalidate cheaply when the file is edited on disk.
+func handleAsset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	path, ok := resolveAssetPath(q.Get("doc"), q.Get("path"))
+	if !ok {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".svg", ".css", ".webp":
+		// The Windows registry does not always know these
+		w.Header().Set("Content-Type", detectMimeType(path, nil))
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	BROWSER_ENV_VAR = "WINHTML_BROWSER" // Explicit browser executable, wins over everything else
+)
+
+// Executable names looked up on PATH, in order of preference.
+var browserPathNames = []string{
+	"msedge", "microsoft-edge", "microsoft-edge-stable",
+	"google-chrome", "google-chrome-stable", "chrome",
+	"chromium", "chromium-browser",
+	"brave-browser", "brave",
+}
+
+type BrowserCandidate struct {
+	Path   string `json:"path"`
+	Source string `json:"source"` // env, config, install, registry, portable, path
+	Found  bool   `json:"found"`
+}
+
+type BrowserDiagnostics struct {
+	Path       string             `json:"path"`
+	Source     string             `json:"source"`
+	Product    string             `json:"product,omitempty"`
+	UserAgent  string             `json:"userAgent,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Candidates []BrowserCandidate `json:"candidates"`
+}
+
+// configBrowserPath reads the browser override from the settings, if any.
+func configBrowserPath() string {
+	return loadSettings().BrowserPath
+}
+
+// installedBrowserPaths lists the well known install locations per platform.
+func installedBrowserPaths() []string {
+	switch runtime.GOOS {
+	case "windows":
+		localAppData := os.Getenv("LOCALAPPDATA")
+		return []string{
+			`C:\Program Files (x86)\Microsoft\Edge\Application\msedge.exe`,
+			`C:\Program Files\Microsoft\Edge\Application\msedge.exe`,
+			`C:\Program Files\Google\Chrome\Application\chrome.exe`,
+			`C:\Program Files (x86)\Google\Chrome\Application\chrome.exe`,
+			filepath.Join(localAppData, `Google\Chrome\Application\chrome.exe`),
+			`C:\Program Files\BraveSoftware\Brave-Browser\Application\brave.exe`,
+			`C:\Program Files (x86)\BraveSoftware\Brave-Browser\Application\brave.exe`,
+			filepath.Join(localAppData, `BraveSoftware\Brave-Browser\Application\brave.exe`),
+			filepath.Join(localAppData, `Chromium\Application\chrome.exe`),
+		}
+	case "darwin":
+		system := []string{
+			"/Applications/Microsoft Edge.app/Contents/MacOS/Microsoft Edge",
+			"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+			"/Applications/Chromium.app/Contents/MacOS/Chromium",
+			"/Applications/Brave Browser.app/Contents/MacOS/Brave Browser",
+		}
+		paths := append([]string{}, system...)
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, p := range system {
+				paths = append(paths, filepath.Join(home, p))
+			}
+		}
+		return paths
+	default:
+		return []string{
+			"/opt/microsoft/msedge/msedge",
+			"/opt/google/chrome/chrome",
+			"/opt/brave.com/brave/brave",
+			"/usr/lib/chromium/chromium",
+			"/usr/lib/chromium-browser/chromium-browser",
+			"/snap/bin/chromium",
+			"/var/lib/flatpak/exports/bin/com.google.Chrome",
+			"/var/lib/flatpak/exports/bin/org.chromium.Chromium",
+		}
+	}
+}
+
+// portableBrowserPaths looks next to our own executable for a portable
+// Chrome/Chromium that was unpacked alongside the editor.
+func portableBrowserPaths() []string {
+	if runtime.GOOS != "windows" {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	dir := filepath.Dir(exe)
+	return []string{
+		filepath.Join(dir, "chrome.exe"),
+		filepath.Join(dir, `chrome-win\chrome.exe`),
+		filepath.Join(dir, `chrome-win64\chrome.exe`),
+		filepath.Join(dir, `GoogleChromePortable\App\Chrome-bin\chrome.exe`),
+	}
+}
+
+// browserCandidates returns every location checked, in priority order, with
+// Found set for the ones that exist.
+func browserCandidates() []BrowserCandidate {
+	var candidates []BrowserCandidate
+	add := func(path, source string) {
+		if path == "" {
+			return
+		}
+		info, err := os.Stat(path)
+		candidates = append(candidates, BrowserCandidate{
+			Path:   path,
+			Source: source,
+			Found:  err == nil && !info.IsDir(),
+		})
+	}
+
+	add(os.Getenv(BROWSER_ENV_VAR), "env")
+	add(configBrowserPath(), "config")
+
+	// Windows keeps the historical preference for installed Edge/Chrome;
+	// elsewhere PATH is the most reliable signal.
+	if runtime.GOOS == "windows" {
+		for _, p := range installedBrowserPaths() {
+			add(p, "install")
+		}
+		for _, p := range registryBrowserPaths() {
+			add(p, "registry")
+		}
+		for _, p := range portableBrowserPaths() {
+			add(p, "portable")
+		}
+	}
+	for _, name := range browserPathNames {
+		if p, err := exec.LookPath(name); err == nil {
+			add(p, "path")
+		}
+	}
+	if runtime.GOOS != "windows" {
+		for _, p := range installedBrowserPaths() {
+			add(p, "install")
+		}
+	}
+	return candidates
+}
+
+// discoverBrowser picks the first existing candidate.
+func discoverBrowser() (path, source string, candidates []BrowserCandidate) {
+	candidates = browserCandidates()
+	for _, c := range candidates {
+		if c.Found {
+			return c.Path, c.Source, candidates
+		}
+	}
+	return "", "", candidates
+}
+
+// findBrowserPath returns the browser used for exports, or "" to let
+// chromedp fall back to its own defaults.
+func findBrowserPath() string {
+	path, _, _ := discoverBrowser()
+	return path
+}
+
+// handleBrowserDiagnostics reports which browser exports would use and asks
+// it for its version over CDP.
+func handleBrowserDiagnostics(w http.ResponseWriter, r *http.Request) {
+	path, source, candidates := discoverBrowser()
+	diag := BrowserDiagnostics{
+		Path:       path,
+		Source:     source,
+		Candidates: candidates,
+	}
+
+	ctx, cancel := newExportBrowser(path, 15*time.Second)
+	defer cancel()
+
+	if err := chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		_, product, _, userAgent, _, err := browser.GetVersion().Do(ctx)
+		diag.Product = product
+		diag.UserAgent = userAgent
+		return err
+	})); err != nil {
+		diag.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diag)
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// registryBrowserPaths has no registry to consult outside Windows.
+func registryBrowserPaths() []string {
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"golang.org/x/sys/windows/registry"
+)
+
+// registryBrowserPaths reads the App Paths registrations, which also cover
+// per-user and non-default install locations.
+func registryBrowserPaths() []string {
+	var paths []string
+	for _, root := range []registry.Key{registry.CURRENT_USER, registry.LOCAL_MACHINE} {
+		for _, exe := range []string{"msedge.exe", "chrome.exe", "brave.exe", "chromium.exe"} {
+			k, err := registry.OpenKey(root, `SOFTWARE\Microsoft\Windows\CurrentVersion\App Paths\`+exe, registry.QUERY_VALUE)
+			if err != nil {
+				continue
+			}
+			if p, _, err := k.GetStringValue(""); err == nil && p != "" {
+				paths = append(paths, p)
+			}
+			k.Close()
+		}
+	}
+	return paths
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runCLIExport implements
+//
+//	WinHTMLEditor.exe --export -o <output.pdf|.png|.html|.mhtml|.docx> [-scale 1.0] [-width 1200] <input>
+//
+// If an editor instance is already running the job is handed to it over the
+// API, otherwise this process serves the render view itself for the
+// duration of the export. Returns the process exit code.
+func runCLIExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "", "output file (.pdf, .png, .html, .mhtml or .docx)")
+	scale := flags.Float64("scale", 1.0, "PDF scale factor")
+	width := flags.Int("width", 1200, "PNG viewport width in CSS pixels")
+	readyTimeout := flags.Int("ready-timeout", 0, "max wait for render readiness in ms")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *output == "" || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: --export -o <output.pdf|.png|.html|.mhtml|.docx> [-scale 1.0] [-width 1200] <input>")
+		return 2
+	}
+
+	inputPath, _ := filepath.Abs(flags.Arg(0))
+	outputPath, _ := filepath.Abs(*output)
+	outExt := strings.ToLower(filepath.Ext(outputPath))
+	if outExt != ".pdf" && outExt != ".png" && outExt != ".html" && outExt != ".mhtml" && outExt != ".docx" {
+		fmt.Fprintln(os.Stderr, "output must be a .pdf, .png, .html, .mhtml or .docx file")
+		return 2
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", APP_PORT))
+	if err != nil {
+		// Primary instance owns the port, let it do the work.
+		if err := exportViaPrimary(inputPath, outputPath, *scale, *width, *readyTimeout); err != nil {
+			log.Println("Export failed:", err)
+			return 1
+		}
+		return 0
+	}
+	defer listener.Close()
+
+	fsys, err := fs.Sub(assets, "dist")
+	if err != nil {
+		log.Println("Export failed:", err)
+		return 1
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/render-view", handleRenderView)
+	mux.Handle("/", http.FileServer(http.FS(fsys)))
+	go http.Serve(listener, mux)
+
+	pageHTML, err := loadDocumentForRender(inputPath)
+	if err != nil {
+		log.Println("Export failed:", err)
+		return 1
+	}
+
+	exporter := selectExporter()
+	opts := ExportOptions{Width: *width, Scale: *scale, ReadyBound: renderReadyBound(*readyTimeout)}
+
+	var buf []byte
+	switch outExt {
+	case ".pdf":
+		buf, err = exporter.PDF(pageHTML, opts)
+	case ".png":
+		buf, err = exporter.Screenshot(pageHTML, opts)
+	case ".docx":
+		buf, err = buildDocx(pageHTML, filepath.Dir(inputPath))
+	default: // Single-file archives need no browser
+		buf, err = buildArchive(pageHTML, strings.TrimPrefix(outExt, "."))
+	}
+	if err != nil {
+		log.Println("Export failed:", err)
+		return 1
+	}
+
+	if err := os.WriteFile(outputPath, buf, 0644); err != nil {
+		log.Println("Export failed:", err)
+		return 1
+	}
+	return 0
+}
+
+// exportViaPrimary posts the export job to the running editor instance.
+func exportViaPrimary(inputPath, outputPath string, scale float64, width, readyTimeout int) error {
+	var endpoint string
+	var payload interface{}
+	switch outExt := strings.ToLower(filepath.Ext(outputPath)); outExt {
+	case ".pdf":
+		endpoint = "/api/export/pdf"
+		payload = PdfExportRequest{Path: outputPath, Scale: scale, SourcePath: inputPath, ReadyTimeout: readyTimeout}
+	case ".html", ".mhtml":
+		endpoint = "/api/export/" + strings.TrimPrefix(outExt, ".")
+		payload = ArchiveExportRequest{Path: outputPath, SourcePath: inputPath}
+	case ".docx":
+		endpoint = "/api/export/docx"
+		payload = DocxExportRequest{Path: outputPath, SourcePath: inputPath}
+	default:
+		endpoint = "/api/export/screenshot"
+		payload = ScreenshotRequest{Width: width, SourcePath: inputPath, ReadyTimeout: readyTimeout}
+	}
+
+	jsonData, _ := json.Marshal(payload)
+	client := http.Client{Timeout: 2 * PDF_TIMEOUT}
+	resp, err := client.Post(globalTargetUrl+endpoint, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// PDFs, archives and documents are written by the primary, screenshots come back in the body.
+	if endpoint == "/api/export/screenshot" {
+		return os.WriteFile(outputPath, body, 0644)
+	}
+	return nil
+}
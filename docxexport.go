@@ -0,0 +1,1436 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// A4 with 1" margins, in twips
+	DOCX_PAGE_WIDTH  = 11906
+	DOCX_PAGE_HEIGHT = 16838
+	DOCX_MARGIN      = 1440
+	DOCX_TEXT_WIDTH  = DOCX_PAGE_WIDTH - 2*DOCX_MARGIN
+
+	DOCX_MAX_IMAGE_WIDTH = 600 // px, about the text width
+	DOCX_BULLET_NUM      = 1   // numId shared by all bullet lists
+
+	docxNamespaces = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" ` +
+		`xmlns:m="http://schemas.openxmlformats.org/officeDocument/2006/math" ` +
+		`xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing" ` +
+		`xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" ` +
+		`xmlns:pic="http://schemas.openxmlformats.org/drawingml/2006/picture"`
+)
+
+// docxBuilder collects the parts of a .docx while the export page is
+// walked: relationships, media, list instances and comments.
+type docxBuilder struct {
+	baseDir  string // For images referenced relative to the document
+	rels     []string
+	media    map[string]string // Image hash -> relationship id
+	files    map[string][]byte // word/media/... -> data
+	nums     []string          // <w:num> of each ordered list
+	comments []string
+	drawings int
+	author   string
+}
+
+// docxRunProps is the inherited character formatting of inline content.
+type docxRunProps struct {
+	bold, italic, underline, strike, sup, sub, code, link bool
+	color, shade, highlight                               string
+	size                                                  int // Half-points
+}
+
+// docxBlockCtx carries list and style state down the block tree.
+type docxBlockCtx struct {
+	style     string // Paragraph style for plain paragraphs (Quote)
+	numID     int    // List of the next paragraph, 0 if none
+	level     int
+	listDepth int    // Enclosing lists
+	indent    int    // Follow-up paragraphs of a list item, in list levels
+	prefix    string // Checkbox of a task list item
+	run       docxRunProps
+}
+
+// docxPara accumulates the runs of one paragraph.
+type docxPara struct {
+	runs       strings.Builder
+	space      bool // Last character was whitespace, collapse the next
+	hasContent bool
+}
+
+// buildDocx converts an export page into a Word document. Headings map to
+// the Heading styles, lists to Word numbering, equations to OMML and the
+// editor's comment marks to Word comments.
+func buildDocx(page, baseDir string) ([]byte, error) {
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+	b := &docxBuilder{
+		baseDir: baseDir,
+		media:   make(map[string]string),
+		files:   make(map[string][]byte),
+		author:  "WinHTML Editor",
+	}
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		b.author = u.Username[strings.LastIndex(u.Username, `\`)+1:]
+	}
+	b.addRel("styles", "styles.xml", false)
+	b.addRel("numbering", "numbering.xml", false)
+
+	body := findElement(doc, atom.Body)
+	if body == nil {
+		body = doc
+	}
+	content := b.blocks(body, &docxBlockCtx{})
+	if strings.HasSuffix(content, "</w:tbl>") {
+		content += "<w:p/>" // Word wants the body to end with a paragraph
+	}
+
+	var document strings.Builder
+	document.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	document.WriteString(`<w:document ` + docxNamespaces + `><w:body>`)
+	document.WriteString(content)
+	fmt.Fprintf(&document, `<w:sectPr><w:pgSz w:w="%d" w:h="%d"/><w:pgMar w:top="%d" w:right="%d" w:bottom="%d" w:left="%d" w:header="708" w:footer="708" w:gutter="0"/></w:sectPr>`,
+		DOCX_PAGE_WIDTH, DOCX_PAGE_HEIGHT, DOCX_MARGIN, DOCX_MARGIN, DOCX_MARGIN, DOCX_MARGIN)
+	document.WriteString(`</w:body></w:document>`)
+
+	if len(b.comments) > 0 {
+		b.addRel("comments", "comments.xml", false)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	parts := []struct {
+		name string
+		data []byte
+	}{
+		{"[Content_Types].xml", []byte(b.contentTypes())},
+		{"_rels/.rels", []byte(docxPackageRels)},
+		{"word/document.xml", []byte(document.String())},
+		{"word/styles.xml", []byte(docxStyles)},
+		{"word/numbering.xml", []byte(b.numbering())},
+		{"word/_rels/document.xml.rels", []byte(docxRelsHeader + strings.Join(b.rels, "") + "</Relationships>")},
+	}
+	if len(b.comments) > 0 {
+		parts = append(parts, struct {
+			name string
+			data []byte
+		}{"word/comments.xml", []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n<w:comments " + docxNamespaces + ">" + strings.Join(b.comments, "") + "</w:comments>")})
+	}
+	for _, part := range parts {
+		w, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(part.data); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(b.files))
+	for name := range b.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data := b.files[name]
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store}) // Already compressed
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleDocxExport serves /api/export/docx, writing the document to req.Path.
+func handleDocxExport(w http.ResponseWriter, r *http.Request) {
+	var req DocxExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "Path is empty", http.StatusBadRequest)
+		return
+	}
+
+	pageHTML, err := resolveExportHTML(req.Html, req.Format, req.SourcePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	baseDir := ""
+	switch {
+	case req.SourcePath != "":
+		baseDir = filepath.Dir(req.SourcePath)
+	case req.DocumentPath != "":
+		baseDir = filepath.Dir(req.DocumentPath)
+	}
+
+	buf, err := buildDocx(pageHTML, baseDir)
+	if err != nil {
+		log.Printf("Error building DOCX: %v", err)
+		http.Error(w, "Export Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(req.Path, buf, 0644); err != nil {
+		log.Println("Error writing DOCX file:", err)
+		http.Error(w, "Failed to write file", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if f := findElement(c, a); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func (b *docxBuilder) addRel(typ, target string, external bool) string {
+	id := fmt.Sprintf("rId%d", len(b.rels)+1)
+	mode := ""
+	if external {
+		mode = ` TargetMode="External"`
+	}
+	b.rels = append(b.rels, fmt.Sprintf(`<Relationship Id="%s" Type="%s%s" Target="%s"%s/>`, id, relTypePrefix, typ, docxEscape(target), mode))
+	return id
+}
+
+// Elements walked as blocks; everything else is inline content.
+var docxBlockElements = map[atom.Atom]bool{
+	atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Div: true, atom.Section: true, atom.Article: true, atom.Main: true, atom.Header: true,
+	atom.Footer: true, atom.Nav: true, atom.Aside: true, atom.Figure: true, atom.Figcaption: true,
+	atom.Blockquote: true, atom.Pre: true, atom.Ul: true, atom.Ol: true, atom.Li: true,
+	atom.Table: true, atom.Hr: true, atom.Dl: true, atom.Dt: true, atom.Dd: true, atom.Address: true,
+	atom.Details: true, atom.Summary: true, atom.Center: true, atom.Form: true,
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+}
+
+// blocks renders the children of n, gathering loose inline content into
+// paragraphs.
+func (b *docxBuilder) blocks(n *html.Node, ctx *docxBlockCtx) string {
+	var out strings.Builder
+	var para *docxPara
+	flush := func() {
+		if para != nil && para.hasContent {
+			out.WriteString(b.paragraph(para, "", "", ctx))
+		}
+		para = nil
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && docxBlockElements[c.DataAtom] {
+			flush()
+			writeDocxBlock(&out, b.block(c, ctx))
+			continue
+		}
+		if para == nil {
+			para = &docxPara{space: true}
+		}
+		b.inline(c, ctx.run, para)
+	}
+	flush()
+	return out.String()
+}
+
+// writeDocxBlock appends block to out. Word merges tables that follow each
+// other directly, so an empty paragraph goes between them.
+func writeDocxBlock(out *strings.Builder, block string) {
+	if strings.HasSuffix(out.String(), "</w:tbl>") && strings.HasPrefix(block, "<w:tbl>") {
+		out.WriteString("<w:p/>")
+	}
+	out.WriteString(block)
+}
+
+func (b *docxBuilder) block(n *html.Node, ctx *docxBlockCtx) string {
+	align := cssTextAlign(n)
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Noscript, atom.Template:
+		return ""
+	case atom.P, atom.Dt, atom.Dd, atom.Summary, atom.Figcaption:
+		return b.inlineParagraph(n, "", align, ctx)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		return b.inlineParagraph(n, "Heading"+n.Data[1:], align, ctx)
+	case atom.Blockquote:
+		sub := *ctx
+		sub.style = "Quote"
+		out := b.blocks(n, &sub)
+		ctx.numID = sub.numID
+		return out
+	case atom.Pre:
+		return b.codeBlock(n, ctx)
+	case atom.Ul, atom.Ol:
+		return b.list(n, ctx)
+	case atom.Table:
+		return b.table(n, ctx)
+	case atom.Hr:
+		return `<w:p><w:pPr><w:pBdr><w:bottom w:val="single" w:sz="6" w:space="1" w:color="AAAAAA"/></w:pBdr></w:pPr></w:p>`
+	case atom.Div:
+		if hasClass(n, "winhtml-textbox") {
+			return b.textBox(n, ctx)
+		}
+	}
+	return b.blocks(n, ctx)
+}
+
+func (b *docxBuilder) inlineParagraph(n *html.Node, style, align string, ctx *docxBlockCtx) string {
+	p := &docxPara{space: true}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.inline(c, ctx.run, p)
+	}
+	return b.paragraph(p, style, align, ctx)
+}
+
+// paragraph writes a <w:p>. The first paragraph of a list item takes the
+// item's numbering, later ones are only indented to match.
+func (b *docxBuilder) paragraph(p *docxPara, style, align string, ctx *docxBlockCtx) string {
+	if style == "" {
+		style = ctx.style
+	}
+	var pPr strings.Builder
+	if style != "" {
+		pPr.WriteString(`<w:pStyle w:val="` + style + `"/>`)
+	}
+	if ctx.numID > 0 {
+		fmt.Fprintf(&pPr, `<w:numPr><w:ilvl w:val="%d"/><w:numId w:val="%d"/></w:numPr>`, ctx.level, ctx.numID)
+		ctx.numID = 0
+		ctx.indent = ctx.level + 1
+	} else if ctx.indent > 0 {
+		fmt.Fprintf(&pPr, `<w:ind w:left="%d"/>`, 720*ctx.indent)
+	}
+	switch align {
+	case "center":
+		pPr.WriteString(`<w:jc w:val="center"/>`)
+	case "right":
+		pPr.WriteString(`<w:jc w:val="right"/>`)
+	case "justify":
+		pPr.WriteString(`<w:jc w:val="both"/>`)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<w:p>")
+	if pPr.Len() > 0 {
+		sb.WriteString("<w:pPr>" + pPr.String() + "</w:pPr>")
+	}
+	if ctx.prefix != "" {
+		sb.WriteString(`<w:r><w:t xml:space="preserve">` + ctx.prefix + ` </w:t></w:r>`)
+		ctx.prefix = ""
+	}
+	sb.WriteString(p.runs.String())
+	sb.WriteString("</w:p>")
+	return sb.String()
+}
+
+func (b *docxBuilder) codeBlock(n *html.Node, ctx *docxBlockCtx) string {
+	var runs strings.Builder
+	lines := strings.Split(strings.TrimSuffix(nodeRawText(n), "\n"), "\n")
+	for i, line := range lines {
+		if i > 0 {
+			runs.WriteString("<w:br/>")
+		}
+		for j, part := range strings.Split(line, "\t") {
+			if j > 0 {
+				runs.WriteString("<w:tab/>")
+			}
+			if part != "" {
+				runs.WriteString(`<w:t xml:space="preserve">` + docxEscape(part) + `</w:t>`)
+			}
+		}
+	}
+	p := &docxPara{}
+	p.runs.WriteString("<w:r>" + runs.String() + "</w:r>")
+	return b.paragraph(p, "Code", "", ctx)
+}
+
+func (b *docxBuilder) list(n *html.Node, ctx *docxBlockCtx) string {
+	level := min(ctx.listDepth, 8)
+	numID := DOCX_BULLET_NUM
+	if n.DataAtom == atom.Ol {
+		start, err := strconv.Atoi(htmlAttr(n, "start"))
+		if err != nil {
+			start = 1
+		}
+		b.nums = append(b.nums, fmt.Sprintf(`<w:lvlOverride w:ilvl="%d"><w:startOverride w:val="%d"/></w:lvlOverride>`, level, start))
+		numID = DOCX_BULLET_NUM + len(b.nums)
+	}
+	taskList := htmlAttr(n, "data-type") == "taskList"
+
+	var out strings.Builder
+	for li := n.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode {
+			continue
+		}
+		sub := *ctx
+		sub.numID, sub.level, sub.listDepth, sub.indent, sub.prefix = numID, level, level+1, 0, ""
+		if taskList {
+			sub.prefix = "☐"
+			if htmlAttr(li, "data-checked") == "true" {
+				sub.prefix = "☒"
+			}
+		}
+		if li.DataAtom != atom.Li {
+			writeDocxBlock(&out, b.block(li, &sub))
+			continue
+		}
+		writeDocxBlock(&out, b.blocks(li, &sub))
+	}
+	return out.String()
+}
+
+// table maps colspan to gridSpan and rowspan to a vMerge run of cells in
+// the rows below.
+func (b *docxBuilder) table(n *html.Node, ctx *docxBlockCtx) string {
+	var rows []*html.Node
+	var collect func(n *html.Node)
+	collect = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.DataAtom {
+			case atom.Tr:
+				rows = append(rows, c)
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				collect(c)
+			}
+		}
+	}
+	collect(n)
+	if len(rows) == 0 {
+		return ""
+	}
+
+	type slot struct{ row, col int }
+	merged := make(map[slot]int) // Continuation cells -> their gridSpan
+	var rowsXML strings.Builder
+	cols := 0
+	for r, tr := range rows {
+		var cells strings.Builder
+		col := 0
+		emitMerged := func() {
+			for {
+				span, ok := merged[slot{r, col}]
+				if !ok {
+					return
+				}
+				cells.WriteString(`<w:tc><w:tcPr>` + docxGridSpan(span) + `<w:vMerge/></w:tcPr><w:p/></w:tc>`)
+				col += span
+			}
+		}
+
+		header := true
+		for td := tr.FirstChild; td != nil; td = td.NextSibling {
+			if td.DataAtom != atom.Td && td.DataAtom != atom.Th {
+				continue
+			}
+			emitMerged()
+			colspan, _ := strconv.Atoi(htmlAttr(td, "colspan"))
+			rowspan, _ := strconv.Atoi(htmlAttr(td, "rowspan"))
+			colspan, rowspan = max(colspan, 1), max(rowspan, 1)
+
+			tcPr := docxGridSpan(colspan)
+			if rowspan > 1 {
+				tcPr += `<w:vMerge w:val="restart"/>`
+				for k := 1; k < rowspan; k++ {
+					merged[slot{r + k, col}] = colspan
+				}
+			}
+			sub := docxBlockCtx{run: ctx.run}
+			fill := cssColor(cssProperty(td, "background-color"))
+			if td.DataAtom == atom.Th {
+				sub.run.bold = true
+				if fill == "" {
+					fill = "F3F4F6"
+				}
+			} else {
+				header = false
+			}
+			if fill != "" {
+				tcPr += `<w:shd w:val="clear" w:color="auto" w:fill="` + fill + `"/>`
+			}
+
+			content := b.blocks(td, &sub)
+			if !strings.HasSuffix(content, "</w:p>") {
+				content += "<w:p/>" // A cell must end with a paragraph
+			}
+			if tcPr != "" {
+				tcPr = "<w:tcPr>" + tcPr + "</w:tcPr>"
+			}
+			cells.WriteString("<w:tc>" + tcPr + content + "</w:tc>")
+			col += colspan
+		}
+		emitMerged()
+		cols = max(cols, col)
+
+		rowsXML.WriteString("<w:tr>")
+		if header && col > 0 {
+			rowsXML.WriteString("<w:trPr><w:tblHeader/></w:trPr>")
+		}
+		rowsXML.WriteString(cells.String() + "</w:tr>")
+	}
+	if cols == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`<w:tbl><w:tblPr><w:tblStyle w:val="TableGrid"/><w:tblW w:w="5000" w:type="pct"/><w:tblLayout w:type="autofit"/></w:tblPr><w:tblGrid>`)
+	for i := 0; i < cols; i++ {
+		fmt.Fprintf(&sb, `<w:gridCol w:w="%d"/>`, DOCX_TEXT_WIDTH/cols)
+	}
+	sb.WriteString("</w:tblGrid>" + rowsXML.String() + "</w:tbl>")
+	return sb.String()
+}
+
+func docxGridSpan(span int) string {
+	if span > 1 {
+		return fmt.Sprintf(`<w:gridSpan w:val="%d"/>`, span)
+	}
+	return ""
+}
+
+// textBox renders the editor's text box as a shaded single-cell table.
+func (b *docxBuilder) textBox(n *html.Node, ctx *docxBlockCtx) string {
+	fill := cssColor(cssProperty(n, "background-color"))
+	if fill == "" {
+		fill = "F9FAFB"
+	}
+	border := cssColor(cssProperty(n, "border-color"))
+	if border == "" {
+		border = "D1D5DB"
+	}
+	sub := docxBlockCtx{run: ctx.run}
+	content := b.blocks(n, &sub)
+	if !strings.HasSuffix(content, "</w:p>") {
+		content += "<w:p/>"
+	}
+
+	var borders strings.Builder
+	for _, side := range []string{"top", "left", "bottom", "right"} {
+		fmt.Fprintf(&borders, `<w:%s w:val="single" w:sz="8" w:space="0" w:color="%s"/>`, side, border)
+	}
+	return `<w:tbl><w:tblPr><w:tblW w:w="5000" w:type="pct"/><w:tblBorders>` + borders.String() + `</w:tblBorders>` +
+		`<w:tblCellMar><w:top w:w="144" w:type="dxa"/><w:left w:w="144" w:type="dxa"/><w:bottom w:w="144" w:type="dxa"/><w:right w:w="144" w:type="dxa"/></w:tblCellMar></w:tblPr>` +
+		fmt.Sprintf(`<w:tblGrid><w:gridCol w:w="%d"/></w:tblGrid>`, DOCX_TEXT_WIDTH) +
+		`<w:tr><w:tc><w:tcPr><w:shd w:val="clear" w:color="auto" w:fill="` + fill + `"/></w:tcPr>` + content + `</w:tc></w:tr></w:tbl>`
+}
+
+// inline renders inline content into p with the formatting inherited in rp.
+func (b *docxBuilder) inline(n *html.Node, rp docxRunProps, p *docxPara) {
+	switch n.Type {
+	case html.TextNode:
+		p.text(n.Data, rp)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Input:
+		return
+	case atom.Br:
+		p.runs.WriteString("<w:r><w:br/></w:r>")
+		p.space, p.hasContent = true, true
+		return
+	case atom.Img:
+		if drawing := b.image(n); drawing != "" {
+			p.runs.WriteString(drawing)
+			p.space, p.hasContent = false, true
+		}
+		return
+	case atom.Strong, atom.B:
+		rp.bold = true
+	case atom.Em, atom.I, atom.Cite, atom.Var:
+		rp.italic = true
+	case atom.U, atom.Ins:
+		rp.underline = true
+	case atom.S, atom.Strike, atom.Del:
+		rp.strike = true
+	case atom.Sup:
+		rp.sup, rp.sub = true, false
+	case atom.Sub:
+		rp.sub, rp.sup = true, false
+	case atom.Mark:
+		rp.highlight = "yellow"
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		rp.code = true
+	case atom.A:
+		if href := htmlAttr(n, "href"); href != "" {
+			var target string
+			if anchor, ok := strings.CutPrefix(href, "#"); ok {
+				target = `w:anchor="` + docxEscape(anchor) + `"`
+			} else {
+				target = `r:id="` + b.addRel("hyperlink", href, true) + `"`
+			}
+			rp.link = true
+			p.runs.WriteString("<w:hyperlink " + target + ">")
+			b.inlineChildren(n, rp, p)
+			p.runs.WriteString("</w:hyperlink>")
+			return
+		}
+	case atom.Span:
+		if htmlAttr(n, "data-type") == "math" {
+			p.runs.WriteString(latexToOMML(htmlAttr(n, "data-latex"), htmlAttr(n, "data-display") == "true"))
+			p.space, p.hasContent = false, true
+			return
+		}
+		if text, ok := htmlAttrOK(n, "data-comment"); ok {
+			id := len(b.comments)
+			b.comments = append(b.comments, fmt.Sprintf(`<w:comment w:id="%d" w:author="%s" w:date="%s"><w:p><w:r><w:t xml:space="preserve">%s</w:t></w:r></w:p></w:comment>`,
+				id, docxEscape(b.author), time.Now().UTC().Format(time.RFC3339), docxEscape(text)))
+			fmt.Fprintf(&p.runs, `<w:commentRangeStart w:id="%d"/>`, id)
+			b.inlineChildren(n, b.styledRun(n, rp), p)
+			fmt.Fprintf(&p.runs, `<w:commentRangeEnd w:id="%d"/><w:r><w:commentReference w:id="%d"/></w:r>`, id, id)
+			return
+		}
+	}
+	b.inlineChildren(n, b.styledRun(n, rp), p)
+}
+
+func (b *docxBuilder) inlineChildren(n *html.Node, rp docxRunProps, p *docxPara) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.inline(c, rp, p)
+	}
+}
+
+// styledRun applies the style attribute of an inline element.
+func (b *docxBuilder) styledRun(n *html.Node, rp docxRunProps) docxRunProps {
+	if c := cssColor(cssProperty(n, "color")); c != "" {
+		rp.color = c
+	}
+	if c := cssColor(cssProperty(n, "background-color")); c != "" {
+		rp.shade = c
+	}
+	if size := cssFontSize(cssProperty(n, "font-size")); size > 0 {
+		rp.size = size
+	}
+	switch cssProperty(n, "font-weight") {
+	case "bold", "bolder", "600", "700", "800", "900":
+		rp.bold = true
+	}
+	if cssProperty(n, "font-style") == "italic" {
+		rp.italic = true
+	}
+	decoration := cssProperty(n, "text-decoration")
+	if strings.Contains(decoration, "underline") {
+		rp.underline = true
+	}
+	if strings.Contains(decoration, "line-through") {
+		rp.strike = true
+	}
+	return rp
+}
+
+// text appends text with HTML whitespace collapsing.
+func (p *docxPara) text(s string, rp docxRunProps) {
+	var sb strings.Builder
+	for _, r := range s {
+		if r == ' ' || r == '\n' || r == '\t' || r == '\r' || r == '\f' {
+			if !p.space {
+				sb.WriteByte(' ')
+				p.space = true
+			}
+			continue
+		}
+		sb.WriteRune(r)
+		p.space = false
+		p.hasContent = true
+	}
+	if sb.Len() == 0 {
+		return
+	}
+	p.runs.WriteString("<w:r>" + rp.rPr() + `<w:t xml:space="preserve">` + docxEscape(sb.String()) + "</w:t></w:r>")
+}
+
+// rPr writes run properties in schema order.
+func (rp docxRunProps) rPr() string {
+	var sb strings.Builder
+	if rp.link {
+		sb.WriteString(`<w:rStyle w:val="Hyperlink"/>`)
+	}
+	if rp.code {
+		sb.WriteString(`<w:rFonts w:ascii="Consolas" w:hAnsi="Consolas" w:cs="Consolas"/>`)
+	}
+	if rp.bold {
+		sb.WriteString("<w:b/>")
+	}
+	if rp.italic {
+		sb.WriteString("<w:i/>")
+	}
+	if rp.strike {
+		sb.WriteString("<w:strike/>")
+	}
+	if rp.color != "" {
+		sb.WriteString(`<w:color w:val="` + rp.color + `"/>`)
+	}
+	if rp.size > 0 {
+		fmt.Fprintf(&sb, `<w:sz w:val="%d"/><w:szCs w:val="%d"/>`, rp.size, rp.size)
+	}
+	if rp.highlight != "" {
+		sb.WriteString(`<w:highlight w:val="` + rp.highlight + `"/>`)
+	}
+	if rp.underline {
+		sb.WriteString(`<w:u w:val="single"/>`)
+	}
+	if rp.shade != "" {
+		sb.WriteString(`<w:shd w:val="clear" w:color="auto" w:fill="` + rp.shade + `"/>`)
+	}
+	if rp.sup {
+		sb.WriteString(`<w:vertAlign w:val="superscript"/>`)
+	} else if rp.sub {
+		sb.WriteString(`<w:vertAlign w:val="subscript"/>`)
+	}
+	if sb.Len() == 0 {
+		return ""
+	}
+	return "<w:rPr>" + sb.String() + "</w:rPr>"
+}
+
+// image embeds an <img> as an inline drawing. Word reads PNG, JPEG, GIF and
+// BMP; other raster formats are converted to PNG, unreadable ones dropped.
+func (b *docxBuilder) image(n *html.Node) string {
+	data, ok := b.loadImage(htmlAttr(n, "src"))
+	if !ok {
+		return ""
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width == 0 || cfg.Height == 0 {
+		return ""
+	}
+	switch format {
+	case "png", "jpeg", "gif", "bmp":
+	default:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return ""
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return ""
+		}
+		data, format = buf.Bytes(), "png"
+	}
+
+	width, height := cssPixels(htmlAttr(n, "width")), cssPixels(htmlAttr(n, "height"))
+	if w := cssPixels(cssProperty(n, "width")); w > 0 {
+		width = w
+	}
+	if h := cssPixels(cssProperty(n, "height")); h > 0 {
+		height = h
+	}
+	switch {
+	case width <= 0 && height <= 0:
+		width, height = cfg.Width, cfg.Height
+	case height <= 0:
+		height = width * cfg.Height / cfg.Width
+	case width <= 0:
+		width = height * cfg.Width / cfg.Height
+	}
+	if width > DOCX_MAX_IMAGE_WIDTH {
+		width, height = DOCX_MAX_IMAGE_WIDTH, height*DOCX_MAX_IMAGE_WIDTH/width
+	}
+
+	relID := b.addMedia(data, format)
+	b.drawings++
+	cx, cy := width*emuPerPixel, max(height, 1)*emuPerPixel
+	return fmt.Sprintf(`<w:r><w:drawing><wp:inline distT="0" distB="0" distL="0" distR="0"><wp:extent cx="%d" cy="%d"/>`+
+		`<wp:docPr id="%d" name="Picture %d" descr="%s"/><wp:cNvGraphicFramePr><a:graphicFrameLocks noChangeAspect="1"/></wp:cNvGraphicFramePr>`+
+		`<a:graphic><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/picture"><pic:pic>`+
+		`<pic:nvPicPr><pic:cNvPr id="%d" name="Picture %d"/><pic:cNvPicPr/></pic:nvPicPr>`+
+		`<pic:blipFill><a:blip r:embed="%s"/><a:stretch><a:fillRect/></a:stretch></pic:blipFill>`+
+		`<pic:spPr><a:xfrm><a:off x="0" y="0"/><a:ext cx="%d" cy="%d"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></pic:spPr>`+
+		`</pic:pic></a:graphicData></a:graphic></wp:inline></w:drawing></w:r>`,
+		cx, cy, b.drawings, b.drawings, docxEscape(htmlAttr(n, "alt")), b.drawings, b.drawings, relID, cx, cy)
+}
+
+// loadImage reads data: URIs, /api/asset URLs and files relative to the
+// document. Remote images are not fetched.
+func (b *docxBuilder) loadImage(src string) ([]byte, bool) {
+	if strings.HasPrefix(src, "data:") {
+		_, data, err := decodeDataURI(src)
+		return data, err == nil
+	}
+	path, ok := assetURLFile(src)
+	if !ok && b.baseDir != "" {
+		path, ok = localAssetPath(src, b.baseDir)
+	}
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	return data, err == nil
+}
+
+// addMedia stores an image once per content and returns its relationship.
+func (b *docxBuilder) addMedia(data []byte, format string) string {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:8])
+	if id, ok := b.media[hash]; ok {
+		return id
+	}
+	ext := format
+	if ext == "jpeg" {
+		ext = "jpg"
+	}
+	name := fmt.Sprintf("media/image%d.%s", len(b.media)+1, ext)
+	b.files["word/"+name] = data
+	id := b.addRel("image", name, false)
+	b.media[hash] = id
+	return id
+}
+
+func (b *docxBuilder) contentTypes() string {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	sb.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	sb.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	sb.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	for _, def := range [][2]string{{"png", "image/png"}, {"jpg", "image/jpeg"}, {"gif", "image/gif"}, {"bmp", "image/bmp"}} {
+		sb.WriteString(`<Default Extension="` + def[0] + `" ContentType="` + def[1] + `"/>`)
+	}
+	sb.WriteString(`<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>`)
+	sb.WriteString(`<Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/>`)
+	sb.WriteString(`<Override PartName="/word/numbering.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.numbering+xml"/>`)
+	if len(b.comments) > 0 {
+		sb.WriteString(`<Override PartName="/word/comments.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.comments+xml"/>`)
+	}
+	sb.WriteString(`</Types>`)
+	return sb.String()
+}
+
+// numbering defines one bullet and one decimal list; every ordered list is
+// its own instance so its numbering starts over.
+func (b *docxBuilder) numbering() string {
+	bullets := []string{"•", "◦", "▪"}
+	ordered := []string{"decimal", "lowerLetter", "lowerRoman"}
+
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	sb.WriteString(`<w:numbering ` + docxNamespaces + `>`)
+	sb.WriteString(`<w:abstractNum w:abstractNumId="0"><w:multiLevelType w:val="hybridMultilevel"/>`)
+	for l := 0; l < 9; l++ {
+		fmt.Fprintf(&sb, `<w:lvl w:ilvl="%d"><w:start w:val="1"/><w:numFmt w:val="bullet"/><w:lvlText w:val="%s"/><w:lvlJc w:val="left"/><w:pPr><w:ind w:left="%d" w:hanging="360"/></w:pPr></w:lvl>`,
+			l, bullets[l%len(bullets)], 720*(l+1))
+	}
+	sb.WriteString(`</w:abstractNum>`)
+	sb.WriteString(`<w:abstractNum w:abstractNumId="1"><w:multiLevelType w:val="hybridMultilevel"/>`)
+	for l := 0; l < 9; l++ {
+		fmt.Fprintf(&sb, `<w:lvl w:ilvl="%d"><w:start w:val="1"/><w:numFmt w:val="%s"/><w:lvlText w:val="%%%d."/><w:lvlJc w:val="left"/><w:pPr><w:ind w:left="%d" w:hanging="360"/></w:pPr></w:lvl>`,
+			l, ordered[l%len(ordered)], l+1, 720*(l+1))
+	}
+	sb.WriteString(`</w:abstractNum>`)
+	fmt.Fprintf(&sb, `<w:num w:numId="%d"><w:abstractNumId w:val="0"/></w:num>`, DOCX_BULLET_NUM)
+	for i, override := range b.nums {
+		fmt.Fprintf(&sb, `<w:num w:numId="%d"><w:abstractNumId w:val="1"/>%s</w:num>`, DOCX_BULLET_NUM+i+1, override)
+	}
+	sb.WriteString(`</w:numbering>`)
+	return sb.String()
+}
+
+const docxPackageRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/></Relationships>`
+
+const docxRelsHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`
+
+// docxStyles uses Word's built-in style ids and names, so headings show up
+// in the navigation pane and the importer maps them back.
+var docxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">` +
+	`<w:docDefaults><w:rPrDefault><w:rPr><w:rFonts w:ascii="Calibri" w:hAnsi="Calibri" w:eastAsia="Microsoft YaHei" w:cs="Calibri"/><w:sz w:val="22"/><w:szCs w:val="22"/><w:lang w:val="en-US" w:eastAsia="zh-CN"/></w:rPr></w:rPrDefault>` +
+	`<w:pPrDefault><w:pPr><w:spacing w:after="120" w:line="276" w:lineRule="auto"/></w:pPr></w:pPrDefault></w:docDefaults>` +
+	`<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/><w:qFormat/></w:style>` +
+	docxHeadingStyles() +
+	`<w:style w:type="paragraph" w:styleId="Quote"><w:name w:val="Quote"/><w:basedOn w:val="Normal"/><w:qFormat/><w:pPr><w:pBdr><w:left w:val="single" w:sz="12" w:space="8" w:color="CCCCCC"/></w:pBdr><w:ind w:left="720"/></w:pPr><w:rPr><w:i/><w:color w:val="555555"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Code"><w:name w:val="Code"/><w:basedOn w:val="Normal"/><w:pPr><w:pBdr><w:top w:val="single" w:sz="4" w:space="4" w:color="E5E7EB"/><w:left w:val="single" w:sz="4" w:space="4" w:color="E5E7EB"/><w:bottom w:val="single" w:sz="4" w:space="4" w:color="E5E7EB"/><w:right w:val="single" w:sz="4" w:space="4" w:color="E5E7EB"/></w:pBdr><w:shd w:val="clear" w:color="auto" w:fill="F5F5F5"/><w:spacing w:after="240" w:line="240" w:lineRule="auto"/></w:pPr><w:rPr><w:rFonts w:ascii="Consolas" w:hAnsi="Consolas" w:cs="Consolas"/><w:sz w:val="20"/><w:szCs w:val="20"/></w:rPr></w:style>` +
+	`<w:style w:type="character" w:styleId="Hyperlink"><w:name w:val="Hyperlink"/><w:rPr><w:color w:val="0563C1"/><w:u w:val="single"/></w:rPr></w:style>` +
+	`<w:style w:type="table" w:styleId="TableGrid"><w:name w:val="Table Grid"/><w:tblPr><w:tblBorders>` +
+	`<w:top w:val="single" w:sz="4" w:space="0" w:color="CCCCCC"/><w:left w:val="single" w:sz="4" w:space="0" w:color="CCCCCC"/><w:bottom w:val="single" w:sz="4" w:space="0" w:color="CCCCCC"/><w:right w:val="single" w:sz="4" w:space="0" w:color="CCCCCC"/>` +
+	`<w:insideH w:val="single" w:sz="4" w:space="0" w:color="CCCCCC"/><w:insideV w:val="single" w:sz="4" w:space="0" w:color="CCCCCC"/>` +
+	`</w:tblBorders><w:tblCellMar><w:left w:w="108" w:type="dxa"/><w:right w:w="108" w:type="dxa"/></w:tblCellMar></w:tblPr></w:style>` +
+	`</w:styles>`
+
+func docxHeadingStyles() string {
+	sizes := []int{36, 32, 28, 26, 24, 22}
+	var sb strings.Builder
+	for i, size := range sizes {
+		fmt.Fprintf(&sb, `<w:style w:type="paragraph" w:styleId="Heading%d"><w:name w:val="heading %d"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/>`+
+			`<w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:outlineLvl w:val="%d"/></w:pPr><w:rPr><w:b/><w:sz w:val="%d"/><w:szCs w:val="%d"/></w:rPr></w:style>`,
+			i+1, i+1, i, size, size)
+	}
+	return sb.String()
+}
+
+// docxEscape escapes text for XML, dropping control characters XML 1.0
+// does not allow.
+func docxEscape(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, s)
+	return html.EscapeString(s)
+}
+
+// --- CSS helpers ---
+
+func htmlAttrOK(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, c := range strings.Fields(htmlAttr(n, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// cssProperty reads one declaration from the style attribute.
+func cssProperty(n *html.Node, name string) string {
+	for _, decl := range strings.Split(htmlAttr(n, "style"), ";") {
+		if prop, value, ok := strings.Cut(decl, ":"); ok && strings.EqualFold(strings.TrimSpace(prop), name) {
+			return strings.ToLower(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important")))
+		}
+	}
+	return ""
+}
+
+func cssTextAlign(n *html.Node) string {
+	if align := cssProperty(n, "text-align"); align != "" {
+		return align
+	}
+	return strings.ToLower(htmlAttr(n, "align"))
+}
+
+var cssNamedColors = map[string]string{
+	"black": "000000", "white": "FFFFFF", "red": "FF0000", "green": "008000", "blue": "0000FF",
+	"yellow": "FFFF00", "orange": "FFA500", "purple": "800080", "gray": "808080", "grey": "808080",
+}
+
+// cssColor converts #rgb, #rrggbb, rgb()/rgba() and a few names to Word's
+// RRGGBB; transparent and unknown values give "".
+func cssColor(value string) string {
+	value = strings.TrimSpace(value)
+	if hex, ok := strings.CutPrefix(value, "#"); ok {
+		switch len(hex) {
+		case 3:
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		case 6:
+		default:
+			return ""
+		}
+		if _, err := strconv.ParseUint(hex, 16, 32); err != nil {
+			return ""
+		}
+		return strings.ToUpper(hex)
+	}
+	if args, ok := strings.CutPrefix(value, "rgb"); ok {
+		args = strings.TrimPrefix(args, "a")
+		args = strings.Trim(args, "() ")
+		parts := strings.FieldsFunc(args, func(r rune) bool { return r == ',' || r == ' ' || r == '/' })
+		if len(parts) < 3 {
+			return ""
+		}
+		if len(parts) > 3 {
+			if alpha, err := strconv.ParseFloat(parts[3], 64); err == nil && alpha == 0 {
+				return ""
+			}
+		}
+		var out string
+		for _, p := range parts[:3] {
+			v, err := strconv.Atoi(p)
+			if err != nil {
+				return ""
+			}
+			out += fmt.Sprintf("%02X", min(max(v, 0), 255))
+		}
+		return out
+	}
+	return cssNamedColors[value]
+}
+
+// cssFontSize converts a CSS font size to half-points, taking 1em as 12pt.
+func cssFontSize(value string) int {
+	i := strings.IndexFunc(value, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	if i < 0 {
+		i = len(value)
+	}
+	v, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil || v <= 0 {
+		return 0
+	}
+	var halfPoints float64
+	switch value[i:] {
+	case "pt":
+		halfPoints = v * 2
+	case "em", "rem":
+		halfPoints = v * 24
+	case "%":
+		halfPoints = v / 100 * 24
+	default: // px
+		halfPoints = v * 1.5
+	}
+	if halfPoints < 10 {
+		return 0
+	}
+	return int(halfPoints + 0.5)
+}
+
+// cssPixels parses "120" or "120px"; other units give 0.
+func cssPixels(value string) int {
+	value = strings.TrimSuffix(strings.TrimSpace(value), "px")
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || v <= 0 {
+		return 0
+	}
+	return int(v + 0.5)
+}
+
+// --- Equations (LaTeX -> OMML) ---
+
+var (
+	latexCommandSymbols = make(map[string]string) // "alpha" -> "α", from latexSymbols
+	latexOperatorChars  = make(map[string]string) // "sum" -> "∑", from latexOperators
+	latexAccentChars    = make(map[string]string) // "hat" -> combining character
+)
+
+func init() {
+	for r, cmd := range latexSymbols {
+		if strings.HasPrefix(cmd, `\`) {
+			latexCommandSymbols[cmd[1:]] = string(r)
+		}
+	}
+	latexCommandSymbols["cdot"] = "⋅"
+	for name, r := range map[string]string{
+		"le": "≤", "ge": "≥", "ne": "≠", "rightarrow": "→", "dots": "…", "ast": "∗",
+		"varepsilon": "ε", "vartheta": "ϑ", "varphi": "φ", "mid": "∣", "circ": "∘",
+		"Leftarrow": "⇐", "leftrightarrow": "↔", "uparrow": "↑", "downarrow": "↓",
+		"quad": " ", "qquad": "  ", ",": " ", ";": " ", ":": " ", "!": "", " ": " ",
+		"{": "{", "}": "}", "%": "%", "&": "&", "_": "_", "#": "#", "$": "$", "|": "‖",
+		"langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉",
+	} {
+		latexCommandSymbols[name] = r
+	}
+	for chr, cmd := range latexOperators {
+		latexOperatorChars[cmd[1:]] = chr
+	}
+	for chr, cmd := range latexAccents {
+		latexAccentChars[cmd[1:]] = chr
+	}
+	latexAccentChars["widehat"] = "̂"
+	latexAccentChars["widetilde"] = "̃"
+}
+
+// latexToOMML converts the LaTeX of a math node to an OMML equation, display
+// equations as their own math paragraph. Unknown commands come out as text
+// so nothing is silently lost.
+func latexToOMML(latex string, display bool) string {
+	p := &latexParser{toks: tokenizeLatex(latex)}
+	math := "<m:oMath>" + p.expr("") + "</m:oMath>"
+	if display {
+		return "<m:oMathPara>" + math + "</m:oMathPara>"
+	}
+	return math
+}
+
+func tokenizeLatex(s string) []string {
+	var toks []string
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '\\' && i+1 < len(s):
+			j := i + 1
+			for j < len(s) && (s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z') {
+				j++
+			}
+			if j == i+1 {
+				_, n := utf8.DecodeRuneInString(s[j:])
+				j += n
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		case unicode.IsSpace(r):
+			if len(toks) == 0 || toks[len(toks)-1] != " " {
+				toks = append(toks, " ")
+			}
+			i += size
+		default:
+			toks = append(toks, s[i:i+size])
+			i += size
+		}
+	}
+	return toks
+}
+
+type latexParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *latexParser) peek() string {
+	for p.pos < len(p.toks) && p.toks[p.pos] == " " {
+		p.pos++
+	}
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *latexParser) next() string {
+	t := p.peek()
+	if p.pos < len(p.toks) {
+		p.pos++
+	}
+	return t
+}
+
+// expr parses atoms with their scripts until "}" or the stop token.
+func (p *latexParser) expr(stop string) string {
+	var sb strings.Builder
+	for {
+		t := p.peek()
+		if t == "" || t == "}" || (stop != "" && t == stop) || t == `\right` || t == `\end` || t == "&" || t == `\\` {
+			return sb.String()
+		}
+		sb.WriteString(p.scripted())
+	}
+}
+
+// group parses {...} or a single atom.
+func (p *latexParser) group() string {
+	if p.peek() == "{" {
+		p.next()
+		out := p.expr("")
+		if p.peek() == "}" {
+			p.next()
+		}
+		return out
+	}
+	return p.atom()
+}
+
+// rawGroup returns the text of {...} unparsed, for \text and friends.
+func (p *latexParser) rawGroup() string {
+	if p.peek() != "{" {
+		return p.next()
+	}
+	p.next()
+	var sb strings.Builder
+	depth := 0
+	for p.pos < len(p.toks) {
+		t := p.toks[p.pos]
+		p.pos++
+		if t == "{" {
+			depth++
+		} else if t == "}" {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+		sb.WriteString(strings.TrimPrefix(t, `\`))
+	}
+	return sb.String()
+}
+
+func (p *latexParser) scripts() (sub, sup string, hasSub, hasSup bool) {
+	for {
+		switch p.peek() {
+		case "_":
+			p.next()
+			sub, hasSub = p.group(), true
+		case "^":
+			p.next()
+			sup, hasSup = p.group(), true
+		case "'":
+			p.next()
+			sup, hasSup = sup+ommlRun("′", ""), true
+		default:
+			return
+		}
+	}
+}
+
+// scripted parses an atom and attaches following sub/superscripts.
+func (p *latexParser) scripted() string {
+	t := p.peek()
+	name := strings.TrimPrefix(t, `\`)
+	if chr, ok := latexOperatorChars[name]; ok && t != name {
+		p.next()
+		sub, sup, hasSub, hasSup := p.scripts()
+		var pr strings.Builder
+		pr.WriteString(`<m:chr m:val="` + chr + `"/>`)
+		if !strings.Contains(name, "int") {
+			pr.WriteString(`<m:limLoc m:val="undOvr"/>`)
+		}
+		if !hasSub {
+			pr.WriteString(`<m:subHide m:val="1"/>`)
+		}
+		if !hasSup {
+			pr.WriteString(`<m:supHide m:val="1"/>`)
+		}
+		body := ""
+		if next := p.peek(); next != "" && next != "}" && next != "&" && next != `\\` && next != `\right` && next != `\end` {
+			body = p.scripted()
+		}
+		return "<m:nary><m:naryPr>" + pr.String() + "</m:naryPr><m:sub>" + sub + "</m:sub><m:sup>" + sup + "</m:sup><m:e>" + body + "</m:e></m:nary>"
+	}
+
+	if latexFunctions[name] && t != name {
+		p.next()
+		fName := ommlRun(name, "p")
+		if p.peek() == "_" && (name == "lim" || name == "max" || name == "min" || name == "sup" || name == "inf") {
+			p.next()
+			fName = "<m:limLow><m:e>" + fName + "</m:e><m:lim>" + p.group() + "</m:lim></m:limLow>"
+		}
+		sub, sup, hasSub, hasSup := p.scripts()
+		fName = ommlScripts(fName, sub, sup, hasSub, hasSup)
+		body := ""
+		if next := p.peek(); next != "" && next != "}" && next != "&" && next != `\\` && next != `\right` && next != `\end` {
+			body = p.scripted()
+		}
+		return "<m:func><m:fName>" + fName + "</m:fName><m:e>" + body + "</m:e></m:func>"
+	}
+
+	base := p.atom()
+	sub, sup, hasSub, hasSup := p.scripts()
+	return ommlScripts(base, sub, sup, hasSub, hasSup)
+}
+
+func ommlScripts(base, sub, sup string, hasSub, hasSup bool) string {
+	switch {
+	case hasSub && hasSup:
+		return "<m:sSubSup><m:e>" + base + "</m:e><m:sub>" + sub + "</m:sub><m:sup>" + sup + "</m:sup></m:sSubSup>"
+	case hasSup:
+		return "<m:sSup><m:e>" + base + "</m:e><m:sup>" + sup + "</m:sup></m:sSup>"
+	case hasSub:
+		return "<m:sSub><m:e>" + base + "</m:e><m:sub>" + sub + "</m:sub></m:sSub>"
+	}
+	return base
+}
+
+// ommlRun writes text as a math run; sty "p" is upright, "b" bold.
+func ommlRun(text, sty string) string {
+	if text == "" {
+		return ""
+	}
+	rPr := ""
+	if sty != "" {
+		rPr = `<m:rPr><m:sty m:val="` + sty + `"/></m:rPr>`
+	}
+	return "<m:r>" + rPr + `<m:t xml:space="preserve">` + docxEscape(text) + "</m:t></m:r>"
+}
+
+func ommlDelim(beg, end, inner string) string {
+	return `<m:d><m:dPr><m:begChr m:val="` + docxEscape(beg) + `"/><m:endChr m:val="` + docxEscape(end) + `"/></m:dPr><m:e>` + inner + "</m:e></m:d>"
+}
+
+func (p *latexParser) atom() string {
+	t := p.next()
+	switch t {
+	case "":
+		return ""
+	case "{":
+		out := p.expr("")
+		if p.peek() == "}" {
+			p.next()
+		}
+		return out
+	case "}", "&", `\\`:
+		return ""
+	}
+	if !strings.HasPrefix(t, `\`) || len(t) == 1 {
+		return ommlRun(t, "")
+	}
+
+	name := t[1:]
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num := p.group()
+		den := p.group()
+		return "<m:f><m:num>" + num + "</m:num><m:den>" + den + "</m:den></m:f>"
+	case "binom":
+		top := p.group()
+		bottom := p.group()
+		return ommlDelim("(", ")", `<m:f><m:fPr><m:type m:val="noBar"/></m:fPr><m:num>`+top+"</m:num><m:den>"+bottom+"</m:den></m:f>")
+	case "sqrt":
+		if p.peek() == "[" {
+			p.next()
+			deg := p.expr("]")
+			if p.peek() == "]" {
+				p.next()
+			}
+			return "<m:rad><m:deg>" + deg + "</m:deg><m:e>" + p.group() + "</m:e></m:rad>"
+		}
+		return `<m:rad><m:radPr><m:degHide m:val="1"/></m:radPr><m:deg/><m:e>` + p.group() + "</m:e></m:rad>"
+	case "left":
+		beg := p.delimiter()
+		inner := p.expr("")
+		end := ""
+		if p.peek() == `\right` {
+			p.next()
+			end = p.delimiter()
+		}
+		return ommlDelim(beg, end, inner)
+	case "overline":
+		return `<m:bar><m:barPr><m:pos m:val="top"/></m:barPr><m:e>` + p.group() + "</m:e></m:bar>"
+	case "underline":
+		return `<m:bar><m:barPr><m:pos m:val="bot"/></m:barPr><m:e>` + p.group() + "</m:e></m:bar>"
+	case "overbrace", "underbrace":
+		chr, pos := "⏞", "top"
+		if name == "underbrace" {
+			chr, pos = "⏟", "bot"
+		}
+		return `<m:groupChr><m:groupChrPr><m:chr m:val="` + chr + `"/><m:pos m:val="` + pos + `"/></m:groupChrPr><m:e>` + p.group() + "</m:e></m:groupChr>"
+	case "text", "textrm", "mbox", "operatorname", "mathrm":
+		return ommlRun(p.rawGroup(), "p")
+	case "mathbf", "boldsymbol", "textbf":
+		return ommlRun(p.rawGroup(), "b")
+	case "mathbb":
+		return `<m:r><m:rPr><m:scr m:val="double-struck"/></m:rPr><m:t>` + docxEscape(p.rawGroup()) + "</m:t></m:r>"
+	case "mathcal":
+		return `<m:r><m:rPr><m:scr m:val="script"/></m:rPr><m:t>` + docxEscape(p.rawGroup()) + "</m:t></m:r>"
+	case "mathit", "displaystyle", "textstyle", "limits", "nolimits":
+		return ""
+	case "begin":
+		return p.environment(p.rawGroup())
+	}
+	if chr, ok := latexAccentChars[name]; ok {
+		return `<m:acc><m:accPr><m:chr m:val="` + chr + `"/></m:accPr><m:e>` + p.group() + "</m:e></m:acc>"
+	}
+	if sym, ok := latexCommandSymbols[name]; ok {
+		return ommlRun(sym, "")
+	}
+	if chr, ok := latexOperatorChars[name]; ok {
+		return ommlRun(chr, "")
+	}
+	if latexFunctions[name] {
+		return ommlRun(name, "p")
+	}
+	return ommlRun(t, "")
+}
+
+// delimiter reads the delimiter after \left or \right; "." is none.
+func (p *latexParser) delimiter() string {
+	t := p.next()
+	switch t {
+	case ".":
+		return ""
+	case `\{`, `\lbrace`:
+		return "{"
+	case `\}`, `\rbrace`:
+		return "}"
+	case `\|`:
+		return "‖"
+	}
+	if sym, ok := latexCommandSymbols[strings.TrimPrefix(t, `\`)]; ok && strings.HasPrefix(t, `\`) {
+		return sym
+	}
+	return t
+}
+
+// environment parses the body of \begin{name} up to \end{name}.
+func (p *latexParser) environment(name string) string {
+	if name == "array" && p.peek() == "{" {
+		p.rawGroup() // Column spec
+	}
+	var rows [][]string
+	row := []string{}
+	for {
+		row = append(row, p.expr(""))
+		switch p.next() {
+		case "&":
+			continue
+		case `\\`:
+			rows = append(rows, row)
+			row = []string{}
+			continue
+		case `\end`:
+			p.rawGroup()
+		}
+		break
+	}
+	if len(row) > 1 || row[0] != "" {
+		rows = append(rows, row)
+	}
+
+	switch name {
+	case "aligned", "align", "align*", "gathered", "gather", "gather*", "split", "cases":
+		var sb strings.Builder
+		sb.WriteString("<m:eqArr>")
+		for _, r := range rows {
+			sb.WriteString("<m:e>" + strings.Join(r, "") + "</m:e>")
+		}
+		sb.WriteString("</m:eqArr>")
+		if name == "cases" {
+			return ommlDelim("{", "", sb.String())
+		}
+		return sb.String()
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<m:m>")
+	for _, r := range rows {
+		sb.WriteString("<m:mr>")
+		for _, cell := range r {
+			sb.WriteString("<m:e>" + cell + "</m:e>")
+		}
+		sb.WriteString("</m:mr>")
+	}
+	sb.WriteString("</m:m>")
+	switch name {
+	case "pmatrix":
+		return ommlDelim("(", ")", sb.String())
+	case "bmatrix":
+		return ommlDelim("[", "]", sb.String())
+	case "Bmatrix":
+		return ommlDelim("{", "}", sb.String())
+	case "vmatrix":
+		return ommlDelim("|", "|", sb.String())
+	case "Vmatrix":
+		return ommlDelim("‖", "‖", sb.String())
+	}
+	return sb.String()
+}
@@ -0,0 +1,1478 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DOCX_MAX_PART = 256 << 20 // Largest single zip entry read from a .docx, .odt or .epub
+
+	nsRelationships = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	relTypePrefix   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/"
+	emuPerPixel     = 9525
+)
+
+// xmlNode is a minimal DOM for the WordprocessingML parts. Elements are
+// matched by local name; the math namespace is only entered through
+// oMath/oMathPara, so names never collide in practice.
+type xmlNode struct {
+	Name     xml.Name
+	Attrs    []xml.Attr
+	Children []*xmlNode
+	Text     string
+}
+
+func parseXMLTree(data []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		top := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{Name: t.Name, Attrs: t.Attr}
+			top.Children = append(top.Children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			top.Text += string(t)
+		}
+	}
+	return root, nil
+}
+
+// The accessors are nil-safe so optional properties chain without checks.
+func (n *xmlNode) child(local string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.Name.Local == local {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *xmlNode) children(local string) []*xmlNode {
+	if n == nil {
+		return nil
+	}
+	var out []*xmlNode
+	for _, c := range n.Children {
+		if c.Name.Local == local {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// find returns the first descendant with the local name.
+func (n *xmlNode) find(local string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.Name.Local == local {
+			return c
+		}
+		if f := c.find(local); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func (n *xmlNode) attr(local string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attrs {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) attrNS(space, local string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attrs {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// onOff reads a toggle property: <w:b/> is on, <w:b w:val="0"/> is off.
+func onOff(n *xmlNode) bool {
+	if n == nil {
+		return false
+	}
+	switch n.attr("val") {
+	case "", "1", "true", "on":
+		return true
+	}
+	return false
+}
+
+type docxRel struct {
+	typ      string
+	target   string // Part name inside the zip, or a URL when external
+	external bool
+}
+
+type docxStyle struct {
+	name    string // Lowercased, e.g. "heading 1"
+	basedOn string
+	outline int // Outline level, -1 for body text
+	numID   string
+	ilvl    int
+	rPr     *xmlNode
+}
+
+type docxLevel struct {
+	format string
+	text   string // lvlText, e.g. "%1.%2."
+	start  int
+}
+
+type docxOpenList struct {
+	numID    string
+	tag      string
+	itemOpen bool
+}
+
+// docxField tracks a complex field (fldChar begin/separate/end); only
+// HYPERLINK fields produce markup.
+type docxField struct {
+	instr  string
+	linked bool
+}
+
+type docxConverter struct {
+	files     map[string]*zip.File
+	rels      map[string]docxRel // Relationships of the part being rendered
+	styles    map[string]*docxStyle
+	numbering map[string]map[int]docxLevel // numId -> ilvl -> level
+	counters  map[string]int               // Items so far per "numId:ilvl"
+	notes     map[string]*xmlNode          // "footnote:id" / "endnote:id"
+	noteRels  map[string]map[string]docxRel
+	comments  map[string]string // Comment id -> plain text
+	active    []string          // Comments whose range is open
+	noteHTML  []string          // Rendered notes in reference order
+	noteNums  map[string]int
+	pending   []string // Text boxes, emitted after the current paragraph
+	images    ImageOptions
+	report    ImageReport
+}
+
+// docxToHTML converts a Word document into editor HTML: headings and quotes
+// from paragraph styles, run formatting, numbered and bulleted lists, tables
+// with merged cells, hyperlinks, images as data: URIs, equations as math
+// nodes, comments as the editor's comment marks and footnotes as a numbered
+// section at the end.
+func docxToHTML(content []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("invalid DOCX: %v", err)
+	}
+	c := &docxConverter{
+		files:     make(map[string]*zip.File),
+		styles:    make(map[string]*docxStyle),
+		numbering: make(map[string]map[int]docxLevel),
+		counters:  make(map[string]int),
+		notes:     make(map[string]*xmlNode),
+		noteRels:  make(map[string]map[string]docxRel),
+		comments:  make(map[string]string),
+		noteNums:  make(map[string]int),
+		images:    globalImageOptions(),
+	}
+	for _, f := range zr.File {
+		c.files[f.Name] = f
+	}
+
+	docPart := "word/document.xml"
+	for _, rel := range c.loadRels("") {
+		if rel.typ == "officeDocument" {
+			docPart = rel.target
+		}
+	}
+	doc, err := c.parsePart(docPart)
+	if err != nil {
+		return "", fmt.Errorf("invalid DOCX: %v", err)
+	}
+	body := doc.find("body")
+	if body == nil {
+		return "", fmt.Errorf("invalid DOCX: no document body")
+	}
+	c.rels = c.loadRels(docPart)
+
+	for _, rel := range c.rels {
+		if rel.external {
+			continue
+		}
+		switch rel.typ {
+		case "styles":
+			c.loadStyles(rel.target)
+		case "numbering":
+			c.loadNumbering(rel.target)
+		case "footnotes", "endnotes":
+			c.loadNotes(rel.target, strings.TrimSuffix(rel.typ, "s"))
+		case "comments":
+			c.loadComments(rel.target)
+		}
+	}
+
+	out := c.blocks(body.Children) + footnotesHTML(c.noteHTML)
+	imageReportLog("DOCX import", &c.report)
+	return out, nil
+}
+
+// docxPlainText returns the text of a Word document, one paragraph per
+// line, for the search index: the body, then footnotes, endnotes and
+// comments. Nothing is converted, so it is much cheaper than docxToHTML.
+func docxPlainText(content []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("invalid DOCX: %v", err)
+	}
+	c := &docxConverter{files: make(map[string]*zip.File)}
+	for _, f := range zr.File {
+		c.files[f.Name] = f
+	}
+	docPart := "word/document.xml"
+	for _, rel := range c.loadRels("") {
+		if rel.typ == "officeDocument" {
+			docPart = rel.target
+		}
+	}
+	parts := []string{docPart}
+	for _, rel := range c.loadRels(docPart) {
+		switch rel.typ {
+		case "footnotes", "endnotes", "comments":
+			if !rel.external {
+				parts = append(parts, rel.target)
+			}
+		}
+	}
+
+	var sb strings.Builder
+	for i, part := range parts {
+		data, err := c.readPart(part)
+		if err != nil {
+			if i == 0 {
+				return "", fmt.Errorf("invalid DOCX: %v", err)
+			}
+			continue
+		}
+		d := xml.NewDecoder(bytes.NewReader(data))
+		inText := false
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				break
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "t": // Not delText or instrText: deleted text and field codes
+					inText = true
+				case "tab":
+					sb.WriteByte('\t')
+				case "br", "cr":
+					sb.WriteByte('\n')
+				}
+			case xml.EndElement:
+				switch t.Name.Local {
+				case "t":
+					inText = false
+				case "p":
+					sb.WriteByte('\n')
+				}
+			case xml.CharData:
+				if inText {
+					sb.Write(t)
+				}
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+func (c *docxConverter) readPart(name string) ([]byte, error) {
+	return readZipPart(c.files, name)
+}
+
+// readZipPart reads one entry of a zipped document (DOCX, ODT, EPUB) by
+// name, refusing entries larger than DOCX_MAX_PART.
+func readZipPart(files map[string]*zip.File, name string) ([]byte, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("missing part %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, DOCX_MAX_PART+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > DOCX_MAX_PART {
+		return nil, fmt.Errorf("part %s is too large", name)
+	}
+	return data, nil
+}
+
+func (c *docxConverter) parsePart(name string) (*xmlNode, error) {
+	data, err := c.readPart(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseXMLTree(data)
+}
+
+// loadRels reads the relationships of a part ("" for the package itself),
+// with targets resolved to part names.
+func (c *docxConverter) loadRels(part string) map[string]docxRel {
+	rels := make(map[string]docxRel)
+	dir, file := path.Split(part)
+	root, err := c.parsePart(dir + "_rels/" + file + ".rels")
+	if err != nil {
+		return rels
+	}
+	for _, r := range root.find("Relationships").children("Relationship") {
+		rel := docxRel{
+			typ:      strings.TrimPrefix(r.attr("Type"), relTypePrefix),
+			target:   r.attr("Target"),
+			external: r.attr("TargetMode") == "External",
+		}
+		if !rel.external {
+			if strings.HasPrefix(rel.target, "/") {
+				rel.target = strings.TrimPrefix(rel.target, "/")
+			} else {
+				rel.target = path.Join(dir, rel.target)
+			}
+		}
+		rels[r.attr("Id")] = rel
+	}
+	return rels
+}
+
+func (c *docxConverter) loadStyles(part string) {
+	root, err := c.parsePart(part)
+	if err != nil {
+		return
+	}
+	for _, s := range root.find("styles").children("style") {
+		st := &docxStyle{
+			name:    strings.ToLower(s.child("name").attr("val")),
+			basedOn: s.child("basedOn").attr("val"),
+			outline: -1,
+			rPr:     s.child("rPr"),
+		}
+		pPr := s.child("pPr")
+		if lvl := pPr.child("outlineLvl"); lvl != nil {
+			st.outline, _ = strconv.Atoi(lvl.attr("val"))
+		}
+		if numPr := pPr.child("numPr"); numPr != nil {
+			st.numID = numPr.child("numId").attr("val")
+			st.ilvl, _ = strconv.Atoi(numPr.child("ilvl").attr("val"))
+		}
+		c.styles[s.attr("styleId")] = st
+	}
+}
+
+func (c *docxConverter) loadNumbering(part string) {
+	root, err := c.parsePart(part)
+	if err != nil {
+		return
+	}
+	numbering := root.find("numbering")
+	abstract := make(map[string]map[int]docxLevel)
+	for _, an := range numbering.children("abstractNum") {
+		levels := make(map[int]docxLevel)
+		for _, lvl := range an.children("lvl") {
+			ilvl, _ := strconv.Atoi(lvl.attr("ilvl"))
+			start, err := strconv.Atoi(lvl.child("start").attr("val"))
+			if err != nil {
+				start = 1
+			}
+			levels[ilvl] = docxLevel{format: lvl.child("numFmt").attr("val"), text: lvl.child("lvlText").attr("val"), start: start}
+		}
+		abstract[an.attr("abstractNumId")] = levels
+	}
+	for _, num := range numbering.children("num") {
+		levels := make(map[int]docxLevel)
+		for ilvl, lvl := range abstract[num.child("abstractNumId").attr("val")] {
+			levels[ilvl] = lvl
+		}
+		for _, o := range num.children("lvlOverride") {
+			ilvl, _ := strconv.Atoi(o.attr("ilvl"))
+			if start, err := strconv.Atoi(o.child("startOverride").attr("val")); err == nil {
+				lvl := levels[ilvl]
+				lvl.start = start
+				levels[ilvl] = lvl
+			}
+		}
+		c.numbering[num.attr("numId")] = levels
+	}
+}
+
+func (c *docxConverter) loadNotes(part, kind string) {
+	root, err := c.parsePart(part)
+	if err != nil {
+		return
+	}
+	rels := c.loadRels(part)
+	for _, n := range root.find(kind + "s").children(kind) {
+		key := kind + ":" + n.attr("id")
+		c.notes[key] = n
+		c.noteRels[key] = rels
+	}
+}
+
+func (c *docxConverter) loadComments(part string) {
+	root, err := c.parsePart(part)
+	if err != nil {
+		return
+	}
+	for _, n := range root.find("comments").children("comment") {
+		var paras []string
+		for _, p := range n.children("p") {
+			var text string
+			for _, r := range p.children("r") {
+				for _, t := range r.children("t") {
+					text += t.Text
+				}
+			}
+			paras = append(paras, text)
+		}
+		c.comments[n.attr("id")] = strings.Join(paras, "\n")
+	}
+}
+
+// styleChain yields a style and the styles it is based on.
+func (c *docxConverter) styleChain(id string) []*docxStyle {
+	var chain []*docxStyle
+	for i := 0; i < 16 && id != ""; i++ {
+		st, ok := c.styles[id]
+		if !ok {
+			break
+		}
+		chain = append(chain, st)
+		id = st.basedOn
+	}
+	return chain
+}
+
+func (c *docxConverter) headingLevel(styleID string, pPr *xmlNode) int {
+	if lvl := pPr.child("outlineLvl"); lvl != nil {
+		if n, err := strconv.Atoi(lvl.attr("val")); err == nil && n < 9 {
+			return min(n+1, 6)
+		}
+	}
+	for _, st := range c.styleChain(styleID) {
+		switch {
+		case st.name == "title":
+			return 1
+		case st.name == "subtitle":
+			return 2
+		case strings.HasPrefix(st.name, "heading "):
+			if n, err := strconv.Atoi(strings.TrimPrefix(st.name, "heading ")); err == nil && n >= 1 {
+				return min(n, 6)
+			}
+		case st.outline >= 0 && st.outline < 9:
+			return min(st.outline+1, 6)
+		}
+	}
+	return 0
+}
+
+func (c *docxConverter) isQuote(styleID string) bool {
+	for _, st := range c.styleChain(styleID) {
+		if st.name == "quote" || st.name == "intense quote" {
+			return true
+		}
+	}
+	return false
+}
+
+// paragraphNumbering returns the list a paragraph belongs to, from its own
+// properties or its style.
+func (c *docxConverter) paragraphNumbering(pPr *xmlNode) (string, int, bool) {
+	numID, ilvl := "", 0
+	if numPr := pPr.child("numPr"); numPr != nil {
+		numID = numPr.child("numId").attr("val")
+		ilvl, _ = strconv.Atoi(numPr.child("ilvl").attr("val"))
+	} else {
+		for _, st := range c.styleChain(pPr.child("pStyle").attr("val")) {
+			if st.numID != "" {
+				numID, ilvl = st.numID, st.ilvl
+				break
+			}
+		}
+	}
+	if _, ok := c.numbering[numID]; !ok || numID == "0" {
+		return "", 0, false
+	}
+	return numID, min(max(ilvl, 0), 8), true
+}
+
+// countItem advances the counter of a list level and restarts the levels
+// below it.
+func (c *docxConverter) countItem(numID string, level int) {
+	c.counters[fmt.Sprintf("%s:%d", numID, level)]++
+	for deeper := level + 1; deeper < 9; deeper++ {
+		delete(c.counters, fmt.Sprintf("%s:%d", numID, deeper))
+	}
+}
+
+// numberLabel renders the number Word shows for the current item of a list
+// level, e.g. "2.1." for a numbered heading.
+func (c *docxConverter) numberLabel(numID string, level int) string {
+	levels := c.numbering[numID]
+	if f := levels[level].format; f == "bullet" || f == "none" {
+		return ""
+	}
+	label := levels[level].text
+	for i := 0; i <= level; i++ {
+		lvl := levels[i]
+		n := lvl.start + c.counters[fmt.Sprintf("%s:%d", numID, i)] - 1
+		label = strings.ReplaceAll(label, "%"+strconv.Itoa(i+1), numberText(lvl.format, n))
+	}
+	return label
+}
+
+// numberText formats n in a numFmt; formats without an equivalent here are
+// written as decimals.
+func numberText(format string, n int) string {
+	switch format {
+	case "lowerLetter", "upperLetter":
+		if n < 1 {
+			break
+		}
+		letters := strings.Repeat(string(rune('a'+(n-1)%26)), (n-1)/26+1)
+		if format == "upperLetter" {
+			letters = strings.ToUpper(letters)
+		}
+		return letters
+	case "lowerRoman", "upperRoman":
+		if n < 1 || n >= 4000 {
+			break
+		}
+		var sb strings.Builder
+		for _, r := range []struct {
+			value  int
+			symbol string
+		}{{1000, "M"}, {900, "CM"}, {500, "D"}, {400, "CD"}, {100, "C"}, {90, "XC"}, {50, "L"}, {40, "XL"}, {10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"}} {
+			for ; n >= r.value; n -= r.value {
+				sb.WriteString(r.symbol)
+			}
+		}
+		if format == "lowerRoman" {
+			return strings.ToLower(sb.String())
+		}
+		return sb.String()
+	}
+	return strconv.Itoa(n)
+}
+
+// flattenBlocks unwraps content controls and other containers that hold
+// block content.
+func flattenBlocks(nodes []*xmlNode) []*xmlNode {
+	var out []*xmlNode
+	for _, n := range nodes {
+		switch n.Name.Local {
+		case "sdt":
+			out = append(out, flattenBlocks(n.child("sdtContent").Children)...)
+		case "customXml", "ins", "moveTo":
+			out = append(out, flattenBlocks(n.Children)...)
+		default:
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// blocks renders body-level content: paragraphs, list runs and tables.
+func (c *docxConverter) blocks(nodes []*xmlNode) string {
+	var sb strings.Builder
+	var lists []docxOpenList
+
+	closeList := func() {
+		top := lists[len(lists)-1]
+		if top.itemOpen {
+			sb.WriteString("</li>\n")
+		}
+		sb.WriteString("</" + top.tag + ">\n")
+		lists = lists[:len(lists)-1]
+	}
+	closeAll := func() {
+		for len(lists) > 0 {
+			closeList()
+		}
+	}
+
+	for _, n := range flattenBlocks(nodes) {
+		switch n.Name.Local {
+		case "p":
+			pPr := n.child("pPr")
+			numID, level, ok := c.paragraphNumbering(pPr)
+			// Numbered headings (Word's multilevel heading numbering) stay
+			// headings, with the number kept as text
+			if c.headingLevel(pPr.child("pStyle").attr("val"), pPr) > 0 {
+				closeAll()
+				label := ""
+				if ok {
+					c.countItem(numID, level)
+					label = c.numberLabel(numID, level)
+				}
+				sb.WriteString(c.paragraph(n, label))
+				break
+			}
+			if !ok {
+				closeAll()
+				sb.WriteString(c.paragraph(n, ""))
+				break
+			}
+
+			for len(lists) > level+1 {
+				closeList()
+			}
+			if len(lists) == level+1 && lists[level].numID != numID {
+				closeList()
+			}
+			for len(lists) < level+1 {
+				depth := len(lists)
+				lvl := c.numbering[numID][depth]
+				tag, attrs := "ol", ""
+				switch lvl.format {
+				case "bullet", "none":
+					tag = "ul"
+				case "lowerLetter":
+					attrs = ` type="a"`
+				case "upperLetter":
+					attrs = ` type="A"`
+				case "lowerRoman":
+					attrs = ` type="i"`
+				case "upperRoman":
+					attrs = ` type="I"`
+				}
+				// Word continues numbering across interruptions
+				if start := lvl.start + c.counters[fmt.Sprintf("%s:%d", numID, depth)]; tag == "ol" && start != 1 {
+					attrs += fmt.Sprintf(` start="%d"`, start)
+				}
+				sb.WriteString("<" + tag + attrs + ">\n")
+				lists = append(lists, docxOpenList{numID: numID, tag: tag})
+			}
+
+			c.countItem(numID, level)
+			if lists[level].itemOpen {
+				sb.WriteString("</li>\n")
+			}
+			lists[level].itemOpen = true
+			sb.WriteString("<li>" + c.inline(n))
+			for _, box := range c.takePending() {
+				sb.WriteString(box)
+			}
+		case "tbl":
+			closeAll()
+			sb.WriteString(c.table(n))
+		}
+	}
+	closeAll()
+	return sb.String()
+}
+
+func (c *docxConverter) takePending() []string {
+	pending := c.pending
+	c.pending = nil
+	return pending
+}
+
+// paragraph renders a paragraph outside lists; label is the number of a
+// numbered heading.
+func (c *docxConverter) paragraph(p *xmlNode, label string) string {
+	pPr := p.child("pPr")
+	styleID := pPr.child("pStyle").attr("val")
+
+	tag := "p"
+	if level := c.headingLevel(styleID, pPr); level > 0 {
+		tag = fmt.Sprintf("h%d", level)
+	} else if c.isQuote(styleID) {
+		tag = "blockquote"
+	}
+	attrs := ""
+	switch pPr.child("jc").attr("val") {
+	case "center":
+		attrs = ` style="text-align: center"`
+	case "right", "end":
+		attrs = ` style="text-align: right"`
+	case "both", "distribute":
+		attrs = ` style="text-align: justify"`
+	}
+
+	content := c.inline(p)
+	if label != "" {
+		content = html.EscapeString(label) + " " + content
+	}
+	pending := c.takePending()
+	if content == "" {
+		if len(pending) > 0 && tag == "p" {
+			return strings.Join(pending, "")
+		}
+		content = "<br>"
+	}
+	return "<" + tag + attrs + ">" + content + "</" + tag + ">\n" + strings.Join(pending, "")
+}
+
+// inlineWriter merges consecutive runs with the same formatting, which Word
+// splits freely (spell checking, revision ids).
+type inlineWriter struct {
+	sb     strings.Builder
+	open   string
+	close  string
+	fields []docxField
+}
+
+func (w *inlineWriter) write(open, close, s string) {
+	if open != w.open {
+		w.sb.WriteString(w.close)
+		w.sb.WriteString(open)
+		w.open, w.close = open, close
+	}
+	w.sb.WriteString(s)
+}
+
+// raw writes markup outside any run formatting.
+func (w *inlineWriter) raw(s string) {
+	w.write("", "", s)
+}
+
+func (w *inlineWriter) String() string {
+	w.raw("")
+	for _, f := range w.fields {
+		if f.linked {
+			w.sb.WriteString("</a>")
+		}
+	}
+	return w.sb.String()
+}
+
+func (c *docxConverter) inline(p *xmlNode) string {
+	w := &inlineWriter{}
+	c.inlineChildren(p.Children, w)
+	return w.String()
+}
+
+func (c *docxConverter) inlineChildren(nodes []*xmlNode, w *inlineWriter) {
+	for _, n := range nodes {
+		switch n.Name.Local {
+		case "r":
+			c.run(n, w)
+		case "hyperlink":
+			href := ""
+			if rel, ok := c.rels[n.attrNS(nsRelationships, "id")]; ok && rel.external {
+				href = rel.target
+			}
+			if anchor := n.attr("anchor"); anchor != "" {
+				href += "#" + anchor
+			}
+			if href == "" {
+				c.inlineChildren(n.Children, w)
+				break
+			}
+			w.raw(`<a href="` + html.EscapeString(href) + `">`)
+			c.inlineChildren(n.Children, w)
+			w.raw("</a>")
+		case "fldSimple":
+			if href, ok := fieldHyperlink(n.attr("instr")); ok {
+				w.raw(`<a href="` + html.EscapeString(href) + `">`)
+				c.inlineChildren(n.Children, w)
+				w.raw("</a>")
+			} else {
+				c.inlineChildren(n.Children, w)
+			}
+		case "ins", "moveTo", "smartTag", "customXml", "dir", "bdo":
+			c.inlineChildren(n.Children, w)
+		case "sdt":
+			c.inlineChildren(n.child("sdtContent").Children, w)
+		case "commentRangeStart":
+			c.active = append(c.active, n.attr("id"))
+		case "commentRangeEnd":
+			for i, id := range c.active {
+				if id == n.attr("id") {
+					c.active = append(c.active[:i], c.active[i+1:]...)
+					break
+				}
+			}
+		case "bookmarkStart":
+			if name := n.attr("name"); name != "" && !strings.HasPrefix(name, "_") {
+				w.raw(`<a id="` + html.EscapeString(name) + `"></a>`)
+			}
+		case "oMath":
+			w.raw(mathHTML(ommlToLatex(n), false))
+		case "oMathPara":
+			for _, m := range n.children("oMath") {
+				w.raw(mathHTML(ommlToLatex(m), true))
+			}
+		}
+	}
+}
+
+// fieldHyperlink parses a HYPERLINK field instruction:
+// HYPERLINK "url" or HYPERLINK \l "bookmark".
+func fieldHyperlink(instr string) (string, bool) {
+	fields := strings.Fields(instr)
+	if len(fields) < 2 || !strings.EqualFold(fields[0], "HYPERLINK") {
+		return "", false
+	}
+	anchor := false
+	for _, f := range fields[1:] {
+		if f == `\l` {
+			anchor = true
+			continue
+		}
+		if strings.HasPrefix(f, `\`) {
+			continue
+		}
+		target := strings.Trim(f, `"`)
+		if anchor {
+			return "#" + target, true
+		}
+		return target, true
+	}
+	return "", false
+}
+
+func mathHTML(latex string, display bool) string {
+	out := `<span data-type="math" data-latex="` + html.EscapeString(latex)
+	if display {
+		out += `" data-display="true`
+	}
+	return out + `"></span>`
+}
+
+// runProps is the formatting of a run, from its character style and direct
+// properties. Paragraph style formatting is left to the editor's styles.
+type runProps struct {
+	bold, italic, underline, strike, sup, sub bool
+	color, highlight, size                    string
+}
+
+func (p *runProps) apply(rPr *xmlNode) {
+	if rPr == nil {
+		return
+	}
+	for _, n := range rPr.Children {
+		v := n.attr("val")
+		switch n.Name.Local {
+		case "b":
+			p.bold = onOff(n)
+		case "i":
+			p.italic = onOff(n)
+		case "u":
+			p.underline = v != "none"
+		case "strike", "dstrike":
+			p.strike = onOff(n)
+		case "vertAlign":
+			p.sup, p.sub = v == "superscript", v == "subscript"
+		case "color":
+			if v == "auto" {
+				v = ""
+			}
+			p.color = v
+		case "highlight":
+			if v == "none" {
+				v = ""
+			}
+			p.highlight = v
+		case "sz":
+			p.size = v
+		}
+	}
+}
+
+// Word highlight names that are not CSS colour keywords.
+var docxHighlightColors = map[string]string{
+	"darkYellow": "#808000",
+	"darkGray":   "#808080",
+	"lightGray":  "#c0c0c0",
+}
+
+func (p runProps) tags() (string, string) {
+	var open, close string
+	wrap := func(tag, attrs string) {
+		open += "<" + tag + attrs + ">"
+		close = "</" + tag + ">" + close
+	}
+	if p.bold {
+		wrap("strong", "")
+	}
+	if p.italic {
+		wrap("em", "")
+	}
+	if p.underline {
+		wrap("u", "")
+	}
+	if p.strike {
+		wrap("s", "")
+	}
+	if p.sup {
+		wrap("sup", "")
+	}
+	if p.sub {
+		wrap("sub", "")
+	}
+	if p.highlight != "" {
+		attrs := ""
+		if p.highlight != "yellow" {
+			color := p.highlight
+			if c, ok := docxHighlightColors[color]; ok {
+				color = c
+			}
+			attrs = ` style="background-color: ` + strings.ToLower(color) + `"`
+		}
+		wrap("mark", attrs)
+	}
+	var css []string
+	if p.color != "" {
+		css = append(css, "color: #"+p.color)
+	}
+	if halfPoints, err := strconv.ParseFloat(p.size, 64); err == nil && halfPoints > 0 {
+		css = append(css, "font-size: "+strconv.FormatFloat(halfPoints/2, 'f', -1, 64)+"pt")
+	}
+	if len(css) > 0 {
+		wrap("span", ` style="`+html.EscapeString(strings.Join(css, "; "))+`"`)
+	}
+	return open, close
+}
+
+func (c *docxConverter) run(r *xmlNode, w *inlineWriter) {
+	rPr := r.child("rPr")
+	var props runProps
+	chain := c.styleChain(rPr.child("rStyle").attr("val"))
+	for i := len(chain) - 1; i >= 0; i-- {
+		props.apply(chain[i].rPr)
+	}
+	props.apply(rPr)
+	open, close := props.tags()
+	// The editor's comment mark holds a single comment, the innermost wins
+	if len(c.active) > 0 {
+		if text, ok := c.comments[c.active[len(c.active)-1]]; ok {
+			open = `<span data-comment="` + html.EscapeString(text) + `">` + open
+			close += "</span>"
+		}
+	}
+	c.runContent(r.Children, open, close, w)
+}
+
+func (c *docxConverter) runContent(nodes []*xmlNode, open, close string, w *inlineWriter) {
+	// Text between a field's begin and separate is its instruction
+	hidden := func() bool {
+		return len(w.fields) > 0 && w.fields[len(w.fields)-1].instr != "\x00"
+	}
+	for _, n := range nodes {
+		switch n.Name.Local {
+		case "t":
+			if !hidden() {
+				w.write(open, close, html.EscapeString(n.Text))
+			}
+		case "tab", "ptab":
+			w.write(open, close, "&emsp;")
+		case "br":
+			if t := n.attr("type"); t == "" || t == "textWrapping" {
+				w.write(open, close, "<br>")
+			}
+		case "cr":
+			w.write(open, close, "<br>")
+		case "noBreakHyphen":
+			w.write(open, close, "&#8209;")
+		case "softHyphen":
+			w.write(open, close, "&shy;")
+		case "sym":
+			if code, err := strconv.ParseUint(n.attr("char"), 16, 32); err == nil {
+				if code >= 0xF000 {
+					code -= 0xF000 // Symbol font characters live in the private use area
+				}
+				w.write(open, close, html.EscapeString(string(rune(code))))
+			}
+		case "drawing":
+			w.raw(c.drawing(n))
+		case "pict", "object":
+			w.raw(c.vmlImage(n))
+		case "AlternateContent":
+			if choice := n.child("Choice"); choice != nil {
+				c.runContent(choice.Children, open, close, w)
+			} else {
+				c.runContent(n.child("Fallback").Children, open, close, w)
+			}
+		case "footnoteReference", "endnoteReference":
+			kind := strings.TrimSuffix(n.Name.Local, "Reference")
+			if num, ok := c.noteRef(kind, n.attr("id")); ok {
+				w.raw(footnoteRefHTML(num))
+			}
+		case "fldChar":
+			switch n.attr("fldCharType") {
+			case "begin":
+				w.fields = append(w.fields, docxField{})
+			case "separate":
+				if len(w.fields) > 0 {
+					f := &w.fields[len(w.fields)-1]
+					if href, ok := fieldHyperlink(f.instr); ok {
+						w.raw(`<a href="` + html.EscapeString(href) + `">`)
+						f.linked = true
+					}
+					f.instr = "\x00" // Field result follows
+				}
+			case "end":
+				if len(w.fields) > 0 {
+					if w.fields[len(w.fields)-1].linked {
+						w.raw("</a>")
+					}
+					w.fields = w.fields[:len(w.fields)-1]
+				}
+			}
+		case "instrText":
+			if len(w.fields) > 0 && hidden() {
+				w.fields[len(w.fields)-1].instr += n.Text
+			}
+		}
+	}
+}
+
+// noteRef numbers a footnote or endnote on its first reference and renders
+// its body in goldmark's footnote markup, so Markdown export keeps it.
+func (c *docxConverter) noteRef(kind, id string) (int, bool) {
+	key := kind + ":" + id
+	if num, ok := c.noteNums[key]; ok {
+		return num, true
+	}
+	note, ok := c.notes[key]
+	if !ok {
+		return 0, false
+	}
+	num := len(c.noteHTML) + 1
+	c.noteNums[key] = num
+	c.noteHTML = append(c.noteHTML, "") // Reserve the slot; notes may nest
+
+	saved := c.rels
+	c.rels = c.noteRels[key]
+	body := c.blocks(note.Children)
+	c.rels = saved
+
+	c.noteHTML[num-1] = footnoteItemHTML(num, body)
+	return num, true
+}
+
+// Notes of imported documents use goldmark's footnote markup, which the
+// Markdown writer turns back into [^n] footnotes.
+
+func footnoteRefHTML(num int) string {
+	return fmt.Sprintf(`<sup id="fnref:%d"><a href="#fn:%d" class="footnote-ref" role="doc-noteref">%d</a></sup>`, num, num, num)
+}
+
+// footnoteItemHTML renders the list item of a note with its back link.
+func footnoteItemHTML(num int, body string) string {
+	backref := fmt.Sprintf(`&#160;<a href="#fnref:%d" class="footnote-backref" role="doc-backlink">&#x21a9;&#xfe0e;</a>`, num)
+	if strings.HasSuffix(body, "</p>\n") {
+		body = strings.TrimSuffix(body, "</p>\n") + backref + "</p>\n"
+	} else {
+		body += "<p>" + backref + "</p>\n"
+	}
+	return fmt.Sprintf("<li id=\"fn:%d\">\n%s</li>\n", num, body)
+}
+
+// footnotesHTML renders the notes section at the end of the document.
+func footnotesHTML(items []string) string {
+	if len(items) == 0 {
+		return ""
+	}
+	return "<div class=\"footnotes\" role=\"doc-endnotes\">\n<hr>\n<ol>\n" + strings.Join(items, "") + "</ol>\n</div>\n"
+}
+
+func (c *docxConverter) drawing(n *xmlNode) string {
+	if blip := n.find("blip"); blip != nil {
+		extent := n.find("extent")
+		cx, _ := strconv.Atoi(extent.attr("cx"))
+		cy, _ := strconv.Atoi(extent.attr("cy"))
+		docPr := n.find("docPr")
+		alt := docPr.attr("descr")
+		if alt == "" {
+			alt = docPr.attr("title")
+		}
+		return c.image(blip.attrNS(nsRelationships, "embed"), alt, cx/emuPerPixel, cy/emuPerPixel)
+	}
+	if box := n.find("txbxContent"); box != nil {
+		c.pending = append(c.pending, "<div class=\"winhtml-textbox\">\n"+c.blocks(box.Children)+"</div>\n")
+	}
+	return ""
+}
+
+// vmlImage handles pictures in the legacy VML markup of older documents.
+func (c *docxConverter) vmlImage(n *xmlNode) string {
+	if data := n.find("imagedata"); data != nil {
+		return c.image(data.attrNS(nsRelationships, "id"), data.attr("title"), 0, 0)
+	}
+	if box := n.find("txbxContent"); box != nil {
+		c.pending = append(c.pending, "<div class=\"winhtml-textbox\">\n"+c.blocks(box.Children)+"</div>\n")
+	}
+	return ""
+}
+
+// Image formats a browser displays; EMF/WMF and TIFF become a placeholder.
+var docxWebImageTypes = map[string]bool{
+	"image/png": true, "image/jpeg": true, "image/gif": true,
+	"image/webp": true, "image/bmp": true, "image/svg+xml": true,
+}
+
+func (c *docxConverter) image(relID, alt string, width, height int) string {
+	rel, ok := c.rels[relID]
+	if !ok || rel.external {
+		return ""
+	}
+	data, err := c.readPart(rel.target)
+	if err != nil {
+		return ""
+	}
+	return importedImage(rel.target, data, alt, width, height, c.images, &c.report)
+}
+
+// importedImage renders an image embedded in an imported document as an
+// <img> with a data: URI, optimized when enabled. Formats a browser cannot
+// show become a placeholder with the alt text or file name.
+func importedImage(name string, data []byte, alt string, width, height int, opts ImageOptions, report *ImageReport) string {
+	mediaType := mediaTypeOf(name, data)
+	if !docxWebImageTypes[mediaType] {
+		label := alt
+		if label == "" {
+			label = path.Base(name)
+		}
+		return html.EscapeString("[" + label + "]")
+	}
+	if opts.Enabled {
+		before := len(data)
+		if optimized, optimizedType := optimizeImage(data, opts); optimizedType != "" {
+			data, mediaType = optimized, optimizedType
+			report.add(before, len(data))
+		}
+	}
+
+	attrs := ` alt="` + html.EscapeString(alt) + `"`
+	if width > 0 && height > 0 {
+		attrs += fmt.Sprintf(` width="%d" height="%d"`, width, height)
+	}
+	return `<img src="data:` + mediaType + `;base64,` + base64.StdEncoding.EncodeToString(data) + `"` + attrs + `>`
+}
+
+type docxCell struct {
+	node             *xmlNode
+	col              int
+	colspan, rowspan int
+	merged           bool // Continuation of a vertical merge, not rendered
+	header           bool
+}
+
+// table maps gridSpan to colspan and vMerge runs to rowspan on the cell
+// that starts them.
+func (c *docxConverter) table(tbl *xmlNode) string {
+	var rows [][]*docxCell
+	cellAt := func(row []*docxCell, col int) *docxCell {
+		for _, cell := range row {
+			if cell.col == col {
+				return cell
+			}
+		}
+		return nil
+	}
+
+	for _, tr := range tbl.children("tr") {
+		trPr := tr.child("trPr")
+		header := onOff(trPr.child("tblHeader"))
+		col, _ := strconv.Atoi(trPr.child("gridBefore").attr("val"))
+		var cells []*docxCell
+		for _, tc := range flattenBlocks(tr.Children) {
+			if tc.Name.Local != "tc" {
+				continue
+			}
+			tcPr := tc.child("tcPr")
+			cell := &docxCell{node: tc, col: col, colspan: 1, rowspan: 1, header: header}
+			if span, err := strconv.Atoi(tcPr.child("gridSpan").attr("val")); err == nil && span > 1 {
+				cell.colspan = span
+			}
+			if vm := tcPr.child("vMerge"); vm != nil && vm.attr("val") != "restart" {
+				cell.merged = true
+				for r := len(rows) - 1; r >= 0; r-- {
+					above := cellAt(rows[r], col)
+					if above == nil {
+						break
+					}
+					if !above.merged {
+						above.rowspan++
+						break
+					}
+				}
+			}
+			cells = append(cells, cell)
+			col += cell.colspan
+		}
+		rows = append(rows, cells)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<table>\n")
+	for _, row := range rows {
+		sb.WriteString("<tr>")
+		for _, cell := range row {
+			if cell.merged {
+				continue
+			}
+			tag := "td"
+			if cell.header {
+				tag = "th"
+			}
+			attrs := ""
+			if cell.colspan > 1 {
+				attrs += fmt.Sprintf(` colspan="%d"`, cell.colspan)
+			}
+			if cell.rowspan > 1 {
+				attrs += fmt.Sprintf(` rowspan="%d"`, cell.rowspan)
+			}
+			content := c.blocks(cell.node.Children)
+			// A single plain paragraph needs no <p> inside the cell
+			if inner, ok := strings.CutPrefix(content, "<p>"); ok && strings.Count(content, "<p") == 1 {
+				content = strings.TrimSuffix(inner, "</p>\n")
+			}
+			sb.WriteString("<" + tag + attrs + ">" + content + "</" + tag + ">")
+		}
+		sb.WriteString("</tr>\n")
+	}
+	sb.WriteString("</table>\n")
+	return sb.String()
+}
+
+// --- Equations (OMML -> LaTeX) ---
+
+var latexSymbols = map[rune]string{
+	'α': `\alpha`, 'β': `\beta`, 'γ': `\gamma`, 'δ': `\delta`, 'ε': `\epsilon`, 'ζ': `\zeta`,
+	'η': `\eta`, 'θ': `\theta`, 'ι': `\iota`, 'κ': `\kappa`, 'λ': `\lambda`, 'μ': `\mu`,
+	'ν': `\nu`, 'ξ': `\xi`, 'π': `\pi`, 'ρ': `\rho`, 'σ': `\sigma`, 'τ': `\tau`,
+	'υ': `\upsilon`, 'φ': `\phi`, 'χ': `\chi`, 'ψ': `\psi`, 'ω': `\omega`,
+	'Γ': `\Gamma`, 'Δ': `\Delta`, 'Θ': `\Theta`, 'Λ': `\Lambda`, 'Ξ': `\Xi`, 'Π': `\Pi`,
+	'Σ': `\Sigma`, 'Φ': `\Phi`, 'Ψ': `\Psi`, 'Ω': `\Omega`,
+	'∞': `\infty`, '≤': `\leq`, '≥': `\geq`, '≠': `\neq`, '≈': `\approx`, '±': `\pm`,
+	'∓': `\mp`, '×': `\times`, '÷': `\div`, '⋅': `\cdot`, '·': `\cdot`, '→': `\to`,
+	'←': `\leftarrow`, '⇒': `\Rightarrow`, '⇔': `\Leftrightarrow`, '∈': `\in`, '∉': `\notin`,
+	'⊂': `\subset`, '⊆': `\subseteq`, '∪': `\cup`, '∩': `\cap`, '∅': `\emptyset`,
+	'∀': `\forall`, '∃': `\exists`, '∂': `\partial`, '∇': `\nabla`, '…': `\ldots`,
+	'⋯': `\cdots`, '′': `'`, '∝': `\propto`, '≡': `\equiv`, '∼': `\sim`,
+}
+
+var latexOperators = map[string]string{
+	"∑": `\sum`, "∏": `\prod`, "∐": `\coprod`, "∫": `\int`, "∬": `\iint`, "∭": `\iiint`,
+	"∮": `\oint`, "⋃": `\bigcup`, "⋂": `\bigcap`, "⋁": `\bigvee`, "⋀": `\bigwedge`,
+}
+
+var latexAccents = map[string]string{
+	"̂": `\hat`, "̃": `\tilde`, "̄": `\bar`, "̅": `\overline`,
+	"⃗": `\vec`, "̇": `\dot`, "̈": `\ddot`,
+}
+
+var latexFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "cot": true, "sec": true, "csc": true,
+	"arcsin": true, "arccos": true, "arctan": true, "sinh": true, "cosh": true, "tanh": true,
+	"log": true, "ln": true, "lg": true, "exp": true, "lim": true, "max": true, "min": true,
+	"sup": true, "inf": true, "det": true, "gcd": true, "arg": true, "deg": true, "dim": true,
+}
+
+func ommlToLatex(n *xmlNode) string {
+	return strings.TrimSpace(ommlChildren(n))
+}
+
+func ommlChildren(n *xmlNode) string {
+	if n == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, c := range n.Children {
+		sb.WriteString(ommlNode(c))
+	}
+	return sb.String()
+}
+
+// ommlArg renders a child element such as m:num or m:sup.
+func ommlArg(n *xmlNode, local string) string {
+	return strings.TrimSpace(ommlChildren(n.child(local)))
+}
+
+func ommlNode(n *xmlNode) string {
+	local := n.Name.Local
+	if strings.HasSuffix(local, "Pr") {
+		return ""
+	}
+	prop := func(pr, name, def string) string {
+		if p := n.child(pr).child(name); p != nil {
+			return p.attr("val")
+		}
+		return def
+	}
+
+	switch local {
+	case "r":
+		var text string
+		for _, t := range n.children("t") {
+			text += t.Text
+		}
+		return latexText(text)
+	case "f":
+		if prop("fPr", "type", "") == "lin" {
+			return ommlArg(n, "num") + "/" + ommlArg(n, "den")
+		}
+		return `\frac{` + ommlArg(n, "num") + "}{" + ommlArg(n, "den") + "}"
+	case "sSup":
+		return "{" + ommlArg(n, "e") + "}^{" + ommlArg(n, "sup") + "}"
+	case "sSub":
+		return "{" + ommlArg(n, "e") + "}_{" + ommlArg(n, "sub") + "}"
+	case "sSubSup":
+		return "{" + ommlArg(n, "e") + "}_{" + ommlArg(n, "sub") + "}^{" + ommlArg(n, "sup") + "}"
+	case "sPre":
+		return "{}_{" + ommlArg(n, "sub") + "}^{" + ommlArg(n, "sup") + "}" + ommlArg(n, "e")
+	case "rad":
+		if deg := ommlArg(n, "deg"); deg != "" {
+			return `\sqrt[` + deg + "]{" + ommlArg(n, "e") + "}"
+		}
+		return `\sqrt{` + ommlArg(n, "e") + "}"
+	case "nary":
+		chr := prop("naryPr", "chr", "∫")
+		op, ok := latexOperators[chr]
+		if !ok {
+			op = latexText(chr)
+		}
+		if sub := ommlArg(n, "sub"); sub != "" {
+			op += "_{" + sub + "}"
+		}
+		if sup := ommlArg(n, "sup"); sup != "" {
+			op += "^{" + sup + "}"
+		}
+		return op + "{" + ommlArg(n, "e") + "} "
+	case "d":
+		delim := func(chr string) string {
+			switch chr {
+			case "":
+				return "."
+			case "{", "}":
+				return `\` + chr
+			case "〈", "⟨":
+				return `\langle`
+			case "〉", "⟩":
+				return `\rangle`
+			case "‖":
+				return `\|`
+			}
+			return chr
+		}
+		sep := prop("dPr", "sepChr", "|")
+		var parts []string
+		for _, e := range n.children("e") {
+			parts = append(parts, strings.TrimSpace(ommlChildren(e)))
+		}
+		return `\left` + delim(prop("dPr", "begChr", "(")) + strings.Join(parts, sep) + `\right` + delim(prop("dPr", "endChr", ")"))
+	case "func":
+		name := strings.TrimSpace(ommlChildren(n.child("fName")))
+		return name + "{" + ommlArg(n, "e") + "}"
+	case "limLow":
+		return "{" + ommlArg(n, "e") + "}_{" + ommlArg(n, "lim") + "}"
+	case "limUpp":
+		return "{" + ommlArg(n, "e") + "}^{" + ommlArg(n, "lim") + "}"
+	case "acc":
+		cmd, ok := latexAccents[prop("accPr", "chr", "̂")]
+		if !ok {
+			cmd = `\hat`
+		}
+		return cmd + "{" + ommlArg(n, "e") + "}"
+	case "bar":
+		if prop("barPr", "pos", "bot") == "top" {
+			return `\overline{` + ommlArg(n, "e") + "}"
+		}
+		return `\underline{` + ommlArg(n, "e") + "}"
+	case "groupChr":
+		switch prop("groupChrPr", "chr", "⏟") {
+		case "⏟":
+			return `\underbrace{` + ommlArg(n, "e") + "}"
+		case "⏞":
+			return `\overbrace{` + ommlArg(n, "e") + "}"
+		}
+		return ommlArg(n, "e")
+	case "m":
+		var rows []string
+		for _, mr := range n.children("mr") {
+			var cells []string
+			for _, e := range mr.children("e") {
+				cells = append(cells, strings.TrimSpace(ommlChildren(e)))
+			}
+			rows = append(rows, strings.Join(cells, " & "))
+		}
+		return `\begin{matrix}` + strings.Join(rows, ` \\ `) + `\end{matrix}`
+	case "eqArr":
+		var rows []string
+		for _, e := range n.children("e") {
+			rows = append(rows, strings.TrimSpace(ommlChildren(e)))
+		}
+		return `\begin{aligned}` + strings.Join(rows, ` \\ `) + `\end{aligned}`
+	}
+	return ommlChildren(n)
+}
+
+// latexText escapes equation text and spells symbols as commands.
+func latexText(text string) string {
+	if latexFunctions[text] {
+		return `\` + text + " "
+	}
+	var sb strings.Builder
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+		if cmd, ok := latexSymbols[r]; ok {
+			sb.WriteString(cmd)
+			if len(cmd) > 1 && text != "" {
+				sb.WriteByte(' ')
+			}
+			continue
+		}
+		switch r {
+		case '{', '}', '%', '#', '&', '_', '$':
+			sb.WriteByte('\\')
+		case '\\':
+			sb.WriteString(`\backslash `)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
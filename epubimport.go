@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+type epubChapter struct {
+	name   string
+	body   *html.Node
+	anchor string // Id that links to the chapter itself point at
+}
+
+// epubToHTML converts an EPUB book to one editor document: the chapters of
+// the spine in reading order, with pictures embedded as data URIs and links
+// between chapters turned into links within the document. Book styles are
+// dropped, as for other imports.
+func epubToHTML(content []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("invalid EPUB: %v", err)
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	data, err := readZipPart(files, "META-INF/container.xml")
+	if err != nil {
+		return "", fmt.Errorf("invalid EPUB: %v", err)
+	}
+	container, err := parseXMLTree(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid EPUB: %v", err)
+	}
+	opfName := container.find("rootfile").attr("full-path")
+	data, err = readZipPart(files, opfName)
+	if err != nil {
+		return "", fmt.Errorf("invalid EPUB: %v", err)
+	}
+	opf, err := parseXMLTree(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid EPUB: %v", err)
+	}
+
+	manifest := make(map[string]string) // Item id -> part name
+	for _, item := range opf.find("manifest").children("item") {
+		if mt := item.attr("media-type"); mt != "application/xhtml+xml" && mt != "text/html" {
+			continue
+		}
+		href, err := url.PathUnescape(item.attr("href"))
+		if err != nil {
+			continue
+		}
+		manifest[item.attr("id")] = path.Join(path.Dir(opfName), href)
+	}
+
+	var chapters []*epubChapter
+	byName := make(map[string]*epubChapter)
+	for _, ref := range opf.find("spine").children("itemref") {
+		name, ok := manifest[ref.attr("idref")]
+		if !ok || byName[name] != nil {
+			continue
+		}
+		data, err := readZipPart(files, name)
+		if err != nil {
+			continue
+		}
+		doc, err := html.Parse(bytes.NewReader(data))
+		if err != nil {
+			continue
+		}
+		body := findElement(doc, atom.Body)
+		if body == nil {
+			continue
+		}
+		ch := &epubChapter{name: name, body: body}
+		removeEPUBClutter(body)
+		for n := body.FirstChild; n != nil; n = n.NextSibling {
+			if n.Type != html.ElementNode {
+				continue
+			}
+			if ch.anchor = htmlAttr(n, "id"); ch.anchor == "" {
+				ch.anchor = "epub-" + ref.attr("idref")
+				n.Attr = append(n.Attr, html.Attribute{Key: "id", Val: ch.anchor})
+			}
+			break
+		}
+		chapters = append(chapters, ch)
+		byName[name] = ch
+	}
+	if len(chapters) == 0 {
+		return "", fmt.Errorf("invalid EPUB: no readable chapters")
+	}
+
+	opts := globalImageOptions()
+	var report ImageReport
+	var sb strings.Builder
+	for _, ch := range chapters {
+		a := &assetRewriter{
+			mapRef: func(ref string) (string, bool) {
+				u, err := url.Parse(ref)
+				if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+					return "", false
+				}
+				name := path.Join(path.Dir(ch.name), u.Path)
+				if target, ok := byName[name]; ok {
+					if u.Fragment != "" {
+						return "#" + u.Fragment, true
+					}
+					return "#" + target.anchor, true
+				}
+				data, err := readZipPart(files, name)
+				if err != nil {
+					return "", false
+				}
+				uri := fmt.Sprintf("data:%s;base64,%s", mediaTypeOf(name, data), base64.StdEncoding.EncodeToString(data))
+				if opts.Enabled {
+					uri = optimizeDataURI(uri, opts, &report)
+				}
+				return uri, true
+			},
+			followLinks: true,
+		}
+		var chapter strings.Builder
+		for n := ch.body.FirstChild; n != nil; n = n.NextSibling {
+			html.Render(&chapter, n)
+		}
+		sb.WriteString(a.rewriteHTML(chapter.String()))
+		sb.WriteString("\n")
+	}
+	imageReportLog("EPUB import", &report)
+	return sb.String(), nil
+}
+
+// removeEPUBClutter drops scripts, styles and other elements that carry no
+// content of their own.
+func removeEPUBClutter(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.CommentNode {
+			n.RemoveChild(c)
+		} else if c.Type == html.ElementNode {
+			switch c.DataAtom {
+			case atom.Script, atom.Style, atom.Link, atom.Meta, atom.Noscript:
+				n.RemoveChild(c)
+			default:
+				removeEPUBClutter(c)
+			}
+		}
+		c = next
+	}
+}
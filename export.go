@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	SCREENSHOT_TIMEOUT = 30 * time.Second
+	PDF_TIMEOUT        = 60 * time.Second // Longer timeout for PDF
+)
+
+var errExportUnsupported = errors.New("this export is not available without a Chromium-based browser")
+
+type ExportOptions struct {
+	Width      int           // Screenshot viewport width in CSS pixels
+	Scale      float64       // PDF scale factor (1.0 = 100%)
+	ReadyBound time.Duration // Max wait for the page to finish rendering
+}
+
+// Exporter turns a render page into PDF or PNG bytes. Backends that cannot
+// produce a format return errExportUnsupported.
+type Exporter interface {
+	Name() string
+	PDF(html string, opts ExportOptions) ([]byte, error)
+	Screenshot(html string, opts ExportOptions) ([]byte, error)
+}
+
+// selectExporter prefers the headless browser and falls back to the
+// built-in renderer when no browser can be found.
+func selectExporter() Exporter {
+	if browserPath := findBrowserPath(); browserPath != "" {
+		return chromedpExporter{browserPath: browserPath}
+	}
+	return builtinExporter{}
+}
+
+// chromedpExporter renders through a local Edge/Chrome/Chromium.
+type chromedpExporter struct {
+	browserPath string
+}
+
+func (e chromedpExporter) Name() string { return "chromedp" }
+
+func (e chromedpExporter) PDF(html string, opts ExportOptions) ([]byte, error) {
+	return printPDF(e.browserPath, html, opts.Scale, opts.ReadyBound)
+}
+
+func (e chromedpExporter) Screenshot(html string, opts ExportOptions) ([]byte, error) {
+	return captureScreenshot(e.browserPath, html, opts.Width, opts.ReadyBound)
+}
+
+// resolveExportHTML produces the page to render for an export request: a
+// document on disk when sourcePath is set, otherwise the posted content in
+// the given format.
+func resolveExportHTML(content, format, sourcePath string) (string, error) {
+	if sourcePath != "" {
+		return loadDocumentForRender(sourcePath)
+	}
+	if content == "" {
+		return "", fmt.Errorf("HTML content is empty")
+	}
+	return buildRenderHTML(content, format)
+}
+
+// storeRenderPage publishes html under a one-off token for /api/render-view
+// and returns its URL plus a func that removes it again.
+func storeRenderPage(html string) (string, func()) {
+	token := generateID()
+	renderStoreMu.Lock()
+	renderStore[token] = html
+	renderStoreMu.Unlock()
+
+	release := func() {
+		renderStoreMu.Lock()
+		delete(renderStore, token)
+		renderStoreMu.Unlock()
+	}
+	return fmt.Sprintf("http://127.0.0.1:%d/api/render-view?token=%s", APP_PORT, token), release
+}
+
+// newExportBrowser launches a headless browser for a single export job. An
+// empty browserPath lets chromedp pick its default executable.
+func newExportBrowser(browserPath string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	opts := append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.NoFirstRun,
+		chromedp.Headless,
+		chromedp.DisableGPU,
+		chromedp.IgnoreCertErrors,
+	)
+
+	if browserPath != "" {
+		opts = append(opts, chromedp.ExecPath(browserPath))
+	}
+
+	allocCtx, cancelAlloc := chromedp.NewExecAllocator(context.Background(), opts...)
+	timeoutCtx, cancelTimeout := context.WithTimeout(allocCtx, timeout)
+	ctx, cancelCtx := chromedp.NewContext(timeoutCtx)
+
+	return ctx, func() {
+		cancelCtx()
+		cancelTimeout()
+		cancelAlloc()
+	}
+}
+
+// captureScreenshot renders html at the given CSS width and returns a full
+// page PNG.
+func captureScreenshot(browserPath, html string, width int, bound time.Duration) ([]byte, error) {
+	renderURL, release := storeRenderPage(html)
+	defer release()
+
+	ctx, cancel := newExportBrowser(browserPath, SCREENSHOT_TIMEOUT)
+	defer cancel()
+
+	tracker := newNetworkTracker()
+	tracker.listen(ctx)
+
+	var buf []byte
+	err := chromedp.Run(ctx,
+		network.Enable(),
+		chromedp.EmulateViewport(int64(width), 1, chromedp.EmulateScale(3.0)),
+		chromedp.Navigate(renderURL),
+		chromedp.WaitReady("body", chromedp.ByQuery),
+		waitRenderReady(tracker, bound),
+		chromedp.FullScreenshot(&buf, 100),
+	)
+	return buf, err
+}
+
+// printPDF renders html and prints it to an A4 PDF.
+func printPDF(browserPath, html string, scale float64, bound time.Duration) ([]byte, error) {
+	renderURL, release := storeRenderPage(html)
+	defer release()
+
+	ctx, cancel := newExportBrowser(browserPath, PDF_TIMEOUT)
+	defer cancel()
+
+	// Determine scale (Default 1.0)
+	if scale <= 0 {
+		scale = 1.0
+	}
+
+	tracker := newNetworkTracker()
+	tracker.listen(ctx)
+
+	var buf []byte
+	err := chromedp.Run(ctx,
+		network.Enable(),
+		chromedp.Navigate(renderURL),
+		chromedp.WaitReady("body", chromedp.ByQuery),
+		waitRenderReady(tracker, bound), // Wait for fonts/images
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			var err error
+			// A4 Size: 8.27 x 11.69 inches
+			buf, _, err = page.PrintToPDF().
+				WithPrintBackground(true).
+				WithPaperWidth(8.27).
+				WithPaperHeight(11.69).
+				WithMarginTop(0.4).
+				WithMarginBottom(0.4).
+				WithMarginLeft(0.4).
+				WithMarginRight(0.4).
+				WithScale(scale). // Apply scale from frontend
+				Do(ctx)
+			return err
+		}),
+	)
+	return buf, err
+}
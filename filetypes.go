@@ -0,0 +1,235 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+// File kinds group the types the backend treats alike. They are reported to
+// the frontend in X-File-Kind.
+const (
+	FILE_KIND_HTML     = "html"
+	FILE_KIND_MARKDOWN = "markdown"
+	FILE_KIND_TEXT     = "text"
+	FILE_KIND_PDF      = "pdf"
+	FILE_KIND_WORD     = "word"
+	FILE_KIND_IMAGE    = "image"
+	FILE_KIND_ARCHIVE  = "archive"  // MHTML web archives
+	FILE_KIND_DOCUMENT = "document" // RTF, ODT, EPUB
+)
+
+type FileType struct {
+	Name       string
+	Kind       string
+	MimeType   string
+	Extensions []string
+	Text       bool              // Decoded to UTF-8 on open
+	sniff      func([]byte) bool // Magic bytes; nil for types without a signature
+}
+
+// fileTypes is the single list of types the editor opens. The open dialog
+// filter, /api/open-file and the CLI handover all go through it. When
+// sniffing, the first signature that matches wins.
+var fileTypes = []*FileType{
+	{Name: "html", Kind: FILE_KIND_HTML, MimeType: "text/html", Extensions: []string{".html", ".htm"}, Text: true},
+	{Name: "xhtml", Kind: FILE_KIND_HTML, MimeType: "application/xhtml+xml", Extensions: []string{".xhtml", ".xht"}, Text: true},
+	{Name: "docx", Kind: FILE_KIND_WORD, MimeType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Extensions: []string{".docx"}, sniff: zipContains("word/document.xml")},
+	{Name: "pdf", Kind: FILE_KIND_PDF, MimeType: "application/pdf", Extensions: []string{".pdf"}, sniff: func(b []byte) bool { return bytes.Contains(b[:min(len(b), 1024)], []byte("%PDF-")) }},
+	{Name: "markdown", Kind: FILE_KIND_MARKDOWN, MimeType: "text/markdown", Extensions: []string{".md", ".markdown"}, Text: true},
+	{Name: "txt", Kind: FILE_KIND_TEXT, MimeType: "text/plain", Extensions: []string{".txt"}, Text: true},
+	{Name: "csv", Kind: FILE_KIND_TEXT, MimeType: "text/csv", Extensions: []string{".csv"}, Text: true},
+	{Name: "mhtml", Kind: FILE_KIND_ARCHIVE, MimeType: "multipart/related", Extensions: []string{".mhtml", ".mht"}, sniff: sniffMHTML},
+	{Name: "rtf", Kind: FILE_KIND_DOCUMENT, MimeType: "application/rtf", Extensions: []string{".rtf"}, sniff: hasPrefix(`{\rtf`)},
+	{Name: "odt", Kind: FILE_KIND_DOCUMENT, MimeType: "application/vnd.oasis.opendocument.text", Extensions: []string{".odt"}, sniff: zipMimetype("application/vnd.oasis.opendocument.text")},
+	{Name: "epub", Kind: FILE_KIND_DOCUMENT, MimeType: "application/epub+zip", Extensions: []string{".epub"}, sniff: zipMimetype("application/epub+zip")},
+	{Name: "png", Kind: FILE_KIND_IMAGE, MimeType: "image/png", Extensions: []string{".png"}, sniff: hasPrefix("\x89PNG\r\n\x1a\n")},
+	{Name: "jpeg", Kind: FILE_KIND_IMAGE, MimeType: "image/jpeg", Extensions: []string{".jpg", ".jpeg"}, sniff: hasPrefix("\xFF\xD8\xFF")},
+	{Name: "gif", Kind: FILE_KIND_IMAGE, MimeType: "image/gif", Extensions: []string{".gif"}, sniff: func(b []byte) bool { return hasPrefix("GIF87a")(b) || hasPrefix("GIF89a")(b) }},
+	{Name: "webp", Kind: FILE_KIND_IMAGE, MimeType: "image/webp", Extensions: []string{".webp"}, sniff: func(b []byte) bool { return len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP" }},
+	{Name: "bmp", Kind: FILE_KIND_IMAGE, MimeType: "image/bmp", Extensions: []string{".bmp"}, sniff: sniffBMP},
+	{Name: "svg", Kind: FILE_KIND_IMAGE, MimeType: "image/svg+xml", Extensions: []string{".svg"}},
+}
+
+// Fallback for content nothing in the registry matches.
+var unknownFileType = &FileType{Name: "", Kind: "", MimeType: "application/octet-stream"}
+
+// Groups of the native open dialog, in display order.
+var dialogFilterGroups = []struct {
+	Label string
+	Kinds []string
+}{
+	{"HTML Files", []string{FILE_KIND_HTML}},
+	{"Word Documents", []string{FILE_KIND_WORD}},
+	{"PDF Files", []string{FILE_KIND_PDF}},
+	{"Image Files", []string{FILE_KIND_IMAGE}},
+	{"Markdown Files", []string{FILE_KIND_MARKDOWN}},
+	{"Text Files", []string{FILE_KIND_TEXT}},
+	{"Web Archives", []string{FILE_KIND_ARCHIVE}},
+	{"Other Documents", []string{FILE_KIND_DOCUMENT}},
+}
+
+func hasPrefix(magic string) func([]byte) bool {
+	return func(b []byte) bool { return bytes.HasPrefix(b, []byte(magic)) }
+}
+
+// zipMimetype matches OpenDocument/EPUB containers, which store their type
+// uncompressed as the first entry ("mimetype") of the zip.
+func zipMimetype(mimeType string) func([]byte) bool {
+	return func(b []byte) bool {
+		return bytes.HasPrefix(b, []byte("PK\x03\x04")) && len(b) > 38 &&
+			string(b[30:38]) == "mimetype" && bytes.HasPrefix(b[38:], []byte(mimeType))
+	}
+}
+
+// zipContains matches a zip that has the named entry.
+func zipContains(name string) func([]byte) bool {
+	return func(b []byte) bool {
+		if !bytes.HasPrefix(b, []byte("PK\x03\x04")) {
+			return false
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return false
+		}
+		for _, f := range zr.File {
+			if f.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// sniffBMP checks the info header size as well, "BM" alone is too weak.
+func sniffBMP(b []byte) bool {
+	if len(b) < 18 || string(b[:2]) != "BM" {
+		return false
+	}
+	switch b[14] {
+	case 12, 40, 52, 56, 64, 108, 124:
+		return b[15] == 0 && b[16] == 0 && b[17] == 0
+	}
+	return false
+}
+
+func sniffMHTML(b []byte) bool {
+	head := strings.ToLower(string(b[:min(len(b), 4096)]))
+	return strings.Contains(head, "mime-version:") && strings.Contains(head, "multipart/related")
+}
+
+// fileTypeForPath looks a type up by extension only.
+func fileTypeForPath(path string) *FileType {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, ft := range fileTypes {
+		for _, e := range ft.Extensions {
+			if e == ext {
+				return ft
+			}
+		}
+	}
+	return nil
+}
+
+// fileTypeForMime looks a type up by the MIME type recorded at handover.
+func fileTypeForMime(mimeType string) *FileType {
+	for _, ft := range fileTypes {
+		if ft.MimeType == mimeType {
+			return ft
+		}
+	}
+	return nil
+}
+
+// sniffSignature identifies content by its magic bytes.
+func sniffSignature(data []byte) *FileType {
+	for _, ft := range fileTypes {
+		if ft.sniff != nil && ft.sniff(data) {
+			return ft
+		}
+	}
+	return nil
+}
+
+// sniffFileType identifies content by its magic bytes, then falls back to
+// recognising HTML, SVG and plain text.
+func sniffFileType(data []byte) *FileType {
+	if ft := sniffSignature(data); ft != nil {
+		return ft
+	}
+	head := data[:min(len(data), 1024)]
+	if bytes.IndexByte(head, 0) >= 0 && sniffUTF16(data) == "" {
+		return nil // Binary
+	}
+	// Text in any encoding; decodeText sorts out the charset later
+	lower := strings.ToLower(string(head))
+	switch {
+	case strings.Contains(lower, "<!doctype html") || strings.Contains(lower, "<html"):
+		return fileTypeForPath(".html")
+	case strings.Contains(lower, "<svg"):
+		return fileTypeForPath(".svg")
+	}
+	return fileTypeForPath(".txt")
+}
+
+// detectFileType trusts the extension unless the content carries the
+// signature of a different type (a PDF saved as .docx, say); files without
+// a known extension are sniffed.
+func detectFileType(path string, data []byte) *FileType {
+	byExt := fileTypeForPath(path)
+	if byExt != nil && (byExt.sniff == nil || len(data) == 0 || byExt.sniff(data)) {
+		return byExt
+	}
+	if ft := sniffSignature(data); ft != nil {
+		return ft
+	}
+	if byExt != nil {
+		return byExt
+	}
+	if ft := sniffFileType(data); ft != nil {
+		return ft
+	}
+	return unknownFileType
+}
+
+// contentType is the Content-Type /api/open-file sends for the type; text
+// has already been converted to UTF-8 at that point.
+func (ft *FileType) contentType() string {
+	if ft.Text {
+		return ft.MimeType + "; charset=utf-8"
+	}
+	return ft.MimeType
+}
+
+// openDialogFilter builds the lpstrFilter string of the native open dialog
+// from the registry.
+func openDialogFilter() string {
+	patterns := func(kinds ...string) []string {
+		var out []string
+		for _, ft := range fileTypes {
+			for _, k := range kinds {
+				if ft.Kind != k {
+					continue
+				}
+				for _, e := range ft.Extensions {
+					out = append(out, "*"+e)
+				}
+			}
+		}
+		return out
+	}
+
+	var all []string
+	for _, g := range dialogFilterGroups {
+		all = append(all, patterns(g.Kinds...)...)
+	}
+	var sb strings.Builder
+	sb.WriteString("Supported Files\x00" + strings.Join(all, ";") + "\x00")
+	for _, g := range dialogFilterGroups {
+		p := strings.Join(patterns(g.Kinds...), ";")
+		sb.WriteString(g.Label + " (" + p + ")\x00" + p + "\x00")
+	}
+	sb.WriteString("\x00")
+	return sb.String()
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	GIT_LOG_LIMIT   = 50
+	GIT_LOG_MAX     = 1000
+	GIT_MAX_MESSAGE = 64 << 10
+
+	GIT_STATUS_UNMODIFIED = "unmodified"
+	GIT_STATUS_MODIFIED   = "modified" // Work tree differs from the index
+	GIT_STATUS_STAGED     = "staged"   // Index differs from HEAD
+	GIT_STATUS_ADDED      = "added"    // In the index, not in HEAD
+	GIT_STATUS_UNTRACKED  = "untracked"
+	GIT_STATUS_IGNORED    = "ignored"
+	GIT_STATUS_DELETED    = "deleted" // In the index, gone from the work tree
+)
+
+// gitDoc is a document inside a git work tree.
+type gitDoc struct {
+	repo *git.Repository
+	wt   *git.Worktree
+	root string // Work tree root
+	rel  string // Document path in the repository, forward slashes
+
+	ignore gitignore.Matcher // .gitignore patterns, read on first use
+}
+
+type GitFileStatus struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+}
+
+type GitStatusResponse struct {
+	Repo   bool            `json:"repo"`
+	Root   string          `json:"root,omitempty"`
+	Branch string          `json:"branch,omitempty"`
+	Path   string          `json:"path,omitempty"`
+	Status string          `json:"status,omitempty"`
+	Assets []GitFileStatus `json:"assets,omitempty"` // Referenced local files inside the work tree
+}
+
+type GitCommitRequest struct {
+	Path        string `json:"path"`
+	Message     string `json:"message"`
+	SkipAssets  bool   `json:"skipAssets"` // Commit the document only
+	AuthorName  string `json:"authorName"` // Default: user.name from git config
+	AuthorEmail string `json:"authorEmail"`
+}
+
+// GitCommitResult reports a commit made for a document. Committed is false
+// with Error empty when nothing had changed.
+type GitCommitResult struct {
+	Committed bool     `json:"committed"`
+	Hash      string   `json:"hash,omitempty"`
+	Files     []string `json:"files,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type GitCommitInfo struct {
+	Hash        string    `json:"hash"`
+	AuthorName  string    `json:"authorName"`
+	AuthorEmail string    `json:"authorEmail"`
+	Date        time.Time `json:"date"`
+	Message     string    `json:"message"`
+}
+
+type GitBlameLine struct {
+	Line        int       `json:"line"`
+	Text        string    `json:"text"`
+	Hash        string    `json:"hash"`
+	AuthorName  string    `json:"authorName"`
+	AuthorEmail string    `json:"authorEmail"`
+	Date        time.Time `json:"date"`
+}
+
+var (
+	errNotInGitRepo = errors.New("not inside a git work tree")
+
+	// Serializes index updates and commits made by the editor
+	gitMu sync.Mutex
+)
+
+// openGitDoc finds the work tree holding docPath, searching parent folders
+// for .git the way git does.
+func openGitDoc(docPath string) (*gitDoc, error) {
+	if !filepath.IsAbs(docPath) {
+		return nil, fmt.Errorf("path must be absolute: %s", docPath)
+	}
+	repo, err := git.PlainOpenWithOptions(filepath.Dir(docPath), &git.PlainOpenOptions{DetectDotGit: true, EnableDotGitCommonDir: true})
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, errNotInGitRepo
+	}
+	if err != nil {
+		return nil, err
+	}
+	wt, err := repo.Worktree()
+	if errors.Is(err, git.ErrIsBareRepository) {
+		return nil, errNotInGitRepo
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &gitDoc{repo: repo, wt: wt, root: wt.Filesystem.Root()}
+	if d.rel, err = d.relPath(docPath); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// relPath turns an absolute path into a repository path. On Windows the
+// case is taken from the disk, since paths handed around the backend may
+// have been lowercased (see getLockKey) and git names are case-sensitive.
+func (d *gitDoc) relPath(path string) (string, error) {
+	rel, err := filepath.Rel(d.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the work tree %s", path, d.root)
+	}
+	if runtime.GOOS == "windows" {
+		parts := strings.Split(rel, string(filepath.Separator))
+		dir := d.root
+		for i, part := range parts {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				break
+			}
+			for _, e := range entries {
+				if strings.EqualFold(e.Name(), part) {
+					parts[i] = e.Name()
+					break
+				}
+			}
+			dir = filepath.Join(dir, parts[i])
+		}
+		rel = filepath.Join(parts...)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (d *gitDoc) absPath(rel string) string {
+	return filepath.Join(d.root, filepath.FromSlash(rel))
+}
+
+func (d *gitDoc) branch() string {
+	ref, err := d.repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return ""
+	}
+	if ref.Type() == plumbing.SymbolicReference {
+		return ref.Target().Short()
+	}
+	return ref.Hash().String()[:7] // Detached
+}
+
+// gitSystemConfigPaths lists the system-wide config files git reads.
+// go-git only knows /etc/gitconfig; Git for Windows keeps its own under
+// Program Files, with ProgramData\Git\config below it.
+func gitSystemConfigPaths() []string {
+	if path := os.Getenv("GIT_CONFIG_SYSTEM"); path != "" {
+		return []string{path}
+	}
+	if runtime.GOOS != "windows" {
+		return []string{"/etc/gitconfig"}
+	}
+	var paths []string
+	for _, dir := range []string{os.Getenv("ProgramFiles"), os.Getenv("ProgramFiles(x86)")} {
+		if dir != "" {
+			paths = append(paths, filepath.Join(dir, "Git", "etc", "gitconfig"), filepath.Join(dir, "Git", "mingw64", "etc", "gitconfig"))
+		}
+	}
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "Git", "config"))
+	}
+	return paths
+}
+
+// configOption looks an option up the way git does: repository config,
+// then global, then system. ConfigScoped cannot be used for this, it
+// only fills in sections the repository config lacks entirely.
+func (d *gitDoc) configOption(section, option string) string {
+	if cfg, err := d.repo.Config(); err == nil {
+		if v := cfg.Raw.Section(section).Option(option); v != "" {
+			return v
+		}
+	}
+	if cfg, err := config.LoadConfig(config.GlobalScope); err == nil {
+		if v := cfg.Raw.Section(section).Option(option); v != "" {
+			return v
+		}
+	}
+	for _, path := range gitSystemConfigPaths() {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		cfg, err := config.ReadConfig(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		if v := cfg.Raw.Section(section).Option(option); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// autocrlf reports whether the repository wants CRLF turned into LF when
+// content goes into git. go-git does not do this itself. Git for Windows
+// sets core.autocrlf=true in its system config; without any git config on
+// Windows the same default is assumed.
+func (d *gitDoc) autocrlf() bool {
+	switch strings.ToLower(d.configOption("core", "autocrlf")) {
+	case "true", "input":
+		return true
+	case "":
+		return runtime.GOOS == "windows"
+	}
+	return false
+}
+
+// blobContent is what git stores for a work tree file.
+func blobContent(data []byte, autocrlf bool) []byte {
+	if !autocrlf || bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return data // Binary files are never converted
+	}
+	return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+}
+
+// ignored matches rel against the .gitignore files of the work tree. They
+// are read once per gitDoc as reading them walks the whole tree.
+func (d *gitDoc) ignored(rel string) bool {
+	if d.ignore == nil {
+		patterns, _ := gitignore.ReadPatterns(d.wt.Filesystem, nil)
+		patterns = append(patterns, d.wt.Excludes...)
+		d.ignore = gitignore.NewMatcher(patterns)
+	}
+	return d.ignore.Match(strings.Split(rel, "/"), false)
+}
+
+// headTree returns the tree of the current commit, nil on an unborn branch.
+func (d *gitDoc) headTree() (*object.Tree, error) {
+	head, err := d.repo.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	commit, err := d.repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+// fileStatus compares one file across the work tree, the index and HEAD,
+// reporting the change nearest to the work tree the way `git status` lists
+// it first.
+func (d *gitDoc) fileStatus(idx *index.Index, head *object.Tree, rel string, autocrlf bool) string {
+	entry, err := idx.Entry(rel)
+	if err != nil {
+		entry = nil
+	}
+	data, err := os.ReadFile(d.absPath(rel))
+	switch {
+	case err != nil && entry != nil:
+		return GIT_STATUS_DELETED
+	case err != nil:
+		return GIT_STATUS_UNTRACKED
+	case entry == nil && d.ignored(rel):
+		return GIT_STATUS_IGNORED
+	case entry == nil:
+		return GIT_STATUS_UNTRACKED
+	}
+	if plumbing.ComputeHash(plumbing.BlobObject, blobContent(data, autocrlf)) != entry.Hash {
+		return GIT_STATUS_MODIFIED
+	}
+	if head == nil {
+		return GIT_STATUS_ADDED
+	}
+	committed, err := head.File(rel)
+	if err != nil {
+		return GIT_STATUS_ADDED
+	}
+	if committed.Hash != entry.Hash {
+		return GIT_STATUS_STAGED
+	}
+	return GIT_STATUS_UNMODIFIED
+}
+
+// assetPaths lists the local files the document refers to that lie inside
+// the work tree, other documents excepted.
+func (d *gitDoc) assetPaths() []string {
+	refs, err := collectDocumentRefs(d.absPath(d.rel))
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for key := range refs {
+		if ft := fileTypeForPath(key); ft != nil && (ft.Kind == FILE_KIND_HTML || ft.Kind == FILE_KIND_MARKDOWN) {
+			continue
+		}
+		if info, err := os.Stat(key); err != nil || info.IsDir() {
+			continue
+		}
+		if rel, err := d.relPath(key); err == nil {
+			paths = append(paths, rel)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (d *gitDoc) status() (*GitStatusResponse, error) {
+	idx, err := d.repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	head, err := d.headTree()
+	if err != nil {
+		return nil, err
+	}
+	autocrlf := d.autocrlf()
+	resp := &GitStatusResponse{
+		Repo:   true,
+		Root:   d.root,
+		Branch: d.branch(),
+		Path:   d.rel,
+		Status: d.fileStatus(idx, head, d.rel, autocrlf),
+	}
+	for _, rel := range d.assetPaths() {
+		resp.Assets = append(resp.Assets, GitFileStatus{Path: rel, Status: d.fileStatus(idx, head, rel, autocrlf)})
+	}
+	return resp, nil
+}
+
+// stage writes the work tree file into the object store and the index,
+// converting line endings like git would. Callers hold gitMu.
+func (d *gitDoc) stage(idx *index.Index, rel string, autocrlf bool) error {
+	path := d.absPath(rel)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data = blobContent(data, autocrlf)
+
+	obj := d.repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(int64(len(data)))
+	w, err := obj.Writer()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	w.Close()
+	hash, err := d.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+
+	entry, err := idx.Entry(rel)
+	if err != nil {
+		entry = idx.Add(rel)
+	}
+	entry.Hash = hash
+	entry.Mode = filemode.Regular
+	entry.ModifiedAt = info.ModTime()
+	entry.Size = uint32(info.Size())
+	return nil
+}
+
+// gitAuthor returns the signature for a commit: the given name and email,
+// or user.name and user.email from the git config.
+func (d *gitDoc) gitAuthor(name, email string) (*object.Signature, error) {
+	if name == "" {
+		name = d.configOption("user", "name")
+	}
+	if email == "" {
+		email = d.configOption("user", "email")
+	}
+	if name == "" || email == "" {
+		return nil, errors.New("no commit author: set user.name and user.email in git config")
+	}
+	return &object.Signature{Name: name, Email: email, When: time.Now()}, nil
+}
+
+// commit stages the document and, unless skipAssets, the files it refers
+// to, then commits the index. Changes staged outside the editor go into
+// the same commit, as they would with `git commit`.
+func (d *gitDoc) commit(message string, skipAssets bool, author *object.Signature) (*GitCommitResult, error) {
+	gitMu.Lock()
+	defer gitMu.Unlock()
+
+	idx, err := d.repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	autocrlf := d.autocrlf()
+	files := []string{d.rel}
+	if !skipAssets {
+		for _, rel := range d.assetPaths() {
+			if _, err := idx.Entry(rel); err != nil && d.ignored(rel) {
+				continue // Not forcing ignored files in
+			}
+			files = append(files, rel)
+		}
+	}
+	for _, rel := range files {
+		if err := d.stage(idx, rel, autocrlf); err != nil {
+			return nil, fmt.Errorf("staging %s: %v", rel, err)
+		}
+	}
+	if err := d.repo.Storer.SetIndex(idx); err != nil {
+		return nil, err
+	}
+
+	hash, err := d.wt.Commit(message, &git.CommitOptions{Author: author})
+	if errors.Is(err, git.ErrEmptyCommit) {
+		return &GitCommitResult{Files: files}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Git] Committed %s as %s", d.rel, hash.String()[:7])
+	return &GitCommitResult{Committed: true, Hash: hash.String(), Files: files}, nil
+}
+
+// commitOnSave commits a document that was just saved, for save-file's
+// gitCommit field. Failures are reported in the result, never fail the save.
+func commitOnSave(docPath, message string) *GitCommitResult {
+	d, err := openGitDoc(docPath)
+	if err == nil {
+		var author *object.Signature
+		if author, err = d.gitAuthor("", ""); err == nil {
+			var result *GitCommitResult
+			if result, err = d.commit(message, false, author); err == nil {
+				return result
+			}
+		}
+	}
+	log.Printf("[Git] Not committing %s: %v", filepath.Base(docPath), err)
+	return &GitCommitResult{Error: err.Error()}
+}
+
+// resolveCommit returns the commit named by rev (a hash, branch or tag),
+// HEAD when empty.
+func (d *gitDoc) resolveCommit(rev string) (*object.Commit, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+	hash, err := d.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("unknown revision %q", rev)
+	}
+	return d.repo.CommitObject(*hash)
+}
+
+// fileAt returns the document as committed in rev.
+func (d *gitDoc) fileAt(rev string) (string, error) {
+	commit, err := d.resolveCommit(rev)
+	if err != nil {
+		return "", err
+	}
+	file, err := commit.File(d.rel)
+	if err != nil {
+		return "", fmt.Errorf("%s is not in %s", d.rel, commit.Hash.String()[:7])
+	}
+	return file.Contents()
+}
+
+func (d *gitDoc) log(limit int) ([]GitCommitInfo, error) {
+	head, err := d.repo.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return []GitCommitInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rel := d.rel
+	iter, err := d.repo.Log(&git.LogOptions{From: head.Hash(), FileName: &rel})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	commits := []GitCommitInfo{}
+	for len(commits) < limit {
+		c, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, GitCommitInfo{
+			Hash:        c.Hash.String(),
+			AuthorName:  c.Author.Name,
+			AuthorEmail: c.Author.Email,
+			Date:        c.Author.When,
+			Message:     c.Message,
+		})
+	}
+	return commits, nil
+}
+
+func (d *gitDoc) blame(rev string) ([]GitBlameLine, error) {
+	commit, err := d.resolveCommit(rev)
+	if err != nil {
+		return nil, err
+	}
+	result, err := git.Blame(commit, d.rel)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]GitBlameLine, len(result.Lines))
+	for i, l := range result.Lines {
+		lines[i] = GitBlameLine{
+			Line:        i + 1,
+			Text:        l.Text,
+			Hash:        l.Hash.String(),
+			AuthorName:  l.AuthorName,
+			AuthorEmail: l.Author,
+			Date:        l.Date,
+		}
+	}
+	return lines, nil
+}
+
+// --- Handlers ---
+
+// handleGit serves the git view of a document in a work tree:
+// GET /api/git/status?path=, GET /api/git/log?path=&limit=,
+// GET /api/git/show?path=&rev=, GET /api/git/diff?path=&from=&to=,
+// GET /api/git/blame?path=&rev= and POST /api/git/commit.
+// Documents outside a work tree get {"repo": false} from status and 404
+// from the rest.
+func handleGit(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && !sameOriginRequest(r) {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	if r.URL.Path == "/api/git/commit" && r.Method == "POST" {
+		handleGitCommit(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	d, err := openGitDoc(query.Get("path"))
+	if errors.Is(err, errNotInGitRepo) && r.URL.Path == "/api/git/status" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GitStatusResponse{Repo: false})
+		return
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errNotInGitRepo) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var result interface{}
+	switch r.URL.Path {
+	case "/api/git/status":
+		result, err = d.status()
+
+	case "/api/git/log":
+		limit := GIT_LOG_LIMIT
+		if n, convErr := strconv.Atoi(query.Get("limit")); convErr == nil && n > 0 {
+			limit = min(n, GIT_LOG_MAX)
+		}
+		var commits []GitCommitInfo
+		commits, err = d.log(limit)
+		result = map[string]interface{}{"path": d.rel, "commits": commits}
+
+	case "/api/git/show":
+		text, err := d.fileAt(query.Get("rev"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		ft := fileTypeForPath(d.rel)
+		if ft == nil {
+			ft = unknownFileType
+		}
+		w.Header().Set("Content-Type", ft.contentType())
+		io.WriteString(w, text)
+		return
+
+	case "/api/git/diff":
+		result, err = d.diff(query.Get("from"), query.Get("to"))
+
+	case "/api/git/blame":
+		var lines []GitBlameLine
+		lines, err = d.blame(query.Get("rev"))
+		result = map[string]interface{}{"path": d.rel, "lines": lines}
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// diff compares the document in two revisions with diffHTML; an empty to
+// is the file on disk.
+func (d *gitDoc) diff(from, to string) (*HTMLDiff, error) {
+	var versions [2]string
+	for i, rev := range []string{from, to} {
+		var data []byte
+		if rev == "" && i == 1 {
+			disk, err := os.ReadFile(d.absPath(d.rel))
+			if err != nil {
+				return nil, err
+			}
+			data = disk
+		} else {
+			text, err := d.fileAt(rev)
+			if err != nil {
+				return nil, err
+			}
+			data = []byte(text)
+		}
+		data, _ = decodeTextDocument(data, d.rel)
+		doc, err := historyDocumentHTML(d.rel, string(data))
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = doc
+	}
+	return diffHTML(versions[0], versions[1])
+}
+
+func handleGitCommit(w http.ResponseWriter, r *http.Request) {
+	var req GitCommitRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, GIT_MAX_MESSAGE+4096)).Decode(&req); err != nil || req.Path == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" {
+		http.Error(w, "A commit message is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, err error) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	}
+	d, err := openGitDoc(req.Path)
+	if err != nil {
+		fail(http.StatusNotFound, err)
+		return
+	}
+	author, err := d.gitAuthor(req.AuthorName, req.AuthorEmail)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	result, err := d.commit(req.Message, req.SkipAssets, author)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
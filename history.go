@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	HISTORY_DIR          = "history"
+	HISTORY_MAX_VERSIONS = 100                  // Per document
+	HISTORY_MAX_AGE      = 180 * 24 * time.Hour // Older versions go, except the newest HISTORY_KEEP
+	HISTORY_KEEP         = 10
+	HISTORY_MAX_ASSET    = 64 << 20 // Larger assets are listed but not stored
+)
+
+// HistoryVersion is one saved state of a document: the file as written
+// plus the local files it referred to, all stored by content hash.
+type HistoryVersion struct {
+	ID      int            `json:"id"`
+	Hash    string         `json:"hash"`
+	Size    int64          `json:"size"`
+	SavedAt time.Time      `json:"savedAt"`
+	Assets  []HistoryAsset `json:"assets,omitempty"`
+}
+
+// HistoryAsset is a file next to the document, Path relative to its folder
+// with forward slashes. Hash is empty for files too large to keep.
+type HistoryAsset struct {
+	Path string `json:"path"`
+	Hash string `json:"hash,omitempty"`
+	Size int64  `json:"size"`
+}
+
+type historyIndex struct {
+	Path     string           `json:"path"`
+	NextID   int              `json:"nextId"`
+	Versions []HistoryVersion `json:"versions"`
+}
+
+type HistoryRestoreRequest struct {
+	Path string `json:"path"`
+	ID   int    `json:"id"`
+}
+
+var historyMu sync.Mutex
+
+func historyRoot() (string, error) {
+	dir, err := appDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, HISTORY_DIR), nil
+}
+
+func historyIndexPath(root, docPath string) string {
+	sum := sha1.Sum([]byte(getLockKey(docPath)))
+	return filepath.Join(root, "docs", hex.EncodeToString(sum[:])+".json")
+}
+
+func historyObjectPath(root, hash string) string {
+	return filepath.Join(root, "objects", hash[:2], hash)
+}
+
+func loadHistoryIndex(root, docPath string) (historyIndex, error) {
+	idx := historyIndex{Path: docPath, NextID: 1}
+	data, err := os.ReadFile(historyIndexPath(root, docPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return idx, err
+	}
+	return idx, json.Unmarshal(data, &idx)
+}
+
+func saveHistoryIndex(root string, idx historyIndex) error {
+	path := historyIndexPath(root, idx.Path)
+	if len(idx.Versions) == 0 {
+		os.Remove(path)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// storeHistoryObject writes data under its SHA-256 unless it is already
+// there, and returns the hash.
+func storeHistoryObject(root string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := historyObjectPath(root, hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp, path)
+}
+
+func readHistoryObject(root, hash string) ([]byte, error) {
+	f, err := os.Open(historyObjectPath(root, hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// historyAssets builds the asset manifest: every local file the document
+// refers to inside its own folder, other documents excepted.
+func historyAssets(root, docPath string) []HistoryAsset {
+	refs, err := collectDocumentRefs(docPath)
+	if err != nil {
+		return nil
+	}
+	baseKey := getLockKey(filepath.Dir(docPath))
+	var assets []HistoryAsset
+	for key := range refs {
+		rel, err := filepath.Rel(baseKey, key)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		path := filepath.Join(filepath.Dir(docPath), rel)
+		if ft := fileTypeForPath(path); ft != nil && (ft.Kind == FILE_KIND_HTML || ft.Kind == FILE_KIND_MARKDOWN) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		asset := HistoryAsset{Path: filepath.ToSlash(rel), Size: info.Size()}
+		if info.Size() <= HISTORY_MAX_ASSET {
+			if data, err := os.ReadFile(path); err == nil {
+				asset.Hash, _ = storeHistoryObject(root, data)
+			}
+		}
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].Path < assets[j].Path })
+	return assets
+}
+
+// recordHistory adds the document as it is on disk now as a new version,
+// unless it equals the latest one. Called after every save; errors are only
+// logged so history never fails a save.
+func recordHistory(docPath string) {
+	if _, err := addHistoryVersion(docPath); err != nil {
+		log.Printf("[History] %s: %v", filepath.Base(docPath), err)
+	}
+}
+
+func addHistoryVersion(docPath string) (HistoryVersion, error) {
+	root, err := historyRoot()
+	if err != nil {
+		return HistoryVersion{}, err
+	}
+	content, err := os.ReadFile(docPath)
+	if err != nil {
+		return HistoryVersion{}, err
+	}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	hash, err := storeHistoryObject(root, content)
+	if err != nil {
+		return HistoryVersion{}, err
+	}
+	assets := historyAssets(root, docPath)
+	idx, err := loadHistoryIndex(root, docPath)
+	if err != nil {
+		return HistoryVersion{}, err
+	}
+	if n := len(idx.Versions); n > 0 {
+		last := idx.Versions[n-1]
+		if last.Hash == hash && reflect.DeepEqual(last.Assets, assets) {
+			return last, nil
+		}
+	}
+
+	v := HistoryVersion{ID: idx.NextID, Hash: hash, Size: int64(len(content)), SavedAt: time.Now(), Assets: assets}
+	idx.Path = docPath
+	idx.NextID++
+	idx.Versions = append(idx.Versions, v)
+	pruned := pruneHistory(&idx)
+	if err := saveHistoryIndex(root, idx); err != nil {
+		return v, err
+	}
+	if pruned {
+		collectHistoryObjects(root)
+	}
+	return v, nil
+}
+
+// pruneHistory applies the retention limits, oldest first. It reports
+// whether any version was dropped.
+func pruneHistory(idx *historyIndex) bool {
+	before := len(idx.Versions)
+	for len(idx.Versions) > HISTORY_KEEP {
+		if len(idx.Versions) <= HISTORY_MAX_VERSIONS && time.Since(idx.Versions[0].SavedAt) <= HISTORY_MAX_AGE {
+			break
+		}
+		idx.Versions = idx.Versions[1:]
+	}
+	return len(idx.Versions) != before
+}
+
+// collectHistoryObjects deletes the objects no version of any document
+// refers to anymore. Callers hold historyMu.
+func collectHistoryObjects(root string) {
+	live := make(map[string]bool)
+	indexes, _ := filepath.Glob(filepath.Join(root, "docs", "*.json"))
+	for _, path := range indexes {
+		var idx historyIndex
+		data, err := os.ReadFile(path)
+		if err != nil || json.Unmarshal(data, &idx) != nil {
+			return // Never delete on a partial view
+		}
+		for _, v := range idx.Versions {
+			live[v.Hash] = true
+			for _, a := range v.Assets {
+				live[a.Hash] = true
+			}
+		}
+	}
+	removed := 0
+	filepath.WalkDir(filepath.Join(root, "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && !live[d.Name()] {
+			if os.Remove(path) == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	if removed > 0 {
+		log.Printf("[History] Removed %d unused objects", removed)
+	}
+}
+
+// renameHistory keeps the history of documents that were moved or renamed
+// under their new path; moved maps an old path to the new one.
+func renameHistory(moved func(path string) (string, bool)) {
+	root, err := historyRoot()
+	if err != nil {
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	indexes, _ := filepath.Glob(filepath.Join(root, "docs", "*.json"))
+	for _, path := range indexes {
+		var idx historyIndex
+		data, err := os.ReadFile(path)
+		if err != nil || json.Unmarshal(data, &idx) != nil {
+			continue
+		}
+		to, ok := moved(idx.Path)
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(historyIndexPath(root, to)); err == nil {
+			continue // Never merge into the history of another document
+		}
+		idx.Path = to
+		if err := saveHistoryIndex(root, idx); err != nil {
+			log.Printf("[History] %s: %v", filepath.Base(to), err)
+			continue
+		}
+		os.Remove(path)
+	}
+}
+
+func findHistoryVersion(idx historyIndex, id int) (HistoryVersion, bool) {
+	for _, v := range idx.Versions {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return HistoryVersion{}, false
+}
+
+// historyVersionText returns a version as UTF-8 text, decoded from the
+// encoding it was saved in.
+func historyVersionText(root, docPath string, v HistoryVersion) (string, error) {
+	data, err := readHistoryObject(root, v.Hash)
+	if err != nil {
+		return "", err
+	}
+	data, _ = decodeTextDocument(data, docPath)
+	return string(data), nil
+}
+
+// historyDocumentHTML turns document text into HTML for diffing.
+func historyDocumentHTML(docPath, text string) (string, error) {
+	if ft := fileTypeForPath(docPath); ft != nil {
+		switch ft.Kind {
+		case FILE_KIND_MARKDOWN:
+			return markdownToHTML([]byte(text))
+		case FILE_KIND_HTML:
+			return text, nil
+		}
+	}
+	return "<pre>" + html.EscapeString(text) + "</pre>", nil
+}
+
+// restoreHistoryVersion writes a version back over the document, together
+// with the assets that are missing or differ. The current state is kept as
+// a version first, so a restore can be undone.
+func restoreHistoryVersion(docPath string, id int) (HistoryVersion, error) {
+	root, err := historyRoot()
+	if err != nil {
+		return HistoryVersion{}, err
+	}
+	if _, err := os.Stat(docPath); err == nil {
+		if _, err := addHistoryVersion(docPath); err != nil {
+			return HistoryVersion{}, err
+		}
+	}
+
+	historyMu.Lock()
+	idx, err := loadHistoryIndex(root, docPath)
+	v, ok := findHistoryVersion(idx, id)
+	historyMu.Unlock()
+	if err != nil {
+		return HistoryVersion{}, err
+	}
+	if !ok {
+		return HistoryVersion{}, fmt.Errorf("no version %d of %s", id, filepath.Base(docPath))
+	}
+	content, err := readHistoryObject(root, v.Hash)
+	if err != nil {
+		return HistoryVersion{}, err
+	}
+
+	dir := filepath.Dir(docPath)
+	for _, a := range v.Assets {
+		if a.Hash == "" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(a.Path))
+		if current, err := os.ReadFile(target); err == nil {
+			if sum := sha256.Sum256(current); hex.EncodeToString(sum[:]) == a.Hash {
+				continue
+			}
+		}
+		data, err := readHistoryObject(root, a.Hash)
+		if err != nil {
+			return HistoryVersion{}, fmt.Errorf("asset %s: %v", a.Path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return HistoryVersion{}, err
+		}
+		if err := os.WriteFile(target, data, 0644); err != nil {
+			return HistoryVersion{}, err
+		}
+	}
+
+	// Like saving: our own lock must not block the write
+	unlockFile(docPath)
+	if err := os.WriteFile(docPath, content, 0644); err != nil {
+		lockFile(docPath)
+		return HistoryVersion{}, fmt.Errorf("failed to write file: %v. The file might be open in another program", err)
+	}
+	return addHistoryVersion(docPath)
+}
+
+// --- Handlers ---
+
+// handleHistory serves the version history of a document:
+// GET /api/history?path= lists the versions, newest first,
+// GET /api/history/version?path=&id= returns one as text,
+// GET /api/history/diff?path=&from=&to= compares two (to empty = the file
+// on disk) and POST /api/history/restore {path, id} restores one.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && !sameOriginRequest(r) {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	root, err := historyRoot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	docPath := r.URL.Query().Get("path")
+
+	switch {
+	case r.URL.Path == "/api/history" && r.Method == "GET":
+		if docPath == "" {
+			http.Error(w, "Missing path", http.StatusBadRequest)
+			return
+		}
+		historyMu.Lock()
+		idx, err := loadHistoryIndex(root, docPath)
+		historyMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		versions := make([]HistoryVersion, 0, len(idx.Versions))
+		for i := len(idx.Versions) - 1; i >= 0; i-- {
+			versions = append(versions, idx.Versions[i])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"path": docPath, "versions": versions})
+
+	case r.URL.Path == "/api/history/version" && r.Method == "GET":
+		v, ok := historyLookup(w, root, docPath, r.URL.Query().Get("id"))
+		if !ok {
+			return
+		}
+		text, err := historyVersionText(root, docPath, v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ft := fileTypeForPath(docPath)
+		if ft == nil {
+			ft = unknownFileType
+		}
+		w.Header().Set("Content-Type", ft.contentType())
+		w.Header().Set("X-History-Version", strconv.Itoa(v.ID))
+		io.WriteString(w, text)
+
+	case r.URL.Path == "/api/history/diff" && r.Method == "GET":
+		from, ok := historyLookup(w, root, docPath, r.URL.Query().Get("from"))
+		if !ok {
+			return
+		}
+		oldText, err := historyVersionText(root, docPath, from)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var newText string
+		if toID := r.URL.Query().Get("to"); toID != "" {
+			to, ok := historyLookup(w, root, docPath, toID)
+			if !ok {
+				return
+			}
+			if newText, err = historyVersionText(root, docPath, to); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			data, err := os.ReadFile(docPath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			data, _ = decodeTextDocument(data, docPath)
+			newText = string(data)
+		}
+		oldHTML, err1 := historyDocumentHTML(docPath, oldText)
+		newHTML, err2 := historyDocumentHTML(docPath, newText)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "Failed to read the versions as HTML", http.StatusInternalServerError)
+			return
+		}
+		diff, err := diffHTML(oldHTML, newHTML)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diff)
+
+	case r.URL.Path == "/api/history/restore" && r.Method == "POST":
+		var req HistoryRestoreRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		v, err := restoreHistoryVersion(req.Path, req.ID)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"path": req.Path, "version": v})
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// historyLookup finds version id of docPath, answering the request itself
+// when it cannot.
+func historyLookup(w http.ResponseWriter, root, docPath, id string) (HistoryVersion, bool) {
+	n, err := strconv.Atoi(id)
+	if docPath == "" || err != nil {
+		http.Error(w, "Missing path or version id", http.StatusBadRequest)
+		return HistoryVersion{}, false
+	}
+	historyMu.Lock()
+	idx, err := loadHistoryIndex(root, docPath)
+	historyMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return HistoryVersion{}, false
+	}
+	v, ok := findHistoryVersion(idx, n)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No version %d", n), http.StatusNotFound)
+	}
+	return v, ok
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	DIFF_MAX_CELLS      = 4 << 20 // Largest LCS table before falling back to replace-all
+	DIFF_MIN_SIMILARITY = 0.4     // Share of equal words for a changed block to be diffed inline
+)
+
+// HTMLDiff is the body of the newer version with the changes marked in
+// place: new blocks carry class diff-added, edited ones diff-changed with
+// <del>/<ins> inside, and blocks that went are put back with diff-removed.
+// Inline content between blocks is wrapped in a span for the same classes.
+type HTMLDiff struct {
+	HTML  string        `json:"html"`
+	Stats HTMLDiffStats `json:"stats"`
+}
+
+type HTMLDiffStats struct {
+	Unchanged int `json:"unchanged"`
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Changed   int `json:"changed"`
+}
+
+// diffBlock is one unit of comparison: a block element without blocks in
+// it, or a run of inline content between blocks (Tag "").
+type diffBlock struct {
+	Tag   string
+	Nodes []*html.Node // The element, or the nodes of the run
+	HTML  string       // Rendered block, the comparison key
+	Text  string
+}
+
+var diffBlockTags = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Body: true, atom.Caption: true, atom.Dd: true, atom.Details: true,
+	atom.Div: true, atom.Dl: true, atom.Dt: true, atom.Fieldset: true,
+	atom.Figcaption: true, atom.Figure: true, atom.Footer: true, atom.Form: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.Li: true, atom.Main: true, atom.Nav: true,
+	atom.Ol: true, atom.P: true, atom.Pre: true, atom.Section: true, atom.Summary: true,
+	atom.Table: true, atom.Tbody: true, atom.Td: true, atom.Tfoot: true, atom.Th: true,
+	atom.Thead: true, atom.Tr: true, atom.Ul: true,
+}
+
+// diffHTML compares two HTML documents block by block and, inside blocks
+// that were edited, word by word.
+func diffHTML(oldHTML, newHTML string) (*HTMLDiff, error) {
+	_, oldBlocks, err := diffBlocks(oldHTML)
+	if err != nil {
+		return nil, err
+	}
+	body, newBlocks, err := diffBlocks(newHTML)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return &HTMLDiff{}, nil
+	}
+
+	ops := diffSequence(len(oldBlocks), len(newBlocks), func(i, j int) bool {
+		return oldBlocks[i].HTML == newBlocks[j].HTML
+	})
+
+	result := &HTMLDiff{}
+	var removed, added []diffBlock
+	var prev *diffBlock // Last new block before the pending changes
+	flush := func(next *diffBlock) {
+		// Pair edits of the same kind of block, in order; the rest stays
+		// a plain removal or addition
+		n := 0
+		for ; n < len(removed) && n < len(added); n++ {
+			if removed[n].Tag != added[n].Tag {
+				break
+			}
+			words, similarity := diffWords(removed[n].Text, added[n].Text)
+			if similarity < DIFF_MIN_SIMILARITY {
+				break
+			}
+			markChangedBlock(added[n], words)
+			result.Stats.Changed++
+		}
+		// Put removed blocks back next to the neighbour that shares their
+		// parent, so list items stay in lists and rows in tables
+		var after, before *html.Node
+		if n > 0 {
+			after = added[n-1].Nodes[len(added[n-1].Nodes)-1]
+		} else if prev != nil {
+			after = prev.Nodes[len(prev.Nodes)-1]
+		}
+		if len(added) > n {
+			before = added[n].Nodes[0]
+		} else if next != nil {
+			before = next.Nodes[0]
+		}
+		for _, b := range removed[n:] {
+			el := markBlock(b, "diff-removed")
+			parent := el.Parent.Data
+			el.Parent.RemoveChild(el)
+			if a := ancestorUnder(after, parent); a != nil {
+				a.Parent.InsertBefore(el, a.NextSibling)
+			} else if a := ancestorUnder(before, parent); a != nil {
+				a.Parent.InsertBefore(el, a)
+			} else if after != nil {
+				after.Parent.InsertBefore(el, after.NextSibling)
+			} else if before != nil {
+				before.Parent.InsertBefore(el, before)
+			} else {
+				body.AppendChild(el)
+			}
+			after = el
+			result.Stats.Removed++
+		}
+		for _, b := range added[n:] {
+			markBlock(b, "diff-added")
+			result.Stats.Added++
+		}
+		if len(added) > 0 {
+			prev = &added[len(added)-1]
+		}
+		removed, added = nil, nil
+	}
+	for _, op := range ops {
+		switch op.kind {
+		case diffEqual:
+			flush(&newBlocks[op.j])
+			prev = &newBlocks[op.j]
+			result.Stats.Unchanged++
+		case diffDelete:
+			removed = append(removed, oldBlocks[op.i])
+		case diffInsert:
+			added = append(added, newBlocks[op.j])
+		}
+	}
+	flush(nil)
+
+	var buf bytes.Buffer
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		html.Render(&buf, c)
+	}
+	result.HTML = buf.String()
+	return result, nil
+}
+
+// diffBlocks parses a document into its body and its blocks in reading
+// order.
+func diffBlocks(src string) (*html.Node, []diffBlock, error) {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return nil, nil, err
+	}
+	body := findElement(doc, atom.Body)
+	if body == nil {
+		return nil, nil, nil
+	}
+	var blocks []diffBlock
+	var run []*html.Node
+	flushRun := func() {
+		var buf, text bytes.Buffer
+		content := false
+		for _, n := range run {
+			html.Render(&buf, n)
+			text.WriteString(nodeText(n))
+			if n.Type == html.ElementNode {
+				content = true
+			}
+		}
+		if content || strings.TrimSpace(text.String()) != "" {
+			blocks = append(blocks, diffBlock{Nodes: run, HTML: buf.String(), Text: text.String()})
+		}
+		run = nil
+	}
+	var walk func(parent *html.Node)
+	walk = func(parent *html.Node) {
+		for c := parent.FirstChild; c != nil; c = c.NextSibling {
+			switch {
+			case c.Type == html.ElementNode && (c.DataAtom == atom.Script || c.DataAtom == atom.Style):
+			case c.Type == html.ElementNode && diffBlockTags[c.DataAtom]:
+				flushRun()
+				if hasBlockDescendant(c) {
+					walk(c)
+					flushRun()
+					continue
+				}
+				var buf bytes.Buffer
+				html.Render(&buf, c)
+				blocks = append(blocks, diffBlock{Tag: c.Data, Nodes: []*html.Node{c}, HTML: buf.String(), Text: nodeText(c)})
+			case c.Type == html.ElementNode || c.Type == html.TextNode:
+				run = append(run, c)
+			}
+		}
+	}
+	walk(body)
+	flushRun()
+	return body, blocks, nil
+}
+
+func hasBlockDescendant(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && (diffBlockTags[c.DataAtom] || hasBlockDescendant(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ancestorUnder returns n or its closest ancestor whose parent is a tag
+// element, nil if there is none.
+func ancestorUnder(n *html.Node, tag string) *html.Node {
+	for ; n != nil && n.Parent != nil; n = n.Parent {
+		if n.Parent.Type == html.ElementNode && n.Parent.Data == tag {
+			return n
+		}
+	}
+	return nil
+}
+
+// markBlock adds class to a block element, or wraps a run of inline content
+// in a span carrying it, and returns the element.
+func markBlock(b diffBlock, class string) *html.Node {
+	if b.Tag != "" {
+		el := b.Nodes[0]
+		for i, a := range el.Attr {
+			if a.Key == "class" && a.Namespace == "" {
+				el.Attr[i].Val = strings.TrimSpace(a.Val + " " + class)
+				return el
+			}
+		}
+		el.Attr = append(el.Attr, html.Attribute{Key: "class", Val: class})
+		return el
+	}
+	span := &html.Node{Type: html.ElementNode, DataAtom: atom.Span, Data: "span",
+		Attr: []html.Attribute{{Key: "class", Val: class}}}
+	b.Nodes[0].Parent.InsertBefore(span, b.Nodes[0])
+	for _, n := range b.Nodes {
+		n.Parent.RemoveChild(n)
+		span.AppendChild(n)
+	}
+	return span
+}
+
+// markChangedBlock replaces the content of a block with the word diff.
+// Inline formatting inside the block is not kept; the diff is of its text.
+func markChangedBlock(b diffBlock, words string) {
+	el := markBlock(b, "diff-changed")
+	for el.FirstChild != nil {
+		el.RemoveChild(el.FirstChild)
+	}
+	el.AppendChild(&html.Node{Type: html.RawNode, Data: words})
+}
+
+// splitDiffWords cuts s into runs of whitespace and words. Chinese,
+// Japanese and Korean text is written without spaces, so each of those
+// characters is a word of its own, as for the search index.
+func splitDiffWords(s string) []string {
+	var out []string
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		start := i
+		i += size
+		if isCJK(r) {
+			out = append(out, s[start:i])
+			continue
+		}
+		space := unicode.IsSpace(r)
+		for i < len(s) {
+			r, size = utf8.DecodeRuneInString(s[i:])
+			if unicode.IsSpace(r) != space || isCJK(r) {
+				break
+			}
+			i += size
+		}
+		out = append(out, s[start:i])
+	}
+	return out
+}
+
+// diffWords marks up the word changes from oldText to newText and returns
+// the share of words left as they were.
+func diffWords(oldText, newText string) (string, float64) {
+	a := splitDiffWords(oldText)
+	b := splitDiffWords(newText)
+	ops := diffSequence(len(a), len(b), func(i, j int) bool { return a[i] == b[j] })
+
+	var out strings.Builder
+	equal, words := 0, 0
+	var del, ins strings.Builder
+	flush := func() {
+		if del.Len() > 0 {
+			out.WriteString("<del>" + html.EscapeString(del.String()) + "</del>")
+		}
+		if ins.Len() > 0 {
+			out.WriteString("<ins>" + html.EscapeString(ins.String()) + "</ins>")
+		}
+		del.Reset()
+		ins.Reset()
+	}
+	for _, op := range ops {
+		switch op.kind {
+		case diffEqual:
+			flush()
+			out.WriteString(html.EscapeString(a[op.i]))
+			if strings.TrimSpace(a[op.i]) != "" {
+				equal++
+				words++
+			}
+		case diffDelete:
+			del.WriteString(a[op.i])
+			if strings.TrimSpace(a[op.i]) != "" {
+				words++
+			}
+		case diffInsert:
+			ins.WriteString(b[op.j])
+		}
+	}
+	flush()
+	if n := len(strings.Fields(newText)); n > words {
+		words = n
+	}
+	if words == 0 {
+		return out.String(), 1
+	}
+	return out.String(), float64(equal) / float64(words)
+}
+
+type diffOpKind int
+
+const (
+	diffEqual diffOpKind = iota
+	diffDelete
+	diffInsert
+)
+
+type diffOp struct {
+	kind diffOpKind
+	i, j int // Index into the old and the new sequence
+}
+
+// diffSequence returns the edit script from a sequence of length n to one
+// of length m by longest common subsequence, deletions before insertions.
+// The common head and tail are matched first; when the rest is too large
+// for the table it is replaced as a whole.
+func diffSequence(n, m int, equal func(i, j int) bool) []diffOp {
+	var ops []diffOp
+	start := 0
+	for start < n && start < m && equal(start, start) {
+		ops = append(ops, diffOp{diffEqual, start, start})
+		start++
+	}
+	endN, endM := n, m
+	for endN > start && endM > start && equal(endN-1, endM-1) {
+		endN--
+		endM--
+	}
+
+	rows, cols := endN-start, endM-start
+	if rows*cols > DIFF_MAX_CELLS {
+		for i := start; i < endN; i++ {
+			ops = append(ops, diffOp{diffDelete, i, 0})
+		}
+		for j := start; j < endM; j++ {
+			ops = append(ops, diffOp{diffInsert, 0, j})
+		}
+	} else {
+		// lcs[i][j] is the LCS length of old[start+i:endN] and new[start+j:endM]
+		lcs := make([][]int32, rows+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, cols+1)
+		}
+		for i := rows - 1; i >= 0; i-- {
+			for j := cols - 1; j >= 0; j-- {
+				if equal(start+i, start+j) {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		var pendingDel, pendingIns []diffOp
+		emit := func() {
+			ops = append(ops, pendingDel...)
+			ops = append(ops, pendingIns...)
+			pendingDel, pendingIns = nil, nil
+		}
+		for i < rows || j < cols {
+			switch {
+			case i < rows && j < cols && equal(start+i, start+j):
+				emit()
+				ops = append(ops, diffOp{diffEqual, start + i, start + j})
+				i++
+				j++
+			case j == cols || (i < rows && lcs[i+1][j] >= lcs[i][j+1]):
+				pendingDel = append(pendingDel, diffOp{diffDelete, start + i, 0})
+				i++
+			default:
+				pendingIns = append(pendingIns, diffOp{diffInsert, 0, start + j})
+				j++
+			}
+		}
+		emit()
+	}
+
+	for k := 0; endN+k < n; k++ {
+		ops = append(ops, diffOp{diffEqual, endN + k, endM + k})
+	}
+	return ops
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	IMAGE_DEFAULT_QUALITY = 85
+	IMAGE_MAX_UPLOAD      = 64 << 20 // Largest image accepted by /api/images/optimize
+)
+
+// ImageOptions configures the optimization pipeline. The global defaults
+// live in the settings ("images"); a save request may override them for its
+// document with an imageOptions form field.
+type ImageOptions struct {
+	Enabled      bool `json:"enabled"`
+	MaxDimension int  `json:"maxDimension"` // Longest side in pixels, 0 = keep size
+	Quality      int  `json:"quality"`      // JPEG quality 1-100, 0 = IMAGE_DEFAULT_QUALITY
+}
+
+// ImageReport sums up what the pipeline saved over a batch of images.
+type ImageReport struct {
+	Images         int   `json:"images"`
+	Optimized      int   `json:"optimized"`
+	OriginalBytes  int64 `json:"originalBytes"`
+	OptimizedBytes int64 `json:"optimizedBytes"`
+}
+
+func (r *ImageReport) add(before, after int) {
+	r.Images++
+	if after < before {
+		r.Optimized++
+	}
+	r.OriginalBytes += int64(before)
+	r.OptimizedBytes += int64(after)
+}
+
+func mergeImageReport(dst, src *ImageReport) {
+	if dst == nil {
+		return
+	}
+	dst.Images += src.Images
+	dst.Optimized += src.Optimized
+	dst.OriginalBytes += src.OriginalBytes
+	dst.OptimizedBytes += src.OptimizedBytes
+}
+
+// globalImageOptions returns the configured defaults.
+func globalImageOptions() ImageOptions {
+	return loadSettings().Images
+}
+
+// imageOptionsFor merges a per-document override (JSON, may be empty) over
+// the global defaults.
+func imageOptionsFor(override string) (ImageOptions, error) {
+	opts := globalImageOptions()
+	if override != "" {
+		if err := json.Unmarshal([]byte(override), &opts); err != nil {
+			return opts, fmt.Errorf("invalid imageOptions: %v", err)
+		}
+	}
+	return opts, nil
+}
+
+// optimizeImage downscales, re-orients and re-encodes an image, dropping
+// EXIF/GPS and text metadata. PNG stays lossless; JPEG and WebP photos are
+// written as JPEG (there is no pure-Go WebP encoder). When re-encoding
+// would not shrink the file, the original minus its metadata is returned; an
+// empty media type means the data is not an image this pipeline handles.
+func optimizeImage(data []byte, opts ImageOptions) ([]byte, string) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return data, ""
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	maxDim := opts.MaxDimension
+	resize := maxDim > 0 && (cfg.Width > maxDim || cfg.Height > maxDim)
+
+	switch format {
+	case "jpeg", "png", "webp", "bmp":
+	default:
+		return data, mediaTypeForFormat(format) // GIF may be animated, leave it
+	}
+
+	// Lossless metadata removal is enough when the pixels stay as they are
+	best, bestType := data, mediaTypeForFormat(format)
+	if format == "jpeg" && orientation == 1 {
+		best = stripJPEGMetadata(data)
+	} else if format == "png" {
+		best = stripPNGMetadata(data)
+	}
+	mustReencode := resize || orientation > 1 || format == "bmp"
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return best, bestType
+	}
+	img = applyOrientation(img, orientation)
+	if resize {
+		img = downscale(img, maxDim)
+	}
+
+	var buf bytes.Buffer
+	outType := "image/png"
+	if (format == "jpeg" || format == "webp") && isOpaque(img) {
+		quality := opts.Quality
+		if quality <= 0 || quality > 100 {
+			quality = IMAGE_DEFAULT_QUALITY
+		}
+		outType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	if err != nil {
+		return best, bestType
+	}
+	if mustReencode || buf.Len() < len(best) {
+		return buf.Bytes(), outType
+	}
+	return best, bestType
+}
+
+func mediaTypeForFormat(format string) string {
+	switch format {
+	case "jpeg":
+		return "image/jpeg"
+	case "png":
+		return "image/png"
+	case "gif":
+		return "image/gif"
+	case "webp":
+		return "image/webp"
+	case "bmp":
+		return "image/bmp"
+	}
+	return ""
+}
+
+// downscale fits img into maxDim x maxDim, keeping the aspect ratio.
+func downscale(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w >= h {
+		h = max(1, h*maxDim/w)
+		w = maxDim
+	} else {
+		w = max(1, w*maxDim/h)
+		h = maxDim
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// applyOrientation turns pixels upright for EXIF orientations 2-8.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	swap := orientation >= 5
+	dw, dh := w, h
+	if swap {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Rotated 90 CW
+				dx, dy = h-1-y, x
+			case 7: // Transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90 CCW
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)))
+		}
+	}
+	return dst
+}
+
+// jpegSegments calls fn for each marker segment before the image data.
+func jpegSegments(data []byte, fn func(marker byte, start, end int) bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 { // Start of scan / end of image
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return
+		}
+		if !fn(marker, i, end) {
+			return
+		}
+		i = end
+	}
+}
+
+// jpegOrientation reads the EXIF orientation tag (1 when absent).
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	jpegSegments(data, func(marker byte, start, end int) bool {
+		seg := data[start+4 : end]
+		if marker != 0xE1 || len(seg) < 14 || string(seg[:6]) != "Exif\x00\x00" {
+			return true
+		}
+		tiff := seg[6:]
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return false
+		}
+		ifd := int(order.Uint32(tiff[4:]))
+		if ifd+2 > len(tiff) {
+			return false
+		}
+		count := int(order.Uint16(tiff[ifd:]))
+		for n := 0; n < count; n++ {
+			entry := ifd + 2 + n*12
+			if entry+12 > len(tiff) {
+				break
+			}
+			if order.Uint16(tiff[entry:]) == 0x0112 {
+				orientation = int(order.Uint16(tiff[entry+8:]))
+				break
+			}
+		}
+		return false
+	})
+	return orientation
+}
+
+// stripJPEGMetadata drops EXIF/XMP (APP1), IPTC (APP13) and comments while
+// keeping JFIF and the ICC profile, without touching the image data.
+func stripJPEGMetadata(data []byte) []byte {
+	var out bytes.Buffer
+	last := 2
+	kept := false
+	out.Write(data[:2])
+	jpegSegments(data, func(marker byte, start, end int) bool {
+		if marker == 0xE1 || marker == 0xED || marker == 0xFE {
+			kept = true
+		} else {
+			out.Write(data[start:end])
+		}
+		last = end
+		return true
+	})
+	if !kept || last <= 2 {
+		return data
+	}
+	out.Write(data[last:])
+	return out.Bytes()
+}
+
+// stripPNGMetadata drops eXIf and text chunks.
+func stripPNGMetadata(data []byte) []byte {
+	const sig = "\x89PNG\r\n\x1a\n"
+	if len(data) < 8 || string(data[:8]) != sig {
+		return data
+	}
+	var out bytes.Buffer
+	out.WriteString(sig)
+	dropped := false
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if end > len(data) || length < 0 {
+			return data
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "iTXt", "zTXt", "tIME":
+			dropped = true
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	if !dropped {
+		return data
+	}
+	return out.Bytes()
+}
+
+// optimizeDataURI runs a data: image URI through the pipeline.
+func optimizeDataURI(uri string, opts ImageOptions, report *ImageReport) string {
+	mediaType, data, err := decodeDataURI(uri)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return uri
+	}
+	out, outType := optimizeImage(data, opts)
+	if outType == "" {
+		return uri
+	}
+	report.add(len(data), len(out))
+	return fmt.Sprintf("data:%s;base64,%s", outType, base64.StdEncoding.EncodeToString(out))
+}
+
+// optimizeInlineImages runs every data: image of an HTML document through
+// the pipeline.
+func optimizeInlineImages(htmlContent string, opts ImageOptions, report *ImageReport) string {
+	a := &assetRewriter{
+		mapRef: func(ref string) (string, bool) {
+			if !strings.HasPrefix(ref, "data:image/") {
+				return "", false
+			}
+			return optimizeDataURI(ref, opts, report), true
+		},
+	}
+	return a.rewriteHTML(htmlContent)
+}
+
+// optimizeInlineImagesInText does the same for Markdown source.
+func optimizeInlineImagesInText(text string, opts ImageOptions, report *ImageReport) string {
+	return dataImageRe.ReplaceAllStringFunc(text, func(uri string) string {
+		return optimizeDataURI(uri, opts, report)
+	})
+}
+
+// imageReportLog logs the result of a batch once.
+func imageReportLog(what string, report *ImageReport) {
+	if report.Images == 0 {
+		return
+	}
+	log.Printf("[Images] %s: %d of %d images optimized, %d -> %d bytes", what, report.Optimized, report.Images, report.OriginalBytes, report.OptimizedBytes)
+}
+
+// handleImageOptimize optimizes a single image posted as the request body,
+// e.g. when it is pasted or inserted into the editor. Options come from the
+// query (maxDimension, quality) on top of the global defaults; the response
+// carries the new bytes and the size before and after in headers.
+func handleImageOptimize(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, IMAGE_MAX_UPLOAD+1))
+	if err != nil || len(data) == 0 || len(data) > IMAGE_MAX_UPLOAD {
+		http.Error(w, "Invalid image body", http.StatusBadRequest)
+		return
+	}
+
+	opts := globalImageOptions()
+	opts.Enabled = true
+	q := r.URL.Query()
+	fmt.Sscan(q.Get("maxDimension"), &opts.MaxDimension)
+	fmt.Sscan(q.Get("quality"), &opts.Quality)
+
+	out, outType := optimizeImage(data, opts)
+	if outType == "" {
+		http.Error(w, "Unsupported image type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", outType)
+	w.Header().Set("X-Original-Size", fmt.Sprint(len(data)))
+	w.Header().Set("X-Optimized-Size", fmt.Sprint(len(out)))
+	w.Write(out)
+}
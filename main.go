@@ -4,7 +4,6 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"crypto/rand"
 	"embed"
 	"encoding/base64"
@@ -20,7 +19,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strings"
 	"sync"
@@ -28,8 +26,6 @@ import (
 	"time"
 	"unsafe"
 
-	"github.com/chromedp/cdproto/page"
-	"github.com/chromedp/chromedp"
 )
 
 //go:embed dist
@@ -89,8 +85,12 @@ const (
 	NIF_TIP     = 0x00000004
 
 	MF_STRING    = 0x00000000
+	MF_GRAYED    = 0x00000001
+	MF_POPUP     = 0x00000010
 	MF_SEPARATOR = 0x00000800
 
+	TRAY_RECENT_BASE = 100 // Menu IDs of the recent documents
+
 	TPM_RETURNCMD   = 0x0100
 	TPM_RIGHTBUTTON = 0x0002
 
@@ -143,22 +143,47 @@ type MSG struct {
 
 type FileData struct {
 	FileName string `json:"fileName"`
-	Data     string `json:"data"` // Base64 encoded content (only for CLI Handover/Initial Load)
+	Data     string `json:"data"`               // Base64 encoded content (only for CLI Handover/Initial Load)
+	MimeType string `json:"mimeType,omitempty"` // Detected when the file was read
 }
 
 type ScreenshotRequest struct {
-	Html  string `json:"html"`
-	Width int    `json:"width"`
+	Html         string `json:"html"`
+	Width        int    `json:"width"`
+	Format       string `json:"format"`       // "" = complete editor page, "html" or "markdown" = wrap in render template
+	SourcePath   string `json:"sourcePath"`   // Export a document from disk instead of Html
+	ReadyTimeout int    `json:"readyTimeout"` // Max wait for render readiness in ms (0 = default)
 }
 
 type PdfExportRequest struct {
-	Html  string  `json:"html"`
-	Path  string  `json:"path"`
-	Scale float64 `json:"scale"` // Scale factor (e.g., 1.0 for 100%)
+	Html         string  `json:"html"`
+	Path         string  `json:"path"`
+	Scale        float64 `json:"scale"`        // Scale factor (e.g., 1.0 for 100%)
+	Format       string  `json:"format"`       // "" = complete editor page, "html" or "markdown" = wrap in render template
+	SourcePath   string  `json:"sourcePath"`   // Export a document from disk instead of Html
+	ReadyTimeout int     `json:"readyTimeout"` // Max wait for render readiness in ms (0 = default)
+}
+
+type ArchiveExportRequest struct {
+	Html       string `json:"html"`
+	Path       string `json:"path"`
+	Format     string `json:"format"`     // "" = complete editor page, "html" or "markdown" = wrap in render template
+	SourcePath string `json:"sourcePath"` // Export a document from disk instead of Html
+}
+
+type DocxExportRequest struct {
+	Html         string `json:"html"`
+	Path         string `json:"path"`
+	Format       string `json:"format"`       // "" = complete editor page, "html" or "markdown" = wrap in render template
+	SourcePath   string `json:"sourcePath"`   // Export a document from disk instead of Html
+	DocumentPath string `json:"documentPath"` // Path of the open document, for images relative to it
 }
 
 type DialogResponse struct {
-	Path string `json:"path"`
+	Path    string           `json:"path"`
+	AssetGC *AssetGCReport   `json:"assetGC,omitempty"` // Set by save-file when assetGC was requested
+	Images  *ImageReport     `json:"images,omitempty"`  // Set by save-file when images were optimized
+	Git     *GitCommitResult `json:"git,omitempty"`     // Set by save-file when gitCommit was given
 }
 
 type LockRequest struct {
@@ -196,6 +221,13 @@ var (
 
 	moduser32               = syscall.NewLazyDLL("user32.dll")
 	procGetForegroundWindow = moduser32.NewProc("GetForegroundWindow")
+
+	procSHBrowseForFolder   = shell32.NewProc("SHBrowseForFolderW")
+	procSHGetPathFromIDList = shell32.NewProc("SHGetPathFromIDListW")
+	modole32                = syscall.NewLazyDLL("ole32.dll")
+	procCoInitializeEx      = modole32.NewProc("CoInitializeEx")
+	procCoUninitialize      = modole32.NewProc("CoUninitialize")
+	procCoTaskMemFree       = modole32.NewProc("CoTaskMemFree")
 )
 
 type OPENFILENAME struct {
@@ -224,6 +256,23 @@ type OPENFILENAME struct {
 	FlagsEx           uint32
 }
 
+type BROWSEINFO struct {
+	hwndOwner      uintptr
+	pidlRoot       uintptr
+	pszDisplayName *uint16
+	lpszTitle      *uint16
+	ulFlags        uint32
+	lpfn           uintptr
+	lParam         uintptr
+	iImage         int32
+}
+
+const (
+	BIF_RETURNONLYFSDIRS     = 0x00000001
+	BIF_NEWDIALOGSTYLE       = 0x00000040
+	COINIT_APARTMENTTHREADED = 0x2
+)
+
 const (
 	OFN_FILEMUSTEXIST   = 0x00001000
 	OFN_PATHMUSTEXIST   = 0x00000800
@@ -249,8 +298,8 @@ func getNativeOpenDialog() (string, error) {
 	ofn.lpstrFile = &buf[0]
 	ofn.nMaxFile = uint32(len(buf))
 
-	// Strict Filters: Added images to supported files
-	filter := "Supported Files\x00*.html;*.htm;*.docx;*.pdf;*.md;*.markdown;*.txt;*.png;*.jpg;*.jpeg;*.webp;*.bmp\x00HTML Files (*.html;*.htm)\x00*.html;*.htm\x00Word Documents (*.docx)\x00*.docx\x00PDF Files (*.pdf)\x00*.pdf\x00Image Files\x00*.png;*.jpg;*.jpeg;*.webp;*.bmp\x00Markdown Files (*.md)\x00*.md\x00Text Files (*.txt)\x00*.txt\x00\x00"
+	// Strict Filters: built from the file type registry
+	filter := openDialogFilter()
 
 	ofn.lpstrFilter = utf16PtrFromString(filter)
 	ofn.nFilterIndex = 1
@@ -265,6 +314,36 @@ func getNativeOpenDialog() (string, error) {
 	return syscall.UTF16ToString(buf), nil
 }
 
+// getNativeFolderDialog asks for a folder, for the workspace.
+func getNativeFolderDialog() (string, error) {
+	// The resizable dialog needs COM on the calling thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	procCoInitializeEx.Call(0, COINIT_APARTMENTTHREADED)
+	defer procCoUninitialize.Call()
+
+	var bi BROWSEINFO
+	hwnd, _, _ := procGetForegroundWindow.Call()
+	bi.hwndOwner = hwnd
+	name := make([]uint16, 260)
+	bi.pszDisplayName = &name[0]
+	bi.lpszTitle = utf16PtrFromString("Open Folder as Workspace")
+	bi.ulFlags = BIF_RETURNONLYFSDIRS | BIF_NEWDIALOGSTYLE
+
+	pidl, _, _ := procSHBrowseForFolder.Call(uintptr(unsafe.Pointer(&bi)))
+	if pidl == 0 {
+		return "", fmt.Errorf("cancelled")
+	}
+	defer procCoTaskMemFree.Call(pidl)
+
+	buf := make([]uint16, 4096)
+	ret, _, _ := procSHGetPathFromIDList.Call(pidl, uintptr(unsafe.Pointer(&buf[0])))
+	if ret == 0 {
+		return "", fmt.Errorf("not a file system folder")
+	}
+	return syscall.UTF16ToString(buf), nil
+}
+
 func getNativeSaveDialog(filterType string) (string, error) {
 	var ofn OPENFILENAME
 	ofn.lStructSize = uint32(unsafe.Sizeof(ofn))
@@ -287,6 +366,9 @@ func getNativeSaveDialog(filterType string) (string, error) {
 	} else if filterType == "md" {
 		filter = "Markdown Files (*.md)\x00*.md\x00\x00"
 		defExt = "md"
+	} else if filterType == "mhtml" {
+		filter = "Web Archives (*.mhtml)\x00*.mhtml\x00\x00"
+		defExt = "mhtml"
 	} else {
 		filter = "HTML Files (*.html)\x00*.html\x00\x00"
 		defExt = "html"
@@ -367,6 +449,15 @@ func encodeHeaderValue(s string) string {
 }
 
 func main() {
+	targetUrl := fmt.Sprintf("http://127.0.0.1:%d", APP_PORT)
+	globalTargetUrl = targetUrl
+
+	// Headless export from the command line (no editor window). Runs before
+	// the console is hidden so errors and usage stay visible.
+	if len(os.Args) > 1 && os.Args[1] == "--export" {
+		os.Exit(runCLIExport(os.Args[2:]))
+	}
+
 	// 1. Hide Console on Windows Start
 	if runtime.GOOS == "windows" {
 		hwnd, _, _ := procGetConsoleWindow.Call()
@@ -375,9 +466,6 @@ func main() {
 		}
 	}
 
-	targetUrl := fmt.Sprintf("http://127.0.0.1:%d", APP_PORT)
-	globalTargetUrl = targetUrl
-
 	// 2. Try to Listen on Fixed Port
 	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", APP_PORT))
 
@@ -393,6 +481,7 @@ func main() {
 					payload := FileData{
 						FileName: absPath,
 						Data:     base64.StdEncoding.EncodeToString(content),
+						MimeType: detectFileType(absPath, content).MimeType,
 					}
 					jsonData, _ := json.Marshal(payload)
 
@@ -420,20 +509,15 @@ func main() {
 
 		if info, err := os.Stat(absPath); err == nil && !info.IsDir() {
 			// Note: We do NOT lock initially. File starts clean/unlocked.
+			// Local assets are resolved when the editor opens the file
 			content, err := os.ReadFile(absPath)
 			if err == nil {
-				finalContent := content
-				ext := strings.ToLower(filepath.Ext(absPath))
-				if ext == ".html" || ext == ".htm" {
-					processed := inlineLocalImages(string(content), absPath)
-					finalContent = []byte(processed)
-				}
-
 				initialID = generateID()
 				fileStoreMu.Lock()
 				fileStore[initialID] = FileData{
 					FileName: absPath,
-					Data:     base64.StdEncoding.EncodeToString(finalContent),
+					Data:     base64.StdEncoding.EncodeToString(content),
+					MimeType: detectFileType(absPath, content).MimeType,
 				}
 				fileStoreMu.Unlock()
 			}
@@ -448,7 +532,7 @@ func main() {
 	// Setup Routes
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
 		if r.Method == "OPTIONS" {
@@ -497,6 +581,17 @@ func main() {
 			return
 		}
 
+		if r.URL.Path == "/api/dialog/folder" {
+			path, err := getNativeFolderDialog()
+			w.Header().Set("Content-Type", "application/json")
+			if err != nil {
+				json.NewEncoder(w).Encode(DialogResponse{Path: ""})
+				return
+			}
+			json.NewEncoder(w).Encode(DialogResponse{Path: path})
+			return
+		}
+
 		if r.URL.Path == "/api/dialog/save" {
 			// Read filter param from URL
 			filter := r.URL.Query().Get("filter")
@@ -517,16 +612,8 @@ func main() {
 				return
 			}
 
-			dataBytes, err := base64.StdEncoding.DecodeString(payload.Data)
-			if err == nil {
-				ext := strings.ToLower(filepath.Ext(payload.FileName))
-				if ext == ".html" || ext == ".htm" {
-					processed := inlineLocalImages(string(dataBytes), payload.FileName)
-					payload.Data = base64.StdEncoding.EncodeToString([]byte(processed))
-				}
-			}
-
-			// Handover does not automatically lock.
+			// Handover does not automatically lock. Local assets are resolved
+			// when the editor opens the file.
 			newID := generateID()
 			fileStoreMu.Lock()
 			fileStore[newID] = payload
@@ -544,6 +631,7 @@ func main() {
 		// Open File Endpoint - Returns Binary Stream
 		if r.URL.Path == "/api/open-file" {
 			paths := r.URL.Query()["path"]
+			assetMode := r.URL.Query().Get("assets")
 			
 			// 1. Handle Path Query (Direct Disk Access)
 			if len(paths) > 0 {
@@ -559,29 +647,40 @@ func main() {
 					return
 				}
 
+				// Text documents are served as UTF-8 whatever they were saved in
+				ft := detectFileType(filePath, content)
+				if ft.Text {
+					var detected string
+					content, detected = decodeText(content, ft.Kind == FILE_KIND_HTML)
+					w.Header().Set("X-Detected-Encoding", detected)
+				}
+
 				finalContent := content
-				ext := strings.ToLower(filepath.Ext(filePath))
-				mimeType := "application/octet-stream"
-
-				if ext == ".html" || ext == ".htm" {
-					mimeType = "text/html"
-					processed := inlineLocalImages(string(content), filePath)
-					finalContent = []byte(processed)
-				} else if ext == ".pdf" {
-					mimeType = "application/pdf"
-				} else if ext == ".docx" {
-					mimeType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
-				} else if ext == ".png" {
-					mimeType = "image/png"
-				} else if ext == ".jpg" || ext == ".jpeg" {
-					mimeType = "image/jpeg"
-				} else if ext == ".webp" {
-					mimeType = "image/webp"
-				} else if ext == ".bmp" {
-					mimeType = "image/bmp"
+				mimeType := ft.contentType()
+				if ft.Kind == FILE_KIND_HTML {
+					finalContent = []byte(resolveLocalAssets(string(content), filePath, assetMode))
 				}
 
+				// Optional backend conversion to editor HTML
+				if r.URL.Query().Get("convert") == "html" || alwaysConvertForEditor(ft) {
+					converted, from, ok, err := convertForEditor(content, ft, filePath, assetMode, r.URL.Query().Get("ocr") == "1")
+					if err != nil {
+						http.Error(w, fmt.Sprintf("Failed to convert file: %v", err), http.StatusInternalServerError)
+						return
+					}
+					if ok {
+						finalContent = converted
+						mimeType = "text/html; charset=utf-8"
+						w.Header().Set("X-Converted-From", from)
+					}
+				}
+
+				if assetMode == ASSET_MODE_LAZY {
+					w.Header().Set("X-Doc-Id", registerDocument(filePath))
+				}
+				recordRecent(filePath, false)
 				w.Header().Set("Content-Type", mimeType)
+				w.Header().Set("X-File-Kind", ft.Kind)
 				// FIX: Encoding filename/path headers to prevent garbled text with Chinese characters
 				w.Header().Set("X-File-Name", encodeHeaderValue(filepath.Base(filePath)))
 				w.Header().Set("X-File-Path", encodeHeaderValue(filePath))
@@ -608,14 +707,42 @@ func main() {
 					http.Error(w, "Failed to decode stored file", http.StatusInternalServerError)
 					return
 				}
-				
-				ext := strings.ToLower(filepath.Ext(data.FileName))
-				mimeType := "application/octet-stream"
-				if ext == ".html" || ext == ".htm" {
-					mimeType = "text/html"
+				ft := fileTypeForMime(data.MimeType)
+				if ft == nil {
+					ft = detectFileType(data.FileName, decoded)
+				}
+				if ft.Text {
+					var detected string
+					decoded, detected = decodeText(decoded, ft.Kind == FILE_KIND_HTML)
+					w.Header().Set("X-Detected-Encoding", detected)
+				}
+
+				source := decoded
+				mimeType := ft.contentType()
+				if ft.Kind == FILE_KIND_HTML {
+					decoded = []byte(resolveLocalAssets(string(decoded), data.FileName, assetMode))
 				}
 
+				if r.URL.Query().Get("convert") == "html" || alwaysConvertForEditor(ft) {
+					converted, from, ok, err := convertForEditor(source, ft, data.FileName, assetMode, r.URL.Query().Get("ocr") == "1")
+					if err != nil {
+						http.Error(w, fmt.Sprintf("Failed to convert file: %v", err), http.StatusInternalServerError)
+						return
+					}
+					if ok {
+						decoded = converted
+						mimeType = "text/html; charset=utf-8"
+						w.Header().Set("X-Converted-From", from)
+					}
+				}
+
+				if assetMode == ASSET_MODE_LAZY {
+					w.Header().Set("X-Doc-Id", registerDocument(data.FileName))
+				}
+				// CLI start, handover and the tray menu arrive here
+				recordRecent(data.FileName, false)
 				w.Header().Set("Content-Type", mimeType)
+				w.Header().Set("X-File-Kind", ft.Kind)
 				// FIX: Encoding filename/path headers
 				w.Header().Set("X-File-Name", encodeHeaderValue(filepath.Base(data.FileName)))
 				w.Header().Set("X-File-Path", encodeHeaderValue(data.FileName))
@@ -627,19 +754,28 @@ func main() {
 			return
 		}
 
-		if r.URL.Path == "/api/render-view" {
-			token := r.URL.Query().Get("token")
-			renderStoreMu.RLock()
-			html, ok := renderStore[token]
-			renderStoreMu.RUnlock()
+		if r.URL.Path == "/api/asset" {
+			handleAsset(w, r)
+			return
+		}
 
-			if !ok {
-				http.NotFound(w, r)
-				return
-			}
+		if r.URL.Path == "/api/images/optimize" && r.Method == "POST" {
+			handleImageOptimize(w, r)
+			return
+		}
+
+		if r.URL.Path == "/api/assets/gc" {
+			handleAssetGC(w, r)
+			return
+		}
+
+		if r.URL.Path == "/api/diagnostics/browser" {
+			handleBrowserDiagnostics(w, r)
+			return
+		}
 
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.Write([]byte(html))
+		if r.URL.Path == "/api/render-view" {
+			handleRenderView(w, r)
 			return
 		}
 
@@ -650,58 +786,28 @@ func main() {
 				return
 			}
 
-			if req.Html == "" {
-				http.Error(w, "HTML content is empty", http.StatusBadRequest)
+			pageHTML, err := resolveExportHTML(req.Html, req.Format, req.SourcePath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			token := generateID()
-			renderStoreMu.Lock()
-			renderStore[token] = req.Html
-			renderStoreMu.Unlock()
-
-			defer func() {
-				renderStoreMu.Lock()
-				delete(renderStore, token)
-				renderStoreMu.Unlock()
-			}()
-
-			renderURL := fmt.Sprintf("http://127.0.0.1:%d/api/render-view?token=%s", APP_PORT, token)
-
-			opts := append(chromedp.DefaultExecAllocatorOptions[:],
-				chromedp.NoFirstRun,
-				chromedp.Headless,
-				chromedp.DisableGPU,
-				chromedp.IgnoreCertErrors,
-			)
-
-			if browserPath := findBrowserPath(); browserPath != "" {
-				opts = append(opts, chromedp.ExecPath(browserPath))
+			exporter := selectExporter()
+			buf, err := exporter.Screenshot(pageHTML, ExportOptions{
+				Width:      req.Width,
+				ReadyBound: renderReadyBound(req.ReadyTimeout),
+			})
+			if err == errExportUnsupported {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+				return
 			}
-
-			allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
-			defer cancel()
-
-			ctx, cancel := context.WithTimeout(allocCtx, 30*time.Second)
-			defer cancel()
-
-			ctx, cancel = chromedp.NewContext(ctx)
-			defer cancel()
-
-			var buf []byte
-
-			if err := chromedp.Run(ctx,
-				chromedp.EmulateViewport(int64(req.Width), 1, chromedp.EmulateScale(3.0)),
-				chromedp.Navigate(renderURL),
-				chromedp.WaitVisible(".ProseMirror", chromedp.ByQuery),
-				chromedp.Sleep(500*time.Millisecond),
-				chromedp.FullScreenshot(&buf, 100),
-			); err != nil {
-				log.Println("Error taking screenshot:", err)
-				http.Error(w, "Chromedp Error: "+err.Error(), http.StatusInternalServerError)
+			if err != nil {
+				log.Printf("Error taking screenshot (%s): %v", exporter.Name(), err)
+				http.Error(w, "Export Error: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
 
+			w.Header().Set("X-Export-Backend", exporter.Name())
 			w.Header().Set("Content-Type", "image/png")
 			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(buf)))
 			w.Write(buf)
@@ -716,74 +822,25 @@ func main() {
 				return
 			}
 
-			if req.Html == "" || req.Path == "" {
-				http.Error(w, "HTML content or Path is empty", http.StatusBadRequest)
+			if req.Path == "" {
+				http.Error(w, "Path is empty", http.StatusBadRequest)
 				return
 			}
 
-			token := generateID()
-			renderStoreMu.Lock()
-			renderStore[token] = req.Html
-			renderStoreMu.Unlock()
-
-			defer func() {
-				renderStoreMu.Lock()
-				delete(renderStore, token)
-				renderStoreMu.Unlock()
-			}()
-
-			renderURL := fmt.Sprintf("http://127.0.0.1:%d/api/render-view?token=%s", APP_PORT, token)
-
-			opts := append(chromedp.DefaultExecAllocatorOptions[:],
-				chromedp.NoFirstRun,
-				chromedp.Headless,
-				chromedp.DisableGPU,
-				chromedp.IgnoreCertErrors,
-			)
-
-			if browserPath := findBrowserPath(); browserPath != "" {
-				opts = append(opts, chromedp.ExecPath(browserPath))
-			}
-
-			allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
-			defer cancel()
-
-			ctx, cancel := context.WithTimeout(allocCtx, 60*time.Second) // Longer timeout for PDF
-			defer cancel()
-
-			ctx, cancel = chromedp.NewContext(ctx)
-			defer cancel()
-
-			// Determine scale (Default 1.0)
-			scale := req.Scale
-			if scale <= 0 {
-				scale = 1.0
+			pageHTML, err := resolveExportHTML(req.Html, req.Format, req.SourcePath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 
-			var buf []byte
-
-			if err := chromedp.Run(ctx,
-				chromedp.Navigate(renderURL),
-				chromedp.WaitVisible(".ProseMirror", chromedp.ByQuery),
-				chromedp.Sleep(500*time.Millisecond), // Wait for fonts/images
-				chromedp.ActionFunc(func(ctx context.Context) error {
-					var err error
-					// A4 Size: 8.27 x 11.69 inches
-					buf, _, err = page.PrintToPDF().
-						WithPrintBackground(true).
-						WithPaperWidth(8.27).
-						WithPaperHeight(11.69).
-						WithMarginTop(0.4).
-						WithMarginBottom(0.4).
-						WithMarginLeft(0.4).
-						WithMarginRight(0.4).
-						WithScale(scale). // Apply scale from frontend
-						Do(ctx)
-					return err
-				}),
-			); err != nil {
-				log.Println("Error generating PDF:", err)
-				http.Error(w, "Chromedp Error: "+err.Error(), http.StatusInternalServerError)
+			exporter := selectExporter()
+			buf, err := exporter.PDF(pageHTML, ExportOptions{
+				Scale:      req.Scale,
+				ReadyBound: renderReadyBound(req.ReadyTimeout),
+			})
+			if err != nil {
+				log.Printf("Error generating PDF (%s): %v", exporter.Name(), err)
+				http.Error(w, "Export Error: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
 
@@ -794,10 +851,76 @@ func main() {
 				return
 			}
 
+			w.Header().Set("X-Export-Backend", exporter.Name())
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
+		// Single-file exports: self-contained HTML or MHTML archive
+		if r.URL.Path == "/api/export/html" && r.Method == "POST" {
+			handleArchiveExport(w, r, ARCHIVE_FORMAT_HTML)
+			return
+		}
+
+		if r.URL.Path == "/api/export/mhtml" && r.Method == "POST" {
+			handleArchiveExport(w, r, ARCHIVE_FORMAT_MHTML)
+			return
+		}
+
+		// Word document generated on the server, no browser involved
+		if r.URL.Path == "/api/export/docx" && r.Method == "POST" {
+			handleDocxExport(w, r)
+			return
+		}
+
+		// Autosave journal for crash recovery
+		if r.URL.Path == "/api/recovery" || strings.HasPrefix(r.URL.Path, "/api/recovery/") {
+			handleRecovery(w, r)
+			return
+		}
+
+		// Folder opened as a workspace: tree and document operations
+		if r.URL.Path == "/api/workspace" || strings.HasPrefix(r.URL.Path, "/api/workspace/") {
+			handleWorkspace(w, r)
+			return
+		}
+
+		// Full-text search over the workspace
+		if r.URL.Path == "/api/search" || strings.HasPrefix(r.URL.Path, "/api/search/") {
+			handleSearch(w, r)
+			return
+		}
+
+		// Git status, history and commits for documents in a work tree
+		if strings.HasPrefix(r.URL.Path, "/api/git/") {
+			handleGit(w, r)
+			return
+		}
+
+		// Version history of saved documents
+		if r.URL.Path == "/api/history" || strings.HasPrefix(r.URL.Path, "/api/history/") {
+			handleHistory(w, r)
+			return
+		}
+
+		// Recent and pinned documents
+		if r.URL.Path == "/api/recent" || strings.HasPrefix(r.URL.Path, "/api/recent/") {
+			handleRecent(w, r)
+			return
+		}
+
+		// Per-user settings shared by all tabs
+		if r.URL.Path == "/api/settings" || r.URL.Path == "/api/settings/events" {
+			handleSettings(w, r)
+			return
+		}
+
+		// AI gateway: provider keys stay on this side
+		if strings.HasPrefix(r.URL.Path, "/api/ai/") {
+			handleAI(w, r)
+			return
+		}
+
 		// Save File Endpoint - Accepts Multipart Form Data
 		if r.URL.Path == "/api/save-file" && r.Method == "POST" {
 			// Increase limit to 128MB
@@ -820,15 +943,44 @@ func main() {
 
 			var finalDir string
 			var finalHtmlPath string
+			isMarkdown := strings.ToLower(inputExt) == ".md" || strings.ToLower(inputExt) == ".markdown"
 			
+			// Read the HTML/Content part up front: extracting inline images
+			// decides whether an asset folder is needed.
+			htmlFile, _, err := r.FormFile("html")
+			if err != nil {
+				http.Error(w, "Content file part missing", http.StatusBadRequest)
+				return
+			}
+			rawContent, err := io.ReadAll(htmlFile)
+			htmlFile.Close()
+			if err != nil {
+				http.Error(w, "Failed to read content", http.StatusBadRequest)
+				return
+			}
+			text := string(rawContent)
+			isEditorHTML := !isMarkdown || r.FormValue("contentFormat") == "html"
+
+			// extractAssets=true moves data: images into the asset folder
+			extractOption := r.FormValue("extractAssets") == "true"
+			extractAssets := extractOption && hasDataImages(text)
+
+			// Image optimization: global config, overridable per document
+			imageOpts, err := imageOptionsFor(r.FormValue("imageOptions"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var imageReport ImageReport
+
 			assets := r.MultipartForm.File["assets"]
-			hasAssets := len(assets) > 0
+			hasAssets := len(assets) > 0 || extractAssets
 
 			// --- SMART SAVING STRATEGY ---
 			// 1. Markdown Files: Always use a sidecar folder (Filename_assets)
 			// 2. HTML Files: Use bundling (Filename dir) only if instructed or consistent with current struct
 			
-			if strings.ToLower(inputExt) == ".md" || strings.ToLower(inputExt) == ".markdown" {
+			if isMarkdown {
 				// Markdown Strategy: Sidecar assets folder
 				finalHtmlPath = inputPath
 				finalDir = filepath.Join(inputDir, inputNameNoExt+"_assets")
@@ -861,13 +1013,57 @@ func main() {
 				}
 			}
 
-			// Save HTML/Content File
-			htmlFile, _, err := r.FormFile("html")
+			// Lazily served assets become relative paths (or data URIs on request)
+			if strings.Contains(text, ASSET_URL_PATH) {
+				inlineAssets := r.FormValue("inlineAssets") == "true"
+				if isEditorHTML {
+					text = resolveAssetURLs(text, finalHtmlPath, inlineAssets)
+				} else {
+					text = resolveAssetURLsInText(text, finalHtmlPath, inlineAssets)
+				}
+			}
+
+			var optimize *ImageOptions
+			if imageOpts.Enabled {
+				optimize = &imageOpts
+			}
+			if extractAssets {
+				var err error
+				if isEditorHTML {
+					text, err = extractDataURIs(text, finalHtmlPath, finalDir, optimize, &imageReport)
+				} else {
+					text, err = extractDataURIsInText(text, finalHtmlPath, finalDir, optimize, &imageReport)
+				}
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Failed to extract inline images: %v", err), http.StatusInternalServerError)
+					return
+				}
+			} else if optimize != nil && hasDataImages(text) {
+				if isEditorHTML {
+					text = optimizeInlineImages(text, imageOpts, &imageReport)
+				} else {
+					text = optimizeInlineImagesInText(text, imageOpts, &imageReport)
+				}
+			}
+
+			// Markdown targets may be sent as editor HTML and converted here
+			if isMarkdown && isEditorHTML {
+				markdown, err := htmlToMarkdown(text)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Failed to convert to Markdown: %v", err), http.StatusInternalServerError)
+					return
+				}
+				text = markdown
+			}
+
+			// Save HTML/Content File, optionally back in its original encoding
+			encoded, err := encodeTextDocument(text, finalHtmlPath, r.FormValue("encoding"))
 			if err != nil {
-				http.Error(w, "Content file part missing", http.StatusBadRequest)
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 				return
 			}
-			defer htmlFile.Close()
+			content := bytes.NewReader(encoded)
 
 			// Unlocking before write allows overwriting if we held the lock.
 			unlockFile(finalHtmlPath)
@@ -885,7 +1081,7 @@ func main() {
 				return
 			}
 			
-			_, err = io.Copy(outFile, htmlFile)
+			_, err = io.Copy(outFile, content)
 			outFile.Close()
 
 			if err != nil {
@@ -907,6 +1103,25 @@ func main() {
 					
 					// Save asset to finalDir (either _assets folder or bundled folder)
 					assetPath := filepath.Join(finalDir, fileHeader.Filename)
+					if optimize != nil {
+						// The document already refers to this name, so only
+						// results in the same format are used.
+						data, err := io.ReadAll(src)
+						src.Close()
+						if err != nil {
+							continue
+						}
+						if out, outType := optimizeImage(data, imageOpts); outType != "" {
+							if outType == mediaTypeOf(assetPath, data) {
+								imageReport.add(len(data), len(out))
+								data = out
+							} else {
+								imageReport.add(len(data), len(data))
+							}
+						}
+						os.WriteFile(assetPath, data, 0644)
+						continue
+					}
 					dst, err := os.Create(assetPath)
 					if err == nil {
 						io.Copy(dst, src)
@@ -916,14 +1131,43 @@ func main() {
 				}
 			}
 
+			// Only dedicated asset folders are cleaned, never a plain directory
+			if extractOption && (isMarkdown || strings.EqualFold(filepath.Base(finalDir), inputNameNoExt)) {
+				removeOrphanedHashedAssets(finalDir, text)
+			}
+
+			recordRecent(finalHtmlPath, true)
+			recordHistory(finalHtmlPath)
+
+			// Optional reference scan of the asset folder (assetGC=report|trash|delete)
+			resp := DialogResponse{Path: finalHtmlPath}
+			if imageReport.Images > 0 {
+				imageReportLog(filepath.Base(finalHtmlPath), &imageReport)
+				resp.Images = &imageReport
+			}
+			if gcMode := r.FormValue("assetGC"); gcMode != "" {
+				if report, err := collectAssetGarbage(finalHtmlPath, gcMode); err == nil {
+					resp.AssetGC = report
+				} else {
+					log.Printf("[Assets] Skipping cleanup of %s: %v", finalHtmlPath, err)
+				}
+			}
+			// Optional commit when the document is in a git work tree (gitCommit=message)
+			if message := strings.TrimSpace(r.FormValue("gitCommit")); message != "" {
+				resp.Git = commitOnSave(finalHtmlPath, message)
+			}
+
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(DialogResponse{Path: finalHtmlPath})
+			json.NewEncoder(w).Encode(resp)
 			return
 		}
 
 		http.FileServer(http.FS(fsys)).ServeHTTP(w, r)
 	})
 
+	// Keep the search index of the workspace folder current
+	go runSearchIndexer()
+
 	// Start Server
 	go func() {
 		if err := http.Serve(listener, nil); err != nil {
@@ -1021,7 +1265,34 @@ func runTrayApp(url string) {
 
 				openStr, _ := syscall.UTF16PtrFromString("Open Editor")
 				procAppendMenuW.Call(hMenu, MF_STRING, 1, uintptr(unsafe.Pointer(openStr)))
-				
+
+				// Recent documents submenu, pinned ones first (destroyed with hMenu)
+				recent, err := recentDocuments()
+				if err != nil {
+					log.Printf("[Recent] %v", err)
+				}
+				if len(recent) > RECENT_TRAY_MAX {
+					recent = recent[:RECENT_TRAY_MAX]
+				}
+				hRecent, _, _ := procCreatePopupMenu.Call()
+				for i, doc := range recent {
+					if i > 0 && recent[i-1].Pinned && !doc.Pinned {
+						procAppendMenuW.Call(hRecent, MF_SEPARATOR, 0, 0)
+					}
+					var flags uintptr = MF_STRING
+					if doc.Missing {
+						flags |= MF_GRAYED
+					}
+					labelStr, _ := syscall.UTF16PtrFromString(strings.ReplaceAll(doc.Name, "&", "&&"))
+					procAppendMenuW.Call(hRecent, flags, uintptr(TRAY_RECENT_BASE+i), uintptr(unsafe.Pointer(labelStr)))
+				}
+				if len(recent) == 0 {
+					emptyStr, _ := syscall.UTF16PtrFromString("(Empty)")
+					procAppendMenuW.Call(hRecent, MF_STRING|MF_GRAYED, 0, uintptr(unsafe.Pointer(emptyStr)))
+				}
+				recentStr, _ := syscall.UTF16PtrFromString("Recent Documents")
+				procAppendMenuW.Call(hMenu, MF_POPUP, hRecent, uintptr(unsafe.Pointer(recentStr)))
+
 				procAppendMenuW.Call(hMenu, MF_SEPARATOR, 0, 0)
 				
 				exitStr, _ := syscall.UTF16PtrFromString("Exit")
@@ -1037,6 +1308,12 @@ func runTrayApp(url string) {
 					openDefaultBrowser(url)
 				} else if res == 2 {
 					procPostQuitMessage.Call(0)
+				} else if i := int(res) - TRAY_RECENT_BASE; i >= 0 && i < len(recent) {
+					go func(path string) {
+						if err := openRecentDocument(path); err != nil {
+							log.Printf("[Recent] Failed to open %s: %v", path, err)
+						}
+					}(recent[i].Path)
 				}
 			}
 		case WM_DESTROY:
@@ -1102,59 +1379,19 @@ func runTrayApp(url string) {
 
 // --- Helpers ---
 
-func inlineLocalImages(htmlContent string, htmlFilePath string) string {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("[Recovery] Panic in inlineLocalImages: %v", r)
-		}
-	}()
-
-	baseDir := filepath.Dir(htmlFilePath)
-	imgTagRe := regexp.MustCompile(`(?i)<img\s+[^>]*>`)
-	srcRe := regexp.MustCompile(`(?i)(\s|^)src\s*=\s*("([^"]*)"|'([^']*)')`)
-
-	return imgTagRe.ReplaceAllStringFunc(htmlContent, func(imgTag string) string {
-		match := srcRe.FindStringSubmatch(imgTag)
-		if match == nil {
-			return imgTag
-		}
-
-		srcContent := match[3]
-		quoteChar := "\""
-		if srcContent == "" {
-			srcContent = match[4]
-			quoteChar = "'"
-		}
-
-		if strings.HasPrefix(srcContent, "data:") ||
-			strings.HasPrefix(srcContent, "http:") ||
-			strings.HasPrefix(srcContent, "https:") ||
-			strings.HasPrefix(srcContent, "//") {
-			return imgTag
-		}
+func handleRenderView(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	renderStoreMu.RLock()
+	html, ok := renderStore[token]
+	renderStoreMu.RUnlock()
 
-		cleanPath := srcContent
-		if idx := strings.IndexAny(cleanPath, "?#"); idx != -1 {
-			cleanPath = cleanPath[:idx]
-		}
-		if unescaped, err := url.QueryUnescape(cleanPath); err == nil {
-			cleanPath = unescaped
-		}
-		cleanPath = filepath.FromSlash(cleanPath)
-		fullPath := filepath.Join(baseDir, cleanPath)
-
-		data, err := os.ReadFile(fullPath)
-		if err != nil {
-			return imgTag
-		}
-
-		mimeType := http.DetectContentType(data)
-		base64Data := base64.StdEncoding.EncodeToString(data)
-		newDataURI := fmt.Sprintf("data:%s;base64,%s", mimeType, base64Data)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
-		newSrcAttr := fmt.Sprintf("%ssrc=%s%s%s", match[1], quoteChar, newDataURI, quoteChar)
-		return strings.Replace(imgTag, match[0], newSrcAttr, 1)
-	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(html))
 }
 
 func generateID() string {
@@ -1177,32 +1414,3 @@ func openDefaultBrowser(url string) {
 		log.Println("Error opening default browser:", err)
 	}
 }
-
-func findBrowserPath() string {
-	if runtime.GOOS != "windows" {
-		return ""
-	}
-
-	edgePaths := []string{
-		`C:\Program Files (x86)\Microsoft\Edge\Application\msedge.exe`,
-		`C:\Program Files\Microsoft\Edge\Application\msedge.exe`,
-	}
-	for _, p := range edgePaths {
-		if _, err := os.Stat(p); err == nil {
-			return p
-		}
-	}
-
-	chromePaths := []string{
-		`C:\Program Files\Google\Chrome\Application\chrome.exe`,
-		`C:\Program Files (x86)\Google\Chrome\Application\chrome.exe`,
-		filepath.Join(os.Getenv("LOCALAPPDATA"), `Google\Chrome\Application\chrome.exe`),
-	}
-	for _, p := range chromePaths {
-		if _, err := os.Stat(p); err == nil {
-			return p
-		}
-	}
-
-	return ""
-}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	gmast "github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Shared converter; goldmark.Markdown is safe for concurrent use.
+var markdownConverter = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, extension.Footnote, mathExtension{}), // GFM = tables, task lists, strikethrough, autolinks
+	goldmark.WithRendererOptions(gmhtml.WithUnsafe()),                           // Keep raw HTML the user typed into the .md
+)
+
+// markdownToHTML converts Markdown source into an HTML fragment.
+func markdownToHTML(src []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := markdownConverter.Convert(src, &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// markdownToEditorHTML converts a Markdown file for the editor, resolving
+// images referenced relative to it (usually ./Name_assets/...) according to
+// assetMode.
+func markdownToEditorHTML(src []byte, mdPath, assetMode string) (string, error) {
+	body, err := markdownToHTML(src)
+	if err != nil {
+		return "", err
+	}
+	return resolveLocalAssets(body, mdPath, assetMode), nil
+}
+
+// --- Math ($...$ and $$...$$) ---
+
+// Same markup the editor's math node and the frontend marked extension use.
+var kindMath = gmast.NewNodeKind("Math")
+
+type mathNode struct {
+	gmast.BaseInline
+	Latex   []byte
+	Display bool
+}
+
+func (n *mathNode) Kind() gmast.NodeKind { return kindMath }
+
+func (n *mathNode) Dump(source []byte, level int) {
+	gmast.DumpHelper(n, source, level, map[string]string{"Latex": string(n.Latex)}, nil)
+}
+
+type mathParser struct{}
+
+func (mathParser) Trigger() []byte { return []byte{'$'} }
+
+// Parse follows the pandoc rules so prices like "$5 and $6" stay text: the
+// opening $ must be followed by a non-space, the closing $ preceded by a
+// non-space and not followed by a digit. $$...$$ may span lines.
+func (mathParser) Parse(parent gmast.Node, block text.Reader, pc parser.Context) gmast.Node {
+	line, _ := block.PeekLine()
+	if len(line) > 1 && line[1] == '$' {
+		return parseDisplayMath(block)
+	}
+
+	for i := 1; i < len(line); i++ {
+		if line[i] == '\n' {
+			return nil
+		}
+		if line[i] != '$' || line[i-1] == '\\' {
+			continue
+		}
+		if i == 1 || isMarkdownSpace(line[1]) || isMarkdownSpace(line[i-1]) {
+			return nil
+		}
+		if i+1 < len(line) && line[i+1] >= '0' && line[i+1] <= '9' {
+			return nil
+		}
+		block.Advance(i + 1)
+		return &mathNode{Latex: bytes.TrimSpace(line[1:i])}
+	}
+	return nil
+}
+
+func parseDisplayMath(block text.Reader) gmast.Node {
+	startLine, startPos := block.Position()
+	line, _ := block.PeekLine()
+	block.Advance(2)
+	line = line[2:]
+
+	var latex []byte
+	for {
+		if idx := bytes.Index(line, []byte("$$")); idx >= 0 {
+			latex = append(latex, line[:idx]...)
+			block.Advance(idx + 2)
+			break
+		}
+		latex = append(latex, line...)
+		block.AdvanceLine()
+		line, _ = block.PeekLine()
+		if line == nil {
+			block.SetPosition(startLine, startPos)
+			return nil
+		}
+	}
+
+	latex = bytes.TrimSpace(latex)
+	if len(latex) == 0 {
+		return nil
+	}
+	return &mathNode{Latex: latex, Display: true}
+}
+
+func isMarkdownSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+type mathRenderer struct{}
+
+func (mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMath, func(w util.BufWriter, source []byte, node gmast.Node, entering bool) (gmast.WalkStatus, error) {
+		if !entering {
+			return gmast.WalkContinue, nil
+		}
+		n := node.(*mathNode)
+		w.WriteString(`<span data-type="math" data-latex="`)
+		w.Write(util.EscapeHTML(n.Latex))
+		if n.Display {
+			w.WriteString(`" data-display="true`)
+		}
+		w.WriteString(`"></span>`)
+		return gmast.WalkSkipChildren, nil
+	})
+}
+
+type mathExtension struct{}
+
+func (mathExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(mathParser{}, 150)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(mathRenderer{}, 500)))
+}
+
+// --- HTML -> Markdown (save path) ---
+
+var (
+	mdEscapeRe     = regexp.MustCompile("([\\\\`*_\\[\\]$<&])")
+	mdBlankLinesRe = regexp.MustCompile(`\n{3,}`)
+	// Text at the start of a line that would turn into a heading, quote,
+	// list item or thematic break
+	mdLineStartRe = regexp.MustCompile(`(?m)^(?:[#>+-]|[0-9]{1,9}[.)](?:[ \t]|$))`)
+)
+
+// htmlToMarkdown converts editor HTML back to GFM, using the same
+// conventions as the frontend turndown export: ATX headings, fenced code,
+// "_" emphasis, "**" strong, $latex$ math and pipe tables. Footnotes and
+// comments become [^n] references.
+func htmlToMarkdown(src string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+	root := findContentRoot(doc)
+	mdCommentFootnotes(root)
+	out := mdBlankLinesRe.ReplaceAllString(mdChildren(root), "\n\n")
+	return strings.TrimSpace(out) + "\n", nil
+}
+
+// mdCommentFootnotes turns the editor's comment marks into footnotes in
+// goldmark's markup, numbered after the document's own, so the comment text
+// is kept as "text[^3]" and "[^3]: comment".
+func mdCommentFootnotes(root *html.Node) {
+	var comments []*html.Node
+	var list *html.Node
+	next := 1
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type != html.ElementNode {
+			return
+		}
+		if n.DataAtom == atom.Span && htmlAttr(n, "data-comment") != "" {
+			comments = append(comments, n)
+		}
+		if n.DataAtom == atom.Ol && list == nil && n.Parent != nil && hasClass(n.Parent, "footnotes") {
+			list = n
+		}
+		if num, err := strconv.Atoi(strings.TrimPrefix(htmlAttr(n, "id"), "fn:")); err == nil && num >= next {
+			next = num + 1
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+	if len(comments) == 0 {
+		return
+	}
+	if list == nil {
+		div := &html.Node{Type: html.ElementNode, DataAtom: atom.Div, Data: "div", Attr: []html.Attribute{{Key: "class", Val: "footnotes"}}}
+		list = &html.Node{Type: html.ElementNode, DataAtom: atom.Ol, Data: "ol"}
+		div.AppendChild(list)
+		root.AppendChild(div)
+	}
+
+	for _, span := range comments {
+		num := strconv.Itoa(next)
+		next++
+		link := &html.Node{Type: html.ElementNode, DataAtom: atom.A, Data: "a", Attr: []html.Attribute{{Key: "href", Val: "#fn:" + num}, {Key: "class", Val: "footnote-ref"}}}
+		link.AppendChild(&html.Node{Type: html.TextNode, Data: num})
+		ref := &html.Node{Type: html.ElementNode, DataAtom: atom.Sup, Data: "sup"}
+		ref.AppendChild(link)
+		span.Parent.InsertBefore(ref, span.NextSibling)
+
+		p := &html.Node{Type: html.ElementNode, DataAtom: atom.P, Data: "p"}
+		p.AppendChild(&html.Node{Type: html.TextNode, Data: htmlAttr(span, "data-comment")})
+		item := &html.Node{Type: html.ElementNode, DataAtom: atom.Li, Data: "li", Attr: []html.Attribute{{Key: "id", Val: "fn:" + num}}}
+		item.AppendChild(p)
+		list.AppendChild(item)
+	}
+}
+
+func isMarkdownBlock(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch n.DataAtom {
+	case atom.P, atom.Div, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+		atom.Ul, atom.Ol, atom.Li, atom.Pre, atom.Blockquote, atom.Table, atom.Hr,
+		atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main, atom.Figure,
+		atom.Figcaption, atom.Aside, atom.Nav, atom.Details, atom.Summary:
+		return true
+	}
+	return false
+}
+
+// mdChildren renders the children of a block container. Runs of inline
+// nodes become paragraphs.
+func mdChildren(n *html.Node) string {
+	var sb, inline strings.Builder
+	flush := func() {
+		if p := mdEscapeLineStarts(mdTrimLines(inline.String())); p != "" {
+			sb.WriteString(p)
+			sb.WriteString("\n\n")
+		}
+		inline.Reset()
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if isMarkdownBlock(c) {
+			flush()
+			sb.WriteString(mdBlock(c))
+		} else {
+			inline.WriteString(mdInline(c))
+		}
+	}
+	flush()
+	return sb.String()
+}
+
+// mdTrimLines trims a paragraph and the spaces left at the start of lines
+// after hard breaks.
+func mdTrimLines(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i := range lines {
+		if i > 0 {
+			lines[i] = strings.TrimLeft(lines[i], " ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mdEscapeLineStarts escapes the markers that would make a line of
+// paragraph text a block of its own: "\# title", "1\. item".
+func mdEscapeLineStarts(s string) string {
+	return mdLineStartRe.ReplaceAllStringFunc(s, func(m string) string {
+		if i := strings.IndexAny(m, ".)"); i > 0 {
+			return m[:i] + `\` + m[i:]
+		}
+		return `\` + m
+	})
+}
+
+func mdBlock(n *html.Node) string {
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		content := strings.ReplaceAll(mdTrimLines(mdInlineChildren(n)), "\n", " ")
+		if content == "" {
+			return ""
+		}
+		return strings.Repeat("#", level) + " " + content + "\n\n"
+
+	case atom.P:
+		if p := mdEscapeLineStarts(mdTrimLines(mdInlineChildren(n))); p != "" {
+			return p + "\n\n"
+		}
+		return ""
+
+	case atom.Hr:
+		return "---\n\n"
+
+	case atom.Pre:
+		return mdCodeBlock(n)
+
+	case atom.Blockquote:
+		inner := strings.TrimSpace(mdChildren(n))
+		if inner == "" {
+			return ""
+		}
+		lines := strings.Split(inner, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight("> "+line, " ")
+		}
+		return strings.Join(lines, "\n") + "\n\n"
+
+	case atom.Ul, atom.Ol:
+		return mdList(n)
+
+	case atom.Li:
+		// Stray <li> outside a list
+		return "- " + strings.TrimSpace(mdChildren(n)) + "\n\n"
+
+	case atom.Table:
+		return mdTable(n)
+
+	case atom.Div:
+		if hasClass(n, "footnotes") {
+			return mdFootnotes(n)
+		}
+	}
+	return mdChildren(n)
+}
+
+// mdFootnotes writes the definitions of a goldmark footnote section (also
+// produced by the DOCX import). Later paragraphs of a note are indented.
+func mdFootnotes(div *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			label, ok := strings.CutPrefix(htmlAttr(c, "id"), "fn:")
+			if c.DataAtom != atom.Li || !ok {
+				walk(c)
+				continue
+			}
+			lines := strings.Split(strings.TrimSpace(mdChildren(c)), "\n")
+			for i := 1; i < len(lines); i++ {
+				if lines[i] != "" {
+					lines[i] = "    " + lines[i]
+				}
+			}
+			sb.WriteString("[^" + label + "]: " + strings.Join(lines, "\n") + "\n\n")
+		}
+	}
+	walk(div)
+	return sb.String()
+}
+
+// mdFootnoteRef returns the label of a goldmark footnote reference,
+// <sup><a href="#fn:1" class="footnote-ref">1</a></sup>.
+func mdFootnoteRef(sup *html.Node) (string, bool) {
+	for c := sup.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.A && hasClass(c, "footnote-ref") {
+			return strings.CutPrefix(htmlAttr(c, "href"), "#fn:")
+		}
+	}
+	return "", false
+}
+
+func mdCodeBlock(pre *html.Node) string {
+	lang := ""
+	code := pre
+	for c := pre.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Code {
+			code = c
+			for _, cls := range strings.Fields(htmlAttr(c, "class")) {
+				if strings.HasPrefix(cls, "language-") {
+					lang = strings.TrimPrefix(cls, "language-")
+				}
+			}
+			break
+		}
+	}
+
+	body := strings.TrimRight(nodeRawText(code), "\n")
+	fence := "```"
+	for strings.Contains(body, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + body + "\n" + fence + "\n\n"
+}
+
+// nodeRawText returns the text content of n with whitespace untouched.
+func nodeRawText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		if n.Type == html.ElementNode && n.DataAtom == atom.Br {
+			sb.WriteString("\n")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+func mdList(list *html.Node) string {
+	ordered := list.DataAtom == atom.Ol
+	num := 1
+	if start, err := strconv.Atoi(htmlAttr(list, "start")); err == nil {
+		num = start
+	}
+
+	var sb strings.Builder
+	for li := list.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode {
+			continue
+		}
+		if li.DataAtom != atom.Li {
+			sb.WriteString(mdBlock(li))
+			continue
+		}
+
+		marker := "-"
+		if ordered {
+			marker = fmt.Sprintf("%d.", num)
+			num++
+		}
+		// Continuation lines align with the content after the bullet, not
+		// after the task box, or CommonMark reads them as indented code.
+		indent := strings.Repeat(" ", len(marker)+1)
+		if checked, ok := mdTaskState(li); ok {
+			if checked {
+				marker += " [x]"
+			} else {
+				marker += " [ ]"
+			}
+		}
+
+		content := strings.TrimSpace(mdChildren(li))
+		if !strings.Contains(content, "```") {
+			content = mdBlankLinesRe.ReplaceAllString(strings.ReplaceAll(content, "\n\n", "\n"), "\n")
+		}
+		lines := strings.Split(content, "\n")
+		for i := 1; i < len(lines); i++ {
+			if lines[i] != "" {
+				lines[i] = indent + lines[i]
+			}
+		}
+		sb.WriteString(strings.TrimRight(marker+" "+strings.Join(lines, "\n"), " "))
+		sb.WriteString("\n")
+	}
+	return sb.String() + "\n"
+}
+
+// mdTaskState recognises task items from Tiptap (data-checked) and from
+// GFM-rendered HTML (a leading checkbox input).
+func mdTaskState(li *html.Node) (checked, ok bool) {
+	if v := htmlAttr(li, "data-checked"); v != "" {
+		return v == "true", true
+	}
+	for c := li.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Input && strings.EqualFold(htmlAttr(c, "type"), "checkbox") {
+			for _, a := range c.Attr {
+				if a.Key == "checked" {
+					return true, true
+				}
+			}
+			return false, true
+		}
+		if c.Type == html.TextNode && strings.TrimSpace(c.Data) == "" {
+			continue
+		}
+		if c.Type == html.ElementNode && c.DataAtom == atom.P {
+			return mdTaskState(c)
+		}
+		break
+	}
+	return false, false
+}
+
+func mdTable(table *html.Node) string {
+	var rows [][]string
+	var collect func(n *html.Node)
+	collect = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				collect(c)
+			case atom.Tr:
+				var row []string
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type != html.ElementNode || (cell.DataAtom != atom.Td && cell.DataAtom != atom.Th) {
+						continue
+					}
+					text := mdTrimLines(mdChildren(cell))
+					text = strings.ReplaceAll(text, "\n\n", "<br>")
+					text = strings.ReplaceAll(text, "  \n", "<br>")
+					text = strings.ReplaceAll(text, "\n", " ")
+					text = strings.ReplaceAll(text, "|", "\\|")
+					if text == "" {
+						text = " "
+					}
+					row = append(row, text)
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	collect(table)
+	if len(rows) == 0 {
+		return ""
+	}
+
+	cols := 0
+	for _, row := range rows {
+		if len(row) > cols {
+			cols = len(row)
+		}
+	}
+
+	var sb strings.Builder
+	for i, row := range rows {
+		for len(row) < cols {
+			row = append(row, " ")
+		}
+		sb.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			sb.WriteString("|" + strings.Repeat(" --- |", cols) + "\n")
+		}
+	}
+	return sb.String() + "\n"
+}
+
+func mdInlineChildren(n *html.Node) string {
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(mdInline(c))
+	}
+	return sb.String()
+}
+
+// mdWrap puts delimiters around inner text, keeping surrounding spaces
+// outside so "** bold**" never happens.
+func mdWrap(inner, open, close string) string {
+	trimmed := strings.TrimSpace(inner)
+	if trimmed == "" {
+		return inner
+	}
+	lead := inner[:strings.Index(inner, trimmed)]
+	trail := inner[len(lead)+len(trimmed):]
+	return lead + open + trimmed + close + trail
+}
+
+func mdInline(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return mdEscapeRe.ReplaceAllString(whitespaceRe.ReplaceAllString(n.Data, " "), `\$1`)
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		return "  \n"
+	case atom.Strong, atom.B:
+		return mdWrap(mdInlineChildren(n), "**", "**")
+	case atom.Em, atom.I:
+		return mdWrap(mdInlineChildren(n), "_", "_")
+	case atom.S, atom.Del, atom.Strike:
+		return mdWrap(mdInlineChildren(n), "~~", "~~")
+	case atom.Sup:
+		if label, ok := mdFootnoteRef(n); ok {
+			return "[^" + label + "]"
+		}
+		return mdWrap(mdInlineChildren(n), "<sup>", "</sup>")
+	case atom.U, atom.Sub, atom.Mark:
+		return mdWrap(mdInlineChildren(n), "<"+n.Data+">", "</"+n.Data+">")
+	case atom.Code:
+		code := nodeRawText(n)
+		fence := "`"
+		for strings.Contains(code, fence) {
+			fence += "`"
+		}
+		if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+			code = " " + code + " "
+		}
+		return fence + code + fence
+	case atom.A:
+		if hasClass(n, "footnote-backref") {
+			return ""
+		}
+		inner := mdInlineChildren(n)
+		href := htmlAttr(n, "href")
+		if href == "" {
+			return inner
+		}
+		return "[" + strings.TrimSpace(inner) + "](" + mdURL(href) + ")"
+	case atom.Img:
+		src := htmlAttr(n, "src")
+		if src == "" {
+			return ""
+		}
+		return "![" + mdEscapeRe.ReplaceAllString(htmlAttr(n, "alt"), `\$1`) + "](" + mdURL(src) + ")"
+	case atom.Input, atom.Script, atom.Style:
+		return ""
+	case atom.Span:
+		if latex := htmlAttr(n, "data-latex"); latex != "" {
+			if htmlAttr(n, "data-display") == "true" {
+				return "$$" + latex + "$$"
+			}
+			return "$" + latex + "$"
+		}
+	}
+
+	if isMarkdownBlock(n) {
+		// Block inside inline context (e.g. <p> in a table cell)
+		return mdTrimLines(mdChildren(n)) + "\n\n"
+	}
+	return mdInlineChildren(n)
+}
+
+// mdURL wraps destinations containing spaces or parentheses in <>.
+func mdURL(u string) string {
+	if strings.ContainsAny(u, " ()") {
+		return "<" + u + ">"
+	}
+	return u
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMarkdownRoundTrip saves editor HTML as Markdown and opens it again.
+func TestMarkdownRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		md     string // Expected Markdown, when checked
+		reopen string
+	}{
+		{"hash", `<p># not a heading</p>`, `\# not a heading`, "<p># not a heading</p>\n"},
+		{"ordered marker", `<p>1. x</p>`, `1\. x`, "<p>1. x</p>\n"},
+		{"ordered marker with parenthesis", `<p>12) x</p>`, `12\) x`, "<p>12) x</p>\n"},
+		{"number without marker", `<p>3.14 is pi</p>`, `3.14 is pi`, "<p>3.14 is pi</p>\n"},
+		{"dash", `<p>- x</p>`, `\- x`, "<p>- x</p>\n"},
+		{"plus", `<p>+ x</p>`, `\+ x`, "<p>+ x</p>\n"},
+		{"thematic break", `<p>---</p>`, `\---`, "<p>---</p>\n"},
+		{"quote", `<p>&gt; x</p>`, `\> x`, "<p>&gt; x</p>\n"},
+		{"after a hard break", `<p>a<br># b<br>2. c</p>`, "a  \n\\# b  \n2\\. c", "<p>a<br>\n# b<br>\n2. c</p>\n"},
+		{"list item text", `<ul><li><p>1. x</p></li></ul>`, `- 1\. x`, "<ul>\n<li>1. x</li>\n</ul>\n"},
+		{"escaped tag", `<p>&lt;b&gt;bold&lt;/b&gt;</p>`, `\<b>bold\</b>`, "<p>&lt;b&gt;bold&lt;/b&gt;</p>\n"},
+		{"escaped entity", `<p>&amp;amp; &amp; &amp;#60;</p>`, `\&amp; \& \&#60;`, "<p>&amp;amp; &amp; &amp;#60;</p>\n"},
+		{"real list stays", `<ol start="2"><li>a</li></ol>`, `2. a`, "<ol start=\"2\">\n<li>a</li>\n</ol>\n"},
+		{"real heading stays", `<h2>t</h2>`, `## t`, "<h2>t</h2>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := htmlToMarkdown(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(md); got != tt.md {
+				t.Errorf("htmlToMarkdown(%s) = %q, want %q", tt.in, got, tt.md)
+			}
+			out, err := markdownToHTML([]byte(md))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.reopen {
+				t.Errorf("reopened %q as %q, want %q", md, out, tt.reopen)
+			}
+		})
+	}
+}
+
+func TestMarkdownComments(t *testing.T) {
+	md, err := htmlToMarkdown(`<p>See <span data-comment="check &quot;this&quot;">the word</span> here.</p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "See the word[^1] here.\n\n[^1]: check \"this\"\n"; md != want {
+		t.Errorf("htmlToMarkdown = %q, want %q", md, want)
+	}
+	out, err := markdownToHTML([]byte(md))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `<a href="#fn:1" class="footnote-ref" role="doc-noteref">1</a>`) || !strings.Contains(out, `<li id="fn:1">`) || !strings.Contains(out, "check &quot;this&quot;") {
+		t.Errorf("reopened as %s", out)
+	}
+
+	// Saving the reopened document keeps the note, and further comments are
+	// numbered after it
+	md, err = htmlToMarkdown(strings.Replace(out, `<div class="footnotes"`, `<p><span data-comment="second">more</span></p><div class="footnotes"`, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "See the word[^1] here.\n\nmore[^2]\n\n[^1]: check \"this\"\n\n[^2]: second\n"; md != want {
+		t.Errorf("saved again as %q, want %q", md, want)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Parts get absolute Content-Locations under a reserved host, so readers
+// never try to fetch them.
+const mhtmlBaseURL = "https://winhtml.invalid/"
+
+type mhtmlPart struct {
+	location  string
+	mediaType string
+	data      []byte
+}
+
+// buildMHTML packs an export page and its resources into a multipart/related
+// archive that Edge, Chrome and Word open as a single document.
+func buildMHTML(page, title string) ([]byte, error) {
+	var parts []mhtmlPart
+	byHash := make(map[string]string)
+
+	p := &resourcePackager{
+		embed: func(data []byte, mediaType string) string {
+			sum := sha256.Sum256(data)
+			hash := hex.EncodeToString(sum[:8])
+			if loc, ok := byHash[hash]; ok {
+				return loc
+			}
+			ext := imageExtensions[mediaType]
+			if ext == "" {
+				if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+					ext = exts[0]
+				}
+			}
+			loc := mhtmlBaseURL + "res/" + hash + ext
+			byHash[hash] = loc
+			parts = append(parts, mhtmlPart{location: loc, mediaType: mediaType, data: data})
+			return loc
+		},
+	}
+	root := mhtmlPart{
+		location:  mhtmlBaseURL + "index.html",
+		mediaType: "text/html",
+		data:      []byte(p.packageHTML(page)),
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	boundary := "----MultipartBoundary--" + generateID()
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(&buf, "From: <Saved by WinHTML Editor>\r\n")
+	fmt.Fprintf(&buf, "Snapshot-Content-Location: %s\r\n", root.location)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", title))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/related;\r\n\ttype=\"text/html\";\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+
+	for _, part := range append([]mhtmlPart{root}, parts...) {
+		if err := writeMHTMLPart(mw, part); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMHTMLPart writes text as quoted-printable and everything else as
+// base64 wrapped at 76 columns.
+func writeMHTMLPart(mw *multipart.Writer, part mhtmlPart) error {
+	isText := strings.HasPrefix(part.mediaType, "text/") || part.mediaType == "image/svg+xml"
+	header := textproto.MIMEHeader{}
+	contentType := part.mediaType
+	if isText {
+		contentType += "; charset=utf-8"
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Location", part.location)
+
+	if isText {
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(part.data); err != nil {
+			return err
+		}
+		return qp.Close()
+	}
+
+	header.Set("Content-Transfer-Encoding", "base64")
+	w, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(part.data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(w, encoded+"\r\n")
+	return err
+}
+
+// mhtmlToHTML unpacks an MHTML archive into one HTML document for the
+// editor, with every resource found in the archive inlined as a data: URI.
+func mhtmlToHTML(content []byte) (string, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(content)))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return "", fmt.Errorf("invalid MHTML header: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return "", fmt.Errorf("not a multipart MHTML archive")
+	}
+
+	byLocation := make(map[string]mhtmlPart)
+	byContentID := make(map[string]mhtmlPart)
+	var root *mhtmlPart
+	start := strings.Trim(params["start"], "<>")
+	snapshot := header.Get("Snapshot-Content-Location")
+
+	mr := multipart.NewReader(tp.R, params["boundary"])
+	for {
+		p, err := mr.NextRawPart() // Transfer encodings are decoded below
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		data, err := decodeMHTMLPart(p)
+		if err != nil {
+			continue
+		}
+		partType, partParams, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if cs := partParams["charset"]; cs != "" && strings.HasPrefix(partType, "text/") {
+			if enc, err := lookupEncoding(cs); err == nil {
+				if utf8Data, err := enc.NewDecoder().Bytes(data); err == nil {
+					data = utf8Data
+					if partType == "text/html" {
+						data = []byte(setMetaCharset(string(data), "utf-8"))
+					}
+				}
+			}
+		}
+		part := mhtmlPart{
+			location:  p.Header.Get("Content-Location"),
+			mediaType: partType,
+			data:      data,
+		}
+		cid := strings.Trim(p.Header.Get("Content-ID"), "<>")
+
+		if part.location != "" {
+			byLocation[part.location] = part
+		}
+		if cid != "" {
+			byContentID[cid] = part
+		}
+		isRoot := (start != "" && cid == start) ||
+			(snapshot != "" && part.location == snapshot) ||
+			(root == nil && start == "" && snapshot == "" && partType == "text/html")
+		if isRoot && part.mediaType == "text/html" {
+			root = &part
+		}
+	}
+	if root == nil {
+		return "", fmt.Errorf("MHTML archive has no HTML part")
+	}
+
+	resolve := func(ref, base string) (mhtmlPart, bool) {
+		if strings.HasPrefix(ref, "cid:") {
+			part, ok := byContentID[strings.TrimPrefix(ref, "cid:")]
+			return part, ok
+		}
+		if part, ok := byLocation[ref]; ok {
+			return part, true
+		}
+		baseURL, err := url.Parse(base)
+		if err != nil {
+			return mhtmlPart{}, false
+		}
+		u, err := url.Parse(ref)
+		if err != nil {
+			return mhtmlPart{}, false
+		}
+		part, ok := byLocation[baseURL.ResolveReference(u).String()]
+		return part, ok
+	}
+
+	var inline func(part mhtmlPart, depth int) string
+	inline = func(part mhtmlPart, depth int) string {
+		data := part.data
+		if part.mediaType == "text/css" && depth < 8 {
+			a := &assetRewriter{
+				mapRef: func(ref string) (string, bool) {
+					sub, ok := resolve(ref, part.location)
+					if !ok {
+						return "", false
+					}
+					return inline(sub, depth+1), true
+				},
+			}
+			css, _ := a.rewriteCSS(string(data), "")
+			data = []byte(css)
+		}
+		return fmt.Sprintf("data:%s;base64,%s", part.mediaType, base64.StdEncoding.EncodeToString(data))
+	}
+
+	a := &assetRewriter{
+		mapRef: func(ref string) (string, bool) {
+			if strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") {
+				return "", false
+			}
+			part, ok := resolve(ref, root.location)
+			if !ok || path.Clean(part.location) == path.Clean(root.location) {
+				return "", false
+			}
+			return inline(part, 0), true
+		},
+		followLinks: true,
+	}
+	return a.rewriteHTML(string(root.data)), nil
+}
+
+func decodeMHTMLPart(p *multipart.Part) ([]byte, error) {
+	var r io.Reader = p
+	switch strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		raw, err := io.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, raw)
+		return base64.StdEncoding.DecodeString(string(clean))
+	case "quoted-printable":
+		r = quotedprintable.NewReader(p)
+	}
+	return io.ReadAll(r)
+}
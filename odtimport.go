@@ -0,0 +1,512 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	nsODFOffice = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+	nsODFText   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+	nsODFTable  = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	nsODFStyle  = "urn:oasis:names:tc:opendocument:xmlns:style:1.0"
+	nsODFDraw   = "urn:oasis:names:tc:opendocument:xmlns:drawing:1.0"
+	nsODFFormat = "urn:oasis:names:tc:opendocument:xmlns:xsl-fo-compatible:1.0"
+	nsODFSVG    = "urn:oasis:names:tc:opendocument:xmlns:svg-compatible:1.0"
+	nsXLink     = "http://www.w3.org/1999/xlink"
+)
+
+// odfNode keeps the mixed content of an OpenDocument element in order
+// (xmlNode concatenates it, which is enough for WordprocessingML where text
+// only lives in <w:t>). Text nodes have an empty Name.
+type odfNode struct {
+	Name     xml.Name
+	Attrs    []xml.Attr
+	Children []*odfNode
+	Text     string
+}
+
+func parseODFTree(data []byte) (*odfNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	root := &odfNode{}
+	stack := []*odfNode{root}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		top := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &odfNode{Name: t.Name, Attrs: t.Attr}
+			top.Children = append(top.Children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			top.Children = append(top.Children, &odfNode{Text: string(t)})
+		}
+	}
+	return root, nil
+}
+
+func (n *odfNode) is(space, local string) bool {
+	return n != nil && n.Name.Space == space && n.Name.Local == local
+}
+
+func (n *odfNode) attr(space, local string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attrs {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// find returns the first descendant with the given name, depth first.
+func (n *odfNode) find(space, local string) *odfNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.is(space, local) {
+			return c
+		}
+		if found := c.find(space, local); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+type odtStyle struct {
+	parent  string
+	props   *odfNode // <style:text-properties>
+	align   string
+	heading int // Outline level of paragraph styles used as headings
+}
+
+type odtConverter struct {
+	files      map[string]*zip.File
+	styles     map[string]*odtStyle
+	listStyles map[string][]bool // Per level: numbered rather than bulleted
+	noteHTML   []string
+	images     ImageOptions
+	report     ImageReport
+}
+
+// odtToHTML converts an OpenDocument text file (.odt) to editor HTML, the
+// same subset docxToHTML produces: headings, paragraphs with character
+// formatting, links, lists, tables, images and notes.
+func odtToHTML(content []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("invalid ODT: %v", err)
+	}
+	c := &odtConverter{
+		files:      make(map[string]*zip.File),
+		styles:     make(map[string]*odtStyle),
+		listStyles: make(map[string][]bool),
+		images:     globalImageOptions(),
+	}
+	for _, f := range zr.File {
+		c.files[f.Name] = f
+	}
+
+	data, err := readZipPart(c.files, "content.xml")
+	if err != nil {
+		return "", fmt.Errorf("invalid ODT: %v", err)
+	}
+	doc, err := parseODFTree(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid ODT: %v", err)
+	}
+	if data, err := readZipPart(c.files, "styles.xml"); err == nil {
+		if styles, err := parseODFTree(data); err == nil {
+			c.loadStyles(styles)
+		}
+	}
+	c.loadStyles(doc) // Automatic styles of the body override named ones
+
+	body := doc.find(nsODFOffice, "text")
+	if body == nil {
+		return "", fmt.Errorf("invalid ODT: no document body")
+	}
+
+	out := c.blocks(body.Children, "") + footnotesHTML(c.noteHTML)
+	imageReportLog("ODT import", &c.report)
+	return out, nil
+}
+
+// loadStyles records paragraph, text and list styles from office:styles and
+// office:automatic-styles.
+func (c *odtConverter) loadStyles(root *odfNode) {
+	var walk func(n *odfNode)
+	walk = func(n *odfNode) {
+		for _, s := range n.Children {
+			switch {
+			case s.is(nsODFStyle, "style"):
+				st := &odtStyle{parent: s.attr(nsODFStyle, "parent-style-name")}
+				st.heading, _ = strconv.Atoi(s.attr(nsODFStyle, "default-outline-level"))
+				for _, p := range s.Children {
+					switch {
+					case p.is(nsODFStyle, "text-properties"):
+						st.props = p
+					case p.is(nsODFStyle, "paragraph-properties"):
+						st.align = p.attr(nsODFFormat, "text-align")
+					}
+				}
+				c.styles[s.attr(nsODFStyle, "name")] = st
+			case s.is(nsODFText, "list-style"):
+				var levels []bool
+				for _, l := range s.Children {
+					level, _ := strconv.Atoi(l.attr(nsODFText, "level"))
+					if level < 1 || level > 10 {
+						continue
+					}
+					for len(levels) < level {
+						levels = append(levels, false)
+					}
+					levels[level-1] = l.is(nsODFText, "list-level-style-number")
+				}
+				c.listStyles[s.attr(nsODFStyle, "name")] = levels
+			case s.is(nsODFOffice, "styles"), s.is(nsODFOffice, "automatic-styles"),
+				s.is(nsODFOffice, "document-styles"), s.is(nsODFOffice, "document-content"):
+				walk(s)
+			}
+		}
+	}
+	walk(root)
+}
+
+// styleChain lists a style and its ancestors, nearest first.
+func (c *odtConverter) styleChain(name string) []*odtStyle {
+	var chain []*odtStyle
+	for depth := 0; name != "" && depth < 16; depth++ {
+		st, ok := c.styles[name]
+		if !ok {
+			break
+		}
+		chain = append(chain, st)
+		name = st.parent
+	}
+	return chain
+}
+
+// applyStyle layers the character formatting of a style over props.
+func (c *odtConverter) applyStyle(props runProps, name string) runProps {
+	chain := c.styleChain(name)
+	for i := len(chain) - 1; i >= 0; i-- {
+		t := chain[i].props
+		if t == nil {
+			continue
+		}
+		for _, a := range t.Attrs {
+			v := a.Value
+			switch a.Name.Local {
+			case "font-weight":
+				if a.Name.Space == nsODFFormat {
+					weight, _ := strconv.Atoi(v)
+					props.bold = v == "bold" || weight >= 600
+				}
+			case "font-style":
+				if a.Name.Space == nsODFFormat {
+					props.italic = v == "italic" || v == "oblique"
+				}
+			case "text-underline-style":
+				props.underline = v != "none"
+			case "text-line-through-style":
+				props.strike = v != "none"
+			case "text-position":
+				pos, _, _ := strings.Cut(v, " ")
+				props.sup = pos == "super" || pos != "sub" && !strings.HasPrefix(pos, "-") && strings.TrimLeft(pos, "0.%") != ""
+				props.sub = pos == "sub" || strings.HasPrefix(pos, "-")
+			case "color":
+				if a.Name.Space == nsODFFormat {
+					// Black is what most default styles spell out
+					props.color = strings.TrimPrefix(v, "#")
+					if strings.EqualFold(props.color, "000000") {
+						props.color = ""
+					}
+				}
+			case "background-color":
+				if a.Name.Space == nsODFFormat {
+					props.highlight = strings.TrimSuffix(v, "transparent")
+				}
+			}
+		}
+	}
+	return props
+}
+
+func (c *odtConverter) blocks(nodes []*odfNode, listStyle string) string {
+	var sb strings.Builder
+	for _, n := range nodes {
+		switch {
+		case n.is(nsODFText, "h"):
+			level, _ := strconv.Atoi(n.attr(nsODFText, "outline-level"))
+			sb.WriteString(c.paragraph(n, fmt.Sprintf("h%d", min(max(level, 1), 6))))
+		case n.is(nsODFText, "p"):
+			tag := "p"
+			for _, st := range c.styleChain(n.attr(nsODFText, "style-name")) {
+				if st.heading > 0 {
+					tag = fmt.Sprintf("h%d", min(st.heading, 6))
+					break
+				}
+			}
+			sb.WriteString(c.paragraph(n, tag))
+		case n.is(nsODFText, "list"):
+			sb.WriteString(c.list(n, listStyle, 0))
+		case n.is(nsODFTable, "table"):
+			sb.WriteString(c.table(n))
+		case n.is(nsODFText, "section"), n.is(nsODFText, "table-of-content"),
+			n.is(nsODFText, "alphabetical-index"), n.is(nsODFText, "illustration-index"),
+			n.is(nsODFText, "index-body"), n.is(nsODFText, "index-title"):
+			sb.WriteString(c.blocks(n.Children, listStyle))
+		}
+	}
+	return sb.String()
+}
+
+func (c *odtConverter) paragraph(p *odfNode, tag string) string {
+	style := p.attr(nsODFText, "style-name")
+	align := ""
+	for _, st := range c.styleChain(style) {
+		if st.align != "" {
+			align = st.align
+			break
+		}
+	}
+	attrs := ""
+	switch align {
+	case "center":
+		attrs = ` style="text-align: center"`
+	case "end", "right":
+		attrs = ` style="text-align: right"`
+	case "justify":
+		attrs = ` style="text-align: justify"`
+	}
+
+	w := &inlineWriter{}
+	c.inline(p.Children, c.applyStyle(runProps{}, style), w)
+	content := strings.TrimSpace(w.String())
+	if content == "" {
+		content = "<br>"
+	}
+	return "<" + tag + attrs + ">" + content + "</" + tag + ">\n"
+}
+
+// list renders a text:list. Nested lists without a style of their own
+// take the level below in the style of the enclosing list.
+func (c *odtConverter) list(n *odfNode, style string, level int) string {
+	if s := n.attr(nsODFText, "style-name"); s != "" {
+		style = s
+	}
+	tag := "ul"
+	if levels := c.listStyles[style]; level < len(levels) && levels[level] {
+		tag = "ol"
+	}
+	attrs := ""
+	var sb strings.Builder
+	for _, item := range n.Children {
+		if !item.is(nsODFText, "list-item") && !item.is(nsODFText, "list-header") {
+			continue
+		}
+		if start := item.attr(nsODFText, "start-value"); start != "" && sb.Len() == 0 && tag == "ol" {
+			attrs = ` start="` + html.EscapeString(start) + `"`
+		}
+		var content strings.Builder
+		for _, child := range item.Children {
+			if child.is(nsODFText, "list") {
+				content.WriteString(c.list(child, style, level+1))
+			} else {
+				content.WriteString(c.blocks([]*odfNode{child}, style))
+			}
+		}
+		text := content.String()
+		// A single plain paragraph needs no <p> inside the item
+		if inner, ok := strings.CutPrefix(text, "<p>"); ok && strings.Count(text, "<p") == 1 {
+			inner, nested, _ := strings.Cut(inner, "</p>\n")
+			text = inner + nested
+		}
+		sb.WriteString("<li>" + text + "</li>\n")
+	}
+	return "<" + tag + attrs + ">\n" + sb.String() + "</" + tag + ">\n"
+}
+
+func (c *odtConverter) inline(nodes []*odfNode, props runProps, w *inlineWriter) {
+	for _, n := range nodes {
+		switch {
+		case n.Name.Local == "":
+			open, close := props.tags()
+			w.write(open, close, html.EscapeString(collapseSpace(n.Text)))
+		case n.is(nsODFText, "span"):
+			c.inline(n.Children, c.applyStyle(props, n.attr(nsODFText, "style-name")), w)
+		case n.is(nsODFText, "a"):
+			href := n.attr(nsXLink, "href")
+			if href == "" {
+				c.inline(n.Children, props, w)
+				break
+			}
+			w.raw(`<a href="` + html.EscapeString(href) + `">`)
+			c.inline(n.Children, c.applyStyle(props, n.attr(nsODFText, "style-name")), w)
+			w.raw("</a>")
+		case n.is(nsODFText, "line-break"):
+			w.raw("<br>")
+		case n.is(nsODFText, "tab"):
+			w.raw("&emsp;")
+		case n.is(nsODFText, "s"):
+			count, err := strconv.Atoi(n.attr(nsODFText, "c"))
+			if err != nil || count < 1 {
+				count = 1
+			}
+			open, close := props.tags()
+			w.write(open, close, strings.Repeat("&#160;", min(count, 100)))
+		case n.is(nsODFText, "note"):
+			w.raw(c.note(n))
+		case n.is(nsODFDraw, "frame"):
+			w.raw(c.frame(n))
+		case n.is(nsODFOffice, "annotation"), n.is(nsODFOffice, "annotation-end"),
+			n.is(nsODFText, "tracked-changes"), n.is(nsODFText, "bookmark-start"),
+			n.is(nsODFText, "bookmark-end"), n.is(nsODFText, "soft-page-break"):
+		default:
+			// Fields (page numbers, dates, references) keep their shown text
+			c.inline(n.Children, props, w)
+		}
+	}
+}
+
+// note renders a footnote or endnote reference, with the note body collected
+// for the end of the document.
+func (c *odtConverter) note(n *odfNode) string {
+	body := n.find(nsODFText, "note-body")
+	if body == nil {
+		return ""
+	}
+	num := len(c.noteHTML) + 1
+	c.noteHTML = append(c.noteHTML, "") // Reserve the slot; notes may nest
+	c.noteHTML[num-1] = footnoteItemHTML(num, c.blocks(body.Children, ""))
+	return footnoteRefHTML(num)
+}
+
+// frame renders a draw:frame: an embedded picture, or the paragraphs of a
+// text box as lines.
+func (c *odtConverter) frame(n *odfNode) string {
+	if img := n.find(nsODFDraw, "image"); img != nil {
+		href := img.attr(nsXLink, "href")
+		data, err := readZipPart(c.files, strings.TrimPrefix(href, "./"))
+		if err != nil {
+			return ""
+		}
+		alt := ""
+		if title := n.find(nsODFSVG, "desc"); title != nil {
+			alt = odfText(title)
+		} else if title := n.find(nsODFSVG, "title"); title != nil {
+			alt = odfText(title)
+		}
+		width := odfLengthPixels(n.attr(nsODFSVG, "width"))
+		height := odfLengthPixels(n.attr(nsODFSVG, "height"))
+		return importedImage(href, data, alt, width, height, c.images, &c.report)
+	}
+	if box := n.find(nsODFDraw, "text-box"); box != nil {
+		var sb strings.Builder
+		for _, p := range box.Children {
+			if !p.is(nsODFText, "p") && !p.is(nsODFText, "h") {
+				continue
+			}
+			w := &inlineWriter{}
+			c.inline(p.Children, c.applyStyle(runProps{}, p.attr(nsODFText, "style-name")), w)
+			sb.WriteString(strings.TrimSpace(w.String()) + "<br>")
+		}
+		return sb.String()
+	}
+	return ""
+}
+
+func (c *odtConverter) table(tbl *odfNode) string {
+	var sb strings.Builder
+	sb.WriteString("<table>\n")
+	var rows func(nodes []*odfNode, header bool)
+	rows = func(nodes []*odfNode, header bool) {
+		for _, n := range nodes {
+			switch {
+			case n.is(nsODFTable, "table-header-rows"):
+				rows(n.Children, true)
+			case n.is(nsODFTable, "table-rows"), n.is(nsODFTable, "table-row-group"):
+				rows(n.Children, header)
+			case n.is(nsODFTable, "table-row"):
+				sb.WriteString("<tr>")
+				for _, cell := range n.Children {
+					if !cell.is(nsODFTable, "table-cell") {
+						continue // Covered cells are part of a span
+					}
+					tag := "td"
+					if header {
+						tag = "th"
+					}
+					attrs := ""
+					if span, err := strconv.Atoi(cell.attr(nsODFTable, "number-columns-spanned")); err == nil && span > 1 {
+						attrs += fmt.Sprintf(` colspan="%d"`, span)
+					}
+					if span, err := strconv.Atoi(cell.attr(nsODFTable, "number-rows-spanned")); err == nil && span > 1 {
+						attrs += fmt.Sprintf(` rowspan="%d"`, span)
+					}
+					content := c.blocks(cell.Children, "")
+					// A single plain paragraph needs no <p> inside the cell
+					if inner, ok := strings.CutPrefix(content, "<p>"); ok && strings.Count(content, "<p") == 1 {
+						content = strings.TrimSuffix(inner, "</p>\n")
+					}
+					sb.WriteString("<" + tag + attrs + ">" + content + "</" + tag + ">")
+				}
+				sb.WriteString("</tr>\n")
+			}
+		}
+	}
+	rows(tbl.Children, false)
+	sb.WriteString("</table>\n")
+	return sb.String()
+}
+
+// odfText returns the text content of an element.
+func odfText(n *odfNode) string {
+	var sb strings.Builder
+	var walk func(n *odfNode)
+	walk = func(n *odfNode) {
+		sb.WriteString(n.Text)
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.TrimSpace(sb.String())
+}
+
+// odfLengthPixels converts an ODF length such as "6.5in" or "2.54cm" to CSS
+// pixels, 0 when it cannot be read.
+func odfLengthPixels(s string) int {
+	units := map[string]float64{"in": 96, "cm": 96 / 2.54, "mm": 96 / 25.4, "pt": 96.0 / 72, "pc": 16, "px": 1}
+	for unit, factor := range units {
+		if v, ok := strings.CutSuffix(s, unit); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0
+			}
+			return int(f*factor + 0.5)
+		}
+	}
+	return 0
+}
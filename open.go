@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"html"
+	"strings"
+)
+
+// convertForEditor turns the bytes of an opened file into editor HTML for
+// clients that ask /api/open-file for converted content (?convert=html).
+// ok is false when the type has no backend converter; the caller then
+// serves the original bytes and leaves conversion to the browser.
+// assetMode is the ?assets= value of the request; ocr (?ocr=1) lets PDF
+// import transcribe scanned pages through the AI gateway.
+func convertForEditor(content []byte, ft *FileType, filePath, assetMode string, ocr bool) (out []byte, from string, ok bool, err error) {
+	switch ft.Name {
+	case "markdown":
+		out, err := markdownToEditorHTML(content, filePath, assetMode)
+		if err != nil {
+			return nil, "", false, err
+		}
+		return []byte(out), "markdown", true, nil
+	case "mhtml":
+		out, err := mhtmlToHTML(content)
+		if err != nil {
+			return nil, "", false, err
+		}
+		return []byte(out), "mhtml", true, nil
+	case "docx":
+		out, err := docxToHTML(content)
+		if err != nil {
+			return nil, "", false, err
+		}
+		return []byte(out), "docx", true, nil
+	case "pdf":
+		out, err := pdfToHTML(content, ocr)
+		if err != nil {
+			return nil, "", false, err
+		}
+		return []byte(out), "pdf", true, nil
+	case "csv":
+		out, err := csvToHTML(content)
+		if err != nil {
+			return nil, "", false, err
+		}
+		return []byte(out), "csv", true, nil
+	case "rtf":
+		out, err := rtfToHTML(content)
+		if err != nil {
+			return nil, "", false, err
+		}
+		return []byte(out), "rtf", true, nil
+	case "odt":
+		out, err := odtToHTML(content)
+		if err != nil {
+			return nil, "", false, err
+		}
+		return []byte(out), "odt", true, nil
+	case "epub":
+		out, err := epubToHTML(content)
+		if err != nil {
+			return nil, "", false, err
+		}
+		return []byte(out), "epub", true, nil
+	}
+	return nil, "", false, nil
+}
+
+// alwaysConvertForEditor reports types the browser cannot open on its own,
+// which /api/open-file converts even without ?convert=html.
+func alwaysConvertForEditor(ft *FileType) bool {
+	return ft.Kind == FILE_KIND_ARCHIVE || ft.Kind == FILE_KIND_DOCUMENT
+}
+
+// csvToHTML renders a CSV file as a table with the first row as header.
+func csvToHTML(content []byte) (string, error) {
+	r := csv.NewReader(bytes.NewReader(content))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	// Excel writes semicolon separated files in many locales
+	if firstLine, _, _ := strings.Cut(string(content), "\n"); strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		r.Comma = ';'
+	}
+	rows, err := r.ReadAll()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<table>\n")
+	for i, row := range rows {
+		cell := "td"
+		if i == 0 {
+			cell = "th"
+		}
+		sb.WriteString("<tr>")
+		for _, field := range row {
+			sb.WriteString("<" + cell + ">" + html.EscapeString(field) + "</" + cell + ">")
+		}
+		sb.WriteString("</tr>\n")
+	}
+	sb.WriteString("</table>\n")
+	return sb.String(), nil
+}
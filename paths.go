@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// appConfigDir is the per-user directory holding settings.json and the
+// other settings files.
+func appConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "WinHTMLEditor"), nil
+}
+
+// appDataDir is the per-user directory for bulky data that must stay on
+// this machine (a local, not roaming, profile folder on Windows).
+func appDataDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "WinHTMLEditor"), nil
+}
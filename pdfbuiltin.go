@@ -0,0 +1,710 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	PDF_FONT_ENV_VAR = "WINHTML_PDF_FONT" // TTF used by the built-in PDF renderer
+	pdfFontFamily    = "doc"
+	pdfMarginMM      = 10.16 // 0.4in, same as the browser export
+	pdfBaseFontPt    = 11.0
+	pdfPtToMM        = 25.4 / 72
+	pdfPxToMM        = 25.4 / 96
+)
+
+var whitespaceRe = regexp.MustCompile(`\s+`)
+
+// Heading sizes relative to body text, matching the editor stylesheet.
+var pdfHeadingScale = map[atom.Atom]float64{
+	atom.H1: 2.25, atom.H2: 1.75, atom.H3: 1.5,
+	atom.H4: 1.25, atom.H5: 1.125, atom.H6: 1.0,
+}
+
+// builtinExporter is the pure-Go fallback used when no Chromium-family
+// browser is available. It lays out the subset of HTML the editor produces
+// (text, headings, lists, tables, images, code) with fpdf. No CSS, no
+// scripts: KaTeX formulas come out as their LaTeX source.
+type builtinExporter struct{}
+
+func (builtinExporter) Name() string { return "builtin" }
+
+func (builtinExporter) Screenshot(html string, opts ExportOptions) ([]byte, error) {
+	return nil, errExportUnsupported
+}
+
+func (builtinExporter) PDF(htmlContent string, opts ExportOptions) (out []byte, err error) {
+	// fpdf panics on some input it cannot lay out; the fallback must not
+	// take the request down with it.
+	defer func() {
+		if x := recover(); x != nil {
+			out, err = nil, fmt.Errorf("built-in PDF renderer failed: %v", x)
+		}
+	}()
+	doc, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		return nil, err
+	}
+
+	r := newPDFRenderer(opts.Scale)
+	r.pdf.AddPage()
+	r.renderChildren(findContentRoot(doc))
+
+	var buf bytes.Buffer
+	if err := r.pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pdfFontPaths lists TTF files with CJK coverage first, then plain Latin
+// ones. TTC collections (msyh.ttc, simsun.ttc) cannot be used by fpdf.
+func pdfFontPaths() []string {
+	paths := []string{os.Getenv(PDF_FONT_ENV_VAR)}
+	switch runtime.GOOS {
+	case "windows":
+		fonts := os.Getenv("WINDIR") + `\Fonts\`
+		if fonts == `\Fonts\` {
+			fonts = `C:\Windows\Fonts\`
+		}
+		paths = append(paths, fonts+"Deng.ttf", fonts+"simhei.ttf", fonts+"simkai.ttf", fonts+"simfang.ttf", fonts+"arial.ttf")
+	case "darwin":
+		paths = append(paths,
+			"/Library/Fonts/Arial Unicode.ttf",
+			"/System/Library/Fonts/Supplemental/Arial Unicode.ttf",
+			"/System/Library/Fonts/Supplemental/Arial.ttf",
+		)
+	default:
+		paths = append(paths,
+			"/usr/share/fonts/truetype/droid/DroidSansFallbackFull.ttf",
+			"/usr/share/fonts/truetype/arphic/uming.ttf",
+			"/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf",
+			"/usr/share/fonts/TTF/DejaVuSans.ttf",
+		)
+	}
+	return paths
+}
+
+type pdfList struct {
+	ordered bool
+	n       int
+}
+
+type pdfRenderer struct {
+	pdf       *fpdf.Fpdf
+	family    string
+	utf8      bool
+	styles    map[string]bool // Bold/italic styles the family really has
+	translate func(string) string
+	scale     float64
+
+	bold, italic, underline, mono int
+	sizeFactor                    float64
+	pre                           int
+	indent                        float64
+	lists                         []pdfList
+	atLineStart                   bool
+	imageSeq                      int
+}
+
+func newPDFRenderer(scale float64) *pdfRenderer {
+	if scale <= 0 {
+		scale = 1.0
+	}
+	r := &pdfRenderer{scale: scale, sizeFactor: 1, atLineStart: true}
+
+	for _, path := range pdfFontPaths() {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		pdf := newPDFDocument()
+		pdf.AddUTF8FontFromBytes(pdfFontFamily, "", data)
+		if pdf.Err() {
+			continue
+		}
+		// Styles without a face of their own are set in the regular one
+		// rather than registering it under their name.
+		styles := map[string]bool{"": true}
+		for style, variant := range pdfFontVariants(path) {
+			if data, err := os.ReadFile(variant); err == nil {
+				pdf.AddUTF8FontFromBytes(pdfFontFamily, style, data)
+				if pdf.Err() {
+					pdf.ClearError()
+					continue
+				}
+				styles[style] = true
+			}
+		}
+		r.pdf, r.family, r.utf8, r.styles = pdf, pdfFontFamily, true, styles
+		break
+	}
+	if r.pdf == nil {
+		// Core fonts only cover cp1252; CJK text will not survive.
+		r.pdf, r.family = newPDFDocument(), "Helvetica"
+		r.translate = r.pdf.UnicodeTranslatorFromDescriptor("")
+		r.styles = map[string]bool{"": true, "B": true, "I": true, "BI": true}
+	}
+
+	r.applyFont()
+	return r
+}
+
+// pdfFontVariants returns the bold ("B"), italic ("I") and bold italic
+// ("BI") files next to a regular TTF, for the naming schemes of the fonts
+// pdfFontPaths lists (arialbd.ttf, Dengb.ttf, DejaVuSans-Bold.ttf, Arial
+// Bold.ttf).
+func pdfFontVariants(path string) map[string]string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+	suffixes := map[string][]string{
+		"B":  {"bd", "b", "-Bold", " Bold"},
+		"I":  {"i", "-Oblique", "-Italic", " Italic"},
+		"BI": {"bi", "z", "-BoldOblique", "-BoldItalic", " Bold Italic"},
+	}
+	variants := make(map[string]string)
+	for style, list := range suffixes {
+		for _, suffix := range list {
+			variant := filepath.Join(dir, name+suffix+ext)
+			if info, err := os.Stat(variant); err == nil && !info.IsDir() {
+				variants[style] = variant
+				break
+			}
+		}
+	}
+	return variants
+}
+
+func newPDFDocument() *fpdf.Fpdf {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(pdfMarginMM, pdfMarginMM, pdfMarginMM)
+	pdf.SetAutoPageBreak(true, pdfMarginMM)
+	pdf.SetCellMargin(0)
+	return pdf
+}
+
+// findContentRoot prefers the editor's .ProseMirror container, then <body>.
+func findContentRoot(doc *html.Node) *html.Node {
+	var body, editor *html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if editor != nil {
+			return
+		}
+		if n.Type == html.ElementNode {
+			if n.DataAtom == atom.Body && body == nil {
+				body = n
+			}
+			for _, cls := range strings.Fields(htmlAttr(n, "class")) {
+				if cls == "ProseMirror" {
+					editor = n
+					return
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if editor != nil {
+		return editor
+	}
+	if body != nil {
+		return body
+	}
+	return doc
+}
+
+func (r *pdfRenderer) fontSize() float64 {
+	return pdfBaseFontPt * r.sizeFactor * r.scale
+}
+
+func (r *pdfRenderer) lineHeight() float64 {
+	return r.fontSize() * pdfPtToMM * 1.5
+}
+
+func (r *pdfRenderer) applyFont() {
+	style := ""
+	if r.bold > 0 {
+		style += "B"
+	}
+	if r.italic > 0 {
+		style += "I"
+	}
+	if !r.styles[style] {
+		switch {
+		case r.styles["B"] && r.bold > 0:
+			style = "B"
+		case r.styles["I"] && r.italic > 0:
+			style = "I"
+		default:
+			style = ""
+		}
+	}
+	if r.underline > 0 {
+		style += "U"
+	}
+	family := r.family
+	if r.mono > 0 && !r.utf8 {
+		family = "Courier"
+	}
+	r.pdf.SetFont(family, style, r.fontSize())
+}
+
+// text prepares s for the current font. fpdf looks widths up by code
+// point, so UTF-8 fonts only take the Basic Multilingual Plane; core fonts
+// get cp1252, where the translator turns anything else into '.'.
+func (r *pdfRenderer) text(s string) string {
+	if r.translate != nil {
+		return r.translate(s)
+	}
+	return strings.Map(func(c rune) rune {
+		if c > 0xFFFF {
+			return '?'
+		}
+		return c
+	}, s)
+}
+
+// lineCount returns how many lines MultiCell needs for s at width w.
+// SplitText reads its input as UTF-8, so translated cp1252 text goes
+// through SplitLines, which works on bytes.
+func (r *pdfRenderer) lineCount(s string, w float64) int {
+	if r.translate != nil {
+		return len(r.pdf.SplitLines([]byte(r.text(s)), w))
+	}
+	return len(r.pdf.SplitText(r.text(s), w))
+}
+
+func (r *pdfRenderer) setIndent(indent float64) {
+	r.indent = indent
+	r.pdf.SetLeftMargin(pdfMarginMM + indent)
+	if r.atLineStart {
+		r.pdf.SetX(pdfMarginMM + indent)
+	}
+}
+
+// newline ends the current line, if anything was written on it.
+func (r *pdfRenderer) newline() {
+	if !r.atLineStart {
+		r.pdf.Ln(r.lineHeight())
+		r.atLineStart = true
+	}
+}
+
+func (r *pdfRenderer) space(mm float64) {
+	r.newline()
+	r.pdf.Ln(mm * r.scale)
+}
+
+func (r *pdfRenderer) write(s string) {
+	if r.pre == 0 {
+		s = whitespaceRe.ReplaceAllString(s, " ")
+		if r.atLineStart {
+			s = strings.TrimLeft(s, " ")
+		}
+	}
+	if s == "" {
+		return
+	}
+	r.pdf.Write(r.lineHeight(), r.text(s))
+	r.atLineStart = strings.HasSuffix(s, "\n")
+}
+
+func (r *pdfRenderer) renderChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.renderNode(c)
+	}
+}
+
+func (r *pdfRenderer) renderNode(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.write(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		r.renderChildren(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title, atom.Meta, atom.Link, atom.Template:
+		return
+
+	case atom.Br:
+		r.atLineStart = false
+		r.newline()
+
+	case atom.Strong, atom.B:
+		r.withStyle(&r.bold, n)
+	case atom.Em, atom.I, atom.Cite:
+		r.withStyle(&r.italic, n)
+	case atom.U, atom.Ins:
+		r.withStyle(&r.underline, n)
+	case atom.Code, atom.Kbd, atom.Samp:
+		r.withStyle(&r.mono, n)
+
+	case atom.Span:
+		if latex := htmlAttr(n, "data-latex"); latex != "" {
+			r.italic++
+			r.applyFont()
+			r.write(" " + latex + " ")
+			r.italic--
+			r.applyFont()
+			return
+		}
+		r.renderChildren(n)
+
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		r.space(3)
+		prev := r.sizeFactor
+		r.sizeFactor = pdfHeadingScale[n.DataAtom]
+		r.bold++
+		r.applyFont()
+		r.renderChildren(n)
+		r.newline()
+		r.bold--
+		r.sizeFactor = prev
+		r.applyFont()
+		r.pdf.Ln(1.5 * r.scale)
+
+	case atom.P:
+		r.space(0)
+		r.renderChildren(n)
+		r.newline()
+		r.pdf.Ln(2 * r.scale)
+
+	case atom.Ul, atom.Ol:
+		r.newline()
+		r.lists = append(r.lists, pdfList{ordered: n.DataAtom == atom.Ol})
+		if start, err := strconv.Atoi(htmlAttr(n, "start")); err == nil {
+			r.lists[len(r.lists)-1].n = start - 1
+		}
+		prev := r.indent
+		r.setIndent(prev + 6*r.scale)
+		r.renderChildren(n)
+		r.newline()
+		r.setIndent(prev)
+		r.lists = r.lists[:len(r.lists)-1]
+
+	case atom.Li:
+		r.newline()
+		marker := "-"
+		if r.utf8 {
+			marker = "•"
+		}
+		if len(r.lists) > 0 {
+			list := &r.lists[len(r.lists)-1]
+			list.n++
+			if list.ordered {
+				marker = fmt.Sprintf("%d.", list.n)
+			}
+		}
+		if checked := htmlAttr(n, "data-checked"); checked != "" {
+			marker = "[ ]"
+			if checked == "true" {
+				marker = "[x]"
+			}
+		}
+		y := r.pdf.GetY()
+		r.pdf.SetXY(pdfMarginMM+r.indent-5*r.scale, y)
+		r.pdf.CellFormat(5*r.scale, r.lineHeight(), r.text(marker), "", 0, "L", false, 0, "")
+		r.pdf.SetXY(pdfMarginMM+r.indent, y)
+		r.renderChildren(n)
+		r.newline()
+
+	case atom.Pre:
+		r.space(1)
+		r.pre++
+		r.mono++
+		r.applyFont()
+		r.renderChildren(n)
+		r.pre--
+		r.mono--
+		r.applyFont()
+		r.newline()
+		r.pdf.Ln(2 * r.scale)
+
+	case atom.Blockquote:
+		r.newline()
+		prev := r.indent
+		r.setIndent(prev + 6*r.scale)
+		r.italic++
+		r.applyFont()
+		r.renderChildren(n)
+		r.newline()
+		r.italic--
+		r.applyFont()
+		r.setIndent(prev)
+
+	case atom.Hr:
+		r.space(2)
+		y := r.pdf.GetY()
+		pageW, _ := r.pdf.GetPageSize()
+		r.pdf.SetDrawColor(200, 200, 200)
+		r.pdf.Line(pdfMarginMM+r.indent, y, pageW-pdfMarginMM, y)
+		r.pdf.SetDrawColor(0, 0, 0)
+		r.pdf.Ln(2 * r.scale)
+
+	case atom.Img:
+		r.renderImage(n)
+
+	case atom.Table:
+		r.renderTable(n)
+
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main,
+		atom.Nav, atom.Aside, atom.Figure, atom.Figcaption, atom.Dl, atom.Dt, atom.Dd:
+		r.newline()
+		r.renderChildren(n)
+		r.newline()
+
+	default:
+		r.renderChildren(n)
+	}
+}
+
+func (r *pdfRenderer) withStyle(counter *int, n *html.Node) {
+	*counter++
+	r.applyFont()
+	r.renderChildren(n)
+	*counter--
+	r.applyFont()
+}
+
+// loadImageData resolves an <img src> to raw bytes. Exports are inlined
+// before they get here, so only data: URIs, absolute file paths/URLs and
+// /api/asset URLs of lazily opened documents are handled.
+func loadImageData(src string) ([]byte, error) {
+	if strings.HasPrefix(src, "data:") {
+		_, data, err := decodeDataURI(src)
+		return data, err
+	}
+	if path, ok := assetURLFile(src); ok {
+		return os.ReadFile(path)
+	}
+	if u, err := url.Parse(src); err == nil && u.Scheme == "file" {
+		return os.ReadFile(u.Path)
+	}
+	return os.ReadFile(src)
+}
+
+func (r *pdfRenderer) renderImage(n *html.Node) {
+	data, err := loadImageData(htmlAttr(n, "src"))
+	if err != nil || len(data) == 0 {
+		return
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	// fpdf reads PNG/JPEG/GIF natively; anything else is re-encoded as PNG.
+	imageType := format
+	switch format {
+	case "png", "gif":
+	case "jpeg":
+		imageType = "jpg"
+	default:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if png.Encode(&buf, img) != nil {
+			return
+		}
+		data, imageType = buf.Bytes(), "png"
+	}
+
+	r.imageSeq++
+	name := fmt.Sprintf("img%d", r.imageSeq)
+	opts := fpdf.ImageOptions{ImageType: imageType}
+	r.pdf.RegisterImageOptionsReader(name, opts, bytes.NewReader(data))
+
+	wPx, hPx := float64(cfg.Width), float64(cfg.Height)
+	if attrW, err := strconv.ParseFloat(strings.TrimSuffix(htmlAttr(n, "width"), "px"), 64); err == nil && attrW > 0 {
+		hPx = hPx * attrW / wPx
+		wPx = attrW
+	}
+	w, h := wPx*pdfPxToMM*r.scale, hPx*pdfPxToMM*r.scale
+
+	pageW, pageH := r.pdf.GetPageSize()
+	maxW := pageW - 2*pdfMarginMM - r.indent
+	if w > maxW {
+		h, w = h*maxW/w, maxW
+	}
+	maxH := pageH - 2*pdfMarginMM
+	if h > maxH {
+		w, h = w*maxH/h, maxH
+	}
+
+	r.newline()
+	if r.pdf.GetY()+h > pageH-pdfMarginMM {
+		r.pdf.AddPage()
+	}
+	y := r.pdf.GetY()
+	r.pdf.ImageOptions(name, pdfMarginMM+r.indent, y, w, h, false, opts, 0, "")
+	r.pdf.SetY(y + h + 2*r.scale)
+	r.atLineStart = true
+}
+
+type pdfCell struct {
+	text    string
+	header  bool
+	colspan int
+}
+
+// nodeText flattens n into a single line of text.
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			sb.WriteString(n.Data)
+		case n.Type == html.ElementNode && n.DataAtom == atom.Br:
+			sb.WriteString("\n")
+		case n.Type == html.ElementNode && htmlAttr(n, "data-latex") != "":
+			sb.WriteString(htmlAttr(n, "data-latex"))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if n.Type == html.ElementNode && (n.DataAtom == atom.P || n.DataAtom == atom.Li || n.DataAtom == atom.Div) {
+			sb.WriteString("\n")
+		}
+	}
+	walk(n)
+
+	lines := strings.Split(sb.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(whitespaceRe.ReplaceAllString(line, " "))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func (r *pdfRenderer) renderTable(table *html.Node) {
+	var rows [][]pdfCell
+	var collect func(n *html.Node)
+	collect = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				collect(c)
+			case atom.Tr:
+				var row []pdfCell
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type != html.ElementNode || (cell.DataAtom != atom.Td && cell.DataAtom != atom.Th) {
+						continue
+					}
+					span, _ := strconv.Atoi(htmlAttr(cell, "colspan"))
+					if span < 1 {
+						span = 1
+					}
+					row = append(row, pdfCell{text: nodeText(cell), header: cell.DataAtom == atom.Th, colspan: span})
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	collect(table)
+
+	cols := 0
+	for _, row := range rows {
+		n := 0
+		for _, cell := range row {
+			n += cell.colspan
+		}
+		if n > cols {
+			cols = n
+		}
+	}
+	if cols == 0 {
+		return
+	}
+
+	r.space(1)
+	pageW, pageH := r.pdf.GetPageSize()
+	left := pdfMarginMM + r.indent
+	colW := (pageW - pdfMarginMM - left) / float64(cols)
+	lineH := r.lineHeight()
+	pad := 1.0 * r.scale
+
+	r.pdf.SetDrawColor(204, 204, 204)
+	r.pdf.SetFillColor(241, 243, 245)
+	for _, row := range rows {
+		rowH := lineH + 2*pad
+		for _, cell := range row {
+			if cell.header {
+				r.bold++
+			}
+			r.applyFont()
+			lines := r.lineCount(cell.text, colW*float64(cell.colspan)-2*pad)
+			if cell.header {
+				r.bold--
+			}
+			if h := float64(lines)*lineH + 2*pad; h > rowH {
+				rowH = h
+			}
+		}
+
+		y := r.pdf.GetY()
+		if y+rowH > pageH-pdfMarginMM {
+			r.pdf.AddPage()
+			y = r.pdf.GetY()
+		}
+
+		x := left
+		for _, cell := range row {
+			w := colW * float64(cell.colspan)
+			style := "D"
+			if cell.header {
+				style = "FD"
+				r.bold++
+			}
+			r.applyFont()
+			r.pdf.Rect(x, y, w, rowH, style)
+			r.pdf.SetXY(x+pad, y+pad)
+			r.pdf.MultiCell(w-2*pad, lineH, r.text(cell.text), "", "L", false)
+			if cell.header {
+				r.bold--
+			}
+			x += w
+		}
+		r.pdf.SetXY(left, y+rowH)
+	}
+	r.pdf.SetDrawColor(0, 0, 0)
+	r.applyFont()
+	r.atLineStart = true
+	r.pdf.Ln(2 * r.scale)
+}
@@ -0,0 +1,1087 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+const (
+	PDF_SCANNED_MAX_CHARS = 20      // Pages with less text and a page-sized image are scans
+	PDF_CELL_GAP          = 2.0     // Gap between glyphs, in font sizes, that separates table cells
+	PDF_WORD_GAP          = 0.2     // Gap that stands for a space
+	PDF_HEADING_RATIO     = 1.15    // Font size over the body size that makes a heading
+	PDF_MAX_IMAGE_BYTES   = 1 << 26 // Decoded size limit of a single image
+	PDF_PX_PER_PT         = 96.0 / 72.0
+)
+
+var (
+	pdfBulletMarker   = regexp.MustCompile(`^([•◦▪▫●○■□‣⁃∙·\-–*]|[\x{F000}-\x{F0FF}])\s+`)
+	pdfOrderedMarker  = regexp.MustCompile(`^\(?(\d{1,3}|[a-z])[.)]\s+`)
+	pdfPageNumberLine = regexp.MustCompile(`(?i)^(page\s*)?[-–]?\s*\d+\s*[-–]?(\s*(/|of)\s*\d+)?$`)
+)
+
+// pdfRun is text drawn in one style.
+type pdfRun struct {
+	text         string
+	bold, italic bool
+}
+
+// pdfTextCell is a stretch of a line between wide gaps: a table cell, or the
+// whole line for ordinary text.
+type pdfTextCell struct {
+	x0, x1 float64
+	runs   []pdfRun
+}
+
+type pdfLine struct {
+	y, size float64 // Baseline and dominant font size
+	x0, x1  float64
+	cells   []pdfTextCell
+	bold    bool
+	image   string // <img> instead of text
+	top     float64
+}
+
+func (l *pdfLine) text() string {
+	var sb strings.Builder
+	for i, c := range l.cells {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		for _, r := range c.runs {
+			sb.WriteString(r.text)
+		}
+	}
+	return sb.String()
+}
+
+// pdfPageLayout is one page reduced to lines, top to bottom.
+type pdfPageLayout struct {
+	number        int
+	width, height float64
+	lines         []*pdfLine
+	chars         int
+	scan          string // Page image of a scanned page, as a data: URI
+}
+
+// pdfToHTML extracts the text of a digitally generated PDF as editor HTML:
+// paragraphs from line spacing, headings from font sizes, lists from their
+// markers and simple tables from aligned columns. Embedded images come out
+// as data: URIs, which saving moves to the assets folder like any other.
+// Pages that are only a scanned image are transcribed by the AI gateway
+// when ocr is set and kept as the image otherwise.
+func pdfToHTML(content []byte, ocr bool) (out string, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("unreadable PDF: %v", x)
+		}
+	}()
+	r, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("invalid PDF: %v", err)
+	}
+
+	var streams map[[3]int][]byte
+	if r.Trailer().Key("Encrypt").IsNull() {
+		streams = scanPdfImageStreams(content)
+	}
+	x := &pdfExtractor{streams: streams, images: globalImageOptions(), report: &ImageReport{}}
+
+	var pages []*pdfPageLayout
+	sizes := make(map[float64]int)
+	for i := 1; i <= r.NumPage(); i++ {
+		page := r.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		layout := x.page(page, i)
+		for _, l := range layout.lines {
+			if l.image == "" {
+				sizes[l.size] += utf8.RuneCountInString(l.text())
+			}
+		}
+		pages = append(pages, layout)
+	}
+	imageReportLog("PDF import", x.report)
+
+	headings := pdfHeadingSizes(sizes)
+	var sb strings.Builder
+	var scanned []int
+	for _, p := range pages {
+		if p.scan == "" {
+			sb.WriteString(pdfPageHTML(p, headings))
+			continue
+		}
+		scanned = append(scanned, p.number)
+		if ocr {
+			if md, err := ocrScannedPage(p); err == nil {
+				if h, err := markdownToHTML([]byte(md)); err == nil {
+					sb.WriteString(h)
+					continue
+				}
+			} else {
+				log.Printf("[PDF] OCR of page %d failed: %v", p.number, err)
+			}
+		}
+		sb.WriteString(`<p><img src="` + p.scan + `" alt="Page ` + strconv.Itoa(p.number) + `"></p>` + "\n")
+	}
+	if len(scanned) > 0 {
+		log.Printf("[PDF] Scanned pages: %v (ocr=%v)", scanned, ocr)
+	}
+	return sb.String(), nil
+}
+
+// pdfPlainText returns the text of a PDF line by line, for the search
+// index. Images are skipped and scanned pages give no text.
+func pdfPlainText(content []byte) (out string, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("unreadable PDF: %v", x)
+		}
+	}()
+	r, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("invalid PDF: %v", err)
+	}
+	x := &pdfExtractor{textOnly: true}
+	var sb strings.Builder
+	for i := 1; i <= r.NumPage(); i++ {
+		page := r.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		for _, l := range x.page(page, i).lines {
+			sb.WriteString(l.text())
+			sb.WriteByte('\n')
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
+
+// ocrScannedPage sends the image of a scanned page through the active AI
+// profile.
+func ocrScannedPage(p *pdfPageLayout) (string, error) {
+	provider, key, err := resolveAiProvider("")
+	if err != nil {
+		return "", err
+	}
+	if provider.Model == "" {
+		return "", fmt.Errorf("no model configured for %s", provider.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), AI_REQUEST_TIMEOUT)
+	defer cancel()
+	return transcribePage(ctx, provider, key, pdfPageImage{page: p.number, dataURI: p.scan}, 0, nil, nil)
+}
+
+type pdfExtractor struct {
+	streams  map[[3]int][]byte // Raw image streams by width, height and length
+	images   ImageOptions
+	report   *ImageReport
+	textOnly bool // Skip images, for pdfPlainText
+}
+
+// page lays out the text and images of one page. A page that fails to
+// parse yields whatever was read before the failure.
+func (x *pdfExtractor) page(p pdf.Page, number int) (layout *pdfPageLayout) {
+	layout = &pdfPageLayout{number: number, width: 612, height: 792}
+	var box pdf.Value // Inherited from the page tree
+	for v := p.V; box.IsNull() && !v.IsNull(); v = v.Key("Parent") {
+		box = v.Key("MediaBox")
+	}
+	if box.Len() == 4 {
+		layout.width = box.Index(2).Float64() - box.Index(0).Float64()
+		layout.height = box.Index(3).Float64() - box.Index(1).Float64()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[PDF] Page %d: %v", number, r)
+		}
+	}()
+
+	var glyphs []pdf.Text
+	for _, t := range p.Content().Text {
+		if t.S == "" || t.S == "\n" || t.FontSize == 0 {
+			continue
+		}
+		t.FontSize = math.Abs(t.FontSize)
+		glyphs = append(glyphs, t)
+		if !unicode.IsSpace([]rune(t.S)[0]) {
+			layout.chars++
+		}
+	}
+	layout.lines = pdfGroupLines(glyphs)
+	if x.textOnly {
+		return layout
+	}
+
+	images := x.pageImages(p)
+	if layout.chars < PDF_SCANNED_MAX_CHARS {
+		for _, img := range images {
+			if img.w*img.h > 0.5*layout.width*layout.height {
+				layout.scan = img.dataURI
+				return layout
+			}
+		}
+	}
+	for _, img := range images {
+		layout.lines = append(layout.lines, &pdfLine{
+			y: img.y, top: img.y + img.h, x0: img.x, x1: img.x + img.w,
+			image: fmt.Sprintf(`<img src="%s" width="%d">`, img.dataURI, int(img.w*PDF_PX_PER_PT)),
+		})
+	}
+	sort.SliceStable(layout.lines, func(i, j int) bool { return layout.lines[i].top > layout.lines[j].top })
+	return layout
+}
+
+// --- Lines ---
+
+func pdfStyle(font string) (bold, italic bool) {
+	f := strings.ToLower(font)
+	bold = strings.Contains(f, "bold") || strings.Contains(f, "black") || strings.Contains(f, "heavy") || strings.Contains(f, "semibold") || strings.Contains(f, "demi")
+	italic = strings.Contains(f, "italic") || strings.Contains(f, "oblique")
+	return
+}
+
+func pdfIsWide(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) || (r >= 0x3000 && r <= 0x303F) || (r >= 0xFF00 && r <= 0xFFEF)
+}
+
+// pdfGlyphWidth falls back to an estimate for fonts whose widths the
+// reader cannot map (two-byte CID fonts).
+func pdfGlyphWidth(t pdf.Text) float64 {
+	if t.W > 0 {
+		return t.W
+	}
+	if pdfIsWide(t.S) {
+		return t.FontSize
+	}
+	return t.FontSize * 0.5
+}
+
+// pdfGroupLines gathers glyphs into lines by baseline and splits each line
+// into cells at wide gaps.
+func pdfGroupLines(glyphs []pdf.Text) []*pdfLine {
+	sort.SliceStable(glyphs, func(i, j int) bool { return glyphs[i].Y > glyphs[j].Y })
+	var groups [][]pdf.Text
+	for _, g := range glyphs {
+		n := len(groups)
+		if n > 0 {
+			ref := groups[n-1][0]
+			if math.Abs(ref.Y-g.Y) < 0.5*math.Max(ref.FontSize, g.FontSize) {
+				groups[n-1] = append(groups[n-1], g)
+				continue
+			}
+		}
+		groups = append(groups, []pdf.Text{g})
+	}
+
+	var lines []*pdfLine
+	for _, group := range groups {
+		if l := pdfBuildLine(group); l != nil {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func pdfBuildLine(group []pdf.Text) *pdfLine {
+	sort.SliceStable(group, func(i, j int) bool { return group[i].X < group[j].X })
+
+	sizeCount := make(map[float64]int)
+	l := &pdfLine{x0: group[0].X, bold: true}
+	var cell *pdfTextCell
+	var prev *pdf.Text
+	space := false
+	prevX := math.NaN()
+	add := func(text string, bold, italic bool) {
+		runs := cell.runs
+		if n := len(runs); n > 0 && runs[n-1].bold == bold && runs[n-1].italic == italic {
+			runs[n-1].text += text
+			return
+		}
+		cell.runs = append(runs, pdfRun{text: text, bold: bold, italic: italic})
+	}
+
+	for i := range group {
+		g := &group[i]
+		x := g.X
+		if prev != nil && x == prevX {
+			// Fonts without widths leave every glyph of a string at its start
+			g.X = prev.X + pdfGlyphWidth(*prev)
+		}
+		prevX = x
+		if unicode.IsSpace([]rune(g.S)[0]) {
+			space = cell != nil
+			continue
+		}
+		if prev != nil && g.S == prev.S && math.Abs(g.X-prev.X) < 0.1*g.FontSize {
+			continue // Drawn twice for a fake bold
+		}
+		bold, italic := pdfStyle(g.Font)
+		if prev != nil {
+			gap := g.X - (prev.X + pdfGlyphWidth(*prev))
+			size := math.Max(g.FontSize, prev.FontSize)
+			if gap > PDF_CELL_GAP*size {
+				cell.x1 = prev.X + pdfGlyphWidth(*prev)
+				cell = nil
+				space = false
+			} else if space || (gap > PDF_WORD_GAP*size && !(pdfIsWide(g.S) && pdfIsWide(prev.S))) {
+				add(" ", bold, italic)
+			}
+		}
+		if cell == nil {
+			l.cells = append(l.cells, pdfTextCell{x0: g.X})
+			cell = &l.cells[len(l.cells)-1]
+		}
+		add(g.S, bold, italic)
+		space = false
+		l.bold = l.bold && bold
+		sizeCount[math.Round(g.FontSize*2)/2]++
+		l.y = g.Y
+		prev = g
+	}
+	if prev == nil {
+		return nil
+	}
+	cell.x1 = prev.X + pdfGlyphWidth(*prev)
+	l.x1 = cell.x1
+	for size, n := range sizeCount {
+		if n > sizeCount[l.size] || (n == sizeCount[l.size] && size > l.size) {
+			l.size = size
+		}
+	}
+	l.top = l.y + l.size
+	return l
+}
+
+// pdfHeadingSizes maps the font sizes clearly above the body text to
+// heading levels, the three largest to h1-h3 and the rest to h4.
+func pdfHeadingSizes(sizes map[float64]int) map[float64]int {
+	body, bodyCount := 0.0, 0
+	for size, n := range sizes {
+		if n > bodyCount {
+			body, bodyCount = size, n
+		}
+	}
+	var larger []float64
+	for size := range sizes {
+		if size > body*PDF_HEADING_RATIO {
+			larger = append(larger, size)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(larger)))
+	levels := make(map[float64]int)
+	for i, size := range larger {
+		levels[size] = min(i+1, 4)
+	}
+	return levels
+}
+
+// --- Blocks ---
+
+func pdfRunsHTML(runs []pdfRun) string {
+	var sb strings.Builder
+	for _, r := range runs {
+		text := html.EscapeString(r.text)
+		if r.italic {
+			text = "<em>" + text + "</em>"
+		}
+		if r.bold {
+			text = "<strong>" + text + "</strong>"
+		}
+		sb.WriteString(text)
+	}
+	return sb.String()
+}
+
+// pdfPlainRuns drops the bold of runs in headings, which are bold anyway.
+func pdfPlainRuns(runs []pdfRun) []pdfRun {
+	for i := range runs {
+		runs[i].bold = false
+	}
+	return runs
+}
+
+// pdfTrimRunes drops the first n characters, for list markers.
+func pdfTrimRunes(runs []pdfRun, n int) []pdfRun {
+	out := append([]pdfRun{}, runs...)
+	for len(out) > 0 && n > 0 {
+		count := utf8.RuneCountInString(out[0].text)
+		if count <= n {
+			n -= count
+			out = out[1:]
+			continue
+		}
+		out[0].text = string([]rune(out[0].text)[n:])
+		n = 0
+	}
+	return out
+}
+
+func (l *pdfLine) runs() []pdfRun {
+	var runs []pdfRun
+	for i, c := range l.cells {
+		if i > 0 {
+			runs = append(runs, pdfRun{text: " "})
+		}
+		runs = append(runs, c.runs...)
+	}
+	return runs
+}
+
+// pdfJoin appends a line to a paragraph, undoing hyphenation and leaving
+// no space between CJK lines.
+func pdfJoin(runs []pdfRun, prevText string, next []pdfRun) []pdfRun {
+	if len(next) == 0 {
+		return runs
+	}
+	last, _ := utf8.DecodeLastRuneInString(prevText)
+	first, _ := utf8.DecodeRuneInString(next[0].text)
+	switch {
+	case last == '-' && unicode.IsLower(first) && len(runs) > 0:
+		n := len(runs) - 1
+		runs[n].text = strings.TrimSuffix(runs[n].text, "-")
+	case pdfIsWide(string(last)) && pdfIsWide(string(first)):
+	default:
+		runs = append(runs, pdfRun{text: " "})
+	}
+	return append(runs, next...)
+}
+
+type pdfListItem struct {
+	runs     []pdfRun
+	ordered  bool
+	start    int
+	x0       float64
+	lastText string
+}
+
+// pdfPageHTML turns the lines of a page into blocks.
+func pdfPageHTML(p *pdfPageLayout, headings map[float64]int) string {
+	var sb strings.Builder
+	lines := p.lines
+	margin := p.height * 0.06
+
+	var para []pdfRun
+	var paraLast *pdfLine
+	var paraText string
+	paraLines := 0
+	paraCentered := true
+	var items []pdfListItem
+
+	flushPara := func() {
+		if paraLast == nil {
+			return
+		}
+		tag := "p"
+		last, _ := utf8.DecodeLastRuneInString(paraText)
+		if level := headings[paraLast.size]; level > 0 {
+			tag = "h" + strconv.Itoa(level)
+		} else if paraLast.bold && len(paraText) < 80 && !strings.ContainsRune(".:;,!?。！？", last) && paraLines == 1 {
+			tag = "h4" // A short bold line of its own
+		}
+		if tag != "p" {
+			para = pdfPlainRuns(para)
+		}
+		style := ""
+		if paraCentered {
+			style = ` style="text-align: center"`
+		}
+		sb.WriteString("<" + tag + style + ">" + pdfRunsHTML(para) + "</" + tag + ">\n")
+		para, paraLast, paraText, paraLines, paraCentered = nil, nil, "", 0, true
+	}
+	flushList := func() {
+		if len(items) == 0 {
+			return
+		}
+		tag := "ul"
+		attrs := ""
+		if items[0].ordered {
+			tag = "ol"
+			if items[0].start > 1 {
+				attrs = fmt.Sprintf(` start="%d"`, items[0].start)
+			}
+		}
+		sb.WriteString("<" + tag + attrs + ">\n")
+		for _, it := range items {
+			sb.WriteString("<li><p>" + pdfRunsHTML(it.runs) + "</p></li>\n")
+		}
+		sb.WriteString("</" + tag + ">\n")
+		items = nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		if l.image != "" {
+			flushPara()
+			flushList()
+			sb.WriteString("<p>" + l.image + "</p>\n")
+			continue
+		}
+		text := strings.TrimSpace(l.text())
+		if (l.y < margin || l.y > p.height-margin) && pdfPageNumberLine.MatchString(text) {
+			continue // Page numbers in headers and footers
+		}
+
+		if n := pdfTableRows(lines, i); n >= 2 {
+			flushPara()
+			flushList()
+			sb.WriteString(pdfTableHTML(lines[i : i+n]))
+			i += n - 1
+			continue
+		}
+
+		prev := paraLast
+		lineGap := 0.0
+		if i > 0 && lines[i-1].image == "" {
+			lineGap = lines[i-1].y - l.y
+		}
+
+		// List items and their continuation lines
+		if m := pdfBulletMarker.FindStringSubmatch(text); m != nil && len(l.cells) > 0 {
+			flushPara()
+			if len(items) > 0 && items[0].ordered {
+				flushList()
+			}
+			items = append(items, pdfListItem{runs: pdfTrimRunes(pdfTrimLeft(l.runs()), utf8.RuneCountInString(m[0])), x0: l.x0, lastText: text})
+			continue
+		}
+		if m := pdfOrderedMarker.FindStringSubmatch(text); m != nil {
+			flushPara()
+			if len(items) > 0 && !items[0].ordered {
+				flushList()
+			}
+			start, err := strconv.Atoi(m[1])
+			if err != nil {
+				start = int(m[1][0]-'a') + 1
+			}
+			items = append(items, pdfListItem{runs: pdfTrimRunes(pdfTrimLeft(l.runs()), utf8.RuneCountInString(m[0])), ordered: true, start: start, x0: l.x0, lastText: text})
+			continue
+		}
+		if n := len(items); n > 0 {
+			if l.x0 > items[n-1].x0+0.5*l.size && lineGap > 0 && lineGap < 1.8*l.size {
+				items[n-1].runs = pdfJoin(items[n-1].runs, items[n-1].lastText, l.runs())
+				items[n-1].lastText = text
+				continue
+			}
+			flushList()
+		}
+
+		// Paragraphs: lines continue one while spacing, size and indent agree
+		centered := math.Abs((l.x0+l.x1)/2-p.width/2) < p.width*0.05 && l.x1-l.x0 < p.width*0.7
+		if prev != nil {
+			sameClass := headings[prev.size] == headings[l.size]
+			closeBelow := lineGap > 0 && lineGap < 1.8*math.Max(prev.size, l.size)
+			last, _ := utf8.DecodeLastRuneInString(paraText)
+			ended := strings.ContainsRune(".!?:。！？：", last) && prev.x1 < pdfRightEdge(lines)-3*l.size
+			if !sameClass || !closeBelow || ended || l.x0 > prev.x0+2*l.size {
+				flushPara()
+			}
+		}
+		if paraLast == nil {
+			para = l.runs()
+		} else {
+			para = pdfJoin(para, paraText, l.runs())
+		}
+		paraText, paraLast = text, l
+		paraLines++
+		paraCentered = paraCentered && centered
+	}
+	flushPara()
+	flushList()
+	return sb.String()
+}
+
+func pdfTrimLeft(runs []pdfRun) []pdfRun {
+	for len(runs) > 0 {
+		runs[0].text = strings.TrimLeftFunc(runs[0].text, unicode.IsSpace)
+		if runs[0].text != "" {
+			break
+		}
+		runs = runs[1:]
+	}
+	return runs
+}
+
+// pdfRightEdge is the right margin of the text on the page.
+func pdfRightEdge(lines []*pdfLine) float64 {
+	edge := 0.0
+	for _, l := range lines {
+		if l.image == "" {
+			edge = math.Max(edge, l.x1)
+		}
+	}
+	return edge
+}
+
+// pdfTableRows counts the lines from i on that read as rows of one table:
+// at least two cells each, closely spaced, with cells starting at columns
+// shared with the first row.
+func pdfTableRows(lines []*pdfLine, i int) int {
+	first := lines[i]
+	if len(first.cells) < 2 || first.image != "" {
+		return 0
+	}
+	n := 1
+	for j := i + 1; j < len(lines); j++ {
+		l := lines[j]
+		if l.image != "" || len(l.cells) < 2 || lines[j-1].y-l.y > 3*l.size {
+			break
+		}
+		shared := 0
+		for _, c := range l.cells {
+			for _, fc := range first.cells {
+				if math.Abs(c.x0-fc.x0) < 1.5*l.size || math.Abs(c.x1-fc.x1) < 1.5*l.size {
+					shared++
+					break
+				}
+			}
+		}
+		if shared < 2 {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func pdfTableHTML(rows []*pdfLine) string {
+	// Column starts, clustered over every row
+	var starts []float64
+	for _, r := range rows {
+		for _, c := range r.cells {
+			starts = append(starts, c.x0)
+		}
+	}
+	sort.Float64s(starts)
+	var cols []float64
+	for _, x := range starts {
+		if len(cols) == 0 || x-cols[len(cols)-1] > 1.5*rows[0].size {
+			cols = append(cols, x)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<table>\n")
+	for ri, r := range rows {
+		cells := make([][]pdfRun, len(cols))
+		for _, c := range r.cells {
+			col := 0
+			for k, x := range cols {
+				if c.x0 >= x-1.5*r.size {
+					col = k
+				}
+			}
+			if len(cells[col]) > 0 {
+				cells[col] = append(cells[col], pdfRun{text: " "})
+			}
+			cells[col] = append(cells[col], c.runs...)
+		}
+		tag := "td"
+		if ri == 0 && r.bold {
+			tag = "th"
+			for k := range cells {
+				cells[k] = pdfPlainRuns(cells[k])
+			}
+		}
+		sb.WriteString("<tr>")
+		for _, c := range cells {
+			sb.WriteString("<" + tag + "><p>" + pdfRunsHTML(c) + "</p></" + tag + ">")
+		}
+		sb.WriteString("</tr>\n")
+	}
+	sb.WriteString("</table>\n")
+	return sb.String()
+}
+
+// --- Images ---
+
+type pdfPlacedImage struct {
+	x, y, w, h float64
+	dataURI    string
+}
+
+type pdfMatrix [6]float64
+
+func (m pdfMatrix) mul(n pdfMatrix) pdfMatrix {
+	return pdfMatrix{
+		m[0]*n[0] + m[1]*n[2], m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2], m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4], m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+// pageImages finds the images a page draws, following form XObjects one
+// level deep, with their placement from the transformation matrix.
+func (x *pdfExtractor) pageImages(p pdf.Page) []pdfPlacedImage {
+	var out []pdfPlacedImage
+	seen := make(map[string]bool)
+	var walk func(strm, res pdf.Value, ctm pdfMatrix, depth int)
+	walk = func(strm, res pdf.Value, ctm pdfMatrix, depth int) {
+		var stack []pdfMatrix
+		pdf.Interpret(strm, func(stk *pdf.Stack, op string) {
+			args := make([]pdf.Value, stk.Len())
+			for i := len(args) - 1; i >= 0; i-- {
+				args[i] = stk.Pop()
+			}
+			switch op {
+			case "q":
+				stack = append(stack, ctm)
+			case "Q":
+				if n := len(stack); n > 0 {
+					ctm, stack = stack[n-1], stack[:n-1]
+				}
+			case "cm":
+				if len(args) == 6 {
+					var m pdfMatrix
+					for i := range m {
+						m[i] = args[i].Float64()
+					}
+					ctm = m.mul(ctm)
+				}
+			case "Do":
+				if len(args) != 1 {
+					return
+				}
+				xobj := res.Key("XObject").Key(args[0].Name())
+				switch xobj.Key("Subtype").Name() {
+				case "Image":
+					w, h := math.Hypot(ctm[0], ctm[1]), math.Hypot(ctm[2], ctm[3])
+					key := fmt.Sprintf("%s@%.0f,%.0f", args[0].Name(), ctm[4], ctm[5])
+					if w < 8 || h < 8 || seen[key] {
+						return // Rules, bullets and repeats drawn as images
+					}
+					seen[key] = true
+					if dataURI := x.image(xobj); dataURI != "" {
+						out = append(out, pdfPlacedImage{x: ctm[4], y: math.Min(ctm[5], ctm[5]+ctm[3]), w: w, h: h, dataURI: dataURI})
+					}
+				case "Form":
+					if depth > 0 {
+						return
+					}
+					m := pdfMatrix{1, 0, 0, 1, 0, 0}
+					if mv := xobj.Key("Matrix"); mv.Len() == 6 {
+						for i := range m {
+							m[i] = mv.Index(i).Float64()
+						}
+					}
+					formRes := xobj.Key("Resources")
+					if formRes.IsNull() {
+						formRes = res
+					}
+					walk(xobj, formRes, m.mul(ctm), depth+1)
+				}
+			}
+		})
+	}
+	func() {
+		defer func() { recover() }() // Keep the images found before a parse error
+		walk(p.V.Key("Contents"), p.Resources(), pdfMatrix{1, 0, 0, 1, 0, 0}, 0)
+	}()
+	return out
+}
+
+// image decodes an image XObject to a data: URI. JPEGs pass through;
+// Flate compressed pixels are re-encoded as PNG. Other filters (CCITT,
+// JBIG2, JPEG 2000) are not supported by browsers either and are skipped.
+func (x *pdfExtractor) image(v pdf.Value) string {
+	width, height := int(v.Key("Width").Int64()), int(v.Key("Height").Int64())
+	raw, ok := x.streams[[3]int{width, height, int(v.Key("Length").Int64())}]
+	if !ok || width <= 0 || height <= 0 {
+		return ""
+	}
+
+	var filters []string
+	var params []pdf.Value
+	switch f := v.Key("Filter"); f.Kind() {
+	case pdf.Name:
+		filters, params = []string{f.Name()}, []pdf.Value{v.Key("DecodeParms")}
+	case pdf.Array:
+		for i := 0; i < f.Len(); i++ {
+			filters = append(filters, f.Index(i).Name())
+			params = append(params, v.Key("DecodeParms").Index(i))
+		}
+	}
+
+	var data []byte
+	var mediaType string
+	switch {
+	case len(filters) == 1 && filters[0] == "DCTDecode":
+		data, mediaType = raw, "image/jpeg"
+	case len(filters) == 0 || (len(filters) == 1 && filters[0] == "FlateDecode"):
+		pixels := raw
+		if len(filters) == 1 {
+			zr, err := zlib.NewReader(bytes.NewReader(raw))
+			if err != nil {
+				return ""
+			}
+			pixels, err = io.ReadAll(io.LimitReader(zr, PDF_MAX_IMAGE_BYTES))
+			if err != nil && len(pixels) == 0 {
+				return ""
+			}
+			pixels = pdfUnpredict(pixels, params[0])
+		}
+		img := pdfPixelsToImage(v, pixels, width, height)
+		if img == nil {
+			return ""
+		}
+		var buf bytes.Buffer
+		if png.Encode(&buf, img) != nil {
+			return ""
+		}
+		data, mediaType = buf.Bytes(), "image/png"
+	default:
+		return ""
+	}
+
+	uri := "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	if x.images.Enabled {
+		uri = optimizeDataURI(uri, x.images, x.report)
+	}
+	return uri
+}
+
+// pdfUnpredict undoes PNG row predictors (Predictor 10-15).
+func pdfUnpredict(data []byte, params pdf.Value) []byte {
+	if params.Key("Predictor").Int64() < 10 {
+		return data
+	}
+	colors, bpc, columns := int(params.Key("Colors").Int64()), int(params.Key("BitsPerComponent").Int64()), int(params.Key("Columns").Int64())
+	colors, bpc, columns = max(colors, 1), max(bpc, 8), max(columns, 1)
+	if params.Key("BitsPerComponent").Int64() > 0 {
+		bpc = int(params.Key("BitsPerComponent").Int64())
+	}
+	bpp := max(colors*bpc/8, 1)
+	stride := (colors*bpc*columns + 7) / 8
+	var out []byte
+	prev := make([]byte, stride)
+	for len(data) >= stride+1 {
+		filter, row := data[0], append([]byte{}, data[1:stride+1]...)
+		data = data[stride+1:]
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			up := prev[i]
+			switch filter {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += pdfPaeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out
+}
+
+func pdfPaeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// pdfPixelsToImage wraps raw samples in DeviceGray, DeviceRGB, DeviceCMYK,
+// ICCBased or Indexed color.
+func pdfPixelsToImage(v pdf.Value, pixels []byte, width, height int) image.Image {
+	bpc := int(v.Key("BitsPerComponent").Int64())
+	if v.Key("ImageMask").Bool() {
+		bpc = 1
+	}
+	cs := v.Key("ColorSpace")
+	space, components := cs.Name(), 0
+	var palette []byte
+	var base string
+	if cs.Kind() == pdf.Array {
+		space = cs.Index(0).Name()
+		switch space {
+		case "ICCBased":
+			components = int(cs.Index(1).Key("N").Int64())
+		case "Indexed":
+			base = cs.Index(1).Name()
+			if cs.Index(1).Kind() == pdf.Array {
+				base = cs.Index(1).Index(0).Name()
+			}
+			lookup := cs.Index(3)
+			if lookup.Kind() == pdf.String {
+				palette = []byte(lookup.RawString())
+			} else {
+				palette, _ = io.ReadAll(io.LimitReader(lookup.Reader(), 4096))
+			}
+		}
+	}
+	switch space {
+	case "DeviceGray", "CalGray", "":
+		components = 1
+	case "DeviceRGB", "CalRGB":
+		components = 3
+	case "DeviceCMYK":
+		components = 4
+	case "Indexed":
+		components = 1
+	}
+	if components == 0 || (bpc != 8 && !(bpc == 1 && components == 1) && space != "Indexed") {
+		return nil
+	}
+	stride := (width*components*bpc + 7) / 8
+	if len(pixels) < stride*height {
+		return nil
+	}
+
+	sample := func(row []byte, i int) int {
+		switch bpc {
+		case 8:
+			return int(row[i])
+		case 4:
+			return int(row[i/2]>>(4*(1-i%2))) & 0x0F
+		case 2:
+			return int(row[i/4]>>(2*(3-i%4))) & 0x03
+		case 1:
+			return int(row[i/8]>>(7-i%8)) & 0x01
+		}
+		return 0
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := pixels[y*stride : (y+1)*stride]
+		for x := 0; x < width; x++ {
+			var c color.RGBA
+			switch {
+			case space == "Indexed":
+				idx := sample(row, x)
+				n := 3
+				if base == "DeviceGray" {
+					n = 1
+				}
+				if (idx+1)*n > len(palette) {
+					continue
+				}
+				if n == 1 {
+					g := palette[idx]
+					c = color.RGBA{g, g, g, 255}
+				} else {
+					c = color.RGBA{palette[idx*3], palette[idx*3+1], palette[idx*3+2], 255}
+				}
+			case components == 1 && bpc == 1:
+				g := byte(255 * sample(row, x))
+				if v.Key("ImageMask").Bool() {
+					g = 255 - g
+				}
+				c = color.RGBA{g, g, g, 255}
+			case components == 1:
+				g := row[x]
+				c = color.RGBA{g, g, g, 255}
+			case components == 3:
+				c = color.RGBA{row[x*3], row[x*3+1], row[x*3+2], 255}
+			case components == 4:
+				k := 255 - int(row[x*4+3])
+				c = color.RGBA{byte((255 - int(row[x*4])) * k / 255), byte((255 - int(row[x*4+1])) * k / 255), byte((255 - int(row[x*4+2])) * k / 255), 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+var (
+	pdfDictWidth  = regexp.MustCompile(`/Width\s+(\d+)`)
+	pdfDictHeight = regexp.MustCompile(`/Height\s+(\d+)`)
+	pdfDictLength = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+)
+
+// scanPdfImageStreams collects the raw bytes of every image stream. The
+// reader only decodes Flate without PNG predictors, so image data is taken
+// from the file directly and matched to XObjects by width, height and
+// length.
+func scanPdfImageStreams(content []byte) map[[3]int][]byte {
+	streams := make(map[[3]int][]byte)
+	keyword := []byte("stream")
+	for pos := 0; ; {
+		i := bytes.Index(content[pos:], keyword)
+		if i < 0 {
+			break
+		}
+		at := pos + i
+		pos = at + len(keyword)
+		if at >= 3 && string(content[at-3:at]) == "end" {
+			continue
+		}
+		head := content[max(0, at-4096):at]
+		if j := bytes.LastIndex(head, []byte(" obj")); j >= 0 {
+			head = head[j:]
+		}
+		if !bytes.HasSuffix(bytes.TrimRight(head, " \t\r\n"), []byte(">>")) || !bytes.Contains(head, []byte("/Image")) {
+			continue
+		}
+		w, h := pdfDictWidth.FindSubmatch(head), pdfDictHeight.FindSubmatch(head)
+		if w == nil || h == nil {
+			continue
+		}
+
+		start := pos
+		if start < len(content) && content[start] == '\r' {
+			start++
+		}
+		if start < len(content) && content[start] == '\n' {
+			start++
+		}
+		var data []byte
+		if l := pdfDictLength.FindSubmatch(head); l != nil && len(l[2]) == 0 {
+			n, _ := strconv.Atoi(string(l[1]))
+			if start+n > len(content) {
+				continue
+			}
+			data = content[start : start+n]
+		} else {
+			end := bytes.Index(content[start:], []byte("endstream"))
+			if end < 0 {
+				continue
+			}
+			data = bytes.TrimRight(content[start:start+end], "\r\n")
+		}
+		width, _ := strconv.Atoi(string(w[1]))
+		height, _ := strconv.Atoi(string(h[1]))
+		streams[[3]int{width, height, len(data)}] = data
+		pos = start + len(data)
+	}
+	return streams
+}
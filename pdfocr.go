@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	PDF_OCR_DEFAULT_DPI         = 150
+	PDF_OCR_MAX_DPI             = 300
+	PDF_OCR_MAX_PIXELS          = 4096             // Longest page side sent to the model
+	PDF_OCR_DEFAULT_CONCURRENCY = 3                // Pages transcribed at once
+	PDF_OCR_MAX_CONCURRENCY     = 8                // Keeps local servers responsive
+	PDF_OCR_ATTEMPTS            = 3                // Per page, for rate limits, 5xx and network errors
+	PDF_OCR_RETRY_DELAY         = 2 * time.Second  // Doubled on every retry
+	PDF_OCR_MAX_RETRY_DELAY     = 60 * time.Second // Cap for Retry-After
+	PDF_OCR_LOAD_TIMEOUT        = 60 * time.Second // pdf.js parsing the document
+	PDF_OCR_JOB_TIMEOUT         = 60 * time.Minute // Whole job, long PDFs on local models
+)
+
+// PdfOCRRequest transcribes a PDF through the AI gateway. Progress is sent
+// as server-sent events when Stream is set, otherwise the merged result is
+// returned as JSON at the end.
+type PdfOCRRequest struct {
+	Path        string `json:"path"`
+	Data        string `json:"data"`        // Base64 PDF, used when Path is empty
+	Pages       string `json:"pages"`       // "1-3,7"; empty for all pages
+	DPI         int    `json:"dpi"`         // Render resolution (default 150)
+	Provider    string `json:"provider"`    // AI profile id, "" for the active one
+	Model       string `json:"model"`       // Overrides the profile's model
+	Concurrency int    `json:"concurrency"` // Pages in flight (default 3)
+	RPM         int    `json:"rpm"`         // Max AI requests per minute, 0 = unlimited
+	Stream      bool   `json:"stream"`
+}
+
+// PdfOCRProgress is the data of a "progress" event.
+type PdfOCRProgress struct {
+	Page    int    `json:"page"`
+	Total   int    `json:"total"`
+	Stage   string `json:"stage"` // rendered, transcribing, retry, done, failed
+	Attempt int    `json:"attempt,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// PdfOCRResult is the data of the final "done" event.
+type PdfOCRResult struct {
+	Markdown string `json:"markdown"`
+	Html     string `json:"html"`
+	Pages    int    `json:"pages"`
+	Failed   []int  `json:"failed,omitempty"` // Pages left as an error note
+}
+
+// Same instructions as the in-browser import, written for small local
+// models as much as for hosted ones.
+const PDF_OCR_PROMPT = `[Task]
+Analyze the image and transcribe the text content into Markdown format.
+
+[Strict Rules]
+1. Output ONLY the transcribed text. NO conversational fillers (e.g., "Here is the text", "Sure", "好的").
+2. NO markdown code blocks (do not use ` + "```" + `).
+3. If there is no text, return an empty string.
+4. Preserve the original structure (headings, paragraphs).
+
+[Formatting]
+- Headings: Use #, ##, ###
+- Lists: Use - or 1.
+- Tables: Use Markdown table syntax
+- Math: Use LaTeX format ($...$ for inline, $$...$$ for block)
+
+[Language]
+Keep the original language of the text found in the image. Do NOT translate.`
+
+// pdfRenderPage loads a PDF into the bundled pdf.js and exposes
+// renderPdfPage(n, scale) returning the page as a JPEG data: URI.
+const pdfRenderPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><script src="/libs/pdf.js"></script></head>
+<body><script type="application/octet-stream" id="pdf-data">%s</script>
+<script>
+window.pdfState = "loading";
+(async () => {
+  try {
+    pdfjsLib.GlobalWorkerOptions.workerSrc = "/libs/pdf.worker.js";
+    const bytes = Uint8Array.from(atob(document.getElementById("pdf-data").textContent), c => c.charCodeAt(0));
+    window.pdfDoc = await pdfjsLib.getDocument({ data: bytes }).promise;
+    window.pdfState = "ready";
+  } catch (e) {
+    window.pdfState = "error: " + (e && e.message || e);
+  }
+})();
+window.renderPdfPage = async (n, scale, maxSide) => {
+  const page = await pdfDoc.getPage(n);
+  const base = page.getViewport({ scale: 1 });
+  scale = Math.min(scale, maxSide / Math.max(base.width, base.height));
+  const viewport = page.getViewport({ scale });
+  const canvas = document.createElement("canvas");
+  canvas.width = Math.ceil(viewport.width);
+  canvas.height = Math.ceil(viewport.height);
+  const ctx = canvas.getContext("2d");
+  ctx.fillStyle = "#fff";
+  ctx.fillRect(0, 0, canvas.width, canvas.height);
+  await page.render({ canvasContext: ctx, viewport }).promise;
+  page.cleanup();
+  return canvas.toDataURL("image/jpeg", 0.9);
+};
+</script></body></html>`
+
+type pdfPageImage struct {
+	page    int
+	dataURI string
+}
+
+// handlePdfOCR renders the pages of a PDF in the headless browser and has
+// them transcribed concurrently, with rate limiting and retries. Events:
+// start {pages}, progress (PdfOCRProgress), page {page, markdown}, done
+// (PdfOCRResult) and error {message}.
+func handlePdfOCR(w http.ResponseWriter, r *http.Request) {
+	var req PdfOCRRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "Invalid request body")
+		return
+	}
+
+	var pdf []byte
+	var err error
+	if req.Path != "" {
+		pdf, err = os.ReadFile(req.Path)
+	} else {
+		pdf, err = base64.StdEncoding.DecodeString(req.Data)
+	}
+	if err != nil || len(pdf) == 0 {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "Cannot read the PDF")
+		return
+	}
+	if detectFileType(req.Path, pdf).Name != "pdf" {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "Not a PDF file")
+		return
+	}
+	browserPath := findBrowserPath()
+	if browserPath == "" {
+		writeAiError(w, http.StatusNotImplemented, AI_ERROR_GATEWAY, "Rendering PDF pages needs a Chromium-based browser")
+		return
+	}
+
+	p, key, err := resolveAiProvider(req.Provider)
+	if err != nil {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, err.Error())
+		return
+	}
+	if req.Model != "" {
+		p.Model = req.Model
+	}
+	if p.Model == "" {
+		writeAiError(w, http.StatusBadRequest, AI_ERROR_GATEWAY, "No model configured for "+p.Name)
+		return
+	}
+	if req.DPI <= 0 {
+		req.DPI = PDF_OCR_DEFAULT_DPI
+	}
+	req.DPI = min(req.DPI, PDF_OCR_MAX_DPI)
+	if req.Concurrency <= 0 {
+		req.Concurrency = PDF_OCR_DEFAULT_CONCURRENCY
+	}
+	req.Concurrency = min(req.Concurrency, PDF_OCR_MAX_CONCURRENCY)
+
+	ctx, cancel := context.WithTimeout(r.Context(), PDF_OCR_JOB_TIMEOUT)
+	defer cancel()
+	events := newSSEWriter(w, req.Stream)
+
+	renderer, err := openPdfRenderer(ctx, browserPath, pdf)
+	if err != nil {
+		events.fail(http.StatusUnprocessableEntity, err)
+		return
+	}
+	defer renderer.close()
+
+	pages, err := parsePageRanges(req.Pages, renderer.numPages)
+	if err != nil {
+		events.fail(http.StatusBadRequest, err)
+		return
+	}
+	total := len(pages)
+	events.send("start", map[string]int{"pages": total})
+	log.Printf("[AI] OCR of %d page(s) with %s/%s", total, p.ID, p.Model)
+
+	// The renderer stays just ahead of the transcribers, so only a few page
+	// images are held at a time.
+	images := make(chan pdfPageImage, req.Concurrency)
+	var renderErr error
+	go func() {
+		defer close(images)
+		for _, n := range pages {
+			dataURI, err := renderer.render(n, float64(req.DPI)/72)
+			if err != nil {
+				renderErr = fmt.Errorf("page %d: %w", n, err)
+				return
+			}
+			events.send("progress", PdfOCRProgress{Page: n, Total: total, Stage: "rendered"})
+			select {
+			case images <- pdfPageImage{page: n, dataURI: dataURI}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var limiter <-chan time.Time
+	if req.RPM > 0 {
+		ticker := time.NewTicker(time.Minute / time.Duration(req.RPM))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	results := make(map[int]string)
+	var failed []int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < req.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for img := range images {
+				md, err := transcribePage(ctx, p, key, img, total, limiter, events)
+				mu.Lock()
+				if err != nil {
+					failed = append(failed, img.page)
+					md = fmt.Sprintf("> [Error processing Page %d: %s]", img.page, err.Error())
+					events.send("progress", PdfOCRProgress{Page: img.page, Total: total, Stage: "failed", Error: err.Error()})
+				} else {
+					events.send("progress", PdfOCRProgress{Page: img.page, Total: total, Stage: "done"})
+					events.send("page", map[string]interface{}{"page": img.page, "markdown": md})
+				}
+				results[img.page] = md
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		events.fail(http.StatusGatewayTimeout, ctx.Err())
+		return
+	}
+	if renderErr != nil {
+		events.fail(http.StatusUnprocessableEntity, renderErr)
+		return
+	}
+
+	var sb strings.Builder
+	for _, n := range pages {
+		sb.WriteString(results[n] + "\n\n")
+	}
+	html, err := markdownToHTML([]byte(sb.String()))
+	if err != nil {
+		events.fail(http.StatusInternalServerError, err)
+		return
+	}
+	sort.Ints(failed)
+	events.finish("done", PdfOCRResult{Markdown: sb.String(), Html: html, Pages: total, Failed: failed})
+}
+
+// transcribePage sends one page image to the model, retrying rate limits,
+// server errors and network failures with backoff.
+func transcribePage(ctx context.Context, p AiProviderConfig, key string, img pdfPageImage, total int, limiter <-chan time.Time, events *sseWriter) (string, error) {
+	req := map[string]interface{}{
+		"model":       p.Model,
+		"stream":      false,
+		"temperature": 0.1,
+		"top_p":       0.1,
+		"messages": []map[string]interface{}{{
+			"role": "user",
+			"content": []map[string]interface{}{
+				{"type": "image_url", "image_url": map[string]string{"url": img.dataURI}},
+				{"type": "text", "text": PDF_OCR_PROMPT},
+			},
+		}},
+	}
+
+	delay := PDF_OCR_RETRY_DELAY
+	for attempt := 1; ; attempt++ {
+		if limiter != nil {
+			select {
+			case <-limiter:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+		events.send("progress", PdfOCRProgress{Page: img.page, Total: total, Stage: "transcribing", Attempt: attempt})
+		text, err := aiComplete(ctx, p, key, req)
+		if err == nil {
+			return cleanTranscription(text), nil
+		}
+
+		var upErr *aiUpstreamError
+		retryable := ctx.Err() == nil
+		wait := delay
+		if errors.As(err, &upErr) {
+			retryable = retryable && (upErr.Status == http.StatusTooManyRequests || upErr.Status >= 500)
+			if upErr.RetryAfter > 0 {
+				wait = min(upErr.RetryAfter, PDF_OCR_MAX_RETRY_DELAY)
+			}
+		}
+		if !retryable || attempt == PDF_OCR_ATTEMPTS {
+			return "", err
+		}
+		log.Printf("[AI] OCR page %d attempt %d failed: %v", img.page, attempt, err)
+		events.send("progress", PdfOCRProgress{Page: img.page, Total: total, Stage: "retry", Attempt: attempt, Error: err.Error()})
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+var transcriptionPrefixes = []string{
+	"Here is the transcribed text:",
+	"Here is the text from the image:",
+	"Here is the text:",
+	"The text in the image is:",
+	"转换结果如下：",
+	"识别内容如下：",
+	"Sure, here is the markdown:",
+	"Certainly!",
+	"Okay,",
+}
+
+var (
+	fenceOpen  = regexp.MustCompile("(?i)^```(markdown|md)?\\s*")
+	fenceClose = regexp.MustCompile("\\s*```$")
+)
+
+// cleanTranscription strips the code fences and chatty openers models add
+// despite the prompt.
+func cleanTranscription(text string) string {
+	text = strings.TrimSpace(text)
+	text = fenceOpen.ReplaceAllString(text, "")
+	text = fenceClose.ReplaceAllString(text, "")
+	for _, prefix := range transcriptionPrefixes {
+		if len(text) >= len(prefix) && strings.EqualFold(text[:len(prefix)], prefix) {
+			text = strings.TrimSpace(text[len(prefix):])
+		}
+	}
+	return text
+}
+
+// parsePageRanges turns "1-3,7" into page numbers; empty means all.
+func parsePageRanges(spec string, numPages int) ([]int, error) {
+	if strings.TrimSpace(spec) == "" {
+		pages := make([]int, numPages)
+		for i := range pages {
+			pages[i] = i + 1
+		}
+		return pages, nil
+	}
+	seen := make(map[int]bool)
+	var pages []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+		first, err1 := strconv.Atoi(strings.TrimSpace(from))
+		last, err2 := first, error(nil)
+		if isRange {
+			last, err2 = strconv.Atoi(strings.TrimSpace(to))
+		}
+		if err1 != nil || err2 != nil || first < 1 || last < first || last > numPages {
+			return nil, fmt.Errorf("invalid page range %q for a %d page document", part, numPages)
+		}
+		for n := first; n <= last; n++ {
+			if !seen[n] {
+				seen[n] = true
+				pages = append(pages, n)
+			}
+		}
+	}
+	return pages, nil
+}
+
+// --- Page rendering ---
+
+type pdfPageRenderer struct {
+	ctx      context.Context
+	cancel   func()
+	release  func()
+	numPages int
+}
+
+// openPdfRenderer starts a headless browser on the PDF and waits for pdf.js
+// to parse it.
+func openPdfRenderer(ctx context.Context, browserPath string, pdf []byte) (*pdfPageRenderer, error) {
+	renderURL, release := storeRenderPage(fmt.Sprintf(pdfRenderPage, base64.StdEncoding.EncodeToString(pdf)))
+	browserCtx, cancelBrowser := newExportBrowser(browserPath, PDF_OCR_JOB_TIMEOUT)
+	stop := context.AfterFunc(ctx, cancelBrowser) // Client went away
+	r := &pdfPageRenderer{
+		ctx:     browserCtx,
+		release: release,
+		cancel: func() {
+			stop()
+			cancelBrowser()
+		},
+	}
+
+	var state string
+	loadCtx, cancelLoad := context.WithTimeout(browserCtx, PDF_OCR_LOAD_TIMEOUT)
+	defer cancelLoad()
+	err := chromedp.Run(loadCtx,
+		chromedp.Navigate(renderURL),
+		chromedp.Poll(`window.pdfState !== "loading"`, nil, chromedp.WithPollingInterval(100*time.Millisecond)),
+		chromedp.Evaluate(`window.pdfState`, &state),
+	)
+	if err == nil && state != "ready" {
+		err = fmt.Errorf("PDF could not be read: %s", strings.TrimPrefix(state, "error: "))
+	}
+	if err == nil {
+		err = chromedp.Run(browserCtx, chromedp.Evaluate(`pdfDoc.numPages`, &r.numPages))
+	}
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *pdfPageRenderer) render(page int, scale float64) (string, error) {
+	var dataURI string
+	err := chromedp.Run(r.ctx, chromedp.Evaluate(
+		fmt.Sprintf(`renderPdfPage(%d, %g, %d)`, page, scale, PDF_OCR_MAX_PIXELS),
+		&dataURI,
+		func(p *runtime.EvaluateParams) *runtime.EvaluateParams { return p.WithAwaitPromise(true) },
+	))
+	return dataURI, err
+}
+
+func (r *pdfPageRenderer) close() {
+	r.cancel()
+	r.release()
+}
+
+// --- Server-sent events ---
+
+// sseWriter sends named events from several goroutines. With streaming
+// off, only the final event is written, as a JSON body.
+type sseWriter struct {
+	w       http.ResponseWriter
+	stream  bool
+	mu      sync.Mutex
+	started bool
+}
+
+func newSSEWriter(w http.ResponseWriter, stream bool) *sseWriter {
+	return &sseWriter{w: w, stream: stream}
+}
+
+func (s *sseWriter) send(event string, v interface{}) {
+	if s == nil || !s.stream {
+		return
+	}
+	data, _ := json.Marshal(v)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes the result: a last event, or the JSON body.
+func (s *sseWriter) finish(event string, v interface{}) {
+	if s.stream {
+		s.send(event, v)
+		return
+	}
+	s.w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(s.w).Encode(v)
+}
+
+// fail reports an error as an "error" event once streaming has begun,
+// otherwise as an HTTP error.
+func (s *sseWriter) fail(status int, err error) {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if s.stream && started {
+		s.send("error", map[string]string{"message": err.Error()})
+		return
+	}
+	writeAiError(s.w, status, AI_ERROR_GATEWAY, err.Error())
+}
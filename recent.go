@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	RECENT_FILE          = "recent.json"
+	RECENT_MAX           = 50 // Unpinned entries kept; pinned ones are never dropped for space
+	RECENT_TRAY_MAX      = 10 // Entries listed in the tray menu
+	THUMBNAIL_SIZE       = 320
+	THUMBNAIL_VIEWPORT_W = 800
+	THUMBNAIL_VIEWPORT_H = 1000
+	THUMBNAIL_TIMEOUT    = 20 * time.Second
+)
+
+// RecentDocument is one entry of the recent files list. Thumbnail is the
+// URL of a preview image for types that can be rendered.
+type RecentDocument struct {
+	Path      string    `json:"path"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	OpenedAt  time.Time `json:"openedAt"`
+	SavedAt   time.Time `json:"savedAt"`
+	Pinned    bool      `json:"pinned"`
+	Missing   bool      `json:"missing,omitempty"` // Pinned file that is gone, e.g. on a removed drive
+	Thumbnail string    `json:"thumbnail,omitempty"`
+}
+
+func (d *RecentDocument) usedAt() time.Time {
+	if d.SavedAt.After(d.OpenedAt) {
+		return d.SavedAt
+	}
+	return d.OpenedAt
+}
+
+type RecentPinRequest struct {
+	Path   string `json:"path"`
+	Pinned bool   `json:"pinned"`
+}
+
+var (
+	recentMu    sync.Mutex
+	thumbnailMu sync.Mutex // One headless browser at a time
+)
+
+func recentPath() (string, error) {
+	dir, err := appConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, RECENT_FILE), nil
+}
+
+// loadRecent reads recent.json; a missing file is an empty list. Callers
+// hold recentMu.
+func loadRecent() ([]RecentDocument, error) {
+	var docs []RecentDocument
+	path, err := recentPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return docs, json.Unmarshal(data, &docs)
+}
+
+func saveRecent(docs []RecentDocument) error {
+	path, err := recentPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(docs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func findRecent(docs []RecentDocument, path string) int {
+	key := getLockKey(path)
+	for i := range docs {
+		if getLockKey(docs[i].Path) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordRecent notes that path was opened or saved (saved = true). Errors
+// are only logged: the list must never get in the way of the document.
+func recordRecent(path string, saved bool) {
+	if !filepath.IsAbs(path) {
+		return
+	}
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	docs, err := loadRecent()
+	if err != nil {
+		log.Printf("[Recent] %v", err)
+		return
+	}
+	i := findRecent(docs, path)
+	if i < 0 {
+		docs = append(docs, RecentDocument{Path: filepath.Clean(path)})
+		i = len(docs) - 1
+	}
+	d := &docs[i]
+	d.Name = filepath.Base(path)
+	d.Kind = detectFileType(path, nil).Kind
+	if saved {
+		d.SavedAt = time.Now()
+	} else {
+		d.OpenedAt = time.Now()
+	}
+	if err := saveRecent(pruneRecent(docs)); err != nil {
+		log.Printf("[Recent] %v", err)
+	}
+}
+
+// pruneRecent sorts the list, pinned entries first and then by last use,
+// drops unpinned files that no longer exist and trims it to RECENT_MAX.
+func pruneRecent(docs []RecentDocument) []RecentDocument {
+	sort.SliceStable(docs, func(i, j int) bool {
+		if docs[i].Pinned != docs[j].Pinned {
+			return docs[i].Pinned
+		}
+		return docs[i].usedAt().After(docs[j].usedAt())
+	})
+	kept := docs[:0]
+	unpinned := 0
+	for _, d := range docs {
+		_, err := os.Stat(d.Path)
+		d.Missing = err != nil
+		if !d.Pinned && (d.Missing || unpinned == RECENT_MAX) {
+			removeThumbnail(d.Path)
+			continue
+		}
+		if !d.Pinned {
+			unpinned++
+		}
+		kept = append(kept, d)
+	}
+	return kept
+}
+
+// recentDocuments returns the pruned list, for the API and the tray menu.
+func recentDocuments() ([]RecentDocument, error) {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	docs, err := loadRecent()
+	if err != nil {
+		return nil, err
+	}
+	before := len(docs)
+	docs = pruneRecent(docs)
+	if len(docs) != before {
+		if err := saveRecent(docs); err != nil {
+			return nil, err
+		}
+	}
+	for i := range docs {
+		if !docs[i].Missing && thumbnailSupported(docs[i].Kind) {
+			docs[i].Thumbnail = "/api/recent/thumbnail?path=" + url.QueryEscape(docs[i].Path)
+		}
+	}
+	return docs, nil
+}
+
+// updateRecent applies fn to the list under the lock and saves it.
+func updateRecent(fn func(docs []RecentDocument) ([]RecentDocument, error)) error {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	docs, err := loadRecent()
+	if err != nil {
+		return err
+	}
+	docs, err = fn(docs)
+	if err != nil {
+		return err
+	}
+	return saveRecent(pruneRecent(docs))
+}
+
+// renameRecent follows documents that were moved or renamed; moved maps an
+// old path to the new one.
+func renameRecent(moved func(path string) (string, bool)) {
+	err := updateRecent(func(docs []RecentDocument) ([]RecentDocument, error) {
+		for i := range docs {
+			if to, ok := moved(docs[i].Path); ok {
+				removeThumbnail(docs[i].Path)
+				docs[i].Path = to
+				docs[i].Name = filepath.Base(to)
+			}
+		}
+		return docs, nil
+	})
+	if err != nil {
+		log.Printf("[Recent] %v", err)
+	}
+}
+
+// openRecentDocument hands a file to a new editor tab, as a second
+// instance started with the file would.
+func openRecentDocument(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	id := generateID()
+	fileStoreMu.Lock()
+	fileStore[id] = FileData{
+		FileName: path,
+		Data:     base64.StdEncoding.EncodeToString(content),
+		MimeType: detectFileType(path, content).MimeType,
+	}
+	fileStoreMu.Unlock()
+	openDefaultBrowser(fmt.Sprintf("%s/?fileId=%s", globalTargetUrl, id))
+	return nil
+}
+
+// --- Thumbnails ---
+
+func thumbnailSupported(kind string) bool {
+	switch kind {
+	case FILE_KIND_HTML, FILE_KIND_MARKDOWN, FILE_KIND_TEXT, FILE_KIND_IMAGE:
+		return true
+	}
+	return false
+}
+
+// thumbnailPath is the cache file for a document's preview. Thumbnails are
+// a cache, so they live in the data dir rather than next to the settings.
+func thumbnailPath(docPath string) (string, error) {
+	dir, err := appDataDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(getLockKey(docPath)))
+	return filepath.Join(dir, "thumbnails", hex.EncodeToString(sum[:])), nil
+}
+
+func removeThumbnail(docPath string) {
+	if path, err := thumbnailPath(docPath); err == nil {
+		os.Remove(path)
+	}
+}
+
+// documentThumbnail returns a PNG or JPEG preview of the document,
+// rendering it when the cached one is older than the file. Documents are
+// captured in the headless browser (first screen only), images are scaled
+// down.
+func documentThumbnail(docPath string) ([]byte, error) {
+	info, err := os.Stat(docPath)
+	if err != nil {
+		return nil, err
+	}
+	cachePath, err := thumbnailPath(docPath)
+	if err != nil {
+		return nil, err
+	}
+
+	thumbnailMu.Lock()
+	defer thumbnailMu.Unlock()
+	if cached, err := os.Stat(cachePath); err == nil && cached.ModTime().After(info.ModTime()) {
+		return os.ReadFile(cachePath)
+	}
+
+	var shot []byte
+	ft := detectFileType(docPath, nil)
+	if ft.Kind == FILE_KIND_IMAGE {
+		shot, err = os.ReadFile(docPath)
+	} else {
+		browserPath := findBrowserPath()
+		if browserPath == "" {
+			return nil, errExportUnsupported
+		}
+		var page string
+		if page, err = loadDocumentForRender(docPath); err == nil {
+			shot, err = captureThumbnail(browserPath, page)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	thumb, mediaType := optimizeImage(shot, ImageOptions{Enabled: true, MaxDimension: THUMBNAIL_SIZE})
+	if mediaType == "" {
+		return nil, fmt.Errorf("cannot decode %s", filepath.Base(docPath))
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err == nil {
+		os.WriteFile(cachePath, thumb, 0600)
+	}
+	return thumb, nil
+}
+
+// captureThumbnail renders the first screen of a page.
+func captureThumbnail(browserPath, html string) ([]byte, error) {
+	renderURL, release := storeRenderPage(html)
+	defer release()
+
+	ctx, cancel := newExportBrowser(browserPath, THUMBNAIL_TIMEOUT)
+	defer cancel()
+
+	tracker := newNetworkTracker()
+	tracker.listen(ctx)
+
+	var buf []byte
+	err := chromedp.Run(ctx,
+		network.Enable(),
+		chromedp.EmulateViewport(THUMBNAIL_VIEWPORT_W, THUMBNAIL_VIEWPORT_H),
+		chromedp.Navigate(renderURL),
+		chromedp.WaitReady("body", chromedp.ByQuery),
+		waitRenderReady(tracker, renderReadyBound(0)),
+		chromedp.CaptureScreenshot(&buf),
+	)
+	return buf, err
+}
+
+// --- Handlers ---
+
+// handleRecent serves the recent files list:
+// GET /api/recent, POST /api/recent/pin {path, pinned},
+// POST /api/recent/remove {path}, POST /api/recent/clear (keeps pinned)
+// and GET /api/recent/thumbnail?path=.
+func handleRecent(w http.ResponseWriter, r *http.Request) {
+	if !sameOriginRequest(r) {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/recent" && r.Method == "GET":
+		docs, err := recentDocuments()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read recent files: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if docs == nil {
+			docs = []RecentDocument{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"documents": docs})
+
+	case r.URL.Path == "/api/recent/pin" && r.Method == "POST":
+		var req RecentPinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		err := updateRecent(func(docs []RecentDocument) ([]RecentDocument, error) {
+			i := findRecent(docs, req.Path)
+			if i < 0 {
+				if !req.Pinned {
+					return docs, nil
+				}
+				if _, err := os.Stat(req.Path); err != nil || !filepath.IsAbs(req.Path) {
+					return nil, fmt.Errorf("not a file: %s", req.Path)
+				}
+				docs = append(docs, RecentDocument{Path: filepath.Clean(req.Path), Name: filepath.Base(req.Path), Kind: detectFileType(req.Path, nil).Kind})
+				i = len(docs) - 1
+			}
+			docs[i].Pinned = req.Pinned
+			return docs, nil
+		})
+		writeRecentResult(w, err)
+
+	case r.URL.Path == "/api/recent/remove" && r.Method == "POST":
+		var req RecentPinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		err := updateRecent(func(docs []RecentDocument) ([]RecentDocument, error) {
+			if i := findRecent(docs, req.Path); i >= 0 {
+				removeThumbnail(docs[i].Path)
+				docs = append(docs[:i], docs[i+1:]...)
+			}
+			return docs, nil
+		})
+		writeRecentResult(w, err)
+
+	case r.URL.Path == "/api/recent/clear" && r.Method == "POST":
+		err := updateRecent(func(docs []RecentDocument) ([]RecentDocument, error) {
+			kept := docs[:0]
+			for _, d := range docs {
+				if d.Pinned {
+					kept = append(kept, d)
+				} else {
+					removeThumbnail(d.Path)
+				}
+			}
+			return kept, nil
+		})
+		writeRecentResult(w, err)
+
+	case r.URL.Path == "/api/recent/thumbnail" && r.Method == "GET":
+		path := r.URL.Query().Get("path")
+		recentMu.Lock()
+		docs, _ := loadRecent()
+		listed := findRecent(docs, path) >= 0
+		recentMu.Unlock()
+		if !listed {
+			http.NotFound(w, r) // Only documents on the list are rendered
+			return
+		}
+		thumb, err := documentThumbnail(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(thumb))
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(thumb)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func writeRecentResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	docs, err := recentDocuments()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if docs == nil {
+		docs = []RecentDocument{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"documents": docs})
+}
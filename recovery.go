@@ -0,0 +1,429 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RECOVERY_DIR         = "recovery"
+	RECOVERY_SNAPSHOTS   = 5                   // Snapshots kept per document
+	RECOVERY_MAX_AGE     = 14 * 24 * time.Hour // Journals untouched for longer are dropped
+	RECOVERY_MAX_TOTAL   = 512 << 20           // Oldest journals go first beyond this size
+	RECOVERY_MAX_UPLOAD  = 128 << 20
+	RECOVERY_META_FILE   = "meta.json"
+	RECOVERY_SNAP_PREFIX = "snap-"
+)
+
+// recoveryStartedAt separates journals of this run, which belong to open
+// tabs, from those a crashed or closed session left behind.
+var recoveryStartedAt = time.Now()
+
+var (
+	recoveryMu        sync.Mutex
+	recoverySessionRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// RecoverySnapshotRequest is posted by a tab every few seconds while a
+// document has unsaved changes. Session identifies the tab; Path is empty
+// for documents that were never saved, which are told apart by Title.
+type RecoverySnapshotRequest struct {
+	Session string `json:"session"`
+	Path    string `json:"path"`
+	Title   string `json:"title"`
+	Format  string `json:"format"` // Content format of Html: "html" (default) or "markdown"
+	Html    string `json:"html"`
+}
+
+type RecoveryDiscardRequest struct {
+	Session string `json:"session"`
+	Path    string `json:"path"`  // Empty with Title empty: the whole session
+	Title   string `json:"title"` // For documents without a path
+}
+
+type RecoveryOpenRequest struct {
+	ID       string `json:"id"`
+	Snapshot int    `json:"snapshot"` // Sequence number, 0 = latest
+	Keep     bool   `json:"keep"`     // Keep the journal after opening
+}
+
+// RecoveryEntry describes a recoverable document. DiskNewer warns that the
+// file was saved after the last snapshot, so the journal may be stale.
+type RecoveryEntry struct {
+	ID        string    `json:"id"`
+	Session   string    `json:"session"`
+	Path      string    `json:"path"`
+	Title     string    `json:"title"`
+	Format    string    `json:"format"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Snapshots []int     `json:"snapshots"`
+	Size      int64     `json:"size"`
+	DiskNewer bool      `json:"diskNewer,omitempty"`
+}
+
+// recoveryMeta is meta.json of a document journal.
+type recoveryMeta struct {
+	Session   string    `json:"session"`
+	Path      string    `json:"path"`
+	Title     string    `json:"title"`
+	Format    string    `json:"format"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Hash      string    `json:"hash"` // Of the latest snapshot, to skip unchanged ones
+	Seq       int       `json:"seq"`
+}
+
+func recoveryRoot() (string, error) {
+	dir, err := appDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, RECOVERY_DIR), nil
+}
+
+// recoveryDocKey names the journal of one document within a session.
+func recoveryDocKey(path, title string) string {
+	key := "untitled:" + title
+	if path != "" {
+		key = getLockKey(path)
+	}
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// recoveryDocDir resolves an entry ID ("session/key") to its directory.
+func recoveryDocDir(id string) (string, error) {
+	session, key, ok := strings.Cut(id, "/")
+	if !ok || !recoverySessionRe.MatchString(session) || !recoverySessionRe.MatchString(key) {
+		return "", fmt.Errorf("invalid recovery id: %s", id)
+	}
+	root, err := recoveryRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, session, key), nil
+}
+
+func readRecoveryMeta(dir string) (recoveryMeta, error) {
+	var meta recoveryMeta
+	data, err := os.ReadFile(filepath.Join(dir, RECOVERY_META_FILE))
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(data, &meta)
+}
+
+func snapshotName(seq int) string {
+	return fmt.Sprintf("%s%06d.html.gz", RECOVERY_SNAP_PREFIX, seq)
+}
+
+// snapshotSeqs lists the snapshot sequence numbers in dir, oldest first.
+func snapshotSeqs(dir string) []int {
+	entries, _ := os.ReadDir(dir)
+	var seqs []int
+	for _, e := range entries {
+		name := strings.TrimSuffix(strings.TrimPrefix(e.Name(), RECOVERY_SNAP_PREFIX), ".html.gz")
+		if seq, err := strconv.Atoi(name); err == nil && strings.HasPrefix(e.Name(), RECOVERY_SNAP_PREFIX) {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return seqs
+}
+
+// writeRecoverySnapshot stores a new snapshot unless the content did not
+// change, and drops the oldest ones beyond RECOVERY_SNAPSHOTS.
+func writeRecoverySnapshot(req RecoverySnapshotRequest) (int, error) {
+	root, err := recoveryRoot()
+	if err != nil {
+		return 0, err
+	}
+	dir := filepath.Join(root, req.Session, recoveryDocKey(req.Path, req.Title))
+
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	meta, err := readRecoveryMeta(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[Recovery] Starting over %s: %v", dir, err)
+	}
+	sum := sha1.Sum([]byte(req.Html))
+	hash := hex.EncodeToString(sum[:])
+	if meta.Hash == hash {
+		return meta.Seq, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	meta.Seq++
+	f, err := os.OpenFile(filepath.Join(dir, snapshotName(meta.Seq)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	zw := gzip.NewWriter(f)
+	_, err = io.WriteString(zw, req.Html)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	meta.Session, meta.Path, meta.Title, meta.Format = req.Session, req.Path, req.Title, req.Format
+	meta.UpdatedAt, meta.Hash = time.Now(), hash
+	data, _ := json.MarshalIndent(meta, "", "  ")
+	if err := os.WriteFile(filepath.Join(dir, RECOVERY_META_FILE), data, 0600); err != nil {
+		return 0, err
+	}
+
+	seqs := snapshotSeqs(dir)
+	for len(seqs) > RECOVERY_SNAPSHOTS {
+		os.Remove(filepath.Join(dir, snapshotName(seqs[0])))
+		seqs = seqs[1:]
+	}
+	return meta.Seq, nil
+}
+
+func readRecoverySnapshot(dir string, seq int) (string, error) {
+	f, err := os.Open(filepath.Join(dir, snapshotName(seq)))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(zr)
+	return string(data), err
+}
+
+// listRecovery returns the journals left behind by earlier runs, newest
+// first. It also applies the age and size limits to all journals.
+func listRecovery() ([]RecoveryEntry, error) {
+	root, err := recoveryRoot()
+	if err != nil {
+		return nil, err
+	}
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+
+	sessions, err := os.ReadDir(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var all []RecoveryEntry
+	for _, s := range sessions {
+		docs, _ := os.ReadDir(filepath.Join(root, s.Name()))
+		for _, d := range docs {
+			dir := filepath.Join(root, s.Name(), d.Name())
+			meta, err := readRecoveryMeta(dir)
+			seqs := snapshotSeqs(dir)
+			if err != nil || len(seqs) == 0 || time.Since(meta.UpdatedAt) > RECOVERY_MAX_AGE {
+				os.RemoveAll(dir)
+				continue
+			}
+			entry := RecoveryEntry{
+				ID: s.Name() + "/" + d.Name(), Session: meta.Session, Path: meta.Path, Title: meta.Title,
+				Format: meta.Format, UpdatedAt: meta.UpdatedAt, Snapshots: seqs,
+			}
+			files, _ := os.ReadDir(dir)
+			for _, f := range files {
+				if info, err := f.Info(); err == nil {
+					entry.Size += info.Size()
+				}
+			}
+			if meta.Path != "" {
+				if info, err := os.Stat(meta.Path); err == nil && info.ModTime().After(meta.UpdatedAt) {
+					entry.DiskNewer = true
+				}
+			}
+			all = append(all, entry)
+		}
+		os.Remove(filepath.Join(root, s.Name())) // Only succeeds once the session is empty
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].UpdatedAt.After(all[j].UpdatedAt) })
+	var total int64
+	var list []RecoveryEntry
+	for _, e := range all {
+		total += e.Size
+		if total > RECOVERY_MAX_TOTAL {
+			if dir, err := recoveryDocDir(e.ID); err == nil {
+				os.RemoveAll(dir)
+			}
+			continue
+		}
+		if e.UpdatedAt.Before(recoveryStartedAt) {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+// discardRecovery removes the journal of one document, or of a whole
+// session when path and title are empty (the tab closed cleanly).
+func discardRecovery(req RecoveryDiscardRequest) error {
+	root, err := recoveryRoot()
+	if err != nil {
+		return err
+	}
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	dir := filepath.Join(root, req.Session)
+	if req.Path != "" || req.Title != "" {
+		dir = filepath.Join(dir, recoveryDocKey(req.Path, req.Title))
+	}
+	return os.RemoveAll(dir)
+}
+
+// openRecovery puts a snapshot into the file store, so the editor opens it
+// with /?fileId= like a handed over file. Saving it then goes to the
+// original path.
+func openRecovery(req RecoveryOpenRequest) (string, error) {
+	dir, err := recoveryDocDir(req.ID)
+	if err != nil {
+		return "", err
+	}
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	meta, err := readRecoveryMeta(dir)
+	if err != nil {
+		return "", fmt.Errorf("no such recovery entry: %s", req.ID)
+	}
+	seq := req.Snapshot
+	if seq == 0 {
+		seqs := snapshotSeqs(dir)
+		if len(seqs) == 0 {
+			return "", fmt.Errorf("no snapshots for %s", req.ID)
+		}
+		seq = seqs[len(seqs)-1]
+	}
+	content, err := readRecoverySnapshot(dir, seq)
+	if err != nil {
+		return "", err
+	}
+
+	name := meta.Path
+	mimeType := "text/html"
+	if meta.Format == "markdown" {
+		mimeType = "text/markdown"
+	}
+	if name == "" {
+		// No extension: the editor then treats it as imported and asks
+		// where to save instead of writing to a relative path
+		title := strings.TrimSuffix(meta.Title, filepath.Ext(meta.Title))
+		if title == "" {
+			title = "Untitled"
+		}
+		name = "Recovered " + title
+	}
+	id := generateID()
+	fileStoreMu.Lock()
+	fileStore[id] = FileData{
+		FileName: name,
+		Data:     base64.StdEncoding.EncodeToString([]byte(content)),
+		MimeType: mimeType,
+	}
+	fileStoreMu.Unlock()
+
+	if !req.Keep {
+		// The tab that opens it keeps its own journal from here on
+		os.RemoveAll(dir)
+	}
+	return id, nil
+}
+
+// handleRecovery serves the crash recovery journal:
+// POST /api/recovery/snapshot (RecoverySnapshotRequest),
+// POST /api/recovery/discard (RecoveryDiscardRequest),
+// GET /api/recovery (entries left by earlier runs) and
+// POST /api/recovery/open (RecoveryOpenRequest) returning {fileId}.
+func handleRecovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && !sameOriginRequest(r) {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/recovery" && r.Method == "GET":
+		list, err := listRecovery()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read recovery journal: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if list == nil {
+			list = []RecoveryEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"documents": list})
+
+	case r.URL.Path == "/api/recovery/snapshot" && r.Method == "POST":
+		var req RecoverySnapshotRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, RECOVERY_MAX_UPLOAD)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !recoverySessionRe.MatchString(req.Session) {
+			http.Error(w, "Invalid session", http.StatusBadRequest)
+			return
+		}
+		seq, err := writeRecoverySnapshot(req)
+		if err != nil {
+			log.Printf("[Recovery] %v", err)
+			http.Error(w, fmt.Sprintf("Failed to write snapshot: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"snapshot": seq})
+
+	case r.URL.Path == "/api/recovery/discard" && r.Method == "POST":
+		var req RecoveryDiscardRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !recoverySessionRe.MatchString(req.Session) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := discardRecovery(req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case r.URL.Path == "/api/recovery/open" && r.Method == "POST":
+		var req RecoveryOpenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		id, err := openRecovery(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"fileId": id})
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	cdpruntime "github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	RENDER_READY_TIMEOUT = 10 * time.Second       // Default upper bound for the readiness wait
+	RENDER_READY_MAX     = 120 * time.Second      // Hard cap, whatever the client asks for
+	NETWORK_IDLE_WINDOW  = 500 * time.Millisecond // No requests in flight for this long = idle
+)
+
+// renderReadyScript resolves once fonts are loaded, every <img> has decoded
+// and, if the page announced it (window.__winhtmlRenderPending = true), the
+// page itself has signalled completion via the "winhtml:render-complete"
+// event or window.__winhtmlRenderComplete = true.
+const renderReadyScript = `(async () => {
+	const imgs = Array.from(document.images);
+	imgs.forEach(img => { if (img.loading === 'lazy') img.loading = 'eager'; });
+
+	if (document.fonts && document.fonts.ready) {
+		await document.fonts.ready;
+	}
+
+	const decode = img => img.decode ? img.decode().catch(() => {}) : null;
+	await Promise.all(imgs.map(img => {
+		if (img.complete) return decode(img);
+		return new Promise(resolve => {
+			img.addEventListener('load', resolve, { once: true });
+			img.addEventListener('error', resolve, { once: true });
+		}).then(() => decode(img));
+	}));
+
+	if (window.__winhtmlRenderPending && !window.__winhtmlRenderComplete) {
+		await new Promise(resolve => {
+			window.addEventListener('winhtml:render-complete', resolve, { once: true });
+		});
+	}
+	return true;
+})()`
+
+// renderReadyBound converts the client supplied timeout (milliseconds) into
+// the wait bound, falling back to the default and clamping to the hard cap.
+func renderReadyBound(ms int) time.Duration {
+	if ms <= 0 {
+		return RENDER_READY_TIMEOUT
+	}
+	d := time.Duration(ms) * time.Millisecond
+	if d > RENDER_READY_MAX {
+		return RENDER_READY_MAX
+	}
+	return d
+}
+
+// networkTracker counts the requests a render target has in flight so we can
+// tell when the page has gone quiet.
+type networkTracker struct {
+	mu           sync.Mutex
+	inflight     map[network.RequestID]struct{}
+	lastActivity time.Time
+}
+
+func newNetworkTracker() *networkTracker {
+	return &networkTracker{
+		inflight:     make(map[network.RequestID]struct{}),
+		lastActivity: time.Now(),
+	}
+}
+
+// listen attaches the tracker to the chromedp context. Must be called before
+// the first chromedp.Run on ctx so no request is missed.
+func (t *networkTracker) listen(ctx context.Context) {
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		switch e := ev.(type) {
+		case *network.EventRequestWillBeSent:
+			t.inflight[e.RequestID] = struct{}{}
+		case *network.EventLoadingFinished:
+			delete(t.inflight, e.RequestID)
+		case *network.EventLoadingFailed:
+			delete(t.inflight, e.RequestID)
+		default:
+			return
+		}
+		t.lastActivity = time.Now()
+	})
+}
+
+// idle reports whether nothing has been in flight for NETWORK_IDLE_WINDOW.
+func (t *networkTracker) idle() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.inflight) == 0 && time.Since(t.lastActivity) >= NETWORK_IDLE_WINDOW
+}
+
+// waitRenderReady replaces a fixed sleep before capture. It waits for the
+// page-side readiness script and then for network idle, but never longer
+// than bound: hitting the bound is logged and the capture goes ahead with
+// whatever has rendered so far.
+func waitRenderReady(tracker *networkTracker, bound time.Duration) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		waitCtx, cancel := context.WithTimeout(ctx, bound)
+		defer cancel()
+
+		var ok bool
+		err := chromedp.Evaluate(renderReadyScript, &ok, func(p *cdpruntime.EvaluateParams) *cdpruntime.EvaluateParams {
+			return p.WithAwaitPromise(true)
+		}).Do(waitCtx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+			log.Printf("[Render] Readiness not reached within %v, capturing anyway", bound)
+			return nil
+		}
+
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for !tracker.idle() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-waitCtx.Done():
+				log.Printf("[Render] Readiness not reached within %v, capturing anyway", bound)
+				return nil
+			case <-ticker.C:
+			}
+		}
+		return nil
+	})
+}
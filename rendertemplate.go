@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// KaTeX build the frontend loads from the CDN
+const (
+	katexCDNBase   = "https://cdn.jsdelivr.net/npm/katex@0.16.9/dist/"
+	katexCDNScript = katexCDNBase + "katex.min.js"
+)
+
+// Render formats accepted by the export endpoints.
+const (
+	RENDER_FORMAT_PAGE     = ""         // Complete page from the editor, served untouched
+	RENDER_FORMAT_HTML     = "html"     // Any HTML document or fragment, wrapped in the render template
+	RENDER_FORMAT_MARKDOWN = "markdown" // Markdown source, converted and wrapped
+)
+
+type renderPage struct {
+	Title       string
+	Head        template.HTML
+	Body        template.HTML
+	KatexScript string
+}
+
+// renderPageTemplate mirrors the print template the frontend builds for
+// exports, but pulls Tailwind and KaTeX from the embedded dist/libs so it
+// works for documents that were never opened in the editor.
+var renderPageTemplate = template.Must(template.New("render").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<script src="/libs/tailwindcss.js"></script>
+<link rel="stylesheet" href="/libs/katex.min.css">
+<script src="{{.KatexScript}}"></script>
+<style>
+  body {
+    margin: 0;
+    font-family: "Microsoft YaHei UI", "Microsoft YaHei", "Segoe UI", sans-serif;
+    background-color: #ffffff;
+    color: #000000;
+    width: 100%;
+    box-sizing: border-box;
+    -webkit-print-color-adjust: exact;
+  }
+  .ProseMirror { outline: none; width: 100%; }
+  .ProseMirror ul, .ProseMirror ol { padding-left: 1.5rem; }
+  .ProseMirror ul { list-style-type: disc; }
+  .ProseMirror ol { list-style-type: decimal; }
+  .ProseMirror h1 { font-size: 2.25em; line-height: 1.2; font-weight: 700; margin: 0.5em 0; }
+  .ProseMirror h2 { font-size: 1.75em; line-height: 1.3; font-weight: 700; margin: 0.5em 0; border-bottom: 1px solid #e5e7eb; padding-bottom: 0.2em; }
+  .ProseMirror h3 { font-size: 1.5em; line-height: 1.4; font-weight: 600; margin: 0.5em 0; }
+  .ProseMirror h4 { font-size: 1.25em; line-height: 1.5; font-weight: 600; margin: 0.5em 0; }
+  .ProseMirror h5 { font-size: 1.125em; font-weight: 600; margin: 0.5em 0; }
+  .ProseMirror h6 { font-size: 1em; font-weight: 600; text-transform: uppercase; color: #6b7280; margin: 0.5em 0; }
+
+  img { max-width: 100%; height: auto; display: block; }
+
+  table { width: 100% !important; border-collapse: collapse; table-layout: fixed !important; }
+  td, th { border: 1px solid #ccc; padding: 4px; word-wrap: break-word; }
+  th { font-weight: bold; text-align: left; background-color: #f1f3f5; }
+
+  pre { background-color: #f6f8fa; padding: 1em; border: 1px solid #e1e4e8; border-radius: 0.5rem; white-space: pre-wrap; word-break: break-word; }
+  code { font-family: monospace; background-color: rgba(0,0,0,0.05); padding: 0.1em; }
+  pre code { background-color: transparent; padding: 0; }
+
+  .annotation-mark { background-color: #fef3c7; border-bottom: 2px solid #fbbf24; }
+  .winhtml-textbox { border-width: 1px; border-style: solid; border-radius: 0.5rem; padding: 1rem; margin: 1rem 0; page-break-inside: avoid; }
+  .math-node { display: inline-block; }
+</style>
+{{.Head}}
+</head>
+<body>
+<div class="ProseMirror">
+{{.Body}}
+</div>
+<script>
+  document.addEventListener("DOMContentLoaded", function() {
+    if (!window.katex) return;
+    document.querySelectorAll('span[data-type="math"], span[data-latex]').forEach(function(el) {
+      var latex = el.getAttribute('data-latex');
+      if (!latex) return;
+      try {
+        window.katex.render(latex, el, { throwOnError: false, displayMode: el.getAttribute('data-display') === 'true' });
+      } catch (e) { console.error(e); }
+    });
+  });
+</script>
+</body>
+</html>`))
+
+// katexScriptURL prefers a katex.min.js shipped in dist/libs and falls back
+// to the CDN copy the frontend uses.
+func katexScriptURL() string {
+	if _, err := fs.Stat(assets, "dist/libs/katex.min.js"); err == nil {
+		return "/libs/katex.min.js"
+	}
+	return katexCDNScript
+}
+
+// wrapRenderPage places an HTML fragment into the render template. head is
+// inserted after the template styles so document styles win.
+func wrapRenderPage(title, head, body string) (string, error) {
+	var sb strings.Builder
+	err := renderPageTemplate.Execute(&sb, renderPage{
+		Title:       title,
+		Head:        template.HTML(head),
+		Body:        template.HTML(body),
+		KatexScript: katexScriptURL(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// splitHTMLDocument breaks a complete HTML document (or a bare fragment) into
+// its title, the style-bearing head nodes and the body content.
+func splitHTMLDocument(src string) (title, head, body string) {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", "", src
+	}
+
+	var headSb, bodySb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.DataAtom {
+		case atom.Head:
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				switch c.DataAtom {
+				case atom.Title:
+					if c.FirstChild != nil {
+						title = c.FirstChild.Data
+					}
+				case atom.Style:
+					html.Render(&headSb, c)
+				case atom.Link:
+					if strings.EqualFold(htmlAttr(c, "rel"), "stylesheet") {
+						html.Render(&headSb, c)
+					}
+				}
+			}
+			return
+		case atom.Body:
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				html.Render(&bodySb, c)
+			}
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return title, headSb.String(), bodySb.String()
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && strings.EqualFold(a.Key, key) {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// buildRenderHTML turns export input into the page served by /api/render-view.
+func buildRenderHTML(content, format string) (string, error) {
+	switch format {
+	case RENDER_FORMAT_PAGE:
+		return content, nil
+	case RENDER_FORMAT_HTML:
+		title, head, body := splitHTMLDocument(content)
+		return wrapRenderPage(title, head, body)
+	case RENDER_FORMAT_MARKDOWN:
+		body, err := markdownToHTML([]byte(content))
+		if err != nil {
+			return "", err
+		}
+		return wrapRenderPage("", "", body)
+	}
+	return "", fmt.Errorf("unknown render format %q", format)
+}
+
+// loadDocumentForRender reads a document from disk and produces a render page
+// for it. Local images are inlined since the page is served from
+// /api/render-view, where relative paths no longer resolve.
+func loadDocumentForRender(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	content, _ = decodeTextDocument(content, path)
+
+	name := filepath.Base(path)
+	title := strings.TrimSuffix(name, filepath.Ext(name))
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		docTitle, head, body := splitHTMLDocument(inlineLocalAssets(string(content), path))
+		if docTitle != "" {
+			title = docTitle
+		}
+		return wrapRenderPage(title, head, body)
+	case ".md", ".markdown":
+		body, err := markdownToHTML(content)
+		if err != nil {
+			return "", err
+		}
+		return wrapRenderPage(title, "", inlineLocalAssets(body, path))
+	case ".txt":
+		var sb strings.Builder
+		for _, line := range strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n") {
+			if line == "" {
+				sb.WriteString("<p><br></p>\n")
+				continue
+			}
+			sb.WriteString("<p>")
+			sb.WriteString(html.EscapeString(line))
+			sb.WriteString("</p>\n")
+		}
+		return wrapRenderPage(title, "", sb.String())
+	}
+	return "", fmt.Errorf("unsupported document type: %s", filepath.Ext(path))
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding"
+)
+
+// Destinations whose content is not part of the document text.
+var rtfSkipDestinations = map[string]bool{
+	"fonttbl": true, "colortbl": true, "info": true, "filetbl": true, "revtbl": true,
+	"listtable": true, "listoverridetable": true, "rsidtbl": true, "generator": true,
+	"header": true, "headerl": true, "headerr": true, "headerf": true,
+	"footer": true, "footerl": true, "footerr": true, "footerf": true,
+	"nonshppict": true, "object": true, "themedata": true, "colorschememapping": true,
+	"latentstyles": true, "datastore": true, "xmlnstbl": true, "pgdsctbl": true,
+	"xe": true, "tc": true, "txe": true, "annotation": true, "atnid": true, "atnauthor": true,
+}
+
+// Destinations the reader handles even when marked ignorable with \*.
+var rtfKnownDestinations = map[string]bool{
+	"shppict": true, "pict": true, "fldinst": true, "pn": true, "footnote": true,
+}
+
+// Control words that stand for a character.
+var rtfSymbols = map[string]string{
+	"emdash": "—", "endash": "–", "bullet": "•",
+	"lquote": "‘", "rquote": "’", "ldblquote": "“", "rdblquote": "”",
+	"emspace": "\u2003", "enspace": "\u2002", "qmspace": "\u2005",
+}
+
+// rtfState is the formatting state saved and restored by RTF groups.
+type rtfState struct {
+	props      runProps
+	dest       string // Destination the text goes to, "" for the body
+	skip       bool   // Inside a destination that is dropped
+	uc         int    // Fallback characters after \uN
+	closesLink bool   // The group is a field result inside a link
+}
+
+// rtfPara holds the paragraph properties, reset by \pard.
+type rtfPara struct {
+	align   string
+	style   int
+	outline int // Heading level from \outlinelevel, 0 for body text
+	intbl   bool
+	list    int // \ls list number, -1 for old-style \pn numbering
+	level   int
+}
+
+// rtfBody collects the blocks of the document or of a footnote.
+type rtfBody struct {
+	sb    strings.Builder
+	w     *inlineWriter
+	lists []docxOpenList
+	rows  []string
+	row   []string
+	cell  []string
+}
+
+type rtfNote struct {
+	num  int
+	body *rtfBody
+	para rtfPara
+}
+
+type rtfPicture struct {
+	format         string
+	hex            strings.Builder
+	width, height  int // Twips
+	scaleX, scaleY int // Percent
+}
+
+type rtfReader struct {
+	data      []byte
+	pos       int
+	st        rtfState
+	stack     []rtfState
+	ignorable bool // The last control symbol was \*
+	ucSkip    int
+	surrogate rune // High half of a \uN pair
+	enc       encoding.Encoding
+	text      []byte // Body bytes in the document codepage, not yet written
+
+	para      rtfPara
+	rowHeader bool
+	body      *rtfBody
+	notes     []rtfNote
+	noteHTML  []string
+
+	styles    map[int]int // Style number -> heading level
+	styleNum  int
+	styleName []byte
+	listText  []byte
+	inst      strings.Builder // Field instruction
+	pict      rtfPicture
+
+	images ImageOptions
+	report ImageReport
+}
+
+// rtfToHTML converts a Rich Text Format document to editor HTML: paragraphs
+// and headings, character formatting, links, lists, tables, PNG and JPEG
+// pictures and footnotes. Fonts, colours and page layout are dropped.
+func rtfToHTML(content []byte) (string, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(content, " \t\r\n"), []byte(`{\rtf`)) {
+		return "", fmt.Errorf("invalid RTF: missing {\\rtf header")
+	}
+	enc, err := lookupEncoding(ENCODING_WINDOWS_1252)
+	if err != nil {
+		return "", err
+	}
+	r := &rtfReader{
+		data:   content,
+		st:     rtfState{uc: 1},
+		enc:    enc,
+		body:   &rtfBody{w: &inlineWriter{}},
+		styles: make(map[int]int),
+		images: globalImageOptions(),
+	}
+	r.run()
+	for len(r.notes) > 0 { // Unterminated footnote
+		r.endNote()
+	}
+	out := r.finishBody() + footnotesHTML(r.noteHTML)
+	imageReportLog("RTF import", &r.report)
+	return out, nil
+}
+
+func (r *rtfReader) run() {
+	for r.pos < len(r.data) {
+		ch := r.data[r.pos]
+		r.pos++
+		switch ch {
+		case '{':
+			r.flushText()
+			r.stack = append(r.stack, r.st)
+			r.st.closesLink = false
+		case '}':
+			r.flushText()
+			if len(r.stack) == 0 {
+				return
+			}
+			r.endGroup()
+		case '\\':
+			r.control()
+		case '\r', '\n':
+		default:
+			r.char(ch)
+		}
+	}
+}
+
+func (r *rtfReader) endGroup() {
+	inner := r.st
+	r.st = r.stack[len(r.stack)-1]
+	r.stack = r.stack[:len(r.stack)-1]
+	r.ucSkip = 0
+	if inner.closesLink {
+		r.body.w.raw("</a>")
+	}
+	if inner.skip || inner.dest == r.st.dest {
+		return
+	}
+	switch inner.dest {
+	case "pict":
+		r.picture()
+	case "footnote":
+		r.endNote()
+	}
+}
+
+func (r *rtfReader) control() {
+	if r.pos >= len(r.data) {
+		return
+	}
+	c := r.data[r.pos]
+	r.pos++
+	if !isASCIILetter(c) {
+		switch c {
+		case '\'':
+			if r.pos+2 <= len(r.data) {
+				b, err := strconv.ParseUint(string(r.data[r.pos:r.pos+2]), 16, 8)
+				r.pos += 2
+				if err == nil {
+					r.char(byte(b))
+				}
+			}
+		case '\\', '{', '}':
+			r.char(c)
+		case '*':
+			r.ignorable = true
+		case '~':
+			r.symbol("\u00a0")
+		case '_':
+			r.symbol("\u2011")
+		case '\r', '\n':
+			r.word("par", 0, false)
+		}
+		return
+	}
+
+	start := r.pos - 1
+	for r.pos < len(r.data) && isASCIILetter(r.data[r.pos]) {
+		r.pos++
+	}
+	word := string(r.data[start:r.pos])
+	numStart := r.pos
+	if r.pos < len(r.data) && r.data[r.pos] == '-' {
+		r.pos++
+	}
+	digits := r.pos
+	for r.pos < len(r.data) && r.data[r.pos] >= '0' && r.data[r.pos] <= '9' {
+		r.pos++
+	}
+	param, hasParam := 0, false
+	if r.pos > digits {
+		param, _ = strconv.Atoi(string(r.data[numStart:r.pos]))
+		hasParam = true
+	} else {
+		r.pos = numStart
+	}
+	if r.pos < len(r.data) && r.data[r.pos] == ' ' {
+		r.pos++
+	}
+	r.word(word, param, hasParam)
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (r *rtfReader) word(word string, param int, hasParam bool) {
+	ignorable := r.ignorable
+	r.ignorable = false
+	if word == "bin" {
+		n := min(max(param, 0), len(r.data)-r.pos)
+		if !r.st.skip && r.st.dest == "pict" {
+			r.pict.hex.WriteString(hex.EncodeToString(r.data[r.pos : r.pos+n]))
+		}
+		r.pos += n
+		return
+	}
+	if r.st.skip {
+		return
+	}
+	r.flushText()
+	if rtfSkipDestinations[word] || ignorable && !rtfKnownDestinations[word] {
+		r.st.skip = true
+		return
+	}
+	on := !hasParam || param != 0
+
+	if s, ok := rtfSymbols[word]; ok {
+		r.symbol(s)
+		return
+	}
+	switch word {
+	case "ansicpg":
+		if enc := rtfCodepage(param); enc != nil {
+			r.enc = enc
+		}
+	case "uc":
+		r.st.uc = max(param, 0)
+	case "u":
+		if param < 0 {
+			param += 0x10000
+		}
+		c := rune(param)
+		switch {
+		case utf16.IsSurrogate(c) && r.surrogate == 0:
+			r.surrogate = c
+		case r.surrogate != 0:
+			r.symbol(string(utf16.DecodeRune(r.surrogate, c)))
+			r.surrogate = 0
+		default:
+			r.symbol(string(c))
+		}
+		r.ucSkip = r.st.uc
+
+	// Destinations
+	case "stylesheet":
+		r.st.dest = "stylesheet"
+	case "listtext", "pntext":
+		r.st.dest = "listtext"
+		r.listText = nil
+	case "pn":
+		r.st.dest = "pn"
+	case "pnlvlblt", "pnlvlbody", "pnlvlcont":
+		r.para.list = -1
+	case "field":
+		r.inst.Reset()
+	case "fldinst":
+		r.st.dest = "fldinst"
+	case "fldrslt":
+		if href, ok := fieldHyperlink(r.inst.String()); ok {
+			r.body.w.raw(`<a href="` + html.EscapeString(href) + `">`)
+			r.st.closesLink = true
+		}
+		r.inst.Reset()
+	case "pict":
+		r.st.dest = "pict"
+		r.pict = rtfPicture{scaleX: 100, scaleY: 100}
+	case "pngblip":
+		r.pict.format = "png"
+	case "jpegblip":
+		r.pict.format = "jpg"
+	case "emfblip":
+		r.pict.format = "emf"
+	case "wmetafile":
+		r.pict.format = "wmf"
+	case "dibitmap", "wbitmap":
+		r.pict.format = "bmp"
+	case "picwgoal":
+		r.pict.width = param
+	case "pichgoal":
+		r.pict.height = param
+	case "picscalex":
+		r.pict.scaleX = param
+	case "picscaley":
+		r.pict.scaleY = param
+	case "footnote":
+		r.startNote()
+
+	// Breaks and special characters
+	case "par", "sect", "page":
+		if r.st.dest == "" || r.st.dest == "footnote" {
+			r.endParagraph()
+		}
+	case "line":
+		if r.st.dest == "" || r.st.dest == "footnote" {
+			r.body.w.raw("<br>")
+		}
+	case "tab":
+		if r.st.dest == "" || r.st.dest == "footnote" {
+			r.body.w.raw("&emsp;")
+		}
+	case "cell", "nestcell":
+		r.endCell()
+	case "row", "nestrow":
+		r.endRow()
+
+	// Paragraph properties
+	case "pard":
+		r.para = rtfPara{}
+	case "s":
+		if r.st.dest == "stylesheet" {
+			r.styleNum = param
+		} else {
+			r.para.style = param
+		}
+	case "outlinelevel":
+		r.para.outline = param + 1
+	case "ql":
+		r.para.align = ""
+	case "qc":
+		r.para.align = "center"
+	case "qr":
+		r.para.align = "right"
+	case "qj":
+		r.para.align = "justify"
+	case "intbl":
+		r.para.intbl = true
+	case "ls":
+		r.para.list = param
+	case "ilvl":
+		r.para.level = min(max(param, 0), 8)
+	case "trowd":
+		r.rowHeader = false
+	case "trhdr":
+		r.rowHeader = true
+
+	// Character formatting
+	case "plain":
+		r.st.props = runProps{}
+	case "b":
+		r.st.props.bold = on
+	case "i":
+		r.st.props.italic = on
+	case "strike", "striked":
+		r.st.props.strike = on
+	case "ulnone":
+		r.st.props.underline = false
+	case "super":
+		r.st.props.sup, r.st.props.sub = true, false
+	case "sub":
+		r.st.props.sup, r.st.props.sub = false, true
+	case "nosupersub":
+		r.st.props.sup, r.st.props.sub = false, false
+	case "up":
+		r.st.props.sup = param > 0
+	case "dn":
+		r.st.props.sub = param > 0
+	default:
+		// \ul, \uld, \uldb, \ulwave, ... but not the colour \ulc
+		if strings.HasPrefix(word, "ul") && word != "ulc" {
+			r.st.props.underline = on
+		}
+	}
+}
+
+// char handles one byte of text in the document codepage.
+func (r *rtfReader) char(c byte) {
+	if r.st.skip {
+		return
+	}
+	if r.ucSkip > 0 {
+		r.ucSkip--
+		return
+	}
+	switch r.st.dest {
+	case "", "footnote":
+		if c == '\t' {
+			r.flushText()
+			r.body.w.raw("&emsp;")
+			return
+		}
+		r.text = append(r.text, c)
+	case "pict":
+		r.pict.hex.WriteByte(c)
+	case "fldinst":
+		r.inst.WriteByte(c)
+	case "listtext":
+		r.listText = append(r.listText, c)
+	case "stylesheet":
+		if c != ';' {
+			r.styleName = append(r.styleName, c)
+			break
+		}
+		name, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(r.decode(r.styleName))), ",")
+		var level int
+		if _, err := fmt.Sscanf(name, "heading %d", &level); err == nil && level > 0 {
+			r.styles[r.styleNum] = min(level, 6)
+		}
+		r.styleNum, r.styleName = 0, nil
+	}
+}
+
+// symbol handles text given as Unicode (\uN and named characters).
+func (r *rtfReader) symbol(s string) {
+	if r.st.skip {
+		return
+	}
+	switch r.st.dest {
+	case "", "footnote":
+		r.flushText()
+		open, close := r.st.props.tags()
+		r.body.w.write(open, close, html.EscapeString(s))
+	case "fldinst":
+		r.inst.WriteString(s)
+	case "listtext":
+		r.listText = append(r.listText, s...)
+	case "stylesheet":
+		r.styleName = append(r.styleName, s...)
+	}
+}
+
+func (r *rtfReader) decode(b []byte) string {
+	s, err := r.enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return string(b)
+	}
+	return string(s)
+}
+
+func (r *rtfReader) flushText() {
+	if len(r.text) == 0 {
+		return
+	}
+	s := r.decode(r.text)
+	r.text = r.text[:0]
+	open, close := r.st.props.tags()
+	r.body.w.write(open, close, html.EscapeString(s))
+}
+
+// rtfCodepage maps an \ansicpg number to its encoding, nil when unknown.
+func rtfCodepage(cp int) encoding.Encoding {
+	name := fmt.Sprintf("windows-%d", cp)
+	switch cp {
+	case 936:
+		name = ENCODING_GB18030
+	case 950:
+		name = ENCODING_BIG5
+	case 932:
+		name = "shift_jis"
+	case 949:
+		name = "euc-kr"
+	case 10000:
+		name = "macintosh"
+	case 20866:
+		name = "koi8-r"
+	case 65001:
+		name = ENCODING_UTF8
+	}
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return nil
+	}
+	return enc
+}
+
+func (r *rtfReader) headingLevel() int {
+	if r.para.outline > 0 && r.para.outline <= 9 {
+		return min(r.para.outline, 6)
+	}
+	return r.styles[r.para.style]
+}
+
+// takeLine returns the text written since the last paragraph break.
+func (r *rtfReader) takeLine() string {
+	content := strings.TrimSpace(r.body.w.String())
+	r.body.w = &inlineWriter{}
+	return content
+}
+
+func (r *rtfReader) endParagraph() {
+	content := r.takeLine()
+	label := strings.TrimSpace(strings.ReplaceAll(r.decode(r.listText), "\u00a0", " "))
+	r.listText = nil
+	b := r.body
+	if r.para.intbl {
+		b.cell = append(b.cell, content)
+		return
+	}
+	b.closeTable()
+
+	level := r.headingLevel()
+	if r.para.list != 0 && level == 0 {
+		tag := "ul"
+		if rtfNumberedLabel(label) {
+			tag = "ol"
+		}
+		b.listItem(strconv.Itoa(r.para.list), r.para.level, tag, content)
+		return
+	}
+	b.closeLists()
+
+	tag := "p"
+	if level > 0 {
+		tag = fmt.Sprintf("h%d", level)
+		// Numbered headings keep their number as text
+		if label != "" {
+			content = html.EscapeString(label) + " " + content
+		}
+	}
+	attrs := ""
+	if r.para.align != "" {
+		attrs = ` style="text-align: ` + r.para.align + `"`
+	}
+	if content == "" {
+		content = "<br>"
+	}
+	b.sb.WriteString("<" + tag + attrs + ">" + content + "</" + tag + ">\n")
+}
+
+// rtfNumberedLabel tells a list number ("1.", "a)", "iv.") from a bullet.
+func rtfNumberedLabel(label string) bool {
+	label = strings.TrimRight(label, ".)")
+	if label == "" || len(label) > 8 {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '.') {
+			return false
+		}
+	}
+	return label != "o" // Word's second-level bullet
+}
+
+func (r *rtfReader) endCell() {
+	b := r.body
+	if content := r.takeLine(); content != "" || len(b.cell) == 0 {
+		b.cell = append(b.cell, content)
+	}
+	b.closeLists()
+	b.row = append(b.row, strings.Join(b.cell, "<br>"))
+	b.cell = nil
+	r.listText = nil
+}
+
+func (r *rtfReader) endRow() {
+	b := r.body
+	if len(b.row) == 0 {
+		return
+	}
+	tag := "td"
+	if r.rowHeader {
+		tag = "th"
+	}
+	var sb strings.Builder
+	sb.WriteString("<tr>")
+	for _, cell := range b.row {
+		sb.WriteString("<" + tag + ">" + cell + "</" + tag + ">")
+	}
+	sb.WriteString("</tr>\n")
+	b.rows = append(b.rows, sb.String())
+	b.row = nil
+}
+
+func (b *rtfBody) closeTable() {
+	if len(b.rows) == 0 {
+		return
+	}
+	b.sb.WriteString("<table>\n" + strings.Join(b.rows, "") + "</table>\n")
+	b.rows = nil
+}
+
+func (b *rtfBody) listItem(id string, level int, tag, content string) {
+	for len(b.lists) > level+1 {
+		b.closeList()
+	}
+	if len(b.lists) == level+1 && (b.lists[level].numID != id || b.lists[level].tag != tag) {
+		b.closeList()
+	}
+	for len(b.lists) < level+1 {
+		b.sb.WriteString("<" + tag + ">\n")
+		b.lists = append(b.lists, docxOpenList{numID: id, tag: tag})
+	}
+	if b.lists[level].itemOpen {
+		b.sb.WriteString("</li>\n")
+	}
+	b.lists[level].itemOpen = true
+	b.sb.WriteString("<li>" + content)
+}
+
+func (b *rtfBody) closeList() {
+	top := b.lists[len(b.lists)-1]
+	if top.itemOpen {
+		b.sb.WriteString("</li>\n")
+	}
+	b.sb.WriteString("</" + top.tag + ">\n")
+	b.lists = b.lists[:len(b.lists)-1]
+}
+
+func (b *rtfBody) closeLists() {
+	for len(b.lists) > 0 {
+		b.closeList()
+	}
+}
+
+// finishBody ends the open paragraph, table and lists of the current body.
+func (r *rtfReader) finishBody() string {
+	r.flushText()
+	if r.body.w.String() != "" {
+		r.endParagraph()
+	}
+	r.endRow()
+	r.body.closeTable()
+	r.body.closeLists()
+	return r.body.sb.String()
+}
+
+func (r *rtfReader) startNote() {
+	num := len(r.noteHTML) + 1
+	r.noteHTML = append(r.noteHTML, "") // Reserve the slot; notes may nest
+	r.body.w.raw(footnoteRefHTML(num))
+	r.notes = append(r.notes, rtfNote{num: num, body: r.body, para: r.para})
+	r.body = &rtfBody{w: &inlineWriter{}}
+	r.para = rtfPara{}
+	r.st.dest = "footnote"
+}
+
+func (r *rtfReader) endNote() {
+	content := r.finishBody()
+	note := r.notes[len(r.notes)-1]
+	r.notes = r.notes[:len(r.notes)-1]
+	r.body, r.para = note.body, note.para
+	r.noteHTML[note.num-1] = footnoteItemHTML(note.num, content)
+}
+
+func (r *rtfReader) picture() {
+	p := &r.pict
+	if p.format == "" {
+		return
+	}
+	digits := strings.Map(func(c rune) rune {
+		if c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' {
+			return c
+		}
+		return -1
+	}, p.hex.String())
+	data, err := hex.DecodeString(digits[:len(digits)&^1])
+	if err != nil || len(data) == 0 {
+		return
+	}
+	// Twips to CSS pixels
+	width := p.width * p.scaleX / 100 / 15
+	height := p.height * p.scaleY / 100 / 15
+	r.body.w.raw(importedImage("image."+p.format, data, "", width, height, r.images, &r.report))
+}
@@ -0,0 +1,1062 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	SEARCH_DIR           = "search"
+	SEARCH_INDEX_VERSION = 1                      // Bump when extraction or tokenizing changes
+	SEARCH_DEBOUNCE      = 500 * time.Millisecond // Quiet time after file events before rescanning
+	SEARCH_MAX_FILE      = 64 << 20               // Larger files are listed but not read
+	SEARCH_MAX_TEXT      = 4 << 20                // Extracted text kept per document, in bytes
+	SEARCH_MAX_WORD      = 64                     // Longer runs of letters are not indexed
+	SEARCH_MAX_RESULTS   = 500
+	SEARCH_MAX_EXPAND    = 50  // Index words a prefix term (word*) stands for
+	SEARCH_MAX_SPANS     = 200 // Matches located per result for snippets
+	SEARCH_SNIPPETS      = 3   // Per result
+	SEARCH_CONTEXT       = 60  // Runes shown on each side of a match
+)
+
+// Kinds the index reads. Everything else in the workspace is skipped.
+var searchKinds = map[string]bool{
+	FILE_KIND_HTML:     true,
+	FILE_KIND_MARKDOWN: true,
+	FILE_KIND_TEXT:     true,
+	FILE_KIND_WORD:     true,
+	FILE_KIND_PDF:      true,
+}
+
+// SearchResult is one document matching a query. Snippets are HTML: the
+// escaped text around the matches, which are wrapped in <mark>.
+type SearchResult struct {
+	Path     string    `json:"path"`
+	FullPath string    `json:"fullPath"`
+	Name     string    `json:"name"`
+	Title    string    `json:"title,omitempty"`
+	Kind     string    `json:"kind"`
+	ModTime  time.Time `json:"modTime"`
+	Score    float64   `json:"score"`
+	Snippets []string  `json:"snippets"`
+}
+
+// searchDoc is one indexed file. Text is what extraction produced; the
+// unexported fields are derived from it when the document is indexed.
+type searchDoc struct {
+	Path    string    `json:"path"` // Relative to the workspace, forward slashes
+	Kind    string    `json:"kind"`
+	Title   string    `json:"title,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Text    string    `json:"text"`
+	Error   string    `json:"error,omitempty"` // Extraction failed; retried when the file changes
+
+	folded string // Text lowercased and width folded, whitespace collapsed
+	head   string // Name and title, folded the same way
+	length int    // Tokens, for ranking
+}
+
+type searchIndexFile struct {
+	Version int          `json:"version"`
+	Root    string       `json:"root"`
+	Docs    []*searchDoc `json:"docs"`
+}
+
+// searchIndex is an inverted index of the open workspace. The indexer
+// goroutine is its only writer; queries read it under mu.
+type searchIndex struct {
+	mu       sync.RWMutex
+	root     string
+	docs     map[string]*searchDoc
+	postings map[string]map[string]int // Token -> document path -> occurrences
+	tokens   int                       // Sum of document lengths
+	indexing bool
+	updated  time.Time
+}
+
+var (
+	workspaceIndex = &searchIndex{}
+	searchReindex  = make(chan bool, 1) // Asks the indexer to start over
+)
+
+// --- Text ---
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) || r == 'ー'
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// foldText lowercases s, applies NFKC rune by rune (full-width forms become
+// ASCII, ligatures split) and collapses whitespace to single spaces. With
+// offsets it also returns, for every byte of the result plus one past the
+// end, the offset in s it came from.
+func foldText(s string, offsets bool) (string, []int) {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	var offs []int
+	if offsets {
+		offs = make([]int, 0, len(s)+1)
+	}
+	space := true // Leading whitespace is dropped
+	for i, r := range s {
+		n := sb.Len()
+		switch {
+		case unicode.IsSpace(r):
+			if space {
+				continue
+			}
+			sb.WriteByte(' ')
+			space = true
+		case r < utf8.RuneSelf:
+			sb.WriteRune(unicode.ToLower(r))
+			space = false
+		default:
+			sb.WriteString(strings.ToLower(norm.NFKC.String(string(r))))
+			space = false
+		}
+		for ; offsets && n < sb.Len(); n++ {
+			offs = append(offs, i)
+		}
+	}
+	offs = append(offs, len(s))
+	return sb.String(), offs
+}
+
+// searchTokens splits folded text into index tokens. Words are runs of
+// letters and digits; Chinese, Japanese and Korean have no spaces to split
+// on, so their runs give every character and every pair of neighbouring
+// characters.
+func searchTokens(folded string, emit func(string)) {
+	for i := 0; i < len(folded); {
+		r, size := utf8.DecodeRuneInString(folded[i:])
+		switch {
+		case isCJK(r):
+			prev := -1
+			for i < len(folded) {
+				r, size = utf8.DecodeRuneInString(folded[i:])
+				if !isCJK(r) {
+					break
+				}
+				emit(folded[i : i+size])
+				if prev >= 0 {
+					emit(folded[prev : i+size])
+				}
+				prev = i
+				i += size
+			}
+		case isWordRune(r):
+			start := i
+			for i < len(folded) {
+				r, size = utf8.DecodeRuneInString(folded[i:])
+				if !isWordRune(r) || isCJK(r) {
+					break
+				}
+				i += size
+			}
+			if i-start <= SEARCH_MAX_WORD {
+				emit(folded[start:i])
+			}
+		default:
+			i += size
+		}
+	}
+}
+
+// htmlPlainText returns the visible text of an HTML document, a line per
+// block, and its title: <title>, else the first <h1>.
+func htmlPlainText(src string) (title, text string) {
+	inline := map[atom.Atom]bool{
+		atom.A: true, atom.Abbr: true, atom.B: true, atom.Bdi: true, atom.Bdo: true, atom.Cite: true,
+		atom.Code: true, atom.Data: true, atom.Del: true, atom.Dfn: true, atom.Em: true, atom.Font: true,
+		atom.I: true, atom.Ins: true, atom.Kbd: true, atom.Mark: true, atom.Q: true, atom.S: true,
+		atom.Samp: true, atom.Small: true, atom.Span: true, atom.Strong: true, atom.Sub: true,
+		atom.Sup: true, atom.Time: true, atom.U: true, atom.Var: true,
+	}
+	var sb, titleText, h1 strings.Builder
+	var skip atom.Atom // Inside script, style or template
+	inTitle, inH1 := false, false
+	z := xhtml.NewTokenizer(strings.NewReader(src))
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			break
+		}
+		name, _ := z.TagName()
+		a := atom.Lookup(name)
+		switch tt {
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			if skip != 0 {
+				continue
+			}
+			switch a {
+			case atom.Script, atom.Style, atom.Template:
+				if tt == xhtml.StartTagToken {
+					skip = a
+				}
+				continue
+			case atom.Title:
+				inTitle = tt == xhtml.StartTagToken
+				continue
+			case atom.H1:
+				inH1 = h1.Len() == 0
+			}
+			if !inline[a] {
+				sb.WriteByte('\n')
+			}
+		case xhtml.EndTagToken:
+			if skip != 0 {
+				if a == skip {
+					skip = 0
+				}
+				continue
+			}
+			switch a {
+			case atom.Title:
+				inTitle = false
+				continue
+			case atom.H1:
+				inH1 = false
+			}
+			if !inline[a] {
+				sb.WriteByte('\n')
+			}
+		case xhtml.TextToken:
+			if skip != 0 {
+				continue
+			}
+			t := string(z.Text())
+			switch {
+			case inTitle:
+				titleText.WriteString(t)
+			case inH1:
+				h1.WriteString(t)
+				sb.WriteString(t)
+			default:
+				sb.WriteString(t)
+			}
+		}
+	}
+	title = strings.Join(strings.Fields(titleText.String()), " ")
+	if title == "" {
+		title = strings.Join(strings.Fields(h1.String()), " ")
+	}
+	var lines []string
+	for _, line := range strings.Split(sb.String(), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return title, strings.Join(lines, "\n")
+}
+
+// extractSearchText reads a workspace file and returns its title and text.
+func extractSearchText(path, kind string) (title, text string, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	switch kind {
+	case FILE_KIND_HTML:
+		decoded, _ := decodeTextDocument(content, path)
+		title, text = htmlPlainText(string(decoded))
+	case FILE_KIND_MARKDOWN:
+		decoded, _ := decodeTextDocument(content, path)
+		rendered, err := markdownToHTML(decoded)
+		if err != nil {
+			return "", "", err
+		}
+		title, text = htmlPlainText(rendered)
+	case FILE_KIND_TEXT:
+		decoded, _ := decodeTextDocument(content, path)
+		text = string(decoded)
+	case FILE_KIND_WORD:
+		text, err = docxPlainText(content)
+	case FILE_KIND_PDF:
+		text, err = pdfPlainText(content)
+	default:
+		err = fmt.Errorf("%s files are not indexed", kind)
+	}
+	if len(text) > SEARCH_MAX_TEXT {
+		cut := SEARCH_MAX_TEXT
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+	}
+	return title, text, err
+}
+
+// --- Index ---
+
+func searchIndexPath(root string) (string, error) {
+	dir, err := appDataDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(getLockKey(root)))
+	return filepath.Join(dir, SEARCH_DIR, hex.EncodeToString(sum[:])+".json.gz"), nil
+}
+
+// docTokens calls emit for every token of the document, name and title
+// included.
+func docTokens(d *searchDoc, emit func(string)) {
+	searchTokens(d.head, emit)
+	searchTokens(d.folded, emit)
+}
+
+// add indexes d, replacing any earlier version of the same path. The
+// caller holds mu.
+func (ix *searchIndex) add(d *searchDoc) {
+	ix.remove(d.Path)
+	d.folded, _ = foldText(d.Text, false)
+	d.head, _ = foldText(path.Base(d.Path)+"\n"+d.Title, false)
+	counts := make(map[string]int)
+	d.length = 0
+	docTokens(d, func(tok string) {
+		counts[tok]++
+		d.length++
+	})
+	for tok, n := range counts {
+		p := ix.postings[tok]
+		if p == nil {
+			p = make(map[string]int)
+			ix.postings[tok] = p
+		}
+		p[d.Path] = n
+	}
+	ix.docs[d.Path] = d
+	ix.tokens += d.length
+}
+
+// remove drops a document from the index. The caller holds mu.
+func (ix *searchIndex) remove(rel string) {
+	d := ix.docs[rel]
+	if d == nil {
+		return
+	}
+	docTokens(d, func(tok string) {
+		if p := ix.postings[tok]; p != nil {
+			delete(p, rel)
+			if len(p) == 0 {
+				delete(ix.postings, tok)
+			}
+		}
+	})
+	delete(ix.docs, rel)
+	ix.tokens -= d.length
+}
+
+// open switches the index to another workspace, starting from what was
+// saved for it last time. An empty root leaves the index empty.
+func (ix *searchIndex) open(root string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.root = root
+	ix.docs = make(map[string]*searchDoc)
+	ix.postings = make(map[string]map[string]int)
+	ix.tokens = 0
+	ix.updated = time.Time{}
+	if root == "" {
+		return
+	}
+	file, err := searchIndexPath(root)
+	if err != nil {
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		log.Printf("[Search] Ignoring index %s: %v", file, err)
+		return
+	}
+	var saved searchIndexFile
+	if err := json.NewDecoder(zr).Decode(&saved); err != nil {
+		log.Printf("[Search] Ignoring index %s: %v", file, err)
+		return
+	}
+	if saved.Version != SEARCH_INDEX_VERSION || getLockKey(saved.Root) != getLockKey(root) {
+		return
+	}
+	for _, d := range saved.Docs {
+		ix.add(d)
+	}
+}
+
+// save writes the index next to the other app data so the next start only
+// reads files changed in between.
+func (ix *searchIndex) save() error {
+	ix.mu.RLock()
+	saved := searchIndexFile{Version: SEARCH_INDEX_VERSION, Root: ix.root}
+	for _, d := range ix.docs {
+		saved.Docs = append(saved.Docs, d)
+	}
+	ix.mu.RUnlock()
+	if saved.Root == "" {
+		return nil
+	}
+	file, err := searchIndexPath(saved.Root)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(saved)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// scan brings the index in line with the workspace on disk: files whose
+// size or modification time changed are read again, vanished ones are
+// dropped. It returns the folders to watch.
+func (ix *searchIndex) scan(root string) []string {
+	ww := &workspaceWalker{root: root}
+	dirs := []string{root}
+	var files []WorkspaceNode
+	var walk func(nodes []WorkspaceNode)
+	walk = func(nodes []WorkspaceNode) {
+		for _, n := range nodes {
+			switch {
+			case n.Dir:
+				dirs = append(dirs, n.FullPath)
+				walk(n.Children)
+			case searchKinds[n.Kind]:
+				if n.Bundle {
+					dirs = append(dirs, filepath.Dir(n.FullPath))
+				}
+				files = append(files, n)
+			}
+		}
+	}
+	walk(ww.list(root))
+	if ww.truncated {
+		log.Printf("[Search] %s has more than %d entries, indexing the first ones", root, WORKSPACE_MAX_NODES)
+	}
+
+	ix.mu.Lock()
+	ix.indexing = true
+	present := make(map[string]bool, len(files))
+	var changed []WorkspaceNode
+	for _, n := range files {
+		present[n.Path] = true
+		if d := ix.docs[n.Path]; d == nil || d.Size != n.Size || !d.ModTime.Equal(n.ModTime) || d.Kind != n.Kind {
+			changed = append(changed, n)
+		}
+	}
+	removed := 0
+	for rel := range ix.docs {
+		if !present[rel] {
+			ix.remove(rel)
+			removed++
+		}
+	}
+	ix.mu.Unlock()
+
+	for _, n := range changed {
+		d := &searchDoc{Path: n.Path, Kind: n.Kind, Size: n.Size, ModTime: n.ModTime}
+		if n.Size > SEARCH_MAX_FILE {
+			d.Error = "file too large"
+		} else if title, text, err := extractSearchText(n.FullPath, n.Kind); err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Title, d.Text = title, text
+		}
+		ix.mu.Lock()
+		ix.add(d)
+		ix.mu.Unlock()
+	}
+
+	ix.mu.Lock()
+	ix.indexing = false
+	ix.updated = time.Now()
+	ix.mu.Unlock()
+	if len(changed) > 0 || removed > 0 {
+		log.Printf("[Search] Indexed %d documents, dropped %d in %s", len(changed), removed, root)
+		if err := ix.save(); err != nil {
+			log.Printf("[Search] Failed to save index: %v", err)
+		}
+	}
+	return dirs
+}
+
+// runSearchIndexer keeps the index of the workspace folder current for the
+// whole run: it follows the workspace setting and rescans after file
+// system events have settled.
+func runSearchIndexer() {
+	ch := make(chan Settings, 1)
+	settingsMu.Lock()
+	current, err := loadSettingsLocked()
+	if err != nil {
+		log.Printf("[Search] %v", err)
+	}
+	settingsSubs[ch] = true
+	settingsMu.Unlock()
+
+	var (
+		root     string
+		watcher  *fsnotify.Watcher
+		events   <-chan fsnotify.Event
+		errs     <-chan error
+		watched  = make(map[string]bool)
+		debounce <-chan time.Time
+	)
+	rescan := func() {
+		debounce = nil
+		if root == "" {
+			return
+		}
+		dirs := workspaceIndex.scan(root)
+		if watcher == nil {
+			return
+		}
+		keep := make(map[string]bool, len(dirs))
+		for _, dir := range dirs {
+			keep[dir] = true
+			if !watched[dir] {
+				if err := watcher.Add(dir); err != nil {
+					log.Printf("[Search] Cannot watch %s: %v", dir, err)
+					continue
+				}
+				watched[dir] = true
+			}
+		}
+		for dir := range watched {
+			if !keep[dir] {
+				watcher.Remove(dir)
+				delete(watched, dir)
+			}
+		}
+	}
+	open := func(dir string) {
+		if watcher != nil {
+			watcher.Close()
+			watcher, events, errs = nil, nil, nil
+			watched = make(map[string]bool)
+		}
+		root = dir
+		workspaceIndex.open(dir)
+		if dir == "" {
+			return
+		}
+		if w, err := fsnotify.NewWatcher(); err != nil {
+			log.Printf("[Search] Cannot watch %s, the index is only updated on restart: %v", dir, err)
+		} else {
+			watcher, events, errs = w, w.Events, w.Errors
+		}
+		rescan()
+	}
+
+	open(current.Workspace)
+	for {
+		select {
+		case s := <-ch:
+			if s.Workspace != root {
+				open(s.Workspace)
+			}
+		case <-searchReindex:
+			open(root)
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if rel := workspaceRel(root, ev.Name); rel != "" && !strings.HasPrefix(rel, ".") && !strings.Contains(rel, "/.") {
+				debounce = time.After(SEARCH_DEBOUNCE)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			// Usually an overflow of the event queue: whatever was lost,
+			// the rescan catches it.
+			log.Printf("[Search] %v", err)
+			debounce = time.After(SEARCH_DEBOUNCE)
+		case <-debounce:
+			rescan()
+		}
+	}
+}
+
+// --- Query ---
+
+// searchTerm is one part of a query. Every term has to match for a
+// document to be found.
+type searchTerm struct {
+	text   string   // Folded
+	tokens []string // All of them are in a matching document
+	exact  bool     // text itself must occur: phrases, CJK runs, words with punctuation
+	prefix bool     // word*: any word starting with text
+}
+
+// parseSearchQuery splits a query into terms: words, "quoted phrases" and
+// word* prefixes.
+func parseSearchQuery(q string) []searchTerm {
+	var chunks []string
+	var quoted []bool
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			chunks = append(chunks, part)
+			quoted = append(quoted, true)
+			continue
+		}
+		for _, f := range strings.Fields(part) {
+			chunks = append(chunks, f)
+			quoted = append(quoted, false)
+		}
+	}
+
+	var terms []searchTerm
+	for i, chunk := range chunks {
+		t := searchTerm{}
+		if !quoted[i] && strings.HasSuffix(chunk, "*") {
+			chunk = strings.TrimRight(chunk, "*")
+			t.prefix = true
+		}
+		t.text, _ = foldText(chunk, false)
+		t.text = strings.TrimSpace(t.text)
+		seen := make(map[string]bool)
+		searchTokens(t.text, func(tok string) {
+			if !seen[tok] {
+				seen[tok] = true
+				t.tokens = append(t.tokens, tok)
+			}
+		})
+		if len(t.tokens) == 0 {
+			continue
+		}
+		single := len(t.tokens) == 1 && t.tokens[0] == t.text && !isCJK([]rune(t.text)[0])
+		t.exact = !single
+		t.prefix = t.prefix && single
+		terms = append(terms, t)
+	}
+	return terms
+}
+
+// find returns where t occurs in folded text, at most max times. Words
+// only match whole words, prefixes only at the start of one.
+func (t searchTerm) find(folded string, max int) [][2]int {
+	var spans [][2]int
+	first, _ := utf8.DecodeRuneInString(t.text)
+	last, _ := utf8.DecodeLastRuneInString(t.text)
+	checkStart := isWordRune(first) && !isCJK(first)
+	checkEnd := isWordRune(last) && !isCJK(last) && !t.prefix
+	for from := 0; len(spans) < max; {
+		i := strings.Index(folded[from:], t.text)
+		if i < 0 {
+			break
+		}
+		start := from + i
+		end := start + len(t.text)
+		from = start + 1
+		if checkStart {
+			if r, _ := utf8.DecodeLastRuneInString(folded[:start]); start > 0 && isWordRune(r) && !isCJK(r) {
+				continue
+			}
+		}
+		if checkEnd {
+			if r, _ := utf8.DecodeRuneInString(folded[end:]); end < len(folded) && isWordRune(r) && !isCJK(r) {
+				continue
+			}
+		}
+		spans = append(spans, [2]int{start, end})
+		from = end
+	}
+	return spans
+}
+
+// expand returns the index tokens a term looks up: its own, or for a
+// prefix the most common words starting with it. The caller holds mu.
+func (ix *searchIndex) expand(t searchTerm) []string {
+	if !t.prefix {
+		return t.tokens
+	}
+	var words []string
+	for tok := range ix.postings {
+		if strings.HasPrefix(tok, t.text) {
+			if r, _ := utf8.DecodeRuneInString(tok); !isCJK(r) {
+				words = append(words, tok)
+			}
+		}
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if len(ix.postings[words[i]]) != len(ix.postings[words[j]]) {
+			return len(ix.postings[words[i]]) > len(ix.postings[words[j]])
+		}
+		return words[i] < words[j]
+	})
+	if len(words) > SEARCH_MAX_EXPAND {
+		words = words[:SEARCH_MAX_EXPAND]
+	}
+	return words
+}
+
+// searchPathFilter reports whether a workspace-relative path passes the
+// ?path= filters: folder or file paths, or patterns with * and ?, which
+// are matched against the whole path or, without a slash, the file name.
+func searchPathFilter(filters []string) func(rel string) bool {
+	var prefixes, patterns []string
+	for _, f := range filters {
+		f = strings.Trim(filepath.ToSlash(strings.TrimSpace(f)), "/")
+		if f == "" {
+			continue
+		}
+		if strings.ContainsAny(f, "*?[") {
+			patterns = append(patterns, f)
+		} else {
+			prefixes = append(prefixes, f)
+		}
+	}
+	if len(prefixes) == 0 && len(patterns) == 0 {
+		return func(string) bool { return true }
+	}
+	key := func(s string) string { return filepath.ToSlash(getLockKey(filepath.FromSlash(s))) }
+	return func(rel string) bool {
+		k := key(rel)
+		for _, p := range prefixes {
+			if p = key(p); k == p || strings.HasPrefix(k, p+"/") {
+				return true
+			}
+		}
+		for _, p := range patterns {
+			p = key(p)
+			target := k
+			if !strings.Contains(p, "/") {
+				target = path.Base(k)
+			}
+			if ok, _ := path.Match(p, target); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// search returns the documents matching every term, best first, with the
+// total count before offset and limit. Scores are BM25 with a bonus for
+// terms in the name or title.
+func (ix *searchIndex) search(terms []searchTerm, allow func(*searchDoc) bool, offset, limit int) ([]SearchResult, int) {
+	const k1, b = 1.2, 0.75
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if len(terms) == 0 || len(ix.docs) == 0 {
+		return nil, 0
+	}
+	n := float64(len(ix.docs))
+	avg := float64(ix.tokens) / n
+	idf := func(tok string) float64 {
+		df := float64(len(ix.postings[tok]))
+		return math.Log(1 + (n-df+0.5)/(df+0.5))
+	}
+
+	var candidates map[string]bool
+	lookups := make([][]string, len(terms))
+	for i, t := range terms {
+		lookups[i] = ix.expand(t)
+		// A prefix matches any of its words, other terms need all tokens
+		var set map[string]bool
+		for j, tok := range lookups[i] {
+			docs := ix.postings[tok]
+			if t.prefix || j == 0 {
+				if set == nil {
+					set = make(map[string]bool)
+				}
+				for rel := range docs {
+					if candidates == nil || candidates[rel] {
+						set[rel] = true
+					}
+				}
+				continue
+			}
+			for rel := range set {
+				if docs[rel] == 0 {
+					delete(set, rel)
+				}
+			}
+		}
+		candidates = set
+		if len(candidates) == 0 {
+			return nil, 0
+		}
+	}
+
+	type hit struct {
+		doc   *searchDoc
+		score float64
+	}
+	var hits []hit
+	for rel := range candidates {
+		d := ix.docs[rel]
+		if !allow(d) {
+			continue
+		}
+		score := 0.0
+		ok := true
+		for i, t := range terms {
+			if t.exact && len(t.find(d.folded, 1)) == 0 && len(t.find(d.head, 1)) == 0 {
+				ok = false
+				break
+			}
+			for _, tok := range lookups[i] {
+				if tf := float64(ix.postings[tok][rel]); tf > 0 {
+					score += idf(tok) * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(d.length)/avg))
+				}
+			}
+			if len(t.find(d.head, 1)) > 0 {
+				score += 2
+			}
+		}
+		if ok {
+			hits = append(hits, hit{d, score})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].doc.Path < hits[j].doc.Path
+	})
+
+	total := len(hits)
+	if offset > len(hits) {
+		offset = len(hits)
+	}
+	hits = hits[offset:]
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	results := make([]SearchResult, 0, len(hits))
+	for _, h := range hits {
+		d := h.doc
+		results = append(results, SearchResult{
+			Path:     d.Path,
+			FullPath: filepath.Join(ix.root, filepath.FromSlash(d.Path)),
+			Name:     path.Base(d.Path),
+			Title:    d.Title,
+			Kind:     d.Kind,
+			ModTime:  d.ModTime,
+			Score:    math.Round(h.score*1000) / 1000,
+			Snippets: searchSnippets(d.Text, terms),
+		})
+	}
+	return results, total
+}
+
+// searchSnippets cuts up to SEARCH_SNIPPETS passages around the matches
+// out of text and marks the matches. Without a match in the text (the
+// name or title matched) it returns the start of the text.
+func searchSnippets(text string, terms []searchTerm) []string {
+	folded, offs := foldText(text, true)
+	var spans [][2]int
+	for _, t := range terms {
+		for _, s := range t.find(folded, SEARCH_MAX_SPANS) {
+			spans = append(spans, [2]int{offs[s[0]], offs[s[1]]})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	// Overlapping matches (a word inside a phrase) become one
+	var merged [][2]int
+	for _, s := range spans {
+		if l := len(merged) - 1; l >= 0 && s[0] <= merged[l][1] {
+			merged[l][1] = max(merged[l][1], s[1])
+			continue
+		}
+		merged = append(merged, s)
+	}
+
+	var snippets []string
+	if len(merged) == 0 {
+		if s := strings.TrimSpace(text); s != "" {
+			end := runeOffset(s, 0, 2*SEARCH_CONTEXT)
+			snippet := html.EscapeString(collapseSpace(s[:end]))
+			if end < len(s) {
+				snippet += "…"
+			}
+			snippets = append(snippets, snippet)
+		}
+		return snippets
+	}
+	for i := 0; i < len(merged) && len(snippets) < SEARCH_SNIPPETS; {
+		start := runeOffset(text, merged[i][0], -SEARCH_CONTEXT)
+		end := runeOffset(text, merged[i][1], SEARCH_CONTEXT)
+		// Later matches close enough share the passage
+		j := i + 1
+		for j < len(merged) && merged[j][0] < end {
+			end = max(end, runeOffset(text, merged[j][1], SEARCH_CONTEXT/2))
+			j++
+		}
+		var sb strings.Builder
+		if start > 0 {
+			sb.WriteString("…")
+		}
+		pos := start
+		for _, s := range merged[i:j] {
+			sb.WriteString(html.EscapeString(collapseSpace(text[pos:s[0]])))
+			sb.WriteString("<mark>")
+			sb.WriteString(html.EscapeString(collapseSpace(text[s[0]:s[1]])))
+			sb.WriteString("</mark>")
+			pos = s[1]
+		}
+		sb.WriteString(html.EscapeString(collapseSpace(text[pos:end])))
+		if end < len(text) {
+			sb.WriteString("…")
+		}
+		snippets = append(snippets, strings.TrimSpace(sb.String()))
+		i = j
+	}
+	return snippets
+}
+
+// runeOffset moves n runes from offset i in s, backwards for negative n,
+// stopping at either end.
+func runeOffset(s string, i, n int) int {
+	for ; n > 0 && i < len(s); n-- {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	for ; n < 0 && i > 0; n++ {
+		_, size := utf8.DecodeLastRuneInString(s[:i])
+		i -= size
+	}
+	return i
+}
+
+func collapseSpace(s string) string {
+	var sb strings.Builder
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			if !space {
+				sb.WriteByte(' ')
+			}
+			space = true
+			continue
+		}
+		sb.WriteRune(r)
+		space = false
+	}
+	return sb.String()
+}
+
+// --- HTTP ---
+
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && !sameOriginRequest(r) {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	ix := workspaceIndex
+	switch {
+	case r.URL.Path == "/api/search/status" && r.Method == "GET":
+		ix.mu.RLock()
+		status := map[string]interface{}{
+			"root":      ix.root,
+			"documents": len(ix.docs),
+			"indexing":  ix.indexing,
+			"updatedAt": ix.updated,
+		}
+		ix.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case r.URL.Path == "/api/search/reindex" && r.Method == "POST":
+		if root, err := workspaceRoot(); err == nil {
+			if file, err := searchIndexPath(root); err == nil {
+				os.Remove(file)
+			}
+		}
+		select {
+		case searchReindex <- true:
+		default: // Already asked for
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.URL.Path == "/api/search" && r.Method == "GET":
+		q := r.URL.Query()
+		if _, err := workspaceRoot(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		limit, err := strconv.Atoi(q.Get("limit"))
+		if err != nil || limit <= 0 || limit > SEARCH_MAX_RESULTS {
+			limit = 50
+		}
+		offset, _ := strconv.Atoi(q.Get("offset"))
+		offset = max(offset, 0)
+		inPath := searchPathFilter(q["path"])
+		kinds := make(map[string]bool)
+		for _, k := range strings.Split(q.Get("kind"), ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				kinds[k] = true
+			}
+		}
+		allow := func(d *searchDoc) bool {
+			return (len(kinds) == 0 || kinds[d.Kind]) && inPath(d.Path)
+		}
+
+		results, total := ix.search(parseSearchQuery(q.Get("q")), allow, offset, limit)
+		if results == nil {
+			results = []SearchResult{}
+		}
+		ix.mu.RLock()
+		indexing := ix.indexing
+		ix.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"query":    q.Get("q"),
+			"total":    total,
+			"results":  results,
+			"indexing": indexing,
+		})
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// protectSecret encrypts data with DPAPI for the current Windows user, so
+// the result is useless when copied to another account or machine.
+func protectSecret(data []byte) ([]byte, error) {
+	return cryptData(data, true)
+}
+
+// unprotectSecret reverses protectSecret.
+func unprotectSecret(data []byte) ([]byte, error) {
+	return cryptData(data, false)
+}
+
+func cryptData(data []byte, protect bool) ([]byte, error) {
+	in := windows.DataBlob{Size: uint32(len(data))}
+	if len(data) > 0 {
+		in.Data = &data[0]
+	}
+	var out windows.DataBlob
+	var err error
+	if protect {
+		err = windows.CryptProtectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	} else {
+		err = windows.CryptUnprotectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return bytes.Clone(unsafe.Slice(out.Data, out.Size)), nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archive formats produced by /api/export/html and /api/export/mhtml.
+const (
+	ARCHIVE_FORMAT_HTML  = "html"  // One HTML file with every resource as a data: URI
+	ARCHIVE_FORMAT_MHTML = "mhtml" // multipart/related archive
+)
+
+const (
+	KATEX_FETCH_TIMEOUT = 15 * time.Second
+	KATEX_MAX_RESOURCE  = 8 << 20
+)
+
+// KaTeX files downloaded for exports, by path below katexCDNBase
+var (
+	katexCache   = make(map[string][]byte)
+	katexCacheMu sync.Mutex
+)
+
+// resourcePackager pulls the resources of an export page into the output:
+// files of lazily opened documents (/api/asset), the editor's own libraries
+// from the embedded dist folder and, for MHTML, inline data: URIs. embed
+// stores one resource and returns the reference written in its place.
+type resourcePackager struct {
+	embed        func(data []byte, mediaType string) string
+	keepDataURIs bool
+}
+
+// packageHTML rewrites every resource reference of page through the packager.
+func (p *resourcePackager) packageHTML(page string) string {
+	a := &assetRewriter{
+		mapRef:      p.mapRef,
+		followLinks: true, // <link rel="stylesheet"> and attachments
+	}
+	return a.rewriteHTML(page)
+}
+
+func (p *resourcePackager) mapRef(ref string) (string, bool) {
+	data, mediaType, ok := loadPackagedResource(ref, p.keepDataURIs)
+	if !ok {
+		return "", false
+	}
+	if mediaType == "text/css" {
+		data = []byte(p.packageCSS(string(data), ref))
+	}
+	return p.embed(data, mediaType), true
+}
+
+// packageCSS embeds the url() and @import references of a stylesheet,
+// resolved against the URL it was loaded from.
+func (p *resourcePackager) packageCSS(css, base string) string {
+	baseURL, err := url.Parse(base)
+	if err != nil || strings.HasPrefix(base, "data:") {
+		baseURL = nil
+	}
+	a := &assetRewriter{
+		mapRef: func(ref string) (string, bool) {
+			if baseURL != nil && !strings.HasPrefix(ref, "data:") {
+				if u, err := url.Parse(ref); err == nil {
+					ref = baseURL.ResolveReference(u).String()
+				}
+			}
+			return p.mapRef(ref)
+		},
+	}
+	out, _ := a.rewriteCSS(css, "")
+	return out
+}
+
+// loadPackagedResource returns the bytes behind ref. Remote URLs other than
+// KaTeX and anything that cannot be found are left alone.
+func loadPackagedResource(ref string, keepDataURIs bool) ([]byte, string, bool) {
+	if strings.HasPrefix(ref, "data:") {
+		if keepDataURIs {
+			return nil, "", false
+		}
+		mediaType, data, err := decodeDataURI(ref)
+		if err != nil || mediaType == "" {
+			return nil, "", false
+		}
+		return data, mediaType, true
+	}
+	if filePath, ok := assetURLFile(ref); ok {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, "", false
+		}
+		return data, mediaTypeOf(filePath, data), true
+	}
+	if name, ok := katexResourceName(ref); ok {
+		return loadKatexResource(name)
+	}
+	return loadDistResource(ref)
+}
+
+// katexResourceName recognizes the KaTeX files on the CDN and their copies
+// in dist/libs, where the README only asks for katex.min.css.
+func katexResourceName(ref string) (string, bool) {
+	if name, ok := strings.CutPrefix(ref, katexCDNBase); ok {
+		return name, true
+	}
+	name, ok := strings.CutPrefix(ref, "/libs/")
+	if ok && (strings.HasPrefix(name, "katex.") || strings.HasPrefix(name, "fonts/KaTeX_")) {
+		return name, true
+	}
+	return "", false
+}
+
+// loadKatexResource returns a file of the KaTeX build the editor pages load
+// from the CDN: the copy in dist/libs when one is shipped, else the CDN file,
+// downloaded once. Exported math renders offline only with the script and
+// fonts embedded.
+func loadKatexResource(name string) ([]byte, string, bool) {
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	name = path.Clean(name)
+	if name == "." || strings.HasPrefix(name, "..") {
+		return nil, "", false
+	}
+	if data, mediaType, ok := loadDistResource("/libs/" + name); ok {
+		return data, mediaType, true
+	}
+
+	katexCacheMu.Lock()
+	defer katexCacheMu.Unlock()
+	data, ok := katexCache[name]
+	if !ok {
+		client := http.Client{Timeout: KATEX_FETCH_TIMEOUT}
+		resp, err := client.Get(katexCDNBase + name)
+		if err != nil {
+			log.Printf("[Export] Could not download %s: %v", name, err)
+			return nil, "", false
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("[Export] Could not download %s: %s", name, resp.Status)
+			return nil, "", false
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, KATEX_MAX_RESOURCE)); err != nil {
+			return nil, "", false
+		}
+		katexCache[name] = data
+	}
+	return data, mediaTypeOf(name, data), true
+}
+
+// loadDistResource serves root-relative references (/libs/katex.min.css)
+// from the embedded frontend build.
+func loadDistResource(ref string) ([]byte, string, bool) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return nil, "", false
+	}
+	name := strings.TrimPrefix(path.Clean(u.Path), "/")
+	if name == "" || name == "." {
+		return nil, "", false
+	}
+	data, err := fs.ReadFile(assets, "dist/"+name)
+	if err != nil {
+		return nil, "", false
+	}
+	return data, mediaTypeOf(name, data), true
+}
+
+// mediaTypeOf is detectMimeType without parameters, as used in data: URIs
+// and MIME part headers.
+func mediaTypeOf(name string, data []byte) string {
+	mediaType := detectMimeType(name, data)
+	if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+		mediaType = strings.TrimSpace(mediaType[:i])
+	}
+	return mediaType
+}
+
+// buildSelfContainedHTML turns an export page into a single HTML file.
+func buildSelfContainedHTML(page string) string {
+	p := &resourcePackager{
+		keepDataURIs: true,
+		embed: func(data []byte, mediaType string) string {
+			return fmt.Sprintf("data:%s;base64,%s", mediaType, base64.StdEncoding.EncodeToString(data))
+		},
+	}
+	return p.packageHTML(page)
+}
+
+// buildArchive packages an export page as a self-contained HTML file or an
+// MHTML archive.
+func buildArchive(page, archiveFormat string) ([]byte, error) {
+	switch archiveFormat {
+	case ARCHIVE_FORMAT_HTML:
+		return []byte(buildSelfContainedHTML(page)), nil
+	case ARCHIVE_FORMAT_MHTML:
+		title, _, _ := splitHTMLDocument(page)
+		return buildMHTML(page, title)
+	}
+	return nil, fmt.Errorf("unknown archive format %q", archiveFormat)
+}
+
+// handleArchiveExport serves /api/export/html and /api/export/mhtml, writing
+// the single-file document to req.Path.
+func handleArchiveExport(w http.ResponseWriter, r *http.Request, archiveFormat string) {
+	var req ArchiveExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "Path is empty", http.StatusBadRequest)
+		return
+	}
+
+	pageHTML, err := resolveExportHTML(req.Html, req.Format, req.SourcePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buf, err := buildArchive(pageHTML, archiveFormat)
+	if err != nil {
+		log.Printf("Error building %s archive: %v", archiveFormat, err)
+		http.Error(w, "Export Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.WriteFile(req.Path, buf, 0644); err != nil {
+		log.Println("Error writing archive file:", err)
+		http.Error(w, "Failed to write file", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
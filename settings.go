@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SETTINGS_FILE     = "settings.json"
+	SETTINGS_VERSION  = 1       // Bump together with a new entry in settingsMigrations
+	SETTINGS_MAX_BODY = 1 << 20 // Largest PUT /api/settings body
+	SETTINGS_PING     = 30 * time.Second
+)
+
+// Settings are the per-user preferences, kept by the backend so they
+// survive a change of browser or port and are shared by every open tab.
+// AI provider profiles are not part of it: they and their keys live in
+// ai.json behind /api/ai/providers.
+type Settings struct {
+	Version          int          `json:"version"`
+	DarkMode         bool         `json:"darkMode"`
+	FontFamily       string       `json:"fontFamily"`       // Editor font stack, "" = built-in
+	FontSize         int          `json:"fontSize"`         // Editor font size in px, 0 = built-in
+	HighlighterColor string       `json:"highlighterColor"` // CSS color of the highlighter tool
+	BrowserPath      string       `json:"browserPath"`      // Browser for exports, "" = detect
+	Images           ImageOptions `json:"images"`
+	Workspace        string       `json:"workspace"` // Folder open as workspace, "" = none
+}
+
+func defaultSettings() Settings {
+	return Settings{Version: SETTINGS_VERSION, HighlighterColor: "#fff59d"}
+}
+
+// settingsMigrations upgrade the raw JSON of older files in place; entry i
+// turns version i into version i+1.
+var settingsMigrations = []func(raw map[string]json.RawMessage) error{
+	migrateLegacyConfig,
+}
+
+// migrateLegacyConfig takes browserPath and images over from config.json,
+// which held them before settings.json existed. config.json is left alone
+// for older versions of the editor.
+func migrateLegacyConfig(raw map[string]json.RawMessage) error {
+	dir, err := appConfigDir()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var legacy map[string]json.RawMessage
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		log.Printf("[Settings] Ignoring unreadable config.json: %v", err)
+		return nil
+	}
+	for _, key := range []string{"browserPath", "images"} {
+		if _, ok := raw[key]; !ok && legacy[key] != nil {
+			raw[key] = legacy[key]
+		}
+	}
+	return nil
+}
+
+var (
+	settingsMu      sync.Mutex
+	settingsCache   Settings
+	settingsModTime time.Time // Of the file behind settingsCache, zero when not loaded
+	settingsSubs    = make(map[chan Settings]bool)
+
+	cssColorValue = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|(rgb|rgba|hsl|hsla)\([0-9.,%\s/]+\)|[a-zA-Z]+)$`)
+)
+
+func settingsPath() (string, error) {
+	dir, err := appConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, SETTINGS_FILE), nil
+}
+
+// loadSettings returns the current settings. The file is read again when
+// it changed on disk, so hand edits apply without a restart; a missing or
+// broken file yields the defaults.
+func loadSettings() Settings {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	s, err := loadSettingsLocked()
+	if err != nil {
+		log.Printf("[Settings] %v", err)
+	}
+	return s
+}
+
+func loadSettingsLocked() (Settings, error) {
+	path, err := settingsPath()
+	if err != nil {
+		return defaultSettings(), err
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.ModTime().Equal(settingsModTime) {
+		return settingsCache, nil
+	}
+
+	raw := make(map[string]json.RawMessage)
+	if err == nil {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return defaultSettings(), err
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return defaultSettings(), fmt.Errorf("invalid %s: %v", SETTINGS_FILE, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return defaultSettings(), err
+	}
+
+	version := 0
+	if v, ok := raw["version"]; ok {
+		json.Unmarshal(v, &version)
+	}
+	migrated := false
+	for ; version < SETTINGS_VERSION; version++ {
+		if err := settingsMigrations[version](raw); err != nil {
+			return defaultSettings(), fmt.Errorf("migrating settings to version %d: %v", version+1, err)
+		}
+		migrated = true
+	}
+	raw["version"], _ = json.Marshal(version)
+
+	s := defaultSettings()
+	data, _ := json.Marshal(raw)
+	if err := json.Unmarshal(data, &s); err != nil {
+		return defaultSettings(), fmt.Errorf("invalid %s: %v", SETTINGS_FILE, err)
+	}
+	if version > SETTINGS_VERSION {
+		// Written by a newer editor: use what we understand, never write back
+		s.Version = version
+		return s, nil
+	}
+	if migrated {
+		log.Printf("[Settings] Migrated to version %d", SETTINGS_VERSION)
+		return s, saveSettingsLocked(s)
+	}
+	settingsCache, settingsModTime = s, info.ModTime()
+	return s, nil
+}
+
+// saveSettingsLocked writes the file through a temporary one, so a crash
+// never leaves half a file behind, and notifies the subscribers.
+func saveSettingsLocked(s Settings) error {
+	path, err := settingsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		settingsCache, settingsModTime = s, info.ModTime()
+	}
+	for ch := range settingsSubs {
+		select {
+		case <-ch: // Drop a change the tab has not picked up yet
+		default:
+		}
+		ch <- s
+	}
+	return nil
+}
+
+// updateSettings changes settings on behalf of the backend itself, such as
+// the workspace folder, notifying the tabs as a PUT would.
+func updateSettings(fn func(s *Settings)) (Settings, error) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	s, err := loadSettingsLocked()
+	if err != nil {
+		log.Printf("[Settings] %v", err)
+	}
+	if s.Version > SETTINGS_VERSION {
+		return s, errors.New("settings were written by a newer version of the editor")
+	}
+	fn(&s)
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+	return s, saveSettingsLocked(s)
+}
+
+// validate checks the values a client may set.
+func (s *Settings) validate() error {
+	if s.FontSize != 0 && (s.FontSize < 8 || s.FontSize > 96) {
+		return errors.New("fontSize must be 0 or between 8 and 96")
+	}
+	if len(s.FontFamily) > 200 || strings.ContainsAny(s.FontFamily, ";{}<>") {
+		return errors.New("fontFamily is not a font list")
+	}
+	if s.HighlighterColor != "" && !cssColorValue.MatchString(s.HighlighterColor) {
+		return errors.New("highlighterColor is not a CSS color")
+	}
+	if s.BrowserPath != "" && !filepath.IsAbs(s.BrowserPath) {
+		return errors.New("browserPath must be an absolute path")
+	}
+	if s.Workspace != "" && !filepath.IsAbs(s.Workspace) {
+		return errors.New("workspace must be an absolute path")
+	}
+	if s.Images.Quality < 0 || s.Images.Quality > 100 {
+		return errors.New("images.quality must be between 0 and 100")
+	}
+	if s.Images.MaxDimension < 0 {
+		return errors.New("images.maxDimension must not be negative")
+	}
+	return nil
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386): objects merge key by
+// key, null removes a key, anything else replaces.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// handleSettings serves GET/PUT /api/settings and the change feed at
+// /api/settings/events.
+func handleSettings(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/api/settings" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(loadSettings())
+	case r.URL.Path == "/api/settings" && r.Method == "PUT":
+		handleSettingsUpdate(w, r)
+	case r.URL.Path == "/api/settings/events" && r.Method == "GET":
+		handleSettingsEvents(w, r)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleSettingsUpdate merges the body, a partial settings object, over
+// the current settings. Keys set to null return to their defaults; unknown
+// keys and invalid values are rejected as a whole.
+func handleSettingsUpdate(w http.ResponseWriter, r *http.Request) {
+	if !sameOriginRequest(r) {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, SETTINGS_MAX_BODY))
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	var patch interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		http.Error(w, "Settings must be a JSON object", http.StatusBadRequest)
+		return
+	}
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	current, err := loadSettingsLocked()
+	if err != nil {
+		log.Printf("[Settings] %v", err)
+	}
+	if current.Version > SETTINGS_VERSION {
+		http.Error(w, "Settings were written by a newer version of the editor", http.StatusConflict)
+		return
+	}
+
+	var base, defaults interface{}
+	data, _ := json.Marshal(current)
+	json.Unmarshal(data, &base)
+	data, _ = json.Marshal(defaultSettings())
+	json.Unmarshal(data, &defaults)
+	merged := mergePatch(base, patch)
+	// Removed keys fall back to their defaults
+	merged = mergePatch(defaults, merged)
+
+	data, _ = json.Marshal(merged)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var next Settings
+	if err := dec.Decode(&next); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid settings: %v", err), http.StatusBadRequest)
+		return
+	}
+	next.Version = SETTINGS_VERSION
+	if err := next.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid settings: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := saveSettingsLocked(next); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(next)
+}
+
+// handleSettingsEvents streams a "settings" event with the full settings
+// on connect and after every change, so all tabs stay in step.
+func handleSettingsEvents(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan Settings, 1)
+	settingsMu.Lock()
+	current, err := loadSettingsLocked()
+	if err != nil {
+		log.Printf("[Settings] %v", err)
+	}
+	settingsSubs[ch] = true
+	settingsMu.Unlock()
+	defer func() {
+		settingsMu.Lock()
+		delete(settingsSubs, ch)
+		settingsMu.Unlock()
+	}()
+
+	events := newSSEWriter(w, true)
+	events.send("settings", current)
+	ping := time.NewTicker(SETTINGS_PING)
+	defer ping.Stop()
+	for {
+		select {
+		case s := <-ch:
+			events.send("settings", s)
+		case <-ping.C:
+			events.send("ping", struct{}{})
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
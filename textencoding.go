@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Encoding names reported in X-Detected-Encoding and accepted by the
+// encoding field of /api/save-file. Other names declared by a document's
+// <meta charset> are passed through in their WHATWG form.
+const (
+	ENCODING_UTF8         = "utf-8"
+	ENCODING_UTF8_BOM     = "utf-8-bom"
+	ENCODING_UTF16LE      = "utf-16le"
+	ENCODING_UTF16BE      = "utf-16be"
+	ENCODING_GB18030      = "gb18030"
+	ENCODING_BIG5         = "big5"
+	ENCODING_WINDOWS_1252 = "windows-1252"
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// metaCharsetRe finds the charset declared by <meta charset> or
+// <meta http-equiv="Content-Type" content="...; charset=...">.
+var metaCharsetRe = regexp.MustCompile(`(?i)(<meta[^>]+charset\s*=\s*["']?)([\w.:-]+)`)
+
+// Frequent characters of Chinese text in both scripts. A GBK file decoded
+// as Big5 (or the reverse) turns into rare characters, so the decoding that
+// hits more of these is the right one.
+const commonHanzi = "的一是不了在人有我他这个们中来上大为和国地到以说时要就出会可也你对生能而子那得于着下自之年过发后作里用道行所然家种事成方多经么去法学如都同现当没动面起看定天分还进好小部其些主样理心她本前开但因只从想实" +
+	"這個們來為國說時會對過發後裡經麼學現當動麵還進從實與問關點電機開長頭書氣區體無話義東車見業處應"
+
+// lookupEncoding maps one of our names or a WHATWG label to an encoder.
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(name) {
+	case ENCODING_UTF8:
+		return unicode.UTF8, nil
+	case ENCODING_UTF8_BOM:
+		return unicode.UTF8BOM, nil
+	case ENCODING_UTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), nil
+	case ENCODING_UTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM), nil
+	case ENCODING_GB18030, "gbk", "gb2312":
+		// GB18030 is a superset that round-trips GBK files
+		return simplifiedchinese.GB18030, nil
+	case ENCODING_BIG5:
+		return traditionalchinese.Big5, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported encoding %q", name)
+	}
+	return enc, nil
+}
+
+// detectTextEncoding works out the charset of a text document: byte order
+// mark, then valid UTF-8, then the HTML <meta> declaration, then a UTF-16
+// and GB18030/Big5 heuristic. Bytes that cannot be GB18030 or read like
+// accented Western text are taken as windows-1252.
+func detectTextEncoding(content []byte, isHTML bool) string {
+	switch {
+	case bytes.HasPrefix(content, utf8BOM):
+		return ENCODING_UTF8_BOM
+	case bytes.HasPrefix(content, []byte{0xFF, 0xFE}):
+		return ENCODING_UTF16LE
+	case bytes.HasPrefix(content, []byte{0xFE, 0xFF}):
+		return ENCODING_UTF16BE
+	}
+	if name := sniffUTF16(content); name != "" {
+		return name
+	}
+	if utf8.Valid(content) {
+		return ENCODING_UTF8
+	}
+	if isHTML {
+		if name := declaredCharset(content[:min(len(content), 1024)]); name != "" {
+			return name
+		}
+	}
+	sample := content[:min(len(content), 64<<10)]
+	if !validGB18030(sample) || plausibleLatin(sample) {
+		return ENCODING_WINDOWS_1252
+	}
+	return guessChineseEncoding(content)
+}
+
+// declaredCharset returns the WHATWG name of the charset declared by a
+// <meta> tag in prefix. iso-8859-1 and windows-1252 both come back as
+// windows-1252. UTF-8 and UTF-16 declarations are ignored: the content is
+// already known not to be either.
+func declaredCharset(prefix []byte) string {
+	m := metaCharsetRe.FindSubmatch(prefix)
+	if m == nil {
+		return ""
+	}
+	enc, err := htmlindex.Get(string(m[2]))
+	if err != nil {
+		return ""
+	}
+	name, err := htmlindex.Name(enc)
+	if err != nil || strings.HasPrefix(name, "utf-") {
+		return ""
+	}
+	return name
+}
+
+// plausibleLatin reports whether the non-ASCII bytes of b read as accented
+// letters of Western text in windows-1252: short runs of letters touching
+// ASCII letters, as in "Größe" or "café". Chinese characters come in longer
+// runs, and Big5 ones often with a lead byte that is a symbol in
+// windows-1252. Runs of punctuation (quotes, dashes, «») are not counted.
+func plausibleLatin(b []byte) bool {
+	isASCIILetter := func(c byte) bool { return c|0x20 >= 'a' && c|0x20 <= 'z' }
+	isLetter := func(c byte) bool {
+		return c >= 0xC0 && c != 0xD7 && c != 0xF7 || c == 0x8A || c == 0x8C || c == 0x8E || c == 0x9A || c == 0x9C || c == 0x9E || c == 0x9F
+	}
+	runs, latin := 0, 0
+	for i := 0; i < len(b); {
+		if b[i] < 0x80 {
+			i++
+			continue
+		}
+		start, letters := i, 0
+		for ; i < len(b) && b[i] >= 0x80; i++ {
+			if isLetter(b[i]) {
+				letters++
+			}
+		}
+		if letters == 0 && i-start <= 2 {
+			continue // Punctuation
+		}
+		runs++
+		touching := start > 0 && isASCIILetter(b[start-1]) || i < len(b) && isASCIILetter(b[i])
+		if i-start <= 3 && letters == i-start && touching {
+			latin++
+		}
+	}
+	return runs > 0 && latin*10 >= runs*8
+}
+
+// sniffUTF16 spots BOM-less UTF-16 by the zero bytes ASCII leaves in every
+// other position.
+func sniffUTF16(content []byte) string {
+	n := min(len(content), 4096) &^ 1
+	if n < 8 {
+		return ""
+	}
+	var evenZero, oddZero int
+	for i := 0; i < n; i += 2 {
+		if content[i] == 0 {
+			evenZero++
+		}
+		if content[i+1] == 0 {
+			oddZero++
+		}
+	}
+	pairs := n / 2
+	switch {
+	case oddZero*10 > pairs*4 && evenZero*10 < pairs:
+		return ENCODING_UTF16LE
+	case evenZero*10 > pairs*4 && oddZero*10 < pairs:
+		return ENCODING_UTF16BE
+	}
+	return ""
+}
+
+// validGB18030 reports whether every non-ASCII byte of b belongs to a
+// GB18030 two- or four-byte sequence. Big5 uses a subset of the same
+// ranges. A sequence cut off at the end of b is accepted.
+func validGB18030(b []byte) bool {
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c < 0x80:
+			i++
+		case c == 0x80 || c == 0xFF:
+			return false
+		case i+1 >= len(b):
+			return true
+		case b[i+1] >= 0x40 && b[i+1] <= 0xFE && b[i+1] != 0x7F:
+			i += 2
+		case b[i+1] >= 0x30 && b[i+1] <= 0x39:
+			if i+3 < len(b) && (b[i+2] < 0x81 || b[i+2] == 0xFF || b[i+3] < 0x30 || b[i+3] > 0x39) {
+				return false
+			}
+			i += 4
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// guessChineseEncoding picks GB18030 or Big5 by decoding a sample with both
+// and counting invalid sequences and common characters.
+func guessChineseEncoding(content []byte) string {
+	sample := content[:min(len(content), 64<<10)]
+	score := func(enc encoding.Encoding) int {
+		decoded, err := enc.NewDecoder().Bytes(sample)
+		if err != nil {
+			return -1 << 30
+		}
+		s := 0
+		for _, r := range string(decoded) {
+			switch {
+			case r == utf8.RuneError:
+				s -= 20
+			case r < 0x80:
+			case strings.ContainsRune(commonHanzi, r):
+				s += 3
+			case r >= 0xE000 && r <= 0xF8FF: // Private use: unmapped codes
+				s -= 10
+			}
+		}
+		return s
+	}
+	if score(traditionalchinese.Big5) > score(simplifiedchinese.GB18030) {
+		return ENCODING_BIG5
+	}
+	return ENCODING_GB18030
+}
+
+// decodeTextDocument converts a text document to UTF-8. Documents that are
+// not text (by extension) pass through untouched with an empty name.
+func decodeTextDocument(content []byte, filePath string) ([]byte, string) {
+	ft := fileTypeForPath(filePath)
+	if ft == nil || !ft.Text {
+		return content, ""
+	}
+	return decodeText(content, ft.Kind == FILE_KIND_HTML)
+}
+
+// decodeText converts text in any detected encoding to UTF-8 and returns
+// the encoding's name. HTML gets its <meta charset> updated to match.
+func decodeText(content []byte, isHTML bool) ([]byte, string) {
+	name := detectTextEncoding(content, isHTML)
+	if name == ENCODING_UTF8 {
+		return content, name
+	}
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return content, ENCODING_UTF8
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return content, ENCODING_UTF8
+	}
+	decoded = bytes.TrimPrefix(decoded, utf8BOM)
+	if isHTML {
+		decoded = []byte(setMetaCharset(string(decoded), "utf-8"))
+	}
+	return decoded, name
+}
+
+// encodeTextDocument converts UTF-8 text back to the named encoding for
+// saving. Characters the encoding cannot represent are an error rather than
+// silently replaced.
+func encodeTextDocument(text, filePath, name string) ([]byte, error) {
+	if name == "" || strings.EqualFold(name, ENCODING_UTF8) {
+		return []byte(text), nil
+	}
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	if ft := fileTypeForPath(filePath); ft != nil && ft.Kind == FILE_KIND_HTML {
+		label := strings.ToLower(name)
+		if label == ENCODING_UTF8_BOM {
+			label = ENCODING_UTF8
+		}
+		text = setMetaCharset(text, label)
+	}
+	out, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("the document contains characters that cannot be saved as %s", name)
+	}
+	return out, nil
+}
+
+// setMetaCharset rewrites an existing charset declaration in the head.
+func setMetaCharset(htmlContent, label string) string {
+	head := htmlContent
+	if i := strings.Index(strings.ToLower(head), "</head"); i >= 0 {
+		head = head[:i]
+	} else {
+		head = head[:min(len(head), 2048)]
+	}
+	replaced := metaCharsetRe.ReplaceAllString(head, "${1}"+label)
+	return replaced + htmlContent[len(head):]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+func encodeTestText(t *testing.T, enc encoding.Encoding, s string) []byte {
+	t.Helper()
+	b, err := enc.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDetectTextEncoding(t *testing.T) {
+	const latin = "Die Größe der Straße ist überall gleich. Le garçon a mangé une crème brûlée à côté du café."
+	const hans = "这是一个测试文件，用来检查编码的识别。我们在中文里面夹一些 English words 和数字 2024 年。"
+	const hant = "這是一個測試文件，用來檢查編碼的識別。我們在中文裡面夾一些 English words 和數字。"
+	tests := []struct {
+		name    string
+		content []byte
+		html    bool
+		want    string
+	}{
+		{"meta iso-8859-1", encodeTestText(t, charmap.ISO8859_1, `<html><head><meta charset="iso-8859-1"></head><body>`+latin+`</body></html>`), true, ENCODING_WINDOWS_1252},
+		{"meta http-equiv windows-1252", encodeTestText(t, charmap.Windows1252, `<meta http-equiv="Content-Type" content="text/html; charset=windows-1252"><p>“Größe” – `+latin), true, ENCODING_WINDOWS_1252},
+		{"meta gbk", encodeTestText(t, simplifiedchinese.GBK, `<meta charset="gbk"><p>`+hans), true, "gbk"},
+		{"meta big5 beats the guess", encodeTestText(t, traditionalchinese.Big5, `<meta charset="big5"><p>`+hant), true, ENCODING_BIG5},
+		{"meta utf-8 on non-UTF-8 bytes is ignored", encodeTestText(t, charmap.Windows1252, `<meta charset="utf-8"><p>`+latin), true, ENCODING_WINDOWS_1252},
+		{"plain Latin-1", encodeTestText(t, charmap.ISO8859_1, latin), false, ENCODING_WINDOWS_1252},
+		{"Latin-1 HTML without meta", encodeTestText(t, charmap.ISO8859_1, "<p>"+latin+"</p>"), true, ENCODING_WINDOWS_1252},
+		{"short Latin-1 word", encodeTestText(t, charmap.ISO8859_1, "Größe"), false, ENCODING_WINDOWS_1252},
+		{"GBK", encodeTestText(t, simplifiedchinese.GBK, hans), false, ENCODING_GB18030},
+		{"Big5", encodeTestText(t, traditionalchinese.Big5, hant), false, ENCODING_BIG5},
+		{"UTF-8", []byte(hans + latin), false, ENCODING_UTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectTextEncoding(tt.content, tt.html); got != tt.want {
+				t.Errorf("detectTextEncoding = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeLatinHTML(t *testing.T) {
+	in := encodeTestText(t, charmap.ISO8859_1, `<html><head><meta charset="iso-8859-1"></head><body>Größe</body></html>`)
+	out, name := decodeText(in, true)
+	if name != ENCODING_WINDOWS_1252 {
+		t.Errorf("encoding = %q", name)
+	}
+	if want := `<html><head><meta charset="utf-8"></head><body>Größe</body></html>`; string(out) != want {
+		t.Errorf("decoded = %s, want %s", out, want)
+	}
+}
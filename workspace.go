@@ -0,0 +1,617 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	WORKSPACE_MAX_NODES = 10000    // Entries listed by /api/workspace/tree before it stops
+	WORKSPACE_TRASH_DIR = ".trash" // Deleted documents go here, inside the workspace
+	ASSETS_SUFFIX       = "_assets"
+)
+
+// WorkspaceNode is a folder or a document of the workspace tree. Path is
+// relative to the workspace root with forward slashes; FullPath is what
+// /api/open-file takes. A Bundle is an HTML document saved in a folder of
+// its own name together with its assets, listed as the document.
+type WorkspaceNode struct {
+	Name     string          `json:"name"`
+	Path     string          `json:"path"`
+	FullPath string          `json:"fullPath"`
+	Dir      bool            `json:"dir,omitempty"`
+	Kind     string          `json:"kind,omitempty"`
+	Bundle   bool            `json:"bundle,omitempty"`
+	Size     int64           `json:"size,omitempty"`
+	ModTime  time.Time       `json:"modTime"`
+	Children []WorkspaceNode `json:"children,omitempty"`
+}
+
+type WorkspaceRequest struct {
+	Path      string `json:"path"`      // Relative to the workspace; absolute for open
+	Name      string `json:"name"`      // New name, for rename
+	To        string `json:"to"`        // Target folder, for move ("" = workspace root)
+	Dir       bool   `json:"dir"`       // Create a folder instead of a document
+	Permanent bool   `json:"permanent"` // Delete instead of moving to WORKSPACE_TRASH_DIR
+}
+
+// pathMove is one rename done on disk.
+type pathMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+var errNoWorkspace = errors.New("no workspace folder is open")
+
+// workspaceRoot returns the open workspace folder.
+func workspaceRoot() (string, error) {
+	root := loadSettings().Workspace
+	if root == "" {
+		return "", errNoWorkspace
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("workspace folder %s is not available", root)
+	}
+	return root, nil
+}
+
+// workspacePath resolves a workspace-relative path, refusing anything that
+// would leave the workspace.
+func workspacePath(root, rel string) (string, error) {
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	check, err := filepath.Rel(root, path)
+	if err != nil || check == ".." || strings.HasPrefix(check, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the workspace", rel)
+	}
+	return path, nil
+}
+
+func workspaceRel(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// isBundleDoc reports whether an HTML document sits in a folder of its own
+// name, the layout save-file uses for HTML with assets.
+func isBundleDoc(path string) bool {
+	name := filepath.Base(path)
+	ext := strings.ToLower(filepath.Ext(name))
+	return (ext == ".html" || ext == ".htm") &&
+		strings.EqualFold(filepath.Base(filepath.Dir(path)), strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// bundleDoc returns the document a bundle folder holds, "" if dir is not a
+// bundle.
+func bundleDoc(dir string) string {
+	for _, ext := range []string{".html", ".htm"} {
+		doc := filepath.Join(dir, filepath.Base(dir)+ext)
+		if info, err := os.Stat(doc); err == nil && !info.IsDir() {
+			return doc
+		}
+	}
+	return ""
+}
+
+func isMarkdownPath(path string) bool {
+	ft := fileTypeForPath(path)
+	return ft != nil && ft.Kind == FILE_KIND_MARKDOWN
+}
+
+func sidecarDir(mdPath string) string {
+	name := filepath.Base(mdPath)
+	return filepath.Join(filepath.Dir(mdPath), strings.TrimSuffix(name, filepath.Ext(name))+ASSETS_SUFFIX)
+}
+
+// --- Tree ---
+
+type workspaceWalker struct {
+	root      string
+	nodes     int
+	truncated bool
+}
+
+func (ww *workspaceWalker) node(path string, info os.FileInfo) WorkspaceNode {
+	ww.nodes++
+	n := WorkspaceNode{
+		Name:     info.Name(),
+		Path:     workspaceRel(ww.root, path),
+		FullPath: path,
+		Dir:      info.IsDir(),
+		ModTime:  info.ModTime(),
+	}
+	if !n.Dir {
+		n.Size = info.Size()
+		if ft := fileTypeForPath(path); ft != nil {
+			n.Kind = ft.Kind
+		}
+	}
+	return n
+}
+
+// list returns the children of dir: folders first, then documents of the
+// types the editor opens. Bundles appear as their document; Markdown
+// _assets folders, hidden folders and symlinked folders are left out.
+func (ww *workspaceWalker) list(dir string) []WorkspaceNode {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	sidecars := make(map[string]bool)
+	bundles := make(map[string]string) // Folder name -> document in it
+	for _, e := range entries {
+		if !e.IsDir() && isMarkdownPath(e.Name()) {
+			sidecars[strings.ToLower(filepath.Base(sidecarDir(e.Name())))] = true
+		}
+		if e.IsDir() {
+			if doc := bundleDoc(filepath.Join(dir, e.Name())); doc != "" {
+				bundles[e.Name()] = doc
+			}
+		}
+	}
+	folder := func(e os.DirEntry) bool { return e.IsDir() && bundles[e.Name()] == "" }
+	sort.Slice(entries, func(i, j int) bool {
+		if folder(entries[i]) != folder(entries[j]) {
+			return folder(entries[i])
+		}
+		return strings.ToLower(entries[i].Name()) < strings.ToLower(entries[j].Name())
+	})
+
+	var nodes []WorkspaceNode
+	for _, e := range entries {
+		if ww.nodes >= WORKSPACE_MAX_NODES {
+			ww.truncated = true
+			break
+		}
+		name := e.Name()
+		path := filepath.Join(dir, name)
+		if strings.HasPrefix(name, ".") || e.Type()&os.ModeSymlink != 0 {
+			continue
+		}
+		if e.IsDir() {
+			if name == "node_modules" || sidecars[strings.ToLower(name)] {
+				continue
+			}
+			if doc := bundles[name]; doc != "" {
+				if info, err := os.Stat(doc); err == nil {
+					n := ww.node(doc, info)
+					n.Bundle = true
+					nodes = append(nodes, n)
+				}
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			n := ww.node(path, info)
+			n.Children = ww.list(path)
+			nodes = append(nodes, n)
+			continue
+		}
+		if fileTypeForPath(name) == nil {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			nodes = append(nodes, ww.node(path, info))
+		}
+	}
+	return nodes
+}
+
+// --- Operations ---
+
+// documentUnit returns what has to move with the document or folder at
+// path: the bundle folder for a bundled HTML document, the document and its
+// _assets folder for Markdown, else the path itself. The first entry is
+// the one the tree shows.
+func documentUnit(path string) []string {
+	if isBundleDoc(path) {
+		return []string{filepath.Dir(path)}
+	}
+	if isMarkdownPath(path) {
+		if info, err := os.Stat(sidecarDir(path)); err == nil && info.IsDir() {
+			return []string{path, sidecarDir(path)}
+		}
+	}
+	return []string{path}
+}
+
+// relocateDocument moves or renames the document (or folder) at src so
+// that it ends up at dst, keeping its assets with it. It returns the
+// renames done, in order.
+func relocateDocument(src, dst string) ([]pathMove, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if src == dst {
+		return nil, nil
+	}
+	if info.IsDir() && strings.HasPrefix(getLockKey(dst), getLockKey(src)+string(filepath.Separator)) {
+		return nil, errors.New("a folder cannot be moved into itself")
+	}
+
+	var moves []pathMove
+	switch unit := documentUnit(src); {
+	case isBundleDoc(src):
+		// The folder moves under the new name, then the document inside it
+		bundle := filepath.Join(filepath.Dir(dst), strings.TrimSuffix(filepath.Base(dst), filepath.Ext(dst)))
+		moves = append(moves, pathMove{unit[0], bundle})
+		if inner := filepath.Join(bundle, filepath.Base(src)); filepath.Base(dst) != filepath.Base(src) {
+			moves = append(moves, pathMove{inner, filepath.Join(bundle, filepath.Base(dst))})
+		}
+	case len(unit) == 2:
+		moves = append(moves, pathMove{src, dst}, pathMove{unit[1], sidecarDir(dst)})
+	default:
+		moves = append(moves, pathMove{src, dst})
+	}
+
+	// Refuse before touching anything when a target is taken. A rename
+	// that only changes case is fine on case-insensitive file systems.
+	for _, m := range moves {
+		if _, err := os.Stat(m.To); err == nil && getLockKey(m.From) != getLockKey(m.To) {
+			return nil, fmt.Errorf("%s already exists", filepath.Base(m.To))
+		}
+	}
+
+	locked := releaseLocks(unitRoots(moves))
+	defer relockMoved(locked, moves)
+
+	if err := os.MkdirAll(filepath.Dir(moves[0].To), 0755); err != nil {
+		return nil, err
+	}
+	var done []pathMove
+	for _, m := range moves {
+		if err := os.Rename(m.From, m.To); err != nil {
+			// Put back what already moved, newest first
+			for i := len(done) - 1; i >= 0; i-- {
+				os.Rename(done[i].To, done[i].From)
+			}
+			return nil, err
+		}
+		done = append(done, m)
+	}
+
+	if len(moves) == 2 && isMarkdownPath(src) && filepath.Base(src) != filepath.Base(dst) {
+		if err := rewriteSidecarLinks(dst, filepath.Base(moves[1].From), filepath.Base(moves[1].To)); err != nil {
+			log.Printf("[Workspace] Links in %s still point to %s: %v", filepath.Base(dst), filepath.Base(moves[1].From), err)
+		}
+	}
+
+	moved := func(path string) (string, bool) { return movedPath(path, moves) }
+	renameRecent(moved)
+	renameHistory(moved)
+	return moves, nil
+}
+
+func unitRoots(moves []pathMove) []string {
+	roots := make([]string, len(moves))
+	for i, m := range moves {
+		roots[i] = m.From
+	}
+	return roots
+}
+
+// movedPath maps a path through the renames in order; ok is false when
+// none of them touched it.
+func movedPath(path string, moves []pathMove) (string, bool) {
+	moved := false
+	for _, m := range moves {
+		key, from := getLockKey(path), getLockKey(m.From)
+		switch {
+		case key == from:
+			path, moved = m.To, true
+		case strings.HasPrefix(key, from+string(filepath.Separator)):
+			path, moved = m.To+path[len(from):], true
+		}
+	}
+	return path, moved
+}
+
+// releaseLocks unlocks the files the editor holds open at or below the
+// given paths, so Windows lets them move, and returns their paths.
+func releaseLocks(paths []string) []string {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	var released []string
+	for key, f := range activeFileHandles {
+		for _, p := range paths {
+			pk := getLockKey(p)
+			if key == pk || strings.HasPrefix(key, pk+string(filepath.Separator)) {
+				released = append(released, f.Name())
+				f.Close()
+				delete(activeFileHandles, key)
+				break
+			}
+		}
+	}
+	return released
+}
+
+// relockMoved locks the released files again where they are now.
+func relockMoved(paths []string, moves []pathMove) {
+	for _, p := range paths {
+		if to, ok := movedPath(p, moves); ok {
+			if _, err := os.Stat(to); err == nil {
+				lockFile(to)
+				continue
+			}
+		}
+		lockFile(p) // The move failed and was undone
+	}
+}
+
+// rewriteSidecarLinks points the links of a renamed Markdown document at
+// its renamed _assets folder.
+func rewriteSidecarLinks(mdPath, oldDir, newDir string) error {
+	content, err := os.ReadFile(mdPath)
+	if err != nil {
+		return err
+	}
+	text, enc := decodeTextDocument(content, mdPath)
+	updated := string(text)
+	for _, form := range [][2]string{
+		{oldDir, newDir},
+		{url.PathEscape(oldDir), url.PathEscape(newDir)},
+	} {
+		for _, prefix := range []string{"(", "(./", "<", "<./", "\"", "\"./", "'", "'./", "]: ", "]: ./"} {
+			updated = strings.ReplaceAll(updated, prefix+form[0]+"/", prefix+form[1]+"/")
+		}
+	}
+	if updated == string(text) {
+		return nil
+	}
+	encoded, err := encodeTextDocument(updated, mdPath, enc)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(mdPath, encoded, 0644)
+}
+
+// deleteDocument moves a document with its assets, or a folder, into the
+// workspace trash, or removes it for good when permanent.
+func deleteDocument(root, path string, permanent bool) ([]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	unit := documentUnit(path)
+	releaseLocks(unit)
+
+	var removed []string
+	for _, p := range unit {
+		if permanent {
+			if err := os.RemoveAll(p); err != nil {
+				return removed, err
+			}
+		} else {
+			dst := filepath.Join(root, WORKSPACE_TRASH_DIR, filepath.FromSlash(workspaceRel(root, p)))
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return removed, err
+			}
+			if _, err := os.Stat(dst); err == nil {
+				ext := filepath.Ext(dst)
+				dst = fmt.Sprintf("%s.%s%s", strings.TrimSuffix(dst, ext), time.Now().Format("20060102-150405"), ext)
+			}
+			if err := os.Rename(p, dst); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
+
+// createDocument makes an empty folder or a new document of a type the
+// editor opens.
+func createDocument(path string, dir bool) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", filepath.Base(path))
+	}
+	if dir {
+		return os.Mkdir(path, 0755)
+	}
+	ft := fileTypeForPath(path)
+	if ft == nil || !ft.Text {
+		return fmt.Errorf("cannot create %s: not a text document type", filepath.Base(path))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	var content string
+	if ft.Kind == FILE_KIND_HTML {
+		title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		content = "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>" +
+			html.EscapeString(title) + "</title>\n</head>\n<body>\n</body>\n</html>\n"
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// --- Handlers ---
+
+// handleWorkspace serves the workspace folder:
+// GET /api/workspace tells which folder is open,
+// POST /api/workspace/open {path} and POST /api/workspace/close change it,
+// GET /api/workspace/tree lists it, and POST /api/workspace/create,
+// /rename, /move and /delete change documents in it.
+func handleWorkspace(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && !sameOriginRequest(r) {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == "GET" {
+		switch r.URL.Path {
+		case "/api/workspace":
+			root := loadSettings().Workspace
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"root": root, "name": filepath.Base(root)})
+		case "/api/workspace/tree":
+			handleWorkspaceTree(w, r)
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var req WorkspaceRequest
+	if r.URL.Path != "/api/workspace/close" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, err error) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	}
+
+	switch r.URL.Path {
+	case "/api/workspace/open":
+		info, err := os.Stat(req.Path)
+		if err != nil || !info.IsDir() || !filepath.IsAbs(req.Path) {
+			fail(http.StatusBadRequest, fmt.Errorf("%s is not a folder", req.Path))
+			return
+		}
+		if _, err := updateSettings(func(s *Settings) { s.Workspace = filepath.Clean(req.Path) }); err != nil {
+			fail(http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("[Workspace] Opened %s", req.Path)
+		json.NewEncoder(w).Encode(map[string]string{"root": filepath.Clean(req.Path), "name": filepath.Base(req.Path)})
+		return
+	case "/api/workspace/close":
+		if _, err := updateSettings(func(s *Settings) { s.Workspace = "" }); err != nil {
+			fail(http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"root": ""})
+		return
+	}
+
+	root, err := workspaceRoot()
+	if err != nil {
+		fail(http.StatusConflict, err)
+		return
+	}
+	path, err := workspacePath(root, req.Path)
+	if err == nil && getLockKey(documentUnit(path)[0]) == getLockKey(root) {
+		err = errors.New("the workspace folder itself cannot be changed")
+	}
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/workspace/create":
+		if err := createDocument(path, req.Dir); err != nil {
+			fail(http.StatusConflict, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"path": workspaceRel(root, path), "fullPath": path})
+
+	case "/api/workspace/rename", "/api/workspace/move":
+		var dst string
+		if r.URL.Path == "/api/workspace/rename" {
+			if req.Name == "" || req.Name != filepath.Base(req.Name) || strings.ContainsAny(req.Name, `/\`) {
+				fail(http.StatusBadRequest, errors.New("name must be a plain file name"))
+				return
+			}
+			dst = filepath.Join(filepath.Dir(path), req.Name)
+			if isBundleDoc(path) {
+				dst = filepath.Join(filepath.Dir(filepath.Dir(path)), req.Name)
+			}
+		} else {
+			dir, err := workspacePath(root, req.To)
+			if err != nil {
+				fail(http.StatusBadRequest, err)
+				return
+			}
+			dst = filepath.Join(dir, filepath.Base(path))
+		}
+		moves, err := relocateDocument(path, dst)
+		if errors.Is(err, os.ErrNotExist) {
+			fail(http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			fail(http.StatusConflict, err)
+			return
+		}
+		// Where the document itself ended up, for the tab showing it
+		to, _ := movedPath(path, moves)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"path":     workspaceRel(root, to),
+			"fullPath": to,
+			"moves":    moves,
+		})
+
+	case "/api/workspace/delete":
+		removed, err := deleteDocument(root, path, req.Permanent)
+		if errors.Is(err, os.ErrNotExist) {
+			fail(http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			fail(http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"removed": removed, "permanent": req.Permanent})
+
+	default:
+		fail(http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// handleWorkspaceTree lists the workspace, or the folder ?path= inside it.
+func handleWorkspaceTree(w http.ResponseWriter, r *http.Request) {
+	root, err := workspaceRoot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	dir, err := workspacePath(root, r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+	ww := &workspaceWalker{root: root}
+	tree := ww.node(dir, info)
+	tree.Children = ww.list(dir)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"root":      root,
+		"tree":      tree,
+		"truncated": ww.truncated,
+	})
+}